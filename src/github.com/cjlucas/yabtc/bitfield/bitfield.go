@@ -48,7 +48,21 @@ func (b *Bitfield) Bytes() []byte {
 }
 
 func (b *Bitfield) SetBytes(bytes []byte) {
-	bytesToCopy := b.length / 8
+	// A partial last byte still holds bits
+	copy(b.bytes, bytes)
+}
+
+func (b *Bitfield) Copy() *Bitfield {
+	c := New(b.length)
+	copy(c.bytes, b.bytes)
+	return c
+}
 
-	copy(b.bytes, bytes[:bytesToCopy])
+// Count returns the number of bits set
+func (b *Bitfield) Count() int {
+	n := 0
+	for i := 0; i < b.length; i++ {
+		n += b.Get(i)
+	}
+	return n
 }
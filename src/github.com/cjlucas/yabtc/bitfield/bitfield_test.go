@@ -25,6 +25,10 @@ func TestSetBytes(t *testing.T) {
 					[]byte{0xaa, 0xaa},
 					[]int{1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0},
 				},
+				{
+					[]byte{0xa0},
+					[]int{1, 0, 1, 0},
+				},
 			}
 
 			for _, c := range cases {
@@ -0,0 +1,347 @@
+// Package checker verifies the pieces of a torrent already in storage
+package checker
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/cjlucas/yabtc/bitfield"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// How often progress is reported while checking
+const DEFAULT_PROGRESS_INTERVAL = 500 * time.Millisecond
+
+// FileProblem describes a file that is missing or has the wrong size.
+// Pieces reaching past what the file holds are counted as failed without
+// being hashed, those within it are still checked.
+type FileProblem struct {
+	Index    int
+	Path     string
+	Missing  bool
+	Expected int64
+	Actual   int64
+}
+
+// State is what a check needs to resume where it left off
+type State struct {
+	// Pieces that have been checked, whether they verified or not
+	Checked *bitfield.Bitfield
+	// Pieces that verified
+	Verified *bitfield.Bitfield
+}
+
+func NewState(numPieces int) *State {
+	return &State{bitfield.New(numPieces), bitfield.New(numPieces)}
+}
+
+func (s *State) copy() *State {
+	return &State{s.Checked.Copy(), s.Verified.Copy()}
+}
+
+type Progress struct {
+	State
+	NumChecked     int
+	NumPieces      int
+	BytesChecked   int64
+	BytesPerSecond float64
+	ETA            time.Duration
+	Problems       []FileProblem
+
+	// Set on the last progress report. Err is set if the check was cut
+	// short, in which case State can be passed to Resume.
+	Done bool
+	Err  error
+}
+
+type TorrentChecker struct {
+	Workers          int
+	ProgressInterval time.Duration
+}
+
+func New() *TorrentChecker {
+	return &TorrentChecker{
+		Workers:          runtime.NumCPU(),
+		ProgressInterval: DEFAULT_PROGRESS_INTERVAL,
+	}
+}
+
+type job struct {
+	index int
+	data  []byte
+	err   error
+}
+
+type result struct {
+	index    int
+	length   int
+	verified bool
+}
+
+// Check verifies every piece of the torrent. Progress is sent on the
+// returned channel, which is closed after the report with Done set.
+func (c *TorrentChecker) Check(ctx context.Context, store storage.Storage, metadata *torrent.MetaData) <-chan *Progress {
+	return c.Resume(ctx, store, metadata, NewState(metadata.NumPieces()))
+}
+
+// Resume continues an interrupted check, skipping pieces already checked
+func (c *TorrentChecker) Resume(ctx context.Context, store storage.Storage, metadata *torrent.MetaData, state *State) <-chan *Progress {
+	progChan := make(chan *Progress, 1)
+	go c.run(ctx, store, metadata, state.copy(), progChan)
+	return progChan
+}
+
+// checkFiles returns the files that are missing or have the wrong size
+func checkFiles(store storage.Storage, files []torrent.File) []FileProblem {
+	sizer, ok := store.(storage.FileSizer)
+	if !ok {
+		return nil
+	}
+
+	var problems []FileProblem
+	for i := range files {
+		f := &files[i]
+		if !f.HasData() {
+			continue
+		}
+
+		size, err := sizer.FileSize(i)
+		if err != nil && os.IsNotExist(err) {
+			problems = append(problems, FileProblem{i, f.Path(), true, int64(f.Length), 0})
+		} else if err == nil && size != int64(f.Length) {
+			problems = append(problems, FileProblem{i, f.Path(), false, int64(f.Length), size})
+		}
+	}
+
+	return problems
+}
+
+// badPieces returns the pieces that reach past the data the problem files
+// hold. Files that are too short, such as partly downloaded sparse files,
+// keep the pieces that lie entirely before their end.
+func badPieces(metadata *torrent.MetaData, problems []FileProblem) map[int]bool {
+	bad := make(map[int]bool)
+	if len(problems) == 0 {
+		return bad
+	}
+
+	files := metadata.Files()
+	offsets := make([]int64, len(files))
+	var offset int64
+	for i, f := range files {
+		offsets[i] = offset
+		offset += int64(f.Length)
+	}
+
+	// Bytes of each problem file that can be read, 0 if it's missing
+	available := make(map[int]int64)
+	for _, p := range problems {
+		available[p.Index] = p.Actual
+	}
+
+	layout := torrent.NewFileStream("", files)
+	for _, p := range metadata.GeneratePieces() {
+		for i := range layout.FileSpans(torrent.Block{Offset: p.ByteOffset, Length: p.Length}) {
+			size, ok := available[i]
+			if !ok {
+				continue
+			}
+
+			end := int64(p.ByteOffset + p.Length)
+			if fileEnd := offsets[i] + int64(files[i].Length); end > fileEnd {
+				end = fileEnd
+			}
+			if end-offsets[i] > size {
+				bad[p.Index] = true
+			}
+		}
+	}
+
+	return bad
+}
+
+// FileResult is how much of one file verified
+type FileResult struct {
+	Index          int
+	Path           string
+	Length         int64
+	Pieces         int
+	VerifiedPieces int
+	// Set if the file is missing or has the wrong size
+	Problem *FileProblem
+}
+
+// OK reports whether every piece of the file verified
+func (r *FileResult) OK() bool {
+	return r.Problem == nil && r.VerifiedPieces == r.Pieces
+}
+
+// FileResults breaks a finished check down by file. Files without data
+// of their own, such as padding files, are left out.
+func FileResults(metadata *torrent.MetaData, p *Progress) []FileResult {
+	files := metadata.Files()
+	results := make([]FileResult, len(files))
+	for i := range files {
+		results[i] = FileResult{Index: i, Path: files[i].Path(), Length: int64(files[i].Length)}
+	}
+	for i := range p.Problems {
+		results[p.Problems[i].Index].Problem = &p.Problems[i]
+	}
+
+	layout := torrent.NewFileStream("", files)
+	for _, piece := range metadata.GeneratePieces() {
+		verified := p.Verified.Get(piece.Index) == 1
+		for i := range layout.FileSpans(torrent.Block{Offset: piece.ByteOffset, Length: piece.Length}) {
+			results[i].Pieces++
+			if verified {
+				results[i].VerifiedPieces++
+			}
+		}
+	}
+
+	var withData []FileResult
+	for i, r := range results {
+		if files[i].HasData() {
+			withData = append(withData, r)
+		}
+	}
+	return withData
+}
+
+// readPieces reads every piece still to be checked in order, so the
+// storage sees sequential reads however many workers are hashing
+func readPieces(ctx context.Context, store storage.Storage, pieces []torrent.Piece, todo []int, jobs chan<- *job) {
+	defer close(jobs)
+
+	for _, i := range todo {
+		j := &job{index: i, data: make([]byte, pieces[i].Length)}
+		_, j.err = store.ReadAt(j.data, i, 0)
+
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func hashPieces(ctx context.Context, metadata *torrent.MetaData, jobs <-chan *job, results chan<- *result) {
+	for j := range jobs {
+		r := &result{j.index, len(j.data), j.err == nil && metadata.VerifyPiece(j.index, j.data)}
+
+		select {
+		case results <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send replaces any report the receiver hasn't picked up yet
+func send(progChan chan *Progress, p *Progress) {
+	select {
+	case <-progChan:
+	default:
+	}
+	progChan <- p
+}
+
+func (c *TorrentChecker) run(ctx context.Context, store storage.Storage, metadata *torrent.MetaData, state *State, progChan chan *Progress) {
+	defer close(progChan)
+
+	pieces := metadata.GeneratePieces()
+	problems := checkFiles(store, metadata.Files())
+	bad := badPieces(metadata, problems)
+
+	progress := &Progress{NumPieces: len(pieces), Problems: problems}
+	var bytesLeft int64
+	var todo []int
+	for i := range pieces {
+		if state.Checked.Get(i) == 1 {
+			progress.NumChecked++
+		} else if bad[i] {
+			state.Checked.Set(i, 1)
+			progress.NumChecked++
+		} else {
+			todo = append(todo, i)
+			bytesLeft += int64(pieces[i].Length)
+		}
+	}
+
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan *job, workers)
+	results := make(chan *result, workers)
+	go readPieces(ctx, store, pieces, todo, jobs)
+
+	done := make(chan bool)
+	for i := 0; i < workers; i++ {
+		go func() {
+			hashPieces(ctx, metadata, jobs, results)
+			done <- true
+		}()
+	}
+	go func() {
+		for i := 0; i < workers; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	start := time.Now()
+	report := func() *Progress {
+		p := *progress
+		p.State = *state.copy()
+
+		elapsed := time.Since(start).Seconds()
+		if elapsed > 0 {
+			p.BytesPerSecond = float64(p.BytesChecked) / elapsed
+		}
+		if p.BytesPerSecond > 0 {
+			p.ETA = time.Duration(float64(bytesLeft) / p.BytesPerSecond * float64(time.Second))
+		}
+		return &p
+	}
+
+	ticker := time.NewTicker(c.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				// Workers also stop early when the context is done
+				p := report()
+				p.Done = true
+				p.Err = ctx.Err()
+				send(progChan, p)
+				return
+			}
+
+			state.Checked.Set(r.index, 1)
+			if r.verified {
+				state.Verified.Set(r.index, 1)
+			}
+			progress.NumChecked++
+			progress.BytesChecked += int64(r.length)
+			bytesLeft -= int64(r.length)
+		case <-ticker.C:
+			send(progChan, report())
+		case <-ctx.Done():
+			p := report()
+			p.Done = true
+			p.Err = ctx.Err()
+			send(progChan, p)
+			return
+		}
+	}
+}
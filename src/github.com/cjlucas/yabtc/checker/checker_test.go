@@ -0,0 +1,166 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestTorrent creates files of 40000 and 30000 bytes under root and
+// returns a torrent for them with 16KiB pieces
+func newTestTorrent(root string) *torrent.MetaData {
+	dir := filepath.Join(root, "content")
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte{1}, 40000), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), bytes.Repeat([]byte{2}, 30000), 0644)
+
+	t, err := torrent.Create(dir, torrent.CreateOptions{PieceLength: 1 << 14, V1: true})
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func lastProgress(progChan <-chan *Progress) *Progress {
+	var last *Progress
+	for p := range progChan {
+		last = p
+	}
+	return last
+}
+
+func TestCheck(t *testing.T) {
+	Convey("When checking a complete torrent", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-checker")
+		defer os.RemoveAll(root)
+		tor := newTestTorrent(root)
+
+		p := lastProgress(New().Check(context.Background(), storage.NewFileStorage(root, tor), tor))
+
+		Convey("Every piece should verify", func() {
+			So(p.Done, ShouldBeTrue)
+			So(p.Err, ShouldBeNil)
+			So(p.NumChecked, ShouldEqual, tor.NumPieces())
+			So(p.Verified.Count(), ShouldEqual, tor.NumPieces())
+			So(p.BytesChecked, ShouldEqual, 70000)
+			So(p.Problems, ShouldBeEmpty)
+		})
+	})
+
+	Convey("When a piece is corrupt", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-checker")
+		defer os.RemoveAll(root)
+		tor := newTestTorrent(root)
+
+		fp, _ := os.OpenFile(filepath.Join(root, "content", "a"), os.O_WRONLY, 0644)
+		fp.WriteAt([]byte{9}, 20000)
+		fp.Close()
+
+		c := New()
+		c.Workers = 3
+		p := lastProgress(c.Check(context.Background(), storage.NewFileStorage(root, tor), tor))
+
+		Convey("Only that piece should fail", func() {
+			So(p.Verified.Get(1), ShouldEqual, 0)
+			So(p.Verified.Count(), ShouldEqual, tor.NumPieces()-1)
+		})
+
+		Convey("Only the file it's in should fail", func() {
+			results := FileResults(tor, p)
+			So(len(results), ShouldEqual, 2)
+			So(results[0].OK(), ShouldBeFalse)
+			So(results[0].Pieces, ShouldEqual, 3)
+			So(results[0].VerifiedPieces, ShouldEqual, 2)
+			So(results[1].OK(), ShouldBeTrue)
+			So(results[1].Path, ShouldEqual, "content/b")
+		})
+	})
+
+	Convey("When a file is missing and another has the wrong size", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-checker")
+		defer os.RemoveAll(root)
+		tor := newTestTorrent(root)
+
+		os.Remove(filepath.Join(root, "content", "a"))
+		os.Truncate(filepath.Join(root, "content", "b"), 100)
+
+		p := lastProgress(New().Check(context.Background(), storage.NewFileStorage(root, tor), tor))
+
+		Convey("Both should be reported", func() {
+			So(len(p.Problems), ShouldEqual, 2)
+			So(p.Problems[0].Missing, ShouldBeTrue)
+			So(p.Problems[1].Actual, ShouldEqual, 100)
+			So(p.Problems[1].Expected, ShouldEqual, 30000)
+		})
+
+		Convey("Their pieces should fail without being hashed", func() {
+			So(p.NumChecked, ShouldEqual, tor.NumPieces())
+			So(p.Verified.Count(), ShouldEqual, 0)
+			So(p.BytesChecked, ShouldEqual, 0)
+		})
+
+		Convey("Their file results should carry the problems", func() {
+			results := FileResults(tor, p)
+			So(results[0].Problem.Missing, ShouldBeTrue)
+			So(results[1].Problem.Actual, ShouldEqual, 100)
+			So(results[1].OK(), ShouldBeFalse)
+		})
+	})
+
+	Convey("When a file is shorter than expected but partly written", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-checker")
+		defer os.RemoveAll(root)
+		tor := newTestTorrent(root)
+
+		// Cuts b off at the end of the fourth piece
+		os.Truncate(filepath.Join(root, "content", "b"), 4<<14-40000)
+
+		p := lastProgress(New().Check(context.Background(), storage.NewFileStorage(root, tor), tor))
+
+		Convey("Its size should be reported", func() {
+			So(len(p.Problems), ShouldEqual, 1)
+			So(p.Problems[0].Actual, ShouldEqual, 4<<14-40000)
+		})
+
+		Convey("The pieces it holds should still be hashed", func() {
+			So(p.NumChecked, ShouldEqual, tor.NumPieces())
+			So(p.BytesChecked, ShouldEqual, 4<<14)
+			So(p.Verified.Count(), ShouldEqual, 4)
+			So(p.Verified.Get(4), ShouldEqual, 0)
+		})
+	})
+
+	Convey("When a check is cancelled and resumed", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-checker")
+		defer os.RemoveAll(root)
+		tor := newTestTorrent(root)
+		store := storage.NewFileStorage(root, tor)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		p := lastProgress(New().Check(ctx, store, tor))
+
+		Convey("The cancelled check should report the context's error", func() {
+			So(p.Done, ShouldBeTrue)
+			So(p.Err, ShouldEqual, context.Canceled)
+		})
+
+		Convey("Resuming should only check the remaining pieces", func() {
+			state := NewState(tor.NumPieces())
+			state.Checked.Set(0, 1)
+			state.Verified.Set(0, 1)
+
+			p := lastProgress(New().Resume(context.Background(), store, tor, state))
+			So(p.Err, ShouldBeNil)
+			So(p.BytesChecked, ShouldEqual, 70000-(1<<14))
+			So(p.Verified.Count(), ShouldEqual, tor.NumPieces())
+		})
+	})
+}
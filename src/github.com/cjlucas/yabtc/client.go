@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cjlucas/yabtc/lsd"
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/portmap"
+	"github.com/cjlucas/yabtc/queue"
+	"github.com/cjlucas/yabtc/ratelimit"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+type ClientConfig struct {
+	Port           int
+	PeerId         []byte
+	SavePath       string
+	ResumeDir      string
+	AllocationMode storage.AllocationMode
+	SeedGoals      swarm.SeedGoals
+	QueueLimits    queue.Limits
+
+	// Speed limits in bytes per second, the alternative limits are used
+	// while the schedule says so (nil for never)
+	SpeedLimits    ratelimit.Limits
+	AltSpeedLimits ratelimit.Limits
+	AltSchedule    *ratelimit.Schedule
+
+	NoPortmap bool
+	NoLsd     bool
+	NoPex     bool
+}
+
+// Client ties the managers together. Torrents added to it are registered
+// with every peer source their policy allows.
+type Client struct {
+	Config ClientConfig
+
+	sm        *SwarmManager
+	pm        *PeerManager
+	tm        *TrackerManager
+	ld        *lsd.Service
+	pmap      *portmap.Manager
+	scheduler *ratelimit.Scheduler
+
+	// Every peer source consults the torrent's policy, which keeps
+	// private torrents to the peers their trackers hand out
+	peerSources []p2p.PeerSource
+
+	lsdAnnounceChan  chan *lsd.Announce
+	externalPortChan chan int
+	// Trackers merged into a running torrent, announced to from Run so
+	// they're in step with the torrent starting and stopping
+	trackersAddedChan chan *trackersAdded
+
+	shutdownOnce sync.Once
+}
+
+type trackersAdded struct {
+	s    *swarm.Swarm
+	urls []string
+}
+
+func NewClient(cfg ClientConfig) (*Client, error) {
+	c := &Client{Config: cfg}
+	c.lsdAnnounceChan = make(chan *lsd.Announce)
+	c.externalPortChan = make(chan int)
+	c.trackersAddedChan = make(chan *trackersAdded, 10)
+
+	pm, err := NewPeerManager(cfg.Port)
+	if err != nil {
+		return nil, fmt.Errorf("could not start peer manager: %s", err)
+	}
+	c.pm = pm
+	go pm.Run()
+
+	c.tm = NewTrackerManager(cfg.Port)
+
+	c.scheduler = ratelimit.NewScheduler(cfg.SpeedLimits, cfg.AltSpeedLimits, cfg.AltSchedule)
+	c.sm = NewSwarmManager(cfg.SavePath, cfg.ResumeDir, cfg.AllocationMode)
+	c.sm.SetSeedGoals(cfg.SeedGoals)
+	c.sm.SetQueueLimits(cfg.QueueLimits)
+	c.sm.SetGoalRemover(c.RemoveTorrent)
+	c.sm.SetSpeedLimits(c.scheduler.Limits())
+	go c.sm.Run()
+	c.scheduler.Update()
+	go c.scheduler.Run()
+
+	if !cfg.NoPortmap {
+		if gw, err := portmap.Discover(); err != nil {
+			logger.Printf("port mapping disabled: %s", err)
+		} else {
+			logger.Printf("Found %s gateway", gw.Name())
+			c.pmap = portmap.NewManager(gw, cfg.Port)
+			c.externalPortChan = c.pmap.ExternalPortChan
+			go c.pmap.Run()
+		}
+	}
+
+	if !cfg.NoLsd {
+		c.peerSources = append(c.peerSources, p2p.PEER_SOURCE_LSD)
+		if ld, err := lsd.New(cfg.Port); err != nil {
+			logger.Printf("local service discovery disabled: %s", err)
+		} else {
+			c.ld = ld
+			c.lsdAnnounceChan = ld.AnnounceChan
+			go ld.Run()
+		}
+	}
+	if !cfg.NoPex {
+		c.peerSources = append(c.peerSources, p2p.PEER_SOURCE_PEX)
+	}
+
+	return c, nil
+}
+
+// AddTorrent returns swarm.TorrentExistsError if the torrent was already
+// added
+func (c *Client) AddTorrent(t *torrent.MetaData, opts AddOptions) error {
+	policy := p2p.NewPeerPolicy(t.IsPrivate(), c.peerSources...)
+	if err := c.sm.AddTorrent(t, policy, opts); err != nil {
+		return err
+	}
+
+	// Hybrid torrents are announced and accepted under both info hashes.
+	// Trackers are only announced to while the torrent is running.
+	for _, infoHash := range t.InfoHashes() {
+		c.pm.RegisterTorrent(infoHash, c.Config.PeerId, policy)
+		if c.ld != nil {
+			c.ld.AddTorrent(infoHash, policy)
+		}
+	}
+	return nil
+}
+
+// MergeTrackers adds t's trackers to the torrent already added under
+// one of its info hashes
+func (c *Client) MergeTrackers(t *torrent.MetaData) error {
+	var s *swarm.Swarm
+	for _, infoHash := range t.InfoHashes() {
+		var hash [20]byte
+		copy(hash[:], infoHash)
+		if s = c.sm.Swarm(hash); s != nil {
+			break
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("unknown torrent %s", t.InfoHashString())
+	}
+
+	if added := s.AddTrackers(t.Trackers()); len(added) > 0 {
+		logger.Printf("Added %d tracker(s) to torrent %s", len(added), s.Torrent.InfoHashString())
+		c.trackersAddedChan <- &trackersAdded{s, added}
+	}
+	return nil
+}
+
+// RemoveTorrent stops a torrent and forgets it, deleting its data too if
+// deleteData is set
+func (c *Client) RemoveTorrent(infoHash [20]byte, deleteData bool) error {
+	s := c.sm.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	for _, h := range s.Torrent.InfoHashes() {
+		c.pm.UnregisterTorrent(h)
+		if c.ld != nil {
+			c.ld.RemoveTorrent(h)
+		}
+	}
+	return c.sm.RemoveTorrent(infoHash, deleteData)
+}
+
+// MoveStorage moves a torrent's data to newRoot, see
+// SwarmManager.MoveStorage
+func (c *Client) MoveStorage(infoHash [20]byte, newRoot string) error {
+	return c.sm.MoveStorage(infoHash, newRoot)
+}
+
+// SetSuperSeeding turns super-seeding on or off, so a torrent's only seed
+// uploads as little as possible until it's spread among the peers
+func (c *Client) SetSuperSeeding(infoHash [20]byte, on bool) error {
+	return c.sm.SetSuperSeeding(infoHash, on)
+}
+
+// Shutdown saves every torrent's progress and gives up the port mapping.
+// Only the first call does anything, later calls wait for it to finish.
+func (c *Client) Shutdown() {
+	c.shutdownOnce.Do(func() {
+		c.sm.SaveResumeData()
+		if c.pmap != nil {
+			c.pmap.Stop()
+		}
+	})
+}
+
+func (c *Client) Run() {
+	sm, pm, tm := c.sm, c.pm, c.tm
+	for {
+		select {
+		case r := <-tm.AnnounceResponseChan:
+			fmt.Printf("Received tracker response: %v\n", r)
+			for _, p := range r.Response.Peers() {
+				pm.VerifyPeer(r.InfoHash[:], p.Ip(), p.Port(), p2p.PEER_SOURCE_TRACKER)
+			}
+		case a := <-c.lsdAnnounceChan:
+			pm.VerifyPeer(a.InfoHash[:], a.Ip, a.Port, p2p.PEER_SOURCE_LSD)
+		case fp := <-sm.PeerFoundChan:
+			pm.VerifyPeer(fp.InfoHash, fp.Ip, fp.Port, fp.Source)
+		case s := <-sm.StartedChan:
+			for _, url := range s.Trackers() {
+				for _, infoHash := range s.Torrent.InfoHashes() {
+					tm.AddTracker(url, infoHash, c.Config.PeerId)
+				}
+			}
+		case ta := <-c.trackersAddedChan:
+			if !ta.s.IsRunning() {
+				continue
+			}
+			for _, url := range ta.urls {
+				for _, infoHash := range ta.s.Torrent.InfoHashes() {
+					tm.AddTracker(url, infoHash, c.Config.PeerId)
+				}
+			}
+		case s := <-sm.StoppedChan:
+			for _, infoHash := range s.Torrent.InfoHashes() {
+				tm.StopTorrent(infoHash)
+			}
+		case s := <-sm.UploadOnlyChan:
+			for _, infoHash := range s.Torrent.InfoHashes() {
+				tm.SetUploadOnly(infoHash, s.IsUploadOnly())
+			}
+		case e := <-c.scheduler.EventChan:
+			logger.Printf("Speed limits are now %d/%d bytes/s down/up (alternative: %t)", e.Limits.Download, e.Limits.Upload, e.Alternative)
+			sm.SetSpeedLimits(e.Limits)
+		case port := <-c.externalPortChan:
+			logger.Printf("External port is %d", port)
+			tm.SetPort(port)
+		case vp := <-pm.VerifiedPeerChan:
+			fmt.Println("here", vp.Peer.Ip())
+			sm.AddPeer(vp.InfoHash, vp.Peer)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cjlucas/yabtc/checker"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	"github.com/cjlucas/yabtc/tracker"
+)
+
+func formatSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+type fileInfo struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// metainfo is what info prints
+type metainfo struct {
+	Name         string     `json:"name"`
+	InfoHashV1   string     `json:"info_hash_v1,omitempty"`
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"`
+	Magnet       string     `json:"magnet"`
+	Announce     string     `json:"announce,omitempty"`
+	Private      bool       `json:"private"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate int64      `json:"creation_date,omitempty"`
+	PieceLength  int        `json:"piece_length"`
+	NumPieces    int        `json:"num_pieces"`
+	TotalLength  int64      `json:"total_length"`
+	Files        []fileInfo `json:"files"`
+}
+
+func newMetainfo(t *torrent.MetaData) *metainfo {
+	info := &metainfo{
+		Name:         t.Name(),
+		Magnet:       t.MagnetURI(),
+		Announce:     t.Announce,
+		Private:      t.IsPrivate(),
+		Comment:      t.Comment,
+		CreatedBy:    t.CreatedBy,
+		CreationDate: t.CreationDate,
+		PieceLength:  t.PieceSize(),
+		NumPieces:    t.NumPieces(),
+		Files:        []fileInfo{},
+	}
+	if t.IsV1() {
+		info.InfoHashV1 = hex.EncodeToString(t.InfoHashV1())
+	}
+	if t.IsV2() {
+		info.InfoHashV2 = hex.EncodeToString(t.InfoHashV2())
+	}
+
+	// Files keep their index in the torrent, which is what download's
+	// -only and -skip take
+	for i, f := range t.Files() {
+		if !f.HasData() {
+			continue
+		}
+		info.Files = append(info.Files, fileInfo{i, f.Path(), int64(f.Length)})
+		info.TotalLength += int64(f.Length)
+	}
+
+	return info
+}
+
+func (info *metainfo) print() {
+	fmt.Printf("Name:         %s\n", info.Name)
+	if info.InfoHashV1 != "" {
+		fmt.Printf("Info hash:    %s\n", info.InfoHashV1)
+	}
+	if info.InfoHashV2 != "" {
+		fmt.Printf("Info hash v2: %s\n", info.InfoHashV2)
+	}
+	fmt.Printf("Magnet:       %s\n", info.Magnet)
+	if info.Announce != "" {
+		fmt.Printf("Announce:     %s\n", info.Announce)
+	}
+	fmt.Printf("Private:      %t\n", info.Private)
+	if info.Comment != "" {
+		fmt.Printf("Comment:      %s\n", info.Comment)
+	}
+	if info.CreatedBy != "" {
+		fmt.Printf("Created by:   %s\n", info.CreatedBy)
+	}
+	if info.CreationDate != 0 {
+		fmt.Printf("Created:      %s\n", time.Unix(info.CreationDate, 0).Format(time.RFC1123))
+	}
+	fmt.Printf("Pieces:       %d x %s\n", info.NumPieces, formatSize(int64(info.PieceLength)))
+	fmt.Printf("Total size:   %s (%d bytes)\n", formatSize(info.TotalLength), info.TotalLength)
+
+	fmt.Printf("Files:\n")
+	for _, f := range info.Files {
+		fmt.Printf("  %4d  %10s  %s\n", f.Index, formatSize(f.Length), f.Path)
+	}
+}
+
+func runInfo(args []string) int {
+	fs := newFlagSet("info", "<torrent>")
+	asJson := fs.Bool("json", false, "print the metainfo as JSON")
+	if !parseArgs(fs, args, 1) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+
+	info := newMetainfo(t)
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(info); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return EXIT_FAILURE
+		}
+	} else {
+		info.print()
+	}
+
+	return EXIT_OK
+}
+
+func runVerify(args []string) int {
+	fs := newFlagSet("verify", "<torrent> <dir>")
+	quiet := fs.Bool("q", false, "only print files that failed")
+	if !parseArgs(fs, args, 2) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+
+	var progress *checker.Progress
+	store := storage.NewFileStorage(fs.Arg(1), t)
+	for progress = range checker.New().Check(context.Background(), store, t) {
+	}
+	if progress.Err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", progress.Err)
+		return EXIT_FAILURE
+	}
+
+	failed := 0
+	for _, r := range checker.FileResults(t, progress) {
+		var status string
+		switch {
+		case r.Problem != nil && r.Problem.Missing:
+			status = "MISSING"
+		case r.Problem != nil:
+			status = fmt.Sprintf("SIZE %d != %d", r.Problem.Actual, r.Problem.Expected)
+		case r.VerifiedPieces != r.Pieces:
+			status = fmt.Sprintf("FAIL %d/%d pieces", r.VerifiedPieces, r.Pieces)
+		default:
+			status = "OK"
+		}
+
+		if !r.OK() {
+			failed++
+		} else if *quiet {
+			continue
+		}
+		fmt.Printf("%-20s %s\n", status, r.Path)
+	}
+
+	fmt.Printf("%d of %d pieces verified\n", progress.Verified.Count(), progress.NumPieces)
+	if failed > 0 {
+		fmt.Printf("%d file(s) failed\n", failed)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+// runMove moves the data of a torrent no client is running. The daemon
+// moves the data of its torrents itself, over RPC.
+func runMove(args []string) int {
+	fs := newFlagSet("move", "<torrent> <dir> <newdir>")
+	if !parseArgs(fs, args, 3) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+
+	store := storage.NewFileStorage(fs.Arg(1), t)
+	lastReport := time.Now()
+	err := store.Move(fs.Arg(2), func(moved, total int64) {
+		if time.Since(lastReport) >= PROGRESS_INTERVAL {
+			fmt.Printf("%s of %s moved\n", formatSize(moved), formatSize(total))
+			lastReport = time.Now()
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_FAILURE
+	}
+
+	fmt.Printf("Moved to %s\n", fs.Arg(2))
+	return EXIT_OK
+}
+
+func runMagnet(args []string) int {
+	fs := newFlagSet("magnet", "<torrent>")
+	if !parseArgs(fs, args, 1) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+
+	fmt.Println(t.MagnetURI())
+	return EXIT_OK
+}
+
+// trackerUrl is the tracker to query, the torrent's unless one is given
+func trackerUrl(t *torrent.MetaData, override string) (string, bool) {
+	if override != "" {
+		return override, true
+	}
+	if t.Announce == "" {
+		fmt.Fprintf(os.Stderr, "error: torrent has no tracker, use -tracker\n")
+		return "", false
+	}
+	return t.Announce, true
+}
+
+func runAnnounce(args []string) int {
+	fs := newFlagSet("announce", "<torrent>")
+	url := fs.String("tracker", "", "tracker to announce to instead of the torrent's")
+	port := fs.Int("port", LISTEN_PORT, "port peers are told to connect to")
+	event := fs.String("event", tracker.EVENT_STARTED, "announce event: started, stopped, completed or none")
+	numWant := fs.Int("numwant", 50, "number of peers to ask for")
+	if !parseArgs(fs, args, 1) {
+		return usageExitCode(args)
+	}
+
+	switch *event {
+	case tracker.EVENT_STARTED, tracker.EVENT_STOPPED, tracker.EVENT_COMPLETED:
+	case "none":
+		*event = tracker.EVENT_NONE
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown event: %s\n", *event)
+		return EXIT_USAGE
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+	announceUrl, ok := trackerUrl(t, *url)
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	left := 0
+	for _, f := range t.Files() {
+		if f.HasData() {
+			left += f.Length
+		}
+	}
+
+	req := tracker.AnnounceRequest{
+		Url:      announceUrl,
+		InfoHash: t.InfoHash(),
+		PeerId:   PEER_ID,
+		Port:     *port,
+		Left:     left,
+		Event:    *event,
+		NumWant:  *numWant,
+	}
+	resp, err := req.Request()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	if reason := resp.FailureReason(); reason != "" {
+		fmt.Fprintf(os.Stderr, "tracker error: %s\n", reason)
+		return EXIT_FAILURE
+	}
+
+	fmt.Printf("Interval: %ds\n", resp.Interval())
+	fmt.Printf("Seeders:  %d\n", resp.Seeders())
+	fmt.Printf("Leechers: %d\n", resp.Leechers())
+	peers := resp.Peers()
+	fmt.Printf("Peers:    %d\n", len(peers))
+	for _, p := range peers {
+		fmt.Printf("  %s:%d\n", p.Ip(), p.Port())
+	}
+
+	return EXIT_OK
+}
+
+func runScrape(args []string) int {
+	fs := newFlagSet("scrape", "<torrent>")
+	url := fs.String("tracker", "", "tracker to scrape instead of the torrent's")
+	if !parseArgs(fs, args, 1) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+	announceUrl, ok := trackerUrl(t, *url)
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	// Trackers know hybrid torrents by either hash
+	infoHashes := t.InfoHashes()
+	results, err := tracker.Scrape(announceUrl, infoHashes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_FAILURE
+	}
+
+	found := false
+	for _, infoHash := range infoHashes {
+		var hash [20]byte
+		copy(hash[:], infoHash)
+		r, ok := results[hash]
+		if !ok {
+			fmt.Printf("%x: unknown to tracker\n", hash)
+			continue
+		}
+		found = true
+		fmt.Printf("%x: %d seeders, %d leechers, %d completed\n", hash, r.Seeders, r.Leechers, r.Completed)
+	}
+
+	if !found {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
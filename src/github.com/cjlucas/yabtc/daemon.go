@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/rpc"
+	"github.com/cjlucas/yabtc/torrent"
+	"github.com/cjlucas/yabtc/watch"
+)
+
+// Daemon is the session the RPC server manages. Torrent control goes
+// straight to the swarm manager. The daemon keeps a copy of every
+// torrent it manages next to the resume data, so they're added back
+// when it restarts.
+type Daemon struct {
+	*SwarmManager
+	client *Client
+
+	// Kept as clients set them, so a limit that's turned off remembers
+	// its value
+	settings rpc.Settings
+	lock     sync.Mutex
+}
+
+func NewDaemon(c *Client) *Daemon {
+	d := &Daemon{SwarmManager: c.sm, client: c}
+
+	st := &d.settings
+	st.DownloadQueueSize = 5
+	st.SeedQueueSize = 10
+	st.SetSpeedLimits(c.Config.SpeedLimits, c.Config.AltSpeedLimits)
+	st.SetSchedule(c.Config.AltSchedule)
+	st.SetQueueLimits(c.Config.QueueLimits)
+	st.SetSeedGoals(c.Config.SeedGoals)
+	st.PeerPort = c.Config.Port
+	st.PexEnabled = !c.Config.NoPex
+	st.LpdEnabled = !c.Config.NoLsd
+
+	// Torrents removed by a seeding goal aren't loaded again either
+	c.sm.SetGoalRemover(d.RemoveTorrent)
+
+	return d
+}
+
+func (d *Daemon) Swarms() []*swarm.Swarm {
+	return d.SwarmList()
+}
+
+func (d *Daemon) torrentFile(infoHash []byte) string {
+	return filepath.Join(d.client.Config.ResumeDir, fmt.Sprintf("%x.torrent", infoHash))
+}
+
+// Start runs the client and adds back the torrents managed before the
+// last restart. The client has to be running first, it's told about
+// every torrent that starts.
+func (d *Daemon) Start() {
+	go d.client.Run()
+	d.LoadTorrents()
+}
+
+// LoadTorrents adds back the torrents managed before the last restart
+func (d *Daemon) LoadTorrents() {
+	files, _ := filepath.Glob(filepath.Join(d.client.Config.ResumeDir, "*.torrent"))
+	for _, fname := range files {
+		t, err := torrent.ParseFile(fname)
+		if err == nil {
+			err = d.client.AddTorrent(t, AddOptions{})
+		}
+		if err != nil {
+			logger.Printf("Could not load torrent %s: %s", fname, err)
+		}
+	}
+}
+
+func (d *Daemon) AddTorrent(t *torrent.MetaData, opts rpc.AddOptions) error {
+	err := d.client.AddTorrent(t, AddOptions{
+		SavePath: opts.DownloadDir,
+		Paused:   opts.Paused,
+		Labels:   opts.Labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	b, err := t.Bytes()
+	if err == nil {
+		if err = os.MkdirAll(d.client.Config.ResumeDir, 0755); err == nil {
+			err = ioutil.WriteFile(d.torrentFile(t.InfoHash()), b, 0644)
+		}
+	}
+	if err != nil {
+		logger.Printf("Could not save torrent %s: %s", t.InfoHashString(), err)
+	}
+	return nil
+}
+
+func (d *Daemon) RemoveTorrent(infoHash [20]byte, deleteData bool) error {
+	s := d.Swarm(infoHash)
+	if err := d.client.RemoveTorrent(infoHash, deleteData); err != nil {
+		return err
+	}
+
+	os.Remove(d.torrentFile(s.Torrent.InfoHash()))
+	return nil
+}
+
+// MergeTrackers adds t's trackers to the torrent already added under
+// the same info hash
+func (d *Daemon) MergeTrackers(t *torrent.MetaData) error {
+	return d.client.MergeTrackers(t)
+}
+
+// watchSession adds the torrents dropped into a watch directory
+type watchSession struct {
+	*Daemon
+}
+
+func (ws watchSession) AddTorrent(t *torrent.MetaData, opts watch.AddOptions) error {
+	return ws.Daemon.AddTorrent(t, rpc.AddOptions{DownloadDir: opts.SavePath, Labels: opts.Labels})
+}
+
+// Watch adds the torrents dropped into dir until the watcher is stopped
+func (d *Daemon) Watch(dir string, opts watch.AddOptions) *watch.Watcher {
+	w := watch.New(dir, watchSession{d}, opts)
+	go w.Run()
+	return w
+}
+
+func (d *Daemon) Settings() rpc.Settings {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	st := d.settings
+	st.DownloadDir = d.SavePath()
+	st.AltSpeedEnabled = d.client.scheduler.IsAlternative()
+	return st
+}
+
+func (d *Daemon) SetSettings(st rpc.Settings) error {
+	prev := d.Settings()
+
+	d.lock.Lock()
+	d.settings = st
+	d.lock.Unlock()
+
+	if st.DownloadDir != "" {
+		d.SetSavePath(st.DownloadDir)
+	}
+
+	scheduler := d.client.scheduler
+	scheduler.SetLimits(st.SpeedLimits())
+	scheduler.SetSchedule(st.Schedule())
+	// Only switch by hand when asked to, the new schedule may already
+	// have switched
+	if st.AltSpeedEnabled != prev.AltSpeedEnabled {
+		scheduler.SetAlternative(st.AltSpeedEnabled)
+	}
+
+	d.SetQueueLimits(st.QueueLimits(d.QueueLimits()))
+	d.SetSeedGoals(st.SeedGoals(d.SeedGoals()))
+	return nil
+}
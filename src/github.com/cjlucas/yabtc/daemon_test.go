@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newCompletedTorrents saves n torrents to resumeDir whose data is
+// already complete in savePath
+func newCompletedTorrents(savePath, resumeDir string, n int) {
+	os.MkdirAll(resumeDir, 0755)
+	for i := 0; i < n; i++ {
+		fname := filepath.Join(savePath, fmt.Sprintf("file%d", i))
+		ioutil.WriteFile(fname, []byte(fmt.Sprintf("content of file %d", i)), 0644)
+
+		t, err := torrent.Create(fname, torrent.CreateOptions{V1: true})
+		if err != nil {
+			panic(err)
+		}
+		b, err := t.Bytes()
+		if err != nil {
+			panic(err)
+		}
+		ioutil.WriteFile(filepath.Join(resumeDir, fmt.Sprintf("%x.torrent", t.InfoHash())), b, 0644)
+	}
+}
+
+func TestDaemonStart(t *testing.T) {
+	Convey("When starting with more completed torrents than the client's channels hold", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-daemon")
+		defer os.RemoveAll(root)
+		savePath, resumeDir := filepath.Join(root, "data"), filepath.Join(root, "resume")
+		os.MkdirAll(savePath, 0755)
+		newCompletedTorrents(savePath, resumeDir, 150)
+
+		client, err := NewClient(ClientConfig{
+			SavePath:  savePath,
+			ResumeDir: resumeDir,
+			NoPortmap: true,
+			NoLsd:     true,
+		})
+		So(err, ShouldBeNil)
+		defer client.Shutdown()
+		daemon := NewDaemon(client)
+
+		done := make(chan bool)
+		go func() {
+			daemon.Start()
+			close(done)
+		}()
+
+		Convey("Every torrent should be loaded", func() {
+			select {
+			case <-done:
+			case <-time.After(30 * time.Second):
+				t.Fatal("loading the torrents did not finish")
+			}
+			So(daemon.Swarms(), ShouldHaveLength, 150)
+		})
+	})
+}
+
+func TestDaemonGoalRemoval(t *testing.T) {
+	Convey("When a torrent reaches a seeding goal that removes it", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-daemon")
+		defer os.RemoveAll(root)
+		savePath, resumeDir := filepath.Join(root, "data"), filepath.Join(root, "resume")
+		os.MkdirAll(savePath, 0755)
+		newCompletedTorrents(savePath, resumeDir, 1)
+
+		cfg := ClientConfig{
+			SavePath:  savePath,
+			ResumeDir: resumeDir,
+			SeedGoals: swarm.SeedGoals{SeedTime: time.Nanosecond, Action: swarm.GOAL_ACTION_REMOVE},
+			NoPortmap: true,
+			NoLsd:     true,
+		}
+		client, err := NewClient(cfg)
+		So(err, ShouldBeNil)
+		daemon := NewDaemon(client)
+		daemon.Start()
+		So(daemon.Swarms(), ShouldHaveLength, 1)
+		s := daemon.Swarms()[0]
+
+		deadline := time.Now().Add(10 * time.Second)
+		for !s.IsUploadOnly() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		client.sm.checkSeedGoals()
+
+		Convey("It should be removed everywhere it was registered", func() {
+			So(daemon.Swarms(), ShouldBeEmpty)
+			So(client.pm.getHandshakeInfo(s.Torrent.InfoHash()), ShouldBeNil)
+		})
+
+		Convey("It should not be loaded again after a restart", func() {
+			client.Shutdown()
+			client, err := NewClient(cfg)
+			So(err, ShouldBeNil)
+			daemon := NewDaemon(client)
+			daemon.Start()
+			So(daemon.Swarms(), ShouldBeEmpty)
+		})
+	})
+}
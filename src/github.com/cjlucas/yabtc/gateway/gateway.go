@@ -0,0 +1,156 @@
+// Package gateway serves torrent content over HTTP at /<infohash>/<path>
+package gateway
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+)
+
+// SwarmLookup returns the swarm for an info hash, or nil if there is none
+type SwarmLookup func(infoHash [20]byte) *swarm.Swarm
+
+type Server struct {
+	lookup SwarmLookup
+}
+
+func New(lookup SwarmLookup) *Server {
+	return &Server{lookup}
+}
+
+func parseInfoHash(s string) ([20]byte, bool) {
+	var hash [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(hash) {
+		return hash, false
+	}
+
+	copy(hash[:], b)
+	return hash, true
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /<infohash>/<path>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	infoHash, ok := parseInfoHash(parts[0])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s := srv.lookup(infoHash)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	p := parts[1]
+	files := s.Torrent.Files()
+	for i := range files {
+		if !files[i].IsPadding() && files[i].Path() == p {
+			srv.serveFile(w, r, s, i, parts[0])
+			return
+		}
+	}
+
+	dir := strings.TrimSuffix(p, "/")
+	entries := listDir(s, dir)
+	if entries == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if p != "" && !strings.HasSuffix(p, "/") {
+		http.Redirect(w, r, path.Base(p)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	serveListing(w, r, entries)
+}
+
+func (srv *Server) serveFile(w http.ResponseWriter, r *http.Request, s *swarm.Swarm, index int, infoHash string) {
+	if s.FilePriority(index) == swarm.PRIORITY_SKIP {
+		http.Error(w, "file is not selected for download", http.StatusForbidden)
+		return
+	}
+
+	f := s.File(index)
+	reader := f.NewReaderContext(r.Context())
+	defer reader.Close()
+
+	// Torrent content never changes, so the info hash and file index
+	// are enough for a strong validator
+	w.Header().Set("ETag", fmt.Sprintf("\"%s-%d\"", strings.ToLower(infoHash), index))
+
+	if ctype := mime.TypeByExtension(path.Ext(f.Path())); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	// Range requests seek the reader, which fetches the pieces under it first
+	http.ServeContent(w, r, f.Path(), time.Time{}, reader)
+}
+
+// listDir returns the names of the entries directly under dir, with
+// directories ending in a slash. Returns nil if dir does not exist.
+func listDir(s *swarm.Swarm, dir string) []string {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	seen := make(map[string]bool)
+	var entries []string
+	for _, f := range s.Torrent.Files() {
+		p := f.Path()
+		if f.IsPadding() || !strings.HasPrefix(p, prefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(p, prefix)
+		if i := strings.Index(name, "/"); i != -1 {
+			name = name[:i+1]
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			entries = append(entries, name)
+		}
+	}
+
+	sort.Strings(entries)
+	return entries
+}
+
+func serveListing(w http.ResponseWriter, r *http.Request, entries []string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	fmt.Fprintf(w, "<pre>\n")
+	for _, name := range entries {
+		u := url.URL{Path: name}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/bitfield"
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var videoData = bytes.Repeat([]byte("0123456789"), 5000)
+
+var notesData = []byte("some notes")
+
+// runSeeder answers every request from the peer on the other end of
+// the listener with data read from store
+func runSeeder(l net.Listener, t *torrent.MetaData, store storage.Storage) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+
+	peer := p2p.NewPeerWithConn(conn)
+	peer.StartHandlers()
+
+	bits := bitfield.New(t.NumPieces())
+	for i := 0; i < t.NumPieces(); i++ {
+		bits.Set(i, 1)
+	}
+	peer.WriteChan <- messages.NewBitfield(bits)
+	peer.WriteChan <- messages.NewUnchoke()
+
+	for msg := range peer.ReadChan {
+		req, ok := msg.(*messages.Request)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, req.Length)
+		if _, err := store.ReadAt(data, req.Index, req.Begin); err == nil {
+			peer.WriteChan <- messages.NewPiece(req.Index, req.Begin, data)
+		}
+	}
+}
+
+// newTestGateway returns a gateway backed by a swarm downloading from a
+// loopback seeder, and the torrent's info hash
+func newTestGateway() (*httptest.Server, string, func()) {
+	seedRoot, _ := ioutil.TempDir("", "yabtc-seed")
+	dir := filepath.Join(seedRoot, "media")
+	os.MkdirAll(filepath.Join(dir, "extra"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "video.mp4"), videoData, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "extra", "notes.txt"), notesData, 0644)
+
+	t, err := torrent.Create(dir, torrent.CreateOptions{PieceLength: 1 << 14, V1: true})
+	if err != nil {
+		panic(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go runSeeder(l, t, storage.NewFileStorage(seedRoot, t))
+
+	downloadRoot, _ := ioutil.TempDir("", "yabtc-download")
+	s := swarm.New(t, storage.NewFileStorage(downloadRoot, t))
+	go s.Run()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	s.AddPeer(p2p.NewPeerWithConn(conn))
+
+	var hash [20]byte
+	copy(hash[:], t.InfoHash())
+	srv := httptest.NewServer(New(func(infoHash [20]byte) *swarm.Swarm {
+		if infoHash == hash {
+			return s
+		}
+		return nil
+	}))
+
+	cleanup := func() {
+		srv.Close()
+		l.Close()
+		os.RemoveAll(seedRoot)
+		os.RemoveAll(downloadRoot)
+	}
+
+	return srv, fmt.Sprintf("%x", hash), cleanup
+}
+
+func get(url string, header map[string]string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestGateway(t *testing.T) {
+	srv, hash, cleanup := newTestGateway()
+	defer cleanup()
+	base := srv.URL + "/" + hash
+
+	Convey("When requesting a torrent's root", t, func() {
+		resp, body := get(base+"/", nil)
+
+		Convey("It should list the top level entries", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(string(body), ShouldContainSubstring, `<a href="media/">media/</a>`)
+		})
+	})
+
+	Convey("When requesting a directory", t, func() {
+		resp, body := get(base+"/media/", nil)
+
+		Convey("It should list files and subdirectories", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(string(body), ShouldContainSubstring, `<a href="extra/">extra/</a>`)
+			So(string(body), ShouldContainSubstring, `<a href="video.mp4">video.mp4</a>`)
+		})
+	})
+
+	Convey("When requesting a file", t, func() {
+		resp, body := get(base+"/media/video.mp4", nil)
+
+		Convey("It should stream its content from the swarm", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "video/mp4")
+			So(resp.Header.Get("ETag"), ShouldNotBeBlank)
+			So(body, ShouldResemble, videoData)
+		})
+	})
+
+	Convey("When requesting a byte range", t, func() {
+		resp, body := get(base+"/media/extra/notes.txt", map[string]string{"Range": "bytes=5-"})
+
+		Convey("It should return only that range", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusPartialContent)
+			So(resp.Header.Get("Content-Range"), ShouldEqual, "bytes 5-9/10")
+			So(string(body), ShouldEqual, "notes")
+		})
+	})
+
+	Convey("When a range request's If-Range matches the ETag", t, func() {
+		resp, _ := get(base+"/media/video.mp4", nil)
+		etag := resp.Header.Get("ETag")
+
+		resp, body := get(base+"/media/video.mp4", map[string]string{
+			"Range":    "bytes=49990-",
+			"If-Range": etag,
+		})
+
+		Convey("It should return the range", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusPartialContent)
+			So(body, ShouldResemble, videoData[49990:])
+		})
+	})
+
+	Convey("When a range request's If-Range does not match", t, func() {
+		resp, body := get(base+"/media/video.mp4", map[string]string{
+			"Range":    "bytes=0-9",
+			"If-Range": `"stale"`,
+		})
+
+		Convey("It should return the whole file", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(body), ShouldEqual, len(videoData))
+		})
+	})
+
+	Convey("When requesting an unknown torrent or path", t, func() {
+		resp, _ := get(srv.URL+"/0000000000000000000000000000000000000000/", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		resp, _ = get(base+"/media/missing", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+	})
+}
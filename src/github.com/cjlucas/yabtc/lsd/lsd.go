@@ -0,0 +1,262 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p"
+)
+
+const IPV4_GROUP = "239.192.152.143:6771"
+const IPV6_GROUP = "[ff15::efc0:988f]:6771"
+
+const ANNOUNCE_INTERVAL = 5 * time.Minute
+
+// Stay below a typical MTU when packing several info hashes in one announce
+const MAX_PACKET_SIZE = 1400
+
+type Announce struct {
+	InfoHash [20]byte
+	Ip       string
+	Port     int
+}
+
+type lsdGroup struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
+type Service struct {
+	// Peers announced by other clients on the local network
+	AnnounceChan chan *Announce
+	port         int
+	cookie       string
+	groups       []*lsdGroup
+	torrents     map[[20]byte]bool
+	torrentsLock sync.Mutex
+	announceNow  chan bool
+	quit         chan bool
+}
+
+func New(port int) (*Service, error) {
+	return newService(port, []string{IPV4_GROUP, IPV6_GROUP})
+}
+
+func newService(port int, groupAddrs []string) (*Service, error) {
+	s := &Service{}
+	s.port = port
+	s.AnnounceChan = make(chan *Announce, 100)
+	s.torrents = make(map[[20]byte]bool)
+	s.announceNow = make(chan bool, 1)
+	s.quit = make(chan bool)
+
+	var cookie [8]byte
+	rand.Read(cookie[:])
+	s.cookie = hex.EncodeToString(cookie[:])
+
+	for _, addr := range groupAddrs {
+		network := "udp4"
+		if strings.HasPrefix(addr, "[") {
+			network = "udp6"
+		}
+
+		gaddr, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := net.ListenMulticastUDP(network, nil, gaddr)
+		if err != nil {
+			fmt.Printf("LSD: could not join %s: %s\n", addr, err)
+			continue
+		}
+
+		s.groups = append(s.groups, &lsdGroup{gaddr, conn})
+	}
+
+	if len(s.groups) == 0 {
+		return nil, errors.New("could not join any LSD multicast group")
+	}
+
+	return s, nil
+}
+
+// AddTorrent starts announcing infoHash on the local network, unless
+// the torrent's policy forbids LAN peers (private torrents).
+func (s *Service) AddTorrent(infoHash []byte, policy *p2p.PeerPolicy) {
+	if !policy.Allows(p2p.PEER_SOURCE_LSD) {
+		return
+	}
+
+	var hash [20]byte
+	copy(hash[:], infoHash)
+
+	s.torrentsLock.Lock()
+	s.torrents[hash] = true
+	s.torrentsLock.Unlock()
+
+	select {
+	case s.announceNow <- true:
+	default:
+	}
+}
+
+func (s *Service) RemoveTorrent(infoHash []byte) {
+	var hash [20]byte
+	copy(hash[:], infoHash)
+
+	s.torrentsLock.Lock()
+	delete(s.torrents, hash)
+	s.torrentsLock.Unlock()
+}
+
+func (s *Service) hasTorrent(hash [20]byte) bool {
+	s.torrentsLock.Lock()
+	defer s.torrentsLock.Unlock()
+	return s.torrents[hash]
+}
+
+func formatAnnounce(host string, port int, cookie string, hashes [][20]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	fmt.Fprintf(&buf, "Port: %d\r\n", port)
+	for _, h := range hashes {
+		fmt.Fprintf(&buf, "Infohash: %s\r\n", hex.EncodeToString(h[:]))
+	}
+	fmt.Fprintf(&buf, "cookie: %s\r\n", cookie)
+	buf.WriteString("\r\n\r\n")
+
+	return buf.Bytes()
+}
+
+// parseAnnounce returns the announced port, info hashes and cookie
+func parseAnnounce(data []byte) (int, [][20]byte, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, "", fmt.Errorf("unexpected method: %s", req.Method)
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, "", errors.New("invalid port")
+	}
+
+	var hashes [][20]byte
+	for _, val := range req.Header["Infohash"] {
+		raw, err := hex.DecodeString(strings.TrimSpace(val))
+		if err != nil || len(raw) != 20 {
+			continue
+		}
+
+		var h [20]byte
+		copy(h[:], raw)
+		hashes = append(hashes, h)
+	}
+
+	return port, hashes, req.Header.Get("Cookie"), nil
+}
+
+func (s *Service) handlePacket(data []byte, from *net.UDPAddr) {
+	port, hashes, cookie, err := parseAnnounce(data)
+	if err != nil {
+		return
+	}
+
+	// Our own announce looped back
+	if cookie == s.cookie {
+		return
+	}
+
+	for _, h := range hashes {
+		if !s.hasTorrent(h) {
+			continue
+		}
+
+		select {
+		case s.AnnounceChan <- &Announce{h, from.IP.String(), port}:
+		default:
+			// Drop announces if nobody is keeping up
+		}
+	}
+}
+
+func (s *Service) listen(g *lsdGroup) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		s.handlePacket(buf[:n], from)
+	}
+}
+
+func (s *Service) announce() {
+	s.torrentsLock.Lock()
+	var hashes [][20]byte
+	for h := range s.torrents {
+		hashes = append(hashes, h)
+	}
+	s.torrentsLock.Unlock()
+
+	for _, g := range s.groups {
+		// Pack as many info hashes into each packet as will fit
+		remaining := hashes
+		for len(remaining) > 0 {
+			n := len(remaining)
+			for n > 1 && len(formatAnnounce(g.addr.String(), s.port, s.cookie, remaining[:n])) > MAX_PACKET_SIZE {
+				n--
+			}
+
+			msg := formatAnnounce(g.addr.String(), s.port, s.cookie, remaining[:n])
+			if _, err := g.conn.WriteToUDP(msg, g.addr); err != nil {
+				fmt.Printf("LSD: announce to %s failed: %s\n", g.addr, err)
+				break
+			}
+			remaining = remaining[n:]
+		}
+	}
+}
+
+func (s *Service) Run() {
+	for _, g := range s.groups {
+		go s.listen(g)
+	}
+
+	ticker := time.NewTicker(ANNOUNCE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			for _, g := range s.groups {
+				g.conn.Close()
+			}
+			return
+		case <-s.announceNow:
+			s.announce()
+		case <-ticker.C:
+			s.announce()
+		}
+	}
+}
+
+func (s *Service) Stop() {
+	close(s.quit)
+}
@@ -0,0 +1,104 @@
+package lsd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cjlucas/yabtc/p2p"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestService() *Service {
+	return &Service{
+		AnnounceChan: make(chan *Announce, 10),
+		port:         6881,
+		cookie:       "abcdef",
+		torrents:     make(map[[20]byte]bool),
+		announceNow:  make(chan bool, 1),
+	}
+}
+
+var hash1 = [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+var hash2 = [20]byte{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+
+func TestFormatAnnounce(t *testing.T) {
+	Convey("When formatting an announce", t, func() {
+		msg := formatAnnounce(IPV4_GROUP, 6881, "abcdef", [][20]byte{hash1})
+
+		Convey("It should follow BEP 14", func() {
+			expected := "BT-SEARCH * HTTP/1.1\r\n" +
+				"Host: 239.192.152.143:6771\r\n" +
+				"Port: 6881\r\n" +
+				"Infohash: 0102030405060708090a0b0c0d0e0f1011121314\r\n" +
+				"cookie: abcdef\r\n" +
+				"\r\n\r\n"
+			So(string(msg), ShouldEqual, expected)
+		})
+
+		Convey("It should parse back to the same values", func() {
+			port, hashes, cookie, err := parseAnnounce(msg)
+			So(err, ShouldBeNil)
+			So(port, ShouldEqual, 6881)
+			So(hashes, ShouldResemble, [][20]byte{hash1})
+			So(cookie, ShouldEqual, "abcdef")
+		})
+	})
+
+	Convey("When parsing an announce with several info hashes", t, func() {
+		msg := formatAnnounce(IPV6_GROUP, 6881, "", [][20]byte{hash1, hash2})
+
+		Convey("It should return every info hash", func() {
+			_, hashes, _, err := parseAnnounce(msg)
+			So(err, ShouldBeNil)
+			So(hashes, ShouldResemble, [][20]byte{hash1, hash2})
+		})
+	})
+
+	Convey("When parsing an announce with an invalid port", t, func() {
+		msg := []byte("BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 0\r\n\r\n\r\n")
+
+		Convey("It should return an error", func() {
+			_, _, _, err := parseAnnounce(msg)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestHandlePacket(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 6771}
+
+	Convey("When receiving an announce for a registered torrent", t, func() {
+		s := newTestService()
+		s.AddTorrent(hash1[:], p2p.NewPeerPolicy(false, p2p.PEER_SOURCE_LSD))
+		s.handlePacket(formatAnnounce(IPV4_GROUP, 51413, "other", [][20]byte{hash1, hash2}), from)
+
+		Convey("It should report the peer for that torrent only", func() {
+			So(len(s.AnnounceChan), ShouldEqual, 1)
+			a := <-s.AnnounceChan
+			So(a.InfoHash, ShouldResemble, hash1)
+			So(a.Ip, ShouldEqual, "192.168.1.20")
+			So(a.Port, ShouldEqual, 51413)
+		})
+	})
+
+	Convey("When receiving our own announce", t, func() {
+		s := newTestService()
+		s.AddTorrent(hash1[:], p2p.NewPeerPolicy(false, p2p.PEER_SOURCE_LSD))
+		s.handlePacket(formatAnnounce(IPV4_GROUP, 6881, s.cookie, [][20]byte{hash1}), from)
+
+		Convey("It should be ignored", func() {
+			So(len(s.AnnounceChan), ShouldEqual, 0)
+		})
+	})
+
+	Convey("When a private torrent is added", t, func() {
+		s := newTestService()
+		s.AddTorrent(hash1[:], p2p.NewPeerPolicy(true, p2p.PEER_SOURCE_LSD))
+		s.handlePacket(formatAnnounce(IPV4_GROUP, 51413, "other", [][20]byte{hash1}), from)
+
+		Convey("It should neither be announced nor accept LAN peers", func() {
+			So(s.hasTorrent(hash1), ShouldBeFalse)
+			So(len(s.AnnounceChan), ShouldEqual, 0)
+		})
+	})
+}
@@ -4,68 +4,584 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/cjlucas/yabtc/gateway"
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/queue"
+	"github.com/cjlucas/yabtc/ratelimit"
+	"github.com/cjlucas/yabtc/rpc"
+	"github.com/cjlucas/yabtc/storage"
 	"github.com/cjlucas/yabtc/torrent"
+	"github.com/cjlucas/yabtc/watch"
 )
 
 var logger = log.New(os.Stdout, "", log.LstdFlags)
 
-var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+const LISTEN_PORT = 54343
+
+var PEER_ID = []byte("-AZ2060-000000000000")
+
+// Exit codes
+const (
+	EXIT_OK = 0
+	// The command ran but didn't succeed, e.g. files failed to verify or
+	// the tracker returned an error
+	EXIT_FAILURE = 1
+	// Invalid flags or arguments
+	EXIT_USAGE = 2
+	// The torrent file couldn't be read or parsed
+	EXIT_INVALID_TORRENT = 3
+	// Stopped by a signal before finishing
+	EXIT_INTERRUPTED = 130
+)
+
+// How often download and seed report progress
+const PROGRESS_INTERVAL = 5 * time.Second
+
+type command struct {
+	name string
+	// Arguments after the flags
+	args string
+	desc string
+	run  func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"info", "<torrent>", "print a torrent's metainfo", runInfo},
+		{"verify", "<torrent> <dir>", "check the torrent's data in dir", runVerify},
+		{"move", "<torrent> <dir> <newdir>", "move the torrent's data from dir to newdir", runMove},
+		{"download", "<torrent>", "download a torrent and exit once it's complete", runDownload},
+		{"seed", "<torrent> <dir>", "seed the torrent's data in dir", runSeed},
+		{"serve", "<torrent>", "download a torrent while streaming its files over HTTP", runServe},
+		{"daemon", "", "manage torrents over Transmission's RPC protocol", runDaemon},
+		{"magnet", "<torrent>", "print a magnet link for a torrent", runMagnet},
+		{"announce", "<torrent>", "announce to the torrent's tracker once", runAnnounce},
+		{"scrape", "<torrent>", "ask the torrent's tracker for peer counts", runScrape},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: yabtc <command> [flags] [arguments]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.name, cmd.desc)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun yabtc <command> -h for a command's flags.\n")
+}
 
 func main() {
-	flag.Parse()
-	if *cpuprofile != "" {
-		logger.Printf("Writing CPU profile to %s", *cpuprofile)
-		f, err := os.Create(*cpuprofile)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	if name == "-h" || name == "-help" || name == "help" {
+		usage()
+		os.Exit(EXIT_OK)
+	}
+
+	// yabtc <torrent> downloads it, as it always did
+	if strings.HasSuffix(name, ".torrent") {
+		os.Exit(runDownload(os.Args[1:]))
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+	usage()
+	os.Exit(EXIT_USAGE)
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: yabtc %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags and checks that nargs arguments follow them
+func parseArgs(fs *flag.FlagSet, args []string, nargs int) bool {
+	if err := fs.Parse(args); err != nil {
+		return false
+	}
+
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return false
+	}
+	return true
+}
+
+// usageExitCode is the exit code for a failed parseArgs, -h isn't an error
+func usageExitCode(args []string) int {
+	for _, a := range args {
+		if a == "-h" || a == "-help" || a == "--help" {
+			return EXIT_OK
+		}
+	}
+	return EXIT_USAGE
+}
+
+func parseTorrent(fname string) (*torrent.MetaData, bool) {
+	t, err := torrent.ParseFile(fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: could not read torrent %s: %s\n", fname, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// clientOptions are the flags of the commands that run torrents
+type clientOptions struct {
+	cpuprofile *string
+	port       *int
+	noPortmap  *bool
+	noLsd      *bool
+	noPex      *bool
+
+	savePath  *string
+	resumeDir *string
+	allocate  *string
+
+	seedRatio  *float64
+	seedTime   *time.Duration
+	idleTime   *time.Duration
+	goalAction *string
+
+	maxDownloads *int
+	maxSeeds     *int
+	maxActive    *int
+	inactiveRate *int
+
+	downloadLimit    *int
+	uploadLimit      *int
+	altDownloadLimit *int
+	altUploadLimit   *int
+	altSchedule      *string
+}
+
+func addClientFlags(fs *flag.FlagSet) *clientOptions {
+	o := &clientOptions{}
+	o.cpuprofile = fs.String("cpuprofile", "", "write cpu profile to file")
+	o.port = fs.Int("port", LISTEN_PORT, "port to accept peer connections on")
+	o.noPortmap = fs.Bool("noportmap", false, "disable NAT-PMP/PCP and UPnP port forwarding")
+	o.noLsd = fs.Bool("nolsd", false, "disable local service discovery")
+	o.noPex = fs.Bool("nopex", false, "disable peer exchange")
+
+	o.savePath = fs.String("savepath", ".", "directory downloaded files are saved in")
+	o.resumeDir = fs.String("resumedir", ".yabtc", "directory resume data is kept in")
+	o.allocate = fs.String("allocate", "sparse", "file allocation mode: sparse, truncate or full")
+
+	o.seedRatio = fs.Float64("ratio", 0, "stop seeding at this share ratio (0 for no limit)")
+	o.seedTime = fs.Duration("seedtime", 0, "stop seeding after this long (0 for no limit)")
+	o.idleTime = fs.Duration("idletime", 0, "stop seeding after this long without uploading (0 for no limit)")
+	o.goalAction = fs.String("goalaction", "pause", "what to do once a seeding goal is reached: pause, remove or delete")
+
+	o.maxDownloads = fs.Int("maxdownloads", 5, "most torrents downloading at once (0 for no limit)")
+	o.maxSeeds = fs.Int("maxseeds", 0, "most torrents seeding at once (0 for no limit)")
+	o.maxActive = fs.Int("maxactive", 0, "most torrents running at once (0 for no limit)")
+	o.inactiveRate = fs.Int("inactiverate", 0, "torrents slower than this many bytes per second don't count against the limits")
+
+	o.downloadLimit = fs.Int("dlimit", 0, "download limit in KiB/s (0 for no limit)")
+	o.uploadLimit = fs.Int("ulimit", 0, "upload limit in KiB/s (0 for no limit)")
+	o.altDownloadLimit = fs.Int("altdlimit", 0, "alternative download limit in KiB/s (0 for no limit)")
+	o.altUploadLimit = fs.Int("altulimit", 0, "alternative upload limit in KiB/s (0 for no limit)")
+	o.altSchedule = fs.String("altschedule", "", `when the alternative limits are used, e.g. "mon-fri 09:00-17:00"`)
+
+	return o
+}
+
+func (o *clientOptions) config() (ClientConfig, error) {
+	allocationMode, err := storage.ParseAllocationMode(*o.allocate)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+
+	action, err := swarm.ParseGoalAction(*o.goalAction)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+
+	var schedule *ratelimit.Schedule
+	if *o.altSchedule != "" {
+		if schedule, err = ratelimit.ParseSchedule(*o.altSchedule); err != nil {
+			return ClientConfig{}, err
+		}
+	}
+
+	return ClientConfig{
+		Port:           *o.port,
+		PeerId:         PEER_ID,
+		SavePath:       *o.savePath,
+		ResumeDir:      *o.resumeDir,
+		AllocationMode: allocationMode,
+		SeedGoals:      swarm.SeedGoals{Ratio: *o.seedRatio, SeedTime: *o.seedTime, IdleTime: *o.idleTime, Action: action},
+		QueueLimits: queue.Limits{
+			MaxDownloads: *o.maxDownloads,
+			MaxSeeds:     *o.maxSeeds,
+			MaxActive:    *o.maxActive,
+			InactiveRate: *o.inactiveRate,
+		},
+		SpeedLimits:    ratelimit.Limits{Download: *o.downloadLimit * 1024, Upload: *o.uploadLimit * 1024},
+		AltSpeedLimits: ratelimit.Limits{Download: *o.altDownloadLimit * 1024, Upload: *o.altUploadLimit * 1024},
+		AltSchedule:    schedule,
+		NoPortmap:      *o.noPortmap,
+		NoLsd:          *o.noLsd,
+		NoPex:          *o.noPex,
+	}, nil
+}
+
+// startClient starts a client with the flags' settings. On SIGINT or
+// SIGTERM the client is shut down and the process exits with
+// signalCode.
+func (o *clientOptions) startClient(signalCode int) (*Client, bool) {
+	cfg, err := o.config()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return nil, false
+	}
+
+	if *o.cpuprofile != "" {
+		logger.Printf("Writing CPU profile to %s", *o.cpuprofile)
+		f, err := os.Create(*o.cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return nil, false
 		}
 		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
+	}
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		pprof.StopCPUProfile()
+		return nil, false
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		fmt.Println("Received ctrl+c")
-		pprof.StopCPUProfile()
-		os.Exit(0)
+		sig := <-c
+		fmt.Printf("Received %s\n", sig)
+		stopClient(client)
+		os.Exit(signalCode)
 	}()
 
-	pm, err := NewPeerManager(54343)
+	return client, true
+}
+
+func stopClient(client *Client) {
+	client.Shutdown()
+	pprof.StopCPUProfile()
+}
+
+// parseFileList parses file indexes such as "0,2-4"
+func parseFileList(s string, numFiles int) ([]int, error) {
+	var indexes []int
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index: %s", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid file index: %s", part)
+			}
+		}
+
+		if first < 0 || last >= numFiles || first > last {
+			return nil, fmt.Errorf("file index out of range: %s", part)
+		}
+		for i := first; i <= last; i++ {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// filePriorities returns the priority of every file given -only and -skip
+func filePriorities(t *torrent.MetaData, only, skip string) ([]swarm.Priority, error) {
+	numFiles := len(t.Files())
+	priorities := make([]swarm.Priority, numFiles)
+	for i := range priorities {
+		priorities[i] = swarm.PRIORITY_NORMAL
+	}
+
+	if only != "" {
+		indexes, err := parseFileList(only, numFiles)
+		if err != nil {
+			return nil, err
+		}
+		for i := range priorities {
+			priorities[i] = swarm.PRIORITY_SKIP
+		}
+		for _, i := range indexes {
+			priorities[i] = swarm.PRIORITY_NORMAL
+		}
+	}
+	if skip != "" {
+		indexes, err := parseFileList(skip, numFiles)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range indexes {
+			priorities[i] = swarm.PRIORITY_SKIP
+		}
+	}
+
+	return priorities, nil
+}
+
+func printProgress(s *swarm.Swarm) {
+	wanted := s.BytesWanted()
+	completed := s.BytesCompleted()
+	percent := 100.0
+	if wanted > 0 {
+		percent = float64(completed) / float64(wanted) * 100
+	}
+
+	stats := s.StatsSnapshot()
+	fmt.Printf("%s: %s, %.1f%% of %s, %s down, %s up\n", s.Torrent.Name(), s.Status(),
+		percent, formatSize(int64(wanted)), formatSize(int64(stats.Downloaded)), formatSize(int64(stats.Uploaded)))
+}
+
+func runDownload(args []string) int {
+	fs := newFlagSet("download", "<torrent>")
+	opts := addClientFlags(fs)
+	only := fs.String("only", "", `download only these files, by index as listed by info, e.g. "0,2-4"`)
+	skip := fs.String("skip", "", "don't download these files, by index")
+	if !parseArgs(fs, args, 1) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+	priorities, err := filePriorities(t, *only, *skip)
 	if err != nil {
-		fmt.Printf("error: could not start peer manager: %s", err)
-		return
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_USAGE
+	}
+
+	client, ok := opts.startClient(EXIT_INTERRUPTED)
+	if !ok {
+		return EXIT_FAILURE
+	}
+	defer stopClient(client)
+
+	// Files are picked before the torrent starts so skipped files
+	// aren't allocated
+	if err := client.AddTorrent(t, AddOptions{Paused: true}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	var hash [20]byte
+	copy(hash[:], t.InfoHash())
+	s := client.sm.Swarm(hash)
+	for i, p := range priorities {
+		s.SetFilePriority(i, p)
+	}
+	if err := client.sm.StartTorrent(hash); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	go client.Run()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastReport := time.Now()
+	for range ticker.C {
+		switch s.Status() {
+		case swarm.ERROR:
+			fmt.Fprintf(os.Stderr, "error: %s\n", s.Err())
+			return EXIT_FAILURE
+		case swarm.SEEDING:
+			printProgress(s)
+			fmt.Println("Download complete")
+			return EXIT_OK
+		}
+
+		if time.Since(lastReport) >= PROGRESS_INTERVAL {
+			printProgress(s)
+			lastReport = time.Now()
+		}
 	}
-	go pm.Run()
+	return EXIT_OK
+}
+
+func runSeed(args []string) int {
+	fs := newFlagSet("seed", "<torrent> <dir>")
+	opts := addClientFlags(fs)
+	superSeed := fs.Bool("superseed", false, "offer pieces one at a time until they're spread among the peers (BEP 16)")
+	superSeedCopies := fs.Int("superseedcopies", swarm.DEFAULT_SUPER_SEED_COPIES, "copies the peers must hold between them before super-seeding stops")
+	if !parseArgs(fs, args, 2) {
+		return usageExitCode(args)
+	}
+
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
+
+	// Seeding ends when the user says so or a seeding goal is reached
+	client, ok := opts.startClient(EXIT_OK)
+	if !ok {
+		return EXIT_FAILURE
+	}
+	defer stopClient(client)
+
+	if err := client.AddTorrent(t, AddOptions{SavePath: fs.Arg(1)}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return EXIT_FAILURE
+	}
+	var hash [20]byte
+	copy(hash[:], t.InfoHash())
+	s := client.sm.Swarm(hash)
+	s.SetSuperSeedCopies(*superSeedCopies)
+	go client.Run()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastReport := time.Now()
+	warned := false
+	// Super-seeding needs every piece, so it's turned on once the data
+	// has been checked. It turns itself off again once the pieces are
+	// spread.
+	superSeeding := false
+	for range ticker.C {
+		status := s.Status()
+		if *superSeed && !superSeeding && status == swarm.SEEDING {
+			if err := client.SetSuperSeeding(hash, true); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not super-seed: %s\n", err)
+			} else {
+				fmt.Println("Super-seeding")
+			}
+			superSeeding = true
+		}
 
-	sm := NewSwarmManager()
-	go sm.Run()
+		switch {
+		case status == swarm.ERROR:
+			fmt.Fprintf(os.Stderr, "error: %s\n", s.Err())
+			return EXIT_FAILURE
+		case status == swarm.PAUSED || client.sm.Swarm(hash) == nil:
+			fmt.Println("Seeding goal reached")
+			return EXIT_OK
+		case status == swarm.DOWNLOADING && !warned:
+			fmt.Fprintf(os.Stderr, "warning: %s is incomplete, downloading the rest\n", fs.Arg(1))
+			warned = true
+		}
 
-	tm := NewTrackerManager()
+		if time.Since(lastReport) >= PROGRESS_INTERVAL {
+			printProgress(s)
+			lastReport = time.Now()
+		}
+	}
+	return EXIT_OK
+}
 
-	t, _ := torrent.ParseFile(os.Args[len(os.Args)-1])
-	sm.AddTorrent(t)
+func runServe(args []string) int {
+	fs := newFlagSet("serve", "<torrent>")
+	opts := addClientFlags(fs)
+	httpAddr := fs.String("http", "127.0.0.1:8080", "listen address of the HTTP gateway")
+	if !parseArgs(fs, args, 1) {
+		return usageExitCode(args)
+	}
 
-	peerId := []byte("-AZ2060-000000000000")
-	tm.AddTracker(t.Announce, t.InfoHash(), peerId)
+	t, ok := parseTorrent(fs.Arg(0))
+	if !ok {
+		return EXIT_INVALID_TORRENT
+	}
 
-	pm.RegisterTorrent(t.InfoHash()[:], peerId)
+	client, ok := opts.startClient(EXIT_OK)
+	if !ok {
+		return EXIT_FAILURE
+	}
+	if err := client.AddTorrent(t, AddOptions{}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		stopClient(client)
+		return EXIT_FAILURE
+	}
 
-	for {
-		select {
-		case r := <-tm.AnnounceResponseChan:
-			fmt.Printf("Received tracker response: %v\n", r)
-			for _, p := range r.Response.Peers() {
-				pm.VerifyPeer(r.InfoHash[:], p.Ip(), p.Port())
+	go func() {
+		logger.Printf("Serving torrent content on http://%s/%s/", *httpAddr, t.InfoHashString())
+		if err := http.ListenAndServe(*httpAddr, gateway.New(client.sm.Swarm)); err != nil {
+			logger.Printf("HTTP gateway stopped: %s", err)
+		}
+	}()
+
+	client.Run()
+	return EXIT_OK
+}
+
+func runDaemon(args []string) int {
+	fs := newFlagSet("daemon", "")
+	opts := addClientFlags(fs)
+	rpcAddr := fs.String("rpc", "127.0.0.1:9091", "listen address of the RPC server")
+	rpcUser := fs.String("rpcuser", "", "username required by the RPC server")
+	rpcPass := fs.String("rpcpass", "", "password required by the RPC server")
+	watchDir := fs.String("watchdir", "", "add the .torrent files dropped into this directory")
+	watchSavePath := fs.String("watchsavepath", "", "directory torrents from -watchdir are saved in (defaults to -savepath)")
+	watchLabels := fs.String("watchlabels", "", "comma separated labels given to torrents from -watchdir")
+	if !parseArgs(fs, args, 0) {
+		return usageExitCode(args)
+	}
+	if *watchDir != "" {
+		if fi, err := os.Stat(*watchDir); err != nil || !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "error: %s is not a directory\n", *watchDir)
+			return EXIT_USAGE
+		}
+	}
+
+	client, ok := opts.startClient(EXIT_OK)
+	if !ok {
+		return EXIT_FAILURE
+	}
+
+	daemon := NewDaemon(client)
+	daemon.Start()
+	server := rpc.New(daemon)
+	if *rpcUser != "" {
+		server.SetAuth(*rpcUser, *rpcPass)
+	}
+	go func() {
+		logger.Printf("Listening for RPC requests on http://%s%s", *rpcAddr, rpc.RPC_PATH)
+		if err := http.ListenAndServe(*rpcAddr, server); err != nil {
+			logger.Printf("RPC server stopped: %s", err)
+		}
+	}()
+
+	if *watchDir != "" {
+		var labels []string
+		for _, label := range strings.Split(*watchLabels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				labels = append(labels, label)
 			}
-		case vp := <-pm.VerifiedPeerChan:
-			fmt.Println("here", vp.Peer.Ip())
-			sm.AddPeer(vp.InfoHash, vp.Peer)
 		}
+
+		logger.Printf("Watching %s for torrents", *watchDir)
+		daemon.Watch(*watchDir, watch.AddOptions{SavePath: *watchSavePath, Labels: labels})
 	}
+
+	// The client runs until a signal stops it
+	select {}
 }
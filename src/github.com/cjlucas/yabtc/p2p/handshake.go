@@ -41,3 +41,11 @@ func (h *Handshake) Bytes() []byte {
 
 	return buf
 }
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[RESERVED_EXTENSIONS_BYTE]&RESERVED_EXTENSIONS_MASK != 0
+}
+
+func (h *Handshake) SupportsDHT() bool {
+	return h.Reserved[RESERVED_DHT_BYTE]&RESERVED_DHT_MASK != 0
+}
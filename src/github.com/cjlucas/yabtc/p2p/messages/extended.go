@@ -0,0 +1,172 @@
+package messages
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/zeebo/bencode"
+)
+
+// Extended message id of the BEP 10 handshake, every other id is one
+// the receiving side assigned in its handshake
+const EXTENDED_HANDSHAKE_ID = 0
+
+// Name of the BEP 11 peer exchange extension
+const UT_PEX = "ut_pex"
+
+// Extended wraps a message of the BEP 10 extension protocol
+type Extended struct {
+	ExtendedId int
+	Data       []byte
+}
+
+// ExtendedHandshake lists the extensions a peer supports, mapped to the
+// extended message id it wants them sent with
+type ExtendedHandshake struct {
+	M       map[string]int `bencode:"m"`
+	Port    int            `bencode:"p,omitempty"`
+	Version string         `bencode:"v,omitempty"`
+	// BEP 21: 1 if the peer won't download anything more
+	UploadOnly int `bencode:"upload_only"`
+}
+
+type PexPeer struct {
+	Ip   string
+	Port int
+}
+
+// Pex lists the peers a peer connected to and disconnected from since its
+// last peer exchange message
+type Pex struct {
+	Added   []PexPeer
+	Dropped []PexPeer
+}
+
+type rawPex struct {
+	Added    string `bencode:"added"`
+	Added6   string `bencode:"added6"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+func NewExtended(extendedId int, data []byte) *Extended {
+	return &Extended{extendedId, data}
+}
+
+func NewExtendedHandshake(hs *ExtendedHandshake) *Extended {
+	data, _ := bencode.EncodeBytes(hs)
+	return &Extended{EXTENDED_HANDSHAKE_ID, data}
+}
+
+func ParseExtendedHandshake(data []byte) (*ExtendedHandshake, error) {
+	var hs ExtendedHandshake
+	if err := bencode.DecodeBytes(data, &hs); err != nil {
+		return nil, err
+	}
+
+	return &hs, nil
+}
+
+func compactPeers(peers []PexPeer, ipLen int) string {
+	var buf []byte
+	for _, p := range peers {
+		ip := net.ParseIP(p.Ip)
+		if ipLen == net.IPv4len {
+			ip = ip.To4()
+		} else if ip.To4() != nil {
+			continue
+		}
+		if len(ip) != ipLen {
+			continue
+		}
+
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(p.Port))
+		buf = append(buf, ip...)
+		buf = append(buf, port[:]...)
+	}
+
+	return string(buf)
+}
+
+func parseCompactPeers(raw string, ipLen int) ([]PexPeer, error) {
+	entryLen := ipLen + 2
+	if len(raw)%entryLen != 0 {
+		return nil, invalidPayloadError
+	}
+
+	var peers []PexPeer
+	for i := 0; i < len(raw); i += entryLen {
+		ip := net.IP([]byte(raw[i : i+ipLen]))
+		port := int(binary.BigEndian.Uint16([]byte(raw[i+ipLen : i+entryLen])))
+		peers = append(peers, PexPeer{ip.String(), port})
+	}
+
+	return peers, nil
+}
+
+// NewPex encodes a peer exchange message for a peer that assigned
+// extendedId to ut_pex
+func NewPex(extendedId int, pex *Pex) *Extended {
+	raw := rawPex{
+		Added:    compactPeers(pex.Added, net.IPv4len),
+		Added6:   compactPeers(pex.Added, net.IPv6len),
+		Dropped:  compactPeers(pex.Dropped, net.IPv4len),
+		Dropped6: compactPeers(pex.Dropped, net.IPv6len),
+	}
+
+	data, _ := bencode.EncodeBytes(raw)
+	return &Extended{extendedId, data}
+}
+
+func ParsePex(data []byte) (*Pex, error) {
+	var raw rawPex
+	if err := bencode.DecodeBytes(data, &raw); err != nil {
+		return nil, err
+	}
+
+	var pex Pex
+	for _, list := range []struct {
+		raw   string
+		ipLen int
+		peers *[]PexPeer
+	}{
+		{raw.Added, net.IPv4len, &pex.Added},
+		{raw.Added6, net.IPv6len, &pex.Added},
+		{raw.Dropped, net.IPv4len, &pex.Dropped},
+		{raw.Dropped6, net.IPv6len, &pex.Dropped},
+	} {
+		peers, err := parseCompactPeers(list.raw, list.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		*list.peers = append(*list.peers, peers...)
+	}
+
+	return &pex, nil
+}
+
+func (m *Extended) Id() int { return EXTENDED_MSG_ID }
+
+func (m *Extended) Payload() []byte {
+	payload := make([]byte, 1+len(m.Data))
+	payload[0] = byte(m.ExtendedId)
+	copy(payload[1:], m.Data)
+
+	return payload
+}
+
+func (m *Extended) decodePayload(payload []byte) error {
+	if len(payload) < 1 {
+		return invalidPayloadError
+	}
+
+	m.ExtendedId = int(payload[0])
+	m.Data = payload[1:]
+	return nil
+}
+
+func (m *Extended) String() string {
+	return fmt.Sprintf("Extended{ExtendedId=%d, len(Data)=%d}", m.ExtendedId, len(m.Data))
+}
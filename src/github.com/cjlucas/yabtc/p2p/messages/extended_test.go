@@ -0,0 +1,58 @@
+package messages
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExtended(t *testing.T) {
+	Convey("When parsing an extended handshake", t, func() {
+		sent := NewExtendedHandshake(&ExtendedHandshake{M: map[string]int{UT_PEX: 3}, Port: 6881})
+		msg, err := ParseBytes(AsBytes(sent))
+
+		Convey("It should round trip", func() {
+			So(err, ShouldBeNil)
+			ext := msg.(*Extended)
+			So(ext.ExtendedId, ShouldEqual, EXTENDED_HANDSHAKE_ID)
+
+			hs, err := ParseExtendedHandshake(ext.Data)
+			So(err, ShouldBeNil)
+			So(hs.M[UT_PEX], ShouldEqual, 3)
+			So(hs.Port, ShouldEqual, 6881)
+		})
+	})
+
+	Convey("When parsing an empty extended message", t, func() {
+		_, err := ParseBytes([]byte{0, 0, 0, 1, EXTENDED_MSG_ID})
+
+		Convey("It should return an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPex(t *testing.T) {
+	Convey("When parsing a peer exchange message", t, func() {
+		sent := NewPex(1, &Pex{
+			Added:   []PexPeer{{"10.0.0.1", 6881}, {"2001:db8::1", 51413}},
+			Dropped: []PexPeer{{"10.0.0.2", 6882}},
+		})
+		pex, err := ParsePex(sent.Data)
+
+		Convey("It should have every IPv4 and IPv6 peer", func() {
+			So(err, ShouldBeNil)
+			So(sent.ExtendedId, ShouldEqual, 1)
+			So(pex.Added, ShouldResemble, []PexPeer{{"10.0.0.1", 6881}, {"2001:db8::1", 51413}})
+			So(pex.Dropped, ShouldResemble, []PexPeer{{"10.0.0.2", 6882}})
+		})
+	})
+
+	Convey("When a compact peer list is truncated", t, func() {
+		_, err := ParsePex([]byte("d5:added5:abcdee"))
+
+		Convey("It should return an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -19,6 +19,10 @@ const (
 	PIECE_MSG_ID          = 7
 	CANCEL_MSG_ID         = 8
 	PORT_MSG_ID           = 9
+	EXTENDED_MSG_ID       = 20
+	HASH_REQUEST_MSG_ID   = 21
+	HASHES_MSG_ID         = 22
+	HASH_REJECT_MSG_ID    = 23
 )
 
 type Message interface {
@@ -65,6 +69,24 @@ type Port struct {
 	Port int
 }
 
+// Asks for Length hashes of a file's merkle tree starting at Index
+// in BaseLayer, along with ProofLayers levels of uncle hashes
+type HashRequest struct {
+	PiecesRoot                            []byte
+	BaseLayer, Index, Length, ProofLayers int
+}
+
+type Hashes struct {
+	PiecesRoot                            []byte
+	BaseLayer, Index, Length, ProofLayers int
+	Hashes                                [][]byte
+}
+
+type HashReject struct {
+	PiecesRoot                            []byte
+	BaseLayer, Index, Length, ProofLayers int
+}
+
 func AsBytes(m Message) []byte {
 	buf := make([]byte, 4+1+len(m.Payload()))
 	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
@@ -116,6 +138,14 @@ func ParseBytes(bytes []byte) (Message, error) {
 		msg = &Cancel{}
 	case PORT_MSG_ID:
 		msg = &Port{}
+	case EXTENDED_MSG_ID:
+		msg = &Extended{}
+	case HASH_REQUEST_MSG_ID:
+		msg = &HashRequest{}
+	case HASHES_MSG_ID:
+		msg = &Hashes{}
+	case HASH_REJECT_MSG_ID:
+		msg = &HashReject{}
 	default:
 		msg = &Generic{}
 	}
@@ -163,6 +193,18 @@ func NewPort(port int) *Port {
 	return &Port{port}
 }
 
+func NewHashRequest(piecesRoot []byte, baseLayer, index, length, proofLayers int) *HashRequest {
+	return &HashRequest{piecesRoot, baseLayer, index, length, proofLayers}
+}
+
+func NewHashes(req *HashRequest, hashes [][]byte) *Hashes {
+	return &Hashes{req.PiecesRoot, req.BaseLayer, req.Index, req.Length, req.ProofLayers, hashes}
+}
+
+func NewHashReject(req *HashRequest) *HashReject {
+	return &HashReject{req.PiecesRoot, req.BaseLayer, req.Index, req.Length, req.ProofLayers}
+}
+
 func (m *Generic) Id() int       { return m.id }
 func (m *Choke) Id() int         { return CHOKE_MSG_ID }
 func (m *Unchoke) Id() int       { return UNCHOKE_MSG_ID }
@@ -174,6 +216,9 @@ func (m *Request) Id() int       { return REQUEST_MSG_ID }
 func (m *Piece) Id() int         { return PIECE_MSG_ID }
 func (m *Cancel) Id() int        { return CANCEL_MSG_ID }
 func (m *Port) Id() int          { return PORT_MSG_ID }
+func (m *HashRequest) Id() int   { return HASH_REQUEST_MSG_ID }
+func (m *Hashes) Id() int        { return HASHES_MSG_ID }
+func (m *HashReject) Id() int    { return HASH_REJECT_MSG_ID }
 
 func (m *Generic) String() string {
 	return fmt.Sprintf("Generic{id=%d len(payload)=%d}", m.id, len(m.Payload()))
@@ -214,3 +259,18 @@ func (m *Cancel) String() string {
 	return fmt.Sprintf("Cancel{Index=%d, Begin=%d, Length=%d}",
 		m.Index, m.Begin, m.Length)
 }
+
+func (m *HashRequest) String() string {
+	return fmt.Sprintf("HashRequest{BaseLayer=%d, Index=%d, Length=%d, ProofLayers=%d}",
+		m.BaseLayer, m.Index, m.Length, m.ProofLayers)
+}
+
+func (m *Hashes) String() string {
+	return fmt.Sprintf("Hashes{BaseLayer=%d, Index=%d, Length=%d, ProofLayers=%d, len(Hashes)=%d}",
+		m.BaseLayer, m.Index, m.Length, m.ProofLayers, len(m.Hashes))
+}
+
+func (m *HashReject) String() string {
+	return fmt.Sprintf("HashReject{BaseLayer=%d, Index=%d, Length=%d, ProofLayers=%d}",
+		m.BaseLayer, m.Index, m.Length, m.ProofLayers)
+}
@@ -61,6 +61,52 @@ func (m *Port) Payload() []byte {
 	return out[:]
 }
 
+// Hash request, hashes and hash reject share the same 48 byte header
+func hashHeaderPayload(piecesRoot []byte, baseLayer, index, length, proofLayers int) []byte {
+	payload := make([]byte, 48)
+
+	copy(payload[0:32], piecesRoot)
+	binary.BigEndian.PutUint32(payload[32:36], uint32(baseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(proofLayers))
+
+	return payload
+}
+
+func decodeHashHeader(payload []byte) ([]byte, int, int, int, int, error) {
+	if len(payload) < 48 {
+		return nil, 0, 0, 0, 0, invalidPayloadError
+	}
+
+	piecesRoot := make([]byte, 32)
+	copy(piecesRoot, payload[0:32])
+
+	return piecesRoot,
+		int(binary.BigEndian.Uint32(payload[32:36])),
+		int(binary.BigEndian.Uint32(payload[36:40])),
+		int(binary.BigEndian.Uint32(payload[40:44])),
+		int(binary.BigEndian.Uint32(payload[44:48])),
+		nil
+}
+
+func (m *HashRequest) Payload() []byte {
+	return hashHeaderPayload(m.PiecesRoot, m.BaseLayer, m.Index, m.Length, m.ProofLayers)
+}
+
+func (m *Hashes) Payload() []byte {
+	payload := hashHeaderPayload(m.PiecesRoot, m.BaseLayer, m.Index, m.Length, m.ProofLayers)
+	for _, h := range m.Hashes {
+		payload = append(payload, h...)
+	}
+
+	return payload
+}
+
+func (m *HashReject) Payload() []byte {
+	return hashHeaderPayload(m.PiecesRoot, m.BaseLayer, m.Index, m.Length, m.ProofLayers)
+}
+
 func (m *Choke) decodePayload([]byte) error         { return nil }
 func (m *Unchoke) decodePayload([]byte) error       { return nil }
 func (m *Interested) decodePayload([]byte) error    { return nil }
@@ -124,3 +170,35 @@ func (m *Port) decodePayload(payload []byte) error {
 	m.Port = int(binary.BigEndian.Uint32(payload))
 	return nil
 }
+
+func (m *HashRequest) decodePayload(payload []byte) error {
+	var err error
+	m.PiecesRoot, m.BaseLayer, m.Index, m.Length, m.ProofLayers, err = decodeHashHeader(payload)
+	return err
+}
+
+func (m *Hashes) decodePayload(payload []byte) error {
+	var err error
+	m.PiecesRoot, m.BaseLayer, m.Index, m.Length, m.ProofLayers, err = decodeHashHeader(payload)
+	if err != nil {
+		return err
+	}
+
+	hashes := payload[48:]
+	if len(hashes)%32 != 0 {
+		return invalidPayloadError
+	}
+
+	m.Hashes = make([][]byte, len(hashes)/32)
+	for i := range m.Hashes {
+		m.Hashes[i] = hashes[i*32 : (i+1)*32]
+	}
+
+	return nil
+}
+
+func (m *HashReject) decodePayload(payload []byte) error {
+	var err error
+	m.PiecesRoot, m.BaseLayer, m.Index, m.Length, m.ProofLayers, err = decodeHashHeader(payload)
+	return err
+}
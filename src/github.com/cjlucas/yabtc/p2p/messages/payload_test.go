@@ -250,3 +250,54 @@ func TestPortPayload(t *testing.T) {
  *    })
  *}
  */
+
+func TestHashRequestPayload(t *testing.T) {
+	Convey("When given a valid HashRequest object", t, func() {
+		root := make([]byte, 32)
+		root[0] = 0xaa
+		msg := NewHashRequest(root, 1, 2, 4, 5)
+		Convey("it should produce a valid payload", func() {
+			expected := append(root,
+				0, 0, 0, 1,
+				0, 0, 0, 2,
+				0, 0, 0, 4,
+				0, 0, 0, 5)
+			So(msg.Payload(), ShouldResemble, expected)
+		})
+
+		Convey("it should decode back to the same message", func() {
+			parsed, err := ParseBytes(AsBytes(msg))
+			So(err, ShouldBeNil)
+			So(parsed, ShouldResemble, msg)
+		})
+	})
+}
+
+func TestHashesPayload(t *testing.T) {
+	Convey("When given a valid Hashes object", t, func() {
+		root := make([]byte, 32)
+		h1 := make([]byte, 32)
+		h2 := make([]byte, 32)
+		h1[0], h2[0] = 1, 2
+		msg := NewHashes(NewHashRequest(root, 0, 0, 2, 0), [][]byte{h1, h2})
+		Convey("it should append the hashes to the header", func() {
+			payload := msg.Payload()
+			So(len(payload), ShouldEqual, 48+64)
+			So(payload[48:80], ShouldResemble, h1)
+			So(payload[80:112], ShouldResemble, h2)
+		})
+
+		Convey("it should decode back to the same message", func() {
+			parsed, err := ParseBytes(AsBytes(msg))
+			So(err, ShouldBeNil)
+			So(parsed, ShouldResemble, msg)
+		})
+	})
+
+	Convey("When given a Hashes payload with a partial hash", t, func() {
+		payload := make([]byte, 48+31)
+		Convey("it should fail to decode", func() {
+			So((&Hashes{}).decodePayload(payload), ShouldNotBeNil)
+		})
+	})
+}
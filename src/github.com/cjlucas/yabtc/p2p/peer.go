@@ -8,12 +8,25 @@ import (
 	"time"
 
 	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/ratelimit"
 )
 
 const READ_DEADLINE = 5 * time.Second
 
+// Where we learned about a peer
+type PeerSource int
+
+const (
+	PEER_SOURCE_TRACKER PeerSource = iota
+	PEER_SOURCE_INCOMING
+	PEER_SOURCE_LSD
+	PEER_SOURCE_DHT
+	PEER_SOURCE_PEX
+)
+
 type Peer struct {
 	Addr           PeerAddr
+	Source         PeerSource
 	peerId         [20]byte
 	Conn           net.Conn
 	Choked         bool
@@ -23,6 +36,14 @@ type Peer struct {
 	ReadChan       chan messages.Message
 	WriteChan      chan messages.Message
 	ClosedConnChan chan bool
+
+	// Reserved bytes of the peer's handshake
+	Reserved [8]byte
+
+	// Limits on piece data shared with other peers, nil for no limit.
+	// Must be set before the handlers are started.
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
 }
 
 type PeerAddr struct {
@@ -56,6 +77,7 @@ func NewPeerWithConn(conn net.Conn) *Peer {
 	fmt.Sscanf(conn.RemoteAddr().String(), "%s:%d", ip, port)
 	p := NewPeer(ip, port)
 	p.Conn = conn
+	p.Source = PEER_SOURCE_INCOMING
 	return p
 }
 
@@ -75,6 +97,17 @@ func (p Peer) PeerId() [20]byte {
 	return p.peerId
 }
 
+// Peers found through local service discovery are on our LAN
+func (p Peer) IsLocal() bool {
+	return p.Source == PEER_SOURCE_LSD
+}
+
+// SupportsExtensions reports whether the peer speaks the BEP 10
+// extension protocol
+func (p *Peer) SupportsExtensions() bool {
+	return p.Reserved[RESERVED_EXTENSIONS_BYTE]&RESERVED_EXTENSIONS_MASK != 0
+}
+
 func (p *Peer) IsConnected() bool {
 	return p.Conn != nil
 }
@@ -90,6 +123,13 @@ func (p *Peer) Connect() error {
 
 }
 
+// Close closes the connection, which stops the peer's handlers
+func (p *Peer) Close() {
+	if p.IsConnected() {
+		p.Conn.Close()
+	}
+}
+
 func (p *Peer) Disconnect() {
 	if p.IsConnected() {
 		p.Conn.Close()
@@ -189,14 +229,27 @@ func readMessage(r net.Conn) (messages.Message, error) {
 
 func (p *Peer) readHandler() {
 	for {
-		if msg, err := readMessage(p.Conn); err == nil {
+		msg, err := readMessage(p.Conn)
+		if err == nil {
+			// Reading slower holds the peer back through TCP
+			if piece, ok := msg.(*messages.Piece); ok {
+				p.DownloadLimiter.Wait(len(piece.Block))
+			}
 			p.ReadChan <- msg
-		} else if err == io.EOF {
+			continue
+		}
+
+		nerr, isNetErr := err.(net.Error)
+		if isNetErr && nerr.Timeout() {
+			continue
+		}
+
+		// Invalid messages are skipped, the connection going away isn't
+		if isNetErr || err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
 			p.ClosedConnChan <- true
 			return
-		} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
-			fmt.Println("readMessage error ", err)
 		}
+		fmt.Println("readMessage error ", err)
 	}
 }
 
@@ -205,6 +258,9 @@ func (p *Peer) writeHandler() {
 		select {
 		case msg := <-p.WriteChan:
 			//fmt.Println("will write", msg)
+			if piece, ok := msg.(*messages.Piece); ok {
+				p.UploadLimiter.Wait(len(piece.Block))
+			}
 			if err := writeBytes(p.Conn, messages.AsBytes(msg)); err == io.EOF {
 				p.ClosedConnChan <- true
 				return
@@ -0,0 +1,59 @@
+package p2p
+
+// Reserved handshake bits, as byte index and mask
+const (
+	// BEP 10 extension protocol
+	RESERVED_EXTENSIONS_BYTE = 5
+	RESERVED_EXTENSIONS_MASK = 0x10
+	// BEP 5 DHT
+	RESERVED_DHT_BYTE = 7
+	RESERVED_DHT_MASK = 0x01
+)
+
+// PeerPolicy decides where a torrent's peers may come from. It's the one
+// place the private flag is enforced: every peer source asks it before
+// finding or accepting peers, so a private torrent only ever talks to
+// peers its trackers hand out.
+type PeerPolicy struct {
+	private bool
+	// Optional sources enabled client-wide
+	enabled map[PeerSource]bool
+}
+
+// NewPeerPolicy creates the policy of a torrent. Trackers and incoming
+// connections are always allowed, enabled lists the other sources the
+// client runs.
+func NewPeerPolicy(private bool, enabled ...PeerSource) *PeerPolicy {
+	p := &PeerPolicy{private: private, enabled: make(map[PeerSource]bool)}
+	for _, source := range enabled {
+		p.enabled[source] = true
+	}
+
+	return p
+}
+
+func (p *PeerPolicy) IsPrivate() bool {
+	return p.private
+}
+
+// Allows reports whether peers may be found through source
+func (p *PeerPolicy) Allows(source PeerSource) bool {
+	switch source {
+	case PEER_SOURCE_TRACKER, PEER_SOURCE_INCOMING:
+		return true
+	}
+
+	return !p.private && p.enabled[source]
+}
+
+// Reserved returns the reserved bytes of the handshakes sent for the
+// torrent. DHT support is only advertised if the torrent may use it.
+func (p *PeerPolicy) Reserved() [8]byte {
+	var reserved [8]byte
+	reserved[RESERVED_EXTENSIONS_BYTE] |= RESERVED_EXTENSIONS_MASK
+	if p.Allows(PEER_SOURCE_DHT) {
+		reserved[RESERVED_DHT_BYTE] |= RESERVED_DHT_MASK
+	}
+
+	return reserved
+}
@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var optionalSources = []PeerSource{PEER_SOURCE_LSD, PEER_SOURCE_DHT, PEER_SOURCE_PEX}
+
+func TestPeerPolicy(t *testing.T) {
+	Convey("When a public torrent's policy is created", t, func() {
+		p := NewPeerPolicy(false, PEER_SOURCE_LSD, PEER_SOURCE_PEX)
+
+		Convey("Only the enabled sources should be allowed", func() {
+			So(p.Allows(PEER_SOURCE_TRACKER), ShouldBeTrue)
+			So(p.Allows(PEER_SOURCE_INCOMING), ShouldBeTrue)
+			So(p.Allows(PEER_SOURCE_LSD), ShouldBeTrue)
+			So(p.Allows(PEER_SOURCE_PEX), ShouldBeTrue)
+			So(p.Allows(PEER_SOURCE_DHT), ShouldBeFalse)
+		})
+	})
+
+	Convey("When a private torrent's policy is created with every source enabled", t, func() {
+		p := NewPeerPolicy(true, optionalSources...)
+
+		Convey("Only trackers and incoming connections should be allowed", func() {
+			So(p.IsPrivate(), ShouldBeTrue)
+			So(p.Allows(PEER_SOURCE_TRACKER), ShouldBeTrue)
+			So(p.Allows(PEER_SOURCE_INCOMING), ShouldBeTrue)
+			for _, source := range optionalSources {
+				So(p.Allows(source), ShouldBeFalse)
+			}
+		})
+	})
+}
+
+func TestPolicyReserved(t *testing.T) {
+	Convey("When DHT is allowed", t, func() {
+		hs := NewHandshake("BitTorrent protocol", nil, nil)
+		hs.Reserved = NewPeerPolicy(false, PEER_SOURCE_DHT).Reserved()
+
+		Convey("The handshake should advertise DHT and extensions", func() {
+			So(hs.SupportsDHT(), ShouldBeTrue)
+			So(hs.SupportsExtensions(), ShouldBeTrue)
+		})
+	})
+
+	Convey("When the torrent is private", t, func() {
+		hs := NewHandshake("BitTorrent protocol", nil, nil)
+		hs.Reserved = NewPeerPolicy(true, optionalSources...).Reserved()
+
+		Convey("The handshake should not advertise DHT", func() {
+			So(hs.SupportsDHT(), ShouldBeFalse)
+			So(hs.SupportsExtensions(), ShouldBeTrue)
+		})
+
+		Convey("The bytes sent should not have the DHT bit set", func() {
+			b := hs.Bytes()
+			So(b[1+hs.Plen+RESERVED_DHT_BYTE]&RESERVED_DHT_MASK, ShouldEqual, 0)
+		})
+	})
+}
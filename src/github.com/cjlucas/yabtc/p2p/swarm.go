@@ -8,12 +8,12 @@ import (
 )
 
 type Swarm struct {
-	TorInfo     torrent.MetaData
+	TorInfo     *torrent.MetaData
 	LocalPeerId []byte
 	Peers       []Peer
 }
 
-func NewSwarm(torInfo torrent.MetaData) *Swarm {
+func NewSwarm(torInfo *torrent.MetaData) *Swarm {
 	var s Swarm
 	s.TorInfo = torInfo
 	s.LocalPeerId = generateLocalPeerId()
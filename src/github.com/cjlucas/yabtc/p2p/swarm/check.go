@@ -0,0 +1,82 @@
+package swarm
+
+import (
+	"context"
+
+	"github.com/cjlucas/yabtc/bitfield"
+	"github.com/cjlucas/yabtc/checker"
+)
+
+// Recheck makes the swarm verify the data in storage the next time it's
+// started, replacing its progress with the pieces that verify. A running
+// swarm has to be stopped and started again.
+func (s *Swarm) Recheck() {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	s.recheck = true
+}
+
+// check verifies the data in storage from the Run goroutine. It returns
+// false if the swarm was stopped before the check finished, in which
+// case it's checked again on the next start.
+func (s *Swarm) check() bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The checker reads storage directly, so nothing may be left in the
+	// write cache
+	s.pieceWriter.Flush()
+
+	progChan := checker.New().Check(ctx, s.storage, s.Torrent)
+	for {
+		select {
+		case p := <-progChan:
+			if !p.Done {
+				continue
+			}
+			if p.Err != nil {
+				s.stop(ERROR, p.Err)
+				return false
+			}
+
+			s.loadCheckedPieces(p.Verified)
+			s.runLock.Lock()
+			s.recheck = false
+			s.runLock.Unlock()
+			return true
+		case req := <-s.stopChan:
+			cancel()
+			for range progChan {
+			}
+			s.stop(req.status, nil)
+			close(req.done)
+			return false
+		case c := <-s.resumeDataChan:
+			c <- s.resumeData()
+		}
+	}
+}
+
+// loadCheckedPieces forgets the swarm's progress, keeping only the
+// pieces that verified
+func (s *Swarm) loadCheckedPieces(verified *bitfield.Bitfield) {
+	numPieces := s.Torrent.NumPieces()
+	s.pendingPieces = make(map[int]*pieceData)
+	s.requestedPieces = make(map[int]*pieceRequest)
+
+	s.priorityLock.Lock()
+	s.Stats.Pieces.SetBytes(bitfield.New(numPieces).Bytes())
+	s.partialPieces = make(map[int]bool)
+	s.priorityLock.Unlock()
+
+	s.readableLock.Lock()
+	s.readable.SetBytes(bitfield.New(numPieces).Bytes())
+	s.readableLock.Unlock()
+
+	for i := 0; i < numPieces; i++ {
+		if verified.Get(i) == 1 {
+			s.setHave(i)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package swarm
+
+import "container/list"
+
+// Default size of the cache of blocks waiting to be written
+const DEFAULT_WRITE_CACHE_SIZE = 16 << 20
+
+// Default size of the cache of pieces read back from storage
+const DEFAULT_READ_CACHE_SIZE = 32 << 20
+
+type CacheStats struct {
+	// Bytes waiting to be written, never more than WriteCacheMax
+	WriteCacheSize int
+	WriteCacheMax  int
+	// Blocks handed to the cache and bytes written out of it. Every
+	// storage write covers a run of adjacent blocks, so Writes is
+	// usually much lower than BlocksWritten.
+	BlocksWritten int
+	BytesFlushed  int
+	Flushes       int
+	Writes        int
+	WriteErrors   int
+	// Times the swarm had to wait for the cache to be flushed
+	Stalls int
+
+	ReadCacheSize int
+	ReadCacheMax  int
+	ReadHits      int
+	ReadMisses    int
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+// readCache keeps whole pieces read from storage, evicting the least
+// recently used ones once it holds more than max bytes
+type readCache struct {
+	max     int
+	size    int
+	lru     *list.List
+	entries map[int]*list.Element
+}
+
+func newReadCache(max int) *readCache {
+	return &readCache{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[int]*list.Element),
+	}
+}
+
+func (c *readCache) get(index int) []byte {
+	e, ok := c.entries[index]
+	if !ok {
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedPiece).data
+}
+
+func (c *readCache) add(index int, data []byte) {
+	if len(data) > c.max {
+		return
+	}
+
+	c.remove(index)
+	c.entries[index] = c.lru.PushFront(&cachedPiece{index, data})
+	c.size += len(data)
+	c.evict()
+}
+
+func (c *readCache) evict() {
+	for c.size > c.max {
+		c.remove(c.lru.Back().Value.(*cachedPiece).index)
+	}
+}
+
+func (c *readCache) remove(index int) {
+	e, ok := c.entries[index]
+	if !ok {
+		return
+	}
+
+	c.lru.Remove(e)
+	delete(c.entries, index)
+	c.size -= len(e.Value.(*cachedPiece).data)
+}
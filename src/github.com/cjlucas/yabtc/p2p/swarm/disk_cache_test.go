@@ -0,0 +1,173 @@
+package swarm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/storage"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeAllBlocks hands every block of the resume test torrent to the writer
+func writeAllBlocks(w *pieceDataWriter) {
+	w.WriteBlock(0, BLOCK_SIZE, resumeContent[BLOCK_SIZE:2*BLOCK_SIZE])
+	w.WriteBlock(1, 0, resumeContent[2*BLOCK_SIZE:])
+	w.WriteBlock(0, 0, resumeContent[:BLOCK_SIZE])
+}
+
+func TestWriteCache(t *testing.T) {
+	Convey("When blocks are cached", t, func() {
+		meta := newResumeTorrent()
+		store := storage.NewMemoryStorage(meta)
+		w := newPieceDataWriter(store, meta.GeneratePieces())
+		writeAllBlocks(w)
+
+		Convey("They should not be written yet", func() {
+			_, err := store.ReadAt(make([]byte, 10), 0, 0)
+			So(err, ShouldEqual, storage.PieceNotFoundError)
+			So(w.Stats().WriteCacheSize, ShouldEqual, len(resumeContent))
+		})
+
+		Convey("They should be readable from the cache", func() {
+			buf := make([]byte, 100)
+			_, err := w.ReadAt(buf, 0, BLOCK_SIZE-50)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, resumeContent[BLOCK_SIZE-50:BLOCK_SIZE+50])
+			So(w.Stats().ReadHits, ShouldEqual, 1)
+		})
+
+		Convey("Flushing should write adjacent blocks of a piece together", func() {
+			w.Flush()
+
+			stats := w.Stats()
+			So(stats.WriteCacheSize, ShouldEqual, 0)
+			So(stats.BlocksWritten, ShouldEqual, 3)
+			So(stats.BytesFlushed, ShouldEqual, len(resumeContent))
+			So(stats.Writes, ShouldEqual, 2)
+
+			buf := make([]byte, 2*BLOCK_SIZE)
+			_, err := store.ReadAt(buf, 0, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, resumeContent[:2*BLOCK_SIZE])
+		})
+	})
+
+	Convey("When the storage can write across pieces", t, func() {
+		meta := newResumeTorrent()
+		dir, _ := ioutil.TempDir("", "yabtc-cache")
+		defer os.RemoveAll(dir)
+
+		store, err := storage.NewSparseStorage(filepath.Join(dir, "data"), meta)
+		So(err, ShouldBeNil)
+		defer store.Close()
+
+		w := newPieceDataWriter(store, meta.GeneratePieces())
+		writeAllBlocks(w)
+		w.Flush()
+
+		Convey("Adjacent pieces should be written in a single write", func() {
+			So(w.Stats().Writes, ShouldEqual, 1)
+
+			data, _ := ioutil.ReadFile(filepath.Join(dir, "data"))
+			So(data, ShouldResemble, resumeContent)
+		})
+	})
+
+	Convey("When the write cache is full", t, func() {
+		meta := newResumeTorrent()
+		w := newPieceDataWriter(storage.NewMemoryStorage(meta), meta.GeneratePieces())
+		w.SetCacheSize(BLOCK_SIZE, 0)
+		w.WriteBlock(0, 0, resumeContent[:BLOCK_SIZE])
+
+		done := make(chan bool)
+		go func() {
+			w.WriteBlock(0, BLOCK_SIZE, resumeContent[BLOCK_SIZE:2*BLOCK_SIZE])
+			done <- true
+		}()
+
+		Convey("Writing should wait until the cache is flushed", func() {
+			select {
+			case <-done:
+				t.Fatal("write did not wait for the flush")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			w.Flush()
+			<-done
+			So(w.Stats().Stalls, ShouldBeGreaterThan, 0)
+			So(w.Stats().WriteCacheSize, ShouldEqual, BLOCK_SIZE)
+		})
+	})
+
+	Convey("When the writer is stopped", t, func() {
+		meta := newResumeTorrent()
+		w := newPieceDataWriter(storage.NewMemoryStorage(meta), meta.GeneratePieces())
+		done := make(chan bool)
+		go func() {
+			w.Run()
+			close(done)
+		}()
+		w.Stop()
+
+		Convey("Run should return", func() {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Run did not return")
+			}
+		})
+
+		Convey("Stopping it again should be harmless", func() {
+			So(w.Stop, ShouldNotPanic)
+		})
+	})
+}
+
+func TestReadCache(t *testing.T) {
+	Convey("When reading pieces already in storage", t, func() {
+		meta := newResumeTorrent()
+		w := newPieceDataWriter(storage.NewMemoryStorage(meta), meta.GeneratePieces())
+		writeAllBlocks(w)
+		w.Flush()
+
+		buf := make([]byte, 10)
+		w.ReadAt(buf, 0, 0)
+
+		Convey("The following reads of the piece should hit the cache", func() {
+			_, err := w.ReadAt(buf, 0, BLOCK_SIZE)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, resumeContent[BLOCK_SIZE:BLOCK_SIZE+10])
+
+			stats := w.Stats()
+			So(stats.ReadMisses, ShouldEqual, 1)
+			So(stats.ReadHits, ShouldEqual, 1)
+			So(stats.ReadCacheSize, ShouldEqual, 2*BLOCK_SIZE)
+		})
+
+		Convey("The least recently used piece should be evicted first", func() {
+			w.SetCacheSize(DEFAULT_WRITE_CACHE_SIZE, 2*BLOCK_SIZE)
+			w.ReadAt(buf, 1, 0)
+			w.ReadAt(buf, 0, 0)
+
+			So(w.Stats().ReadMisses, ShouldEqual, 3)
+			So(w.Stats().ReadCacheSize, ShouldEqual, 2*BLOCK_SIZE)
+		})
+
+		Convey("A new block should replace the cached piece", func() {
+			block := make([]byte, BLOCK_SIZE)
+			w.WriteBlock(0, 0, block)
+
+			_, err := w.ReadAt(buf, 0, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, block[:10])
+
+			w.Flush()
+			_, err = w.ReadAt(buf, 0, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, block[:10])
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package swarm
+
+import (
+	"fmt"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+)
+
+// Extended message ids we ask peers to send each extension with
+const UT_PEX_ID = 1
+
+// A peer learned about from another peer
+type FoundPeer struct {
+	InfoHash []byte
+	Ip       string
+	Port     int
+	Source   p2p.PeerSource
+}
+
+// SetPeerPolicy sets where the swarm may find peers. It must be called
+// before the swarm is started.
+func (s *Swarm) SetPeerPolicy(policy *p2p.PeerPolicy) {
+	s.policy = policy
+}
+
+func (s *Swarm) PeerPolicy() *p2p.PeerPolicy {
+	return s.policy
+}
+
+// extendedHandshake only offers the extensions the policy allows, so
+// peers of a private torrent are never asked for peer exchange. It's
+// sent again whenever the swarm becomes upload only or stops being it.
+func (s *Swarm) extendedHandshake() *messages.ExtendedHandshake {
+	m := make(map[string]int)
+	if s.policy.Allows(p2p.PEER_SOURCE_PEX) {
+		m[messages.UT_PEX] = UT_PEX_ID
+	}
+
+	hs := &messages.ExtendedHandshake{M: m}
+	if s.IsUploadOnly() {
+		hs.UploadOnly = 1
+	}
+
+	return hs
+}
+
+func (s *Swarm) handleExtended(p *Peer, msg *messages.Extended) {
+	switch msg.ExtendedId {
+	case messages.EXTENDED_HANDSHAKE_ID:
+		hs, err := messages.ParseExtendedHandshake(msg.Data)
+		if err != nil {
+			fmt.Printf("invalid extended handshake from %s:%d: %s\n", p.Ip(), p.Port(), err)
+			return
+		}
+		p.Extensions = hs.M
+		p.UploadOnly = hs.UploadOnly == 1
+		s.dropSeedConnection(p)
+	case UT_PEX_ID:
+		s.handlePex(p, msg.Data)
+	}
+}
+
+func (s *Swarm) handlePex(p *Peer, data []byte) {
+	// Peers may send peer exchange messages even though we never offered it
+	if !s.policy.Allows(p2p.PEER_SOURCE_PEX) {
+		return
+	}
+
+	pex, err := messages.ParsePex(data)
+	if err != nil {
+		fmt.Printf("invalid peer exchange message from %s:%d: %s\n", p.Ip(), p.Port(), err)
+		return
+	}
+
+	for _, added := range pex.Added {
+		s.peerFound(added.Ip, added.Port, p2p.PEER_SOURCE_PEX)
+	}
+}
+
+func (s *Swarm) peerFound(ip string, port int, source p2p.PeerSource) {
+	if s.PeerFoundChan == nil || !s.policy.Allows(source) {
+		return
+	}
+
+	select {
+	case s.PeerFoundChan <- FoundPeer{s.Torrent.InfoHash(), ip, port, source}:
+	default:
+		// Drop peers if nobody is keeping up
+	}
+}
@@ -0,0 +1,135 @@
+package swarm
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newPolicySwarm returns a swarm whose client has every optional peer
+// source enabled
+func newPolicySwarm(private bool) *Swarm {
+	root, err := ioutil.TempDir("", "yabtc-policy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	fname := filepath.Join(root, "file")
+	ioutil.WriteFile(fname, resumeContent, 0644)
+
+	t, err := torrent.Create(fname, torrent.CreateOptions{PieceLength: BLOCK_SIZE, V1: true, Private: private})
+	if err != nil {
+		panic(err)
+	}
+
+	s := New(t, storage.NewMemoryStorage(t))
+	s.SetPeerPolicy(p2p.NewPeerPolicy(t.IsPrivate(), p2p.PEER_SOURCE_LSD, p2p.PEER_SOURCE_DHT, p2p.PEER_SOURCE_PEX))
+	return s
+}
+
+// connectExtendedPeer adds a peer that supports extensions to s and
+// returns the remote end of its connection
+func connectExtendedPeer(s *Swarm) *p2p.Peer {
+	local, remote := net.Pipe()
+
+	peer := p2p.NewPeer("10.0.0.9", 6881)
+	peer.Conn = local
+	peer.Reserved = p2p.NewPeerPolicy(false).Reserved()
+	s.AddPeer(peer)
+
+	other := p2p.NewPeer("10.0.0.1", 6881)
+	other.Conn = remote
+	other.StartHandlers()
+	return other
+}
+
+func receiveMessage(p *p2p.Peer) messages.Message {
+	select {
+	case msg := <-p.ReadChan:
+		return msg
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// sendPex sends a peer exchange message from the remote peer and has the
+// swarm handle it
+func sendPex(s *Swarm, remote *p2p.Peer, added ...messages.PexPeer) {
+	remote.WriteChan <- messages.NewPex(UT_PEX_ID, &messages.Pex{Added: added})
+
+	for {
+		pm := <-s.peerMessageChan
+		s.handlePeerMessage(pm)
+		if _, ok := pm.msg.(*messages.Extended); ok {
+			return
+		}
+	}
+}
+
+func TestPrivatePeerPolicy(t *testing.T) {
+	Convey("Given a private torrent's swarm", t, func() {
+		s := newPolicySwarm(true)
+		found := make(chan FoundPeer, 10)
+		s.PeerFoundChan = found
+		remote := connectExtendedPeer(s)
+
+		Convey("Its extended handshake should not offer peer exchange", func() {
+			msg, ok := receiveMessage(remote).(*messages.Extended)
+			So(ok, ShouldBeTrue)
+			So(msg.ExtendedId, ShouldEqual, messages.EXTENDED_HANDSHAKE_ID)
+
+			hs, err := messages.ParseExtendedHandshake(msg.Data)
+			So(err, ShouldBeNil)
+			So(hs.M, ShouldNotContainKey, messages.UT_PEX)
+		})
+
+		Convey("Peer exchange messages should be ignored", func() {
+			sendPex(s, remote, messages.PexPeer{Ip: "10.0.0.2", Port: 6882})
+			So(len(found), ShouldEqual, 0)
+		})
+
+		Convey("No optional peer source should be able to add peers", func() {
+			s.peerFound("10.0.0.3", 6883, p2p.PEER_SOURCE_PEX)
+			s.peerFound("10.0.0.4", 6884, p2p.PEER_SOURCE_DHT)
+			s.peerFound("10.0.0.5", 6885, p2p.PEER_SOURCE_LSD)
+			So(len(found), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a public torrent's swarm", t, func() {
+		s := newPolicySwarm(false)
+		found := make(chan FoundPeer, 10)
+		s.PeerFoundChan = found
+		remote := connectExtendedPeer(s)
+
+		Convey("Its extended handshake should offer peer exchange", func() {
+			msg, ok := receiveMessage(remote).(*messages.Extended)
+			So(ok, ShouldBeTrue)
+
+			hs, err := messages.ParseExtendedHandshake(msg.Data)
+			So(err, ShouldBeNil)
+			So(hs.M[messages.UT_PEX], ShouldEqual, UT_PEX_ID)
+		})
+
+		Convey("Peers from peer exchange should be reported", func() {
+			sendPex(s, remote, messages.PexPeer{Ip: "10.0.0.2", Port: 6882})
+			So(len(found), ShouldEqual, 1)
+
+			fp := <-found
+			So(fp.Ip, ShouldEqual, "10.0.0.2")
+			So(fp.Port, ShouldEqual, 6882)
+			So(fp.Source, ShouldEqual, p2p.PEER_SOURCE_PEX)
+			So(fp.InfoHash, ShouldResemble, s.Torrent.InfoHash())
+		})
+	})
+}
@@ -0,0 +1,90 @@
+package swarm
+
+import (
+	"fmt"
+	"time"
+)
+
+// What's done with a torrent once it reaches a seeding goal
+type GoalAction int
+
+const (
+	GOAL_ACTION_PAUSE GoalAction = iota
+	GOAL_ACTION_REMOVE
+	// Remove the torrent and delete its data
+	GOAL_ACTION_DELETE
+)
+
+func (a GoalAction) String() string {
+	switch a {
+	case GOAL_ACTION_PAUSE:
+		return "pause"
+	case GOAL_ACTION_REMOVE:
+		return "remove"
+	case GOAL_ACTION_DELETE:
+		return "delete"
+	}
+	return "unknown"
+}
+
+func ParseGoalAction(s string) (GoalAction, error) {
+	for _, a := range []GoalAction{GOAL_ACTION_PAUSE, GOAL_ACTION_REMOVE, GOAL_ACTION_DELETE} {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown seeding goal action: %s", s)
+}
+
+type Goal int
+
+const (
+	GOAL_NONE Goal = iota
+	GOAL_RATIO
+	GOAL_SEED_TIME
+	GOAL_IDLE_TIME
+)
+
+func (g Goal) String() string {
+	switch g {
+	case GOAL_RATIO:
+		return "ratio"
+	case GOAL_SEED_TIME:
+		return "seed time"
+	case GOAL_IDLE_TIME:
+		return "idle time"
+	default:
+		return "none"
+	}
+}
+
+// SeedGoals says how long a torrent is seeded for. Zero disables a goal.
+type SeedGoals struct {
+	// Share ratio to stop at
+	Ratio float64
+	// Longest time to seed for
+	SeedTime time.Duration
+	// Stop after seeding this long without uploading
+	IdleTime time.Duration
+	Action   GoalAction
+}
+
+// GoalReached returns the first of the goals the swarm has reached.
+// Goals only apply while the swarm is seeding.
+func (s *Swarm) GoalReached(g *SeedGoals) Goal {
+	if !s.IsUploadOnly() {
+		return GOAL_NONE
+	}
+
+	switch {
+	case g.Ratio > 0 && s.Ratio() >= g.Ratio:
+		return GOAL_RATIO
+	case g.SeedTime > 0 && s.StatsSnapshot().SeedingTime >= g.SeedTime:
+		return GOAL_SEED_TIME
+	case g.IdleTime > 0 && s.IdleTime() >= g.IdleTime:
+		return GOAL_IDLE_TIME
+	}
+
+	return GOAL_NONE
+}
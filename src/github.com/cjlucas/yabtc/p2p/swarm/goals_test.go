@@ -0,0 +1,141 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newSeedingSwarm returns a seed that started seeding at the clock's time
+// and holds the data of its first piece
+func newSeedingSwarm(clock *fakeClock) *Swarm {
+	s := newSeedSwarm()
+	s.clock = clock.Now
+	s.storage.WriteAt(make([]byte, BLOCK_SIZE), 0, 0)
+	s.updateUploadOnly()
+	return s
+}
+
+// uploadBlock has an unchoked peer request the first block
+func uploadBlock(s *Swarm, p *Peer) {
+	s.handlePeerMessage(PeerMessage{p, messages.NewInterested()})
+	s.handlePeerMessage(PeerMessage{p, messages.NewRequest(0, 0, BLOCK_SIZE)})
+}
+
+func TestUpload(t *testing.T) {
+	Convey("Given a seed", t, func() {
+		s := newSeedingSwarm(&fakeClock{time.Unix(1000, 0)})
+		p := newPeer(p2p.NewPeer("10.0.0.1", 6881))
+
+		Convey("Requests from choked peers should be ignored", func() {
+			s.handlePeerMessage(PeerMessage{p, messages.NewRequest(0, 0, BLOCK_SIZE)})
+			So(nextWrite(p), ShouldBeNil)
+			So(s.StatsSnapshot().Uploaded, ShouldEqual, 0)
+		})
+
+		Convey("Interested peers should be unchoked and served", func() {
+			uploadBlock(s, p)
+
+			_, ok := nextWrite(p).(*messages.Unchoke)
+			So(ok, ShouldBeTrue)
+			piece, ok := nextWrite(p).(*messages.Piece)
+			So(ok, ShouldBeTrue)
+			So(len(piece.Block), ShouldEqual, BLOCK_SIZE)
+
+			stats := s.StatsSnapshot()
+			So(stats.Uploaded, ShouldEqual, BLOCK_SIZE)
+			So(stats.TotalUploaded, ShouldEqual, BLOCK_SIZE)
+		})
+	})
+}
+
+func TestSeedGoals(t *testing.T) {
+	Convey("Given a swarm that is still downloading", t, func() {
+		s := newTestSwarm()
+		s.updateUploadOnly()
+
+		Convey("No goal should apply", func() {
+			So(s.GoalReached(&SeedGoals{Ratio: 0.01, SeedTime: time.Nanosecond}), ShouldEqual, GOAL_NONE)
+		})
+	})
+
+	Convey("Given a seed that uploaded a block", t, func() {
+		clock := &fakeClock{time.Unix(1000, 0)}
+		s := newSeedingSwarm(clock)
+		p := newPeer(p2p.NewPeer("10.0.0.1", 6881))
+		uploadBlock(s, p)
+
+		Convey("The ratio should be measured against the wanted size", func() {
+			So(s.Ratio(), ShouldAlmostEqual, float64(BLOCK_SIZE)/float64(s.BytesWanted()))
+			So(s.GoalReached(&SeedGoals{Ratio: 0.3}), ShouldEqual, GOAL_RATIO)
+			So(s.GoalReached(&SeedGoals{Ratio: 0.5}), ShouldEqual, GOAL_NONE)
+		})
+
+		Convey("The seed time goal should be reached once enough time passed", func() {
+			goals := &SeedGoals{SeedTime: time.Hour}
+			clock.Advance(59 * time.Minute)
+			So(s.GoalReached(goals), ShouldEqual, GOAL_NONE)
+			clock.Advance(time.Minute)
+			So(s.GoalReached(goals), ShouldEqual, GOAL_SEED_TIME)
+		})
+
+		Convey("The idle goal should count from the last upload", func() {
+			goals := &SeedGoals{IdleTime: time.Hour}
+			clock.Advance(50 * time.Minute)
+			uploadBlock(s, p)
+			clock.Advance(50 * time.Minute)
+			So(s.IdleTime(), ShouldEqual, 50*time.Minute)
+			So(s.GoalReached(goals), ShouldEqual, GOAL_NONE)
+
+			clock.Advance(10 * time.Minute)
+			So(s.GoalReached(goals), ShouldEqual, GOAL_IDLE_TIME)
+		})
+
+		Convey("The lifetime counters should be kept in the resume data", func() {
+			clock.Advance(time.Hour)
+			rd := s.ResumeData()
+
+			restored := newSeedSwarm()
+			So(restored.LoadResumeData(rd), ShouldBeNil)
+			stats := restored.StatsSnapshot()
+			So(stats.TotalUploaded, ShouldEqual, BLOCK_SIZE)
+			So(stats.TotalDownloaded, ShouldEqual, 0)
+			So(stats.SeedingTime, ShouldEqual, time.Hour)
+			So(stats.Uploaded, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a running seed", t, func() {
+		clock := &fakeClock{time.Unix(1000, 0)}
+		s := newSeedSwarm()
+		s.clock = clock.Now
+		go s.Run()
+		for !s.IsRunning() || !s.IsUploadOnly() {
+			time.Sleep(time.Millisecond)
+		}
+
+		Convey("Stopping it should stop the seeding time", func() {
+			s.Stop()
+			So(s.IsRunning(), ShouldBeFalse)
+
+			clock.Advance(time.Hour)
+			So(s.StatsSnapshot().SeedingTime, ShouldEqual, 0)
+			So(s.GoalReached(&SeedGoals{SeedTime: time.Minute}), ShouldEqual, GOAL_NONE)
+		})
+	})
+}
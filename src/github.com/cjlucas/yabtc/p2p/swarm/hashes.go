@@ -0,0 +1,161 @@
+package swarm
+
+import (
+	"fmt"
+
+	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// BEP 52 limits a single hash request to 512 hashes
+const MAX_HASHES_PER_REQUEST = 512
+
+// Piece layer being assembled from hash responses
+type pendingLayer struct {
+	file      torrent.File
+	hashes    [][]byte
+	received  []bool
+	requested bool
+}
+
+func (l *pendingLayer) done() bool {
+	for _, ok := range l.received {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Swarm) initPendingLayers() {
+	if !s.Torrent.IsV2() {
+		return
+	}
+
+	for _, f := range s.Torrent.Files() {
+		if f.IsPadding() || f.Length <= s.Torrent.PieceSize() {
+			continue
+		}
+
+		if s.Torrent.PieceLayer(f.PiecesRoot) != nil {
+			continue
+		}
+
+		numPieces := (f.Length + s.Torrent.PieceSize() - 1) / s.Torrent.PieceSize()
+		s.pendingLayers[string(f.PiecesRoot)] = &pendingLayer{
+			file:     f,
+			hashes:   make([][]byte, numPieces),
+			received: make([]bool, numPieces),
+		}
+	}
+}
+
+func (s *Swarm) requestPieceLayers(p *Peer) {
+	for _, l := range s.pendingLayers {
+		if l.requested {
+			continue
+		}
+
+		height := s.Torrent.PieceLayerHeight(l.file.Length)
+		length := len(l.hashes)
+		if length > MAX_HASHES_PER_REQUEST {
+			length = MAX_HASHES_PER_REQUEST
+		}
+		length = torrent.NextPowerOfTwo(length)
+
+		for i := 0; i < len(l.hashes); i += length {
+			proofLayers := height - torrent.Log2(length)
+			p.Peer.WriteChan <- messages.NewHashRequest(l.file.PiecesRoot,
+				s.Torrent.PieceLayerIndex(), i, length, proofLayers)
+		}
+		l.requested = true
+	}
+}
+
+func (s *Swarm) handleHashRequest(p *Peer, msg *messages.HashRequest) {
+	if msg.BaseLayer != s.Torrent.PieceLayerIndex() || msg.Length > MAX_HASHES_PER_REQUEST {
+		p.Peer.WriteChan <- messages.NewHashReject(msg)
+		return
+	}
+
+	hashes, err := s.Torrent.PieceLayerHashes(msg.PiecesRoot, msg.Index, msg.Length, msg.ProofLayers)
+	if err != nil {
+		p.Peer.WriteChan <- messages.NewHashReject(msg)
+		return
+	}
+
+	p.Peer.WriteChan <- messages.NewHashes(msg, hashes)
+}
+
+func (s *Swarm) handleHashes(p *Peer, msg *messages.Hashes) {
+	l, ok := s.pendingLayers[string(msg.PiecesRoot)]
+	if !ok || msg.BaseLayer != s.Torrent.PieceLayerIndex() {
+		return
+	}
+
+	if !torrent.VerifyMerkleProof(msg.Hashes, msg.PiecesRoot, msg.Index, msg.Length) {
+		fmt.Printf("received invalid hashes from %s:%d\n", p.Ip(), p.Port())
+		l.requested = false
+		return
+	}
+
+	for i := 0; i < msg.Length && msg.Index+i < len(l.hashes); i++ {
+		l.hashes[msg.Index+i] = msg.Hashes[i]
+		l.received[msg.Index+i] = true
+	}
+
+	if !l.done() {
+		return
+	}
+
+	var layer []byte
+	for _, h := range l.hashes {
+		layer = append(layer, h...)
+	}
+
+	if err := s.Torrent.SetPieceLayer(msg.PiecesRoot, layer); err != nil {
+		fmt.Printf("could not set piece layer: %s\n", err)
+		l.requested = false
+		return
+	}
+
+	delete(s.pendingLayers, string(msg.PiecesRoot))
+}
+
+func (s *Swarm) handlePeerMessage(pm PeerMessage) {
+	switch msg := pm.msg.(type) {
+	case nil:
+		// The peer disconnected
+		s.removePeer(pm.peer)
+	case *messages.Choke:
+		// Choking discards every request the peer hasn't answered yet
+		s.releaseRequests(pm.peer)
+	case *messages.Interested:
+		s.handleInterested(pm.peer)
+	case *messages.Request:
+		s.handleRequest(pm.peer, msg)
+	case *messages.Have:
+		s.superSeedPiecesSeen(pm.peer, []int{msg.PieceIndex})
+		s.dropSeedConnection(pm.peer)
+	case *messages.Bitfield:
+		var pieces []int
+		for i := 0; i < msg.Bits.Length(); i++ {
+			if msg.Bits.Get(i) == 1 {
+				pieces = append(pieces, i)
+			}
+		}
+		s.superSeedPiecesSeen(pm.peer, pieces)
+		s.dropSeedConnection(pm.peer)
+	case *messages.Extended:
+		s.handleExtended(pm.peer, msg)
+	case *messages.HashRequest:
+		s.handleHashRequest(pm.peer, msg)
+	case *messages.Hashes:
+		s.handleHashes(pm.peer, msg)
+	case *messages.HashReject:
+		fmt.Printf("%s:%d rejected %s\n", pm.peer.Ip(), pm.peer.Port(), msg)
+		if l, ok := s.pendingLayers[string(msg.PiecesRoot)]; ok {
+			l.requested = false
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package swarm
+
+import (
+	"errors"
+
+	"github.com/cjlucas/yabtc/storage"
+)
+
+var StorageNotMovableError = errors.New("storage can't be moved")
+
+type MoveProgress struct {
+	BytesMoved int64
+	BytesTotal int64
+
+	// Set on the last progress report. If Err is set the data was
+	// left where it was.
+	Done bool
+	Err  error
+}
+
+// sendMoveProgress replaces any report the receiver hasn't picked up yet
+func sendMoveProgress(progChan chan *MoveProgress, p *MoveProgress) {
+	select {
+	case <-progChan:
+	default:
+	}
+	progChan <- p
+}
+
+// MoveStorage moves the torrent's data to newRoot while the swarm keeps
+// running. Reads and writes wait until the move is done and then carry
+// on at the new location. Progress is sent on the returned channel,
+// which is closed after the report with Done set.
+func (s *Swarm) MoveStorage(newRoot string) <-chan *MoveProgress {
+	progChan := make(chan *MoveProgress, 1)
+
+	go func() {
+		defer close(progChan)
+
+		mover, ok := s.storage.(storage.Mover)
+		if !ok {
+			sendMoveProgress(progChan, &MoveProgress{Done: true, Err: StorageNotMovableError})
+			return
+		}
+
+		// Cached blocks are written to the old location so they move too.
+		// Blocks cached after this are flushed later to whichever root is
+		// current then: the old one before Move locks the storage, which
+		// moves them along, or the new one once the move is done.
+		s.pieceWriter.Flush()
+
+		p := &MoveProgress{}
+		err := mover.Move(newRoot, func(moved, total int64) {
+			p.BytesMoved = moved
+			p.BytesTotal = total
+			report := *p
+			sendMoveProgress(progChan, &report)
+		})
+
+		p.Done = true
+		p.Err = err
+		sendMoveProgress(progChan, p)
+	}()
+
+	return progChan
+}
@@ -0,0 +1,50 @@
+package swarm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/storage"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMoveStorage(t *testing.T) {
+	Convey("Given a swarm with cached blocks", t, func() {
+		meta := newResumeTorrent()
+		oldRoot, _ := ioutil.TempDir("", "yabtc-move")
+		newRoot, _ := ioutil.TempDir("", "yabtc-move")
+		defer os.RemoveAll(oldRoot)
+		defer os.RemoveAll(newRoot)
+
+		s := New(meta, storage.NewFileStorage(oldRoot, meta))
+		s.handleNewBlock(messages.NewPiece(0, 0, resumeContent[:BLOCK_SIZE]))
+
+		Convey("Moving its storage should move the cached blocks too", func() {
+			var p *MoveProgress
+			for p = range s.MoveStorage(newRoot) {
+			}
+			So(p.Done, ShouldBeTrue)
+			So(p.Err, ShouldBeNil)
+			So(p.BytesMoved, ShouldEqual, p.BytesTotal)
+
+			data, err := ioutil.ReadFile(filepath.Join(newRoot, "file"))
+			So(err, ShouldBeNil)
+			So(data[:BLOCK_SIZE], ShouldResemble, resumeContent[:BLOCK_SIZE])
+			So(s.resumeData().Root, ShouldEqual, newRoot)
+		})
+	})
+
+	Convey("When the storage can't be moved", t, func() {
+		meta := newResumeTorrent()
+		s := New(meta, storage.NewMemoryStorage(meta))
+
+		Convey("The move should fail", func() {
+			p := <-s.MoveStorage("/elsewhere")
+			So(p.Done, ShouldBeTrue)
+			So(p.Err, ShouldEqual, StorageNotMovableError)
+		})
+	})
+}
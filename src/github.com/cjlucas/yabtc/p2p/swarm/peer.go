@@ -8,6 +8,8 @@ import (
 	"github.com/cjlucas/yabtc/p2p/messages"
 )
 
+// PeerMessage is a message from a peer, msg is nil once the peer has
+// disconnected
 type PeerMessage struct {
 	peer *Peer
 	msg  messages.Message
@@ -22,8 +24,18 @@ type Peer struct {
 	// Is peer interested in us?
 	Interested bool
 
+	// Are we choking peer?
+	AmChoking bool
+
 	Pieces *bitfield.Bitfield
 
+	// Extensions the peer supports, mapped to the extended message id
+	// it wants them sent with
+	Extensions map[string]int
+
+	// Peer won't download anything more (BEP 21)
+	UploadOnly bool
+
 	// Pending incoming block requests
 	InBlockRequests []*messages.Request
 
@@ -45,7 +57,7 @@ func (p *Peer) Port() int {
 }
 
 func newPeer(peer *p2p.Peer) *Peer {
-	p := &Peer{Choked: true, Interested: false, Peer: peer}
+	p := &Peer{Choked: true, Interested: false, AmChoking: true, Peer: peer}
 	p.InBlockRequests = make([]*messages.Request, 0)
 	p.OutBlockRequests = make([]*messages.Request, 0)
 	return p
@@ -86,13 +98,22 @@ func (p *Peer) handleMessage(msg messages.Message) {
 		p.InBlockRequests = append(p.InBlockRequests, msg)
 	case *messages.Piece:
 		p.BlockReceivedChan <- msg
+	case *messages.Extended:
+		// Handled by the swarm, which knows which extensions it offered
 	default:
 		fmt.Println("got unknown message")
 	}
 }
 
 func (p *Peer) Run() {
-	// TODO defer remove from s.Peers
+	// The swarm is told once the connection is gone. It may have stopped
+	// listening by then, in which case it has dropped the peer already.
+	defer func() {
+		select {
+		case p.PeerMessageChan <- PeerMessage{p, nil}:
+		default:
+		}
+	}()
 	p.Peer.StartHandlers()
 	defer p.Peer.Disconnect()
 
@@ -1,40 +1,135 @@
 package swarm
 
 import (
-	"github.com/cjlucas/yabtc/p2p/messages"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cjlucas/yabtc/bitfield"
+	"github.com/cjlucas/yabtc/storage"
 	"github.com/cjlucas/yabtc/torrent"
 )
 
+type pieceReader interface {
+	ReadAt(p []byte, piece, offset int) (int, error)
+}
+
 type pieceData struct {
-	piece  *torrent.Piece
-	blocks []*messages.Piece
+	piece *torrent.Piece
+	// Blocks received this session
+	data []byte
+	// Blocks received, including those written before a restart
+	received    *bitfield.Bitfield
+	inMemory    []bool
+	numReceived int
 }
 
+// How long blocks may stay in the write cache before being flushed
+const FLUSH_INTERVAL = 1 * time.Second
+
+type dirtyBlock struct {
+	piece, offset int
+	// Offset in the torrent's byte stream
+	streamOffset int
+	data         []byte
+}
+
+type blockKey struct {
+	piece, offset int
+}
+
+type byStreamOffset []*dirtyBlock
+
+func (b byStreamOffset) Len() int           { return len(b) }
+func (b byStreamOffset) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStreamOffset) Less(i, j int) bool { return b[i].streamOffset < b[j].streamOffset }
+
+// pieceDataWriter is a write-back cache in front of the storage. Blocks
+// are kept in memory until enough have piled up, then adjacent blocks
+// are written out together. WriteBlock blocks while the cache is full.
 type pieceDataWriter struct {
-	PieceDataChan chan *pieceData
-	fs            *torrent.FileStream
-	ErrorChan     chan error
+	storage   storage.Storage
+	pieces    []torrent.Piece
+	ErrorChan chan error
+
+	dirty      map[blockKey]*dirtyBlock
+	dirtySize  int
+	maxDirty   int
+	readCache  *readCache
+	stats      CacheStats
+	lock       sync.Mutex
+	spaceFreed *sync.Cond
+	notify     chan bool
+	quit       chan bool
+	stopOnce   sync.Once
+
+	// Held for writing while a flush moves blocks from the cache to
+	// storage, so reads never miss a block in transit
+	ioLock sync.RWMutex
 }
 
 func newPieceData(p *torrent.Piece) *pieceData {
 	pd := &pieceData{}
 	pd.piece = p
-	pd.blocks = make([]*messages.Piece, 0, pd.numBlocks())
+	pd.data = make([]byte, p.Length)
+	pd.received = bitfield.New(pd.numBlocks())
+	pd.inMemory = make([]bool, pd.numBlocks())
 	return pd
 }
 
 func (pd *pieceData) Done() bool {
-	return len(pd.blocks) == cap(pd.blocks)
+	return pd.numReceived == pd.numBlocks()
 }
 
-func (pd *pieceData) bytes() []byte {
-	data := make([]byte, pd.piece.Length)
+func (pd *pieceData) blockLength(block int) int {
+	if block == pd.numBlocks()-1 && pd.piece.Length%BLOCK_SIZE > 0 {
+		return pd.piece.Length % BLOCK_SIZE
+	}
+	return BLOCK_SIZE
+}
+
+// addBlock stores a received block, returning false if it isn't a
+// block of the piece or was already received
+func (pd *pieceData) addBlock(begin int, data []byte) bool {
+	if begin < 0 || begin%BLOCK_SIZE != 0 || begin >= pd.piece.Length {
+		return false
+	}
+
+	block := begin / BLOCK_SIZE
+	if len(data) != pd.blockLength(block) || pd.received.Get(block) == 1 {
+		return false
+	}
+
+	copy(pd.data[begin:], data)
+	pd.received.Set(block, 1)
+	pd.inMemory[block] = true
+	pd.numReceived++
+
+	return true
+}
+
+// setReceived marks the blocks in the bitmask as already in storage
+func (pd *pieceData) setReceived(bitmask []byte) {
+	pd.received.SetBytes(bitmask)
+	pd.numReceived = pd.received.Count()
+}
+
+// bytes returns the piece's data, reading blocks received before a
+// restart back from r
+func (pd *pieceData) bytes(r pieceReader) ([]byte, error) {
+	for block, ok := range pd.inMemory {
+		if ok {
+			continue
+		}
 
-	for _, block := range pd.blocks {
-		copy(data[block.Begin:], block.Block)
+		begin := block * BLOCK_SIZE
+		buf := pd.data[begin : begin+pd.blockLength(block)]
+		if _, err := r.ReadAt(buf, pd.piece.Index, begin); err != nil {
+			return nil, err
+		}
 	}
 
-	return data
+	return pd.data, nil
 }
 
 func (pd *pieceData) numBlocks() int {
@@ -46,34 +141,277 @@ func (pd *pieceData) numBlocks() int {
 	return numBlocks
 }
 
-func newPieceDataWriter(fs *torrent.FileStream) *pieceDataWriter {
-	return &pieceDataWriter{
-		PieceDataChan: make(chan *pieceData),
-		fs:            fs,
-		ErrorChan:     make(chan error),
+func newPieceDataWriter(store storage.Storage, pieces []torrent.Piece) *pieceDataWriter {
+	w := &pieceDataWriter{
+		storage:   store,
+		pieces:    pieces,
+		ErrorChan: make(chan error, 16),
+		dirty:     make(map[blockKey]*dirtyBlock),
+		maxDirty:  DEFAULT_WRITE_CACHE_SIZE,
+		readCache: newReadCache(DEFAULT_READ_CACHE_SIZE),
+		notify:    make(chan bool, 1),
+		quit:      make(chan bool),
 	}
+	w.spaceFreed = sync.NewCond(&w.lock)
+
+	return w
 }
 
-func (w *pieceDataWriter) Write(p *pieceData) {
-	go func() {
-		w.PieceDataChan <- p
-	}()
+// SetCacheSize changes the size of the write and read caches
+func (w *pieceDataWriter) SetCacheSize(write, read int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.maxDirty = write
+	w.readCache.max = read
+	w.readCache.evict()
+	w.spaceFreed.Broadcast()
 }
 
-func (w *pieceDataWriter) Run() {
-	for {
-		pd, ok := <-w.PieceDataChan
+func (w *pieceDataWriter) Stats() CacheStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	stats := w.stats
+	stats.WriteCacheSize = w.dirtySize
+	stats.WriteCacheMax = w.maxDirty
+	stats.ReadCacheSize = w.readCache.size
+	stats.ReadCacheMax = w.readCache.max
+	return stats
+}
+
+func (w *pieceDataWriter) flushSoon() {
+	select {
+	case w.notify <- true:
+	default:
+	}
+}
+
+// WriteBlock adds a block to the cache, waiting for a flush to make
+// room if the cache is full
+func (w *pieceDataWriter) WriteBlock(piece, offset int, data []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for w.dirtySize > 0 && w.dirtySize+len(data) > w.maxDirty {
+		w.stats.Stalls++
+		w.flushSoon()
+		w.spaceFreed.Wait()
+	}
+
+	key := blockKey{piece, offset}
+	if old, ok := w.dirty[key]; ok {
+		w.dirtySize -= len(old.data)
+	}
+	w.dirty[key] = &dirtyBlock{piece, offset, w.pieces[piece].ByteOffset + offset, data}
+	w.dirtySize += len(data)
+	w.stats.BlocksWritten++
+	w.readCache.remove(piece)
+
+	// Start writing at half capacity so there's room while the flush runs
+	if w.dirtySize >= w.maxDirty/2 {
+		w.flushSoon()
+	}
+}
+
+// Flush writes every cached block to storage
+func (w *pieceDataWriter) Flush() {
+	w.ioLock.Lock()
+	defer w.ioLock.Unlock()
+
+	w.lock.Lock()
+	blocks := make(byStreamOffset, 0, len(w.dirty))
+	for _, b := range w.dirty {
+		blocks = append(blocks, b)
+	}
+	w.dirty = make(map[blockKey]*dirtyBlock)
+	// Pieces read while their blocks were cached are stale without them
+	for _, b := range blocks {
+		w.readCache.remove(b.piece)
+	}
+	w.lock.Unlock()
+
+	if len(blocks) == 0 {
+		return
+	}
+
+	sort.Sort(blocks)
+	writes, flushed, errs := 0, 0, 0
+	for _, run := range coalesce(blocks) {
+		n, err := w.writeRun(run)
+		writes += n
+		for _, b := range run {
+			flushed += len(b.data)
+		}
+
+		if err != nil {
+			errs++
+			select {
+			case w.ErrorChan <- err:
+			default:
+			}
+		}
+	}
+
+	w.lock.Lock()
+	// Blocks that failed to write are dropped too. Their piece may
+	// already have verified from memory, it's the swarm stopping with
+	// ERROR on ErrorChan that keeps it from carrying on regardless
+	w.dirtySize -= flushed
+	w.stats.Flushes++
+	w.stats.Writes += writes
+	w.stats.BytesFlushed += flushed
+	w.stats.WriteErrors += errs
+	w.spaceFreed.Broadcast()
+	w.lock.Unlock()
+}
+
+// coalesce splits blocks sorted by stream offset into runs of adjacent blocks
+func coalesce(blocks []*dirtyBlock) [][]*dirtyBlock {
+	var runs [][]*dirtyBlock
+	start := 0
+	for i := 1; i <= len(blocks); i++ {
+		if i < len(blocks) {
+			prev := blocks[i-1]
+			if prev.streamOffset+len(prev.data) == blocks[i].streamOffset {
+				continue
+			}
+		}
+
+		runs = append(runs, blocks[start:i])
+		start = i
+	}
+
+	return runs
+}
+
+func joinBlocks(run []*dirtyBlock) []byte {
+	if len(run) == 1 {
+		return run[0].data
+	}
+
+	var buf []byte
+	for _, b := range run {
+		buf = append(buf, b.data...)
+	}
+	return buf
+}
+
+// writeRun writes a run of adjacent blocks, in a single write if the
+// storage can write across pieces or one write per piece otherwise.
+// It returns the number of writes made.
+func (w *pieceDataWriter) writeRun(run []*dirtyBlock) (int, error) {
+	if sw, ok := w.storage.(storage.StreamWriter); ok && run[0].piece != run[len(run)-1].piece {
+		_, err := sw.WriteStreamAt(joinBlocks(run), run[0].streamOffset)
+		return 1, err
+	}
+
+	writes := 0
+	start := 0
+	for i := 1; i <= len(run); i++ {
+		if i < len(run) && run[i].piece == run[start].piece {
+			continue
+		}
+
+		writes++
+		if _, err := w.storage.WriteAt(joinBlocks(run[start:i]), run[start].piece, run[start].offset); err != nil {
+			return writes, err
+		}
+		start = i
+	}
+
+	return writes, nil
+}
+
+// overlay copies the cached blocks overlapping [offset, offset+len(p))
+// into p and returns the number of bytes copied. Must be called with
+// the lock held.
+func (w *pieceDataWriter) overlay(p []byte, piece, offset int) int {
+	copied := 0
+	first := offset / BLOCK_SIZE * BLOCK_SIZE
+	for begin := first; begin < offset+len(p); begin += BLOCK_SIZE {
+		b, ok := w.dirty[blockKey{piece, begin}]
 		if !ok {
-			break
+			continue
 		}
 
-		b := torrent.Block{
-			Offset: pd.piece.ByteOffset,
-			Length: pd.piece.Length,
+		from, to := begin, begin+len(b.data)
+		if from < offset {
+			from = offset
+		}
+		if to > offset+len(p) {
+			to = offset + len(p)
 		}
+		if from < to {
+			copied += copy(p[from-offset:to-offset], b.data[from-begin:])
+		}
+	}
+
+	return copied
+}
+
+// ReadAt reads from the write cache, the read cache and then the storage.
+// Whole pieces are read into the read cache so uploads of the following
+// blocks don't touch the disk.
+func (w *pieceDataWriter) ReadAt(p []byte, piece, offset int) (int, error) {
+	if piece < 0 || piece >= len(w.pieces) || offset < 0 || offset+len(p) > w.pieces[piece].Length {
+		return 0, storage.InvalidOffsetError
+	}
+
+	w.ioLock.RLock()
+	defer w.ioLock.RUnlock()
+
+	w.lock.Lock()
+	if w.overlay(p, piece, offset) == len(p) {
+		w.stats.ReadHits++
+		w.lock.Unlock()
+		return len(p), nil
+	}
 
-		if err := w.fs.WriteBlock(b, pd.bytes()); err != nil {
-			w.ErrorChan <- err
+	if data := w.readCache.get(piece); data != nil {
+		copy(p, data[offset:])
+		w.overlay(p, piece, offset)
+		w.stats.ReadHits++
+		w.lock.Unlock()
+		return len(p), nil
+	}
+	w.stats.ReadMisses++
+	w.lock.Unlock()
+
+	data := make([]byte, w.pieces[piece].Length)
+	if _, err := w.storage.ReadAt(data, piece, 0); err == nil {
+		copy(p, data[offset:])
+		w.lock.Lock()
+		w.readCache.add(piece, data)
+		w.lock.Unlock()
+	} else if _, err := w.storage.ReadAt(p, piece, offset); err != nil {
+		// Pieces that aren't fully written can still have the range on disk
+		return 0, err
+	}
+
+	w.lock.Lock()
+	w.overlay(p, piece, offset)
+	w.lock.Unlock()
+
+	return len(p), nil
+}
+
+func (w *pieceDataWriter) Run() {
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.notify:
+		case <-ticker.C:
+		case <-w.quit:
+			return
 		}
+		w.Flush()
 	}
 }
+
+// Stop makes Run return, it's safe to call even if Run was never started
+func (w *pieceDataWriter) Stop() {
+	w.stopOnce.Do(func() { close(w.quit) })
+}
@@ -0,0 +1,276 @@
+package swarm
+
+import (
+	"sort"
+
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+type Priority int
+
+const (
+	PRIORITY_SKIP Priority = iota
+	PRIORITY_LOW
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+
+	// Pieces in a reader's readahead window beat every file priority
+	priorityReadahead
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PRIORITY_SKIP:
+		return "skip"
+	case PRIORITY_LOW:
+		return "low"
+	case PRIORITY_NORMAL:
+		return "normal"
+	case PRIORITY_HIGH:
+		return "high"
+	case priorityReadahead:
+		return "readahead"
+	}
+	return "unknown"
+}
+
+// fileSpan is the part of a piece that falls within a file
+type fileSpan struct {
+	fileIndex int
+	length    int
+}
+
+func (s *Swarm) initPriorities() {
+	files := s.Torrent.Files()
+	s.filePriorities = make([]Priority, len(files))
+	for i := range s.filePriorities {
+		s.filePriorities[i] = PRIORITY_NORMAL
+	}
+
+	layout := torrent.NewFileStream("", files)
+	pieces := s.Torrent.GeneratePieces()
+	s.pieceSpans = make([][]fileSpan, len(pieces))
+	for i, p := range pieces {
+		spans := layout.FileSpans(torrent.Block{Offset: p.ByteOffset, Length: p.Length})
+		for fileIndex, length := range spans {
+			if !files[fileIndex].IsPadding() {
+				s.pieceSpans[i] = append(s.pieceSpans[i], fileSpan{fileIndex, length})
+			}
+		}
+	}
+
+	s.partialPieces = make(map[int]bool)
+}
+
+func (s *Swarm) FilePriority(fileIndex int) Priority {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	return s.filePriorities[fileIndex]
+}
+
+// SetFilePriority changes the priority of a file. Skipped files are never
+// requested or created on disk.
+func (s *Swarm) SetFilePriority(fileIndex int, priority Priority) {
+	s.priorityLock.Lock()
+	defer s.priorityLock.Unlock()
+
+	// Skipping or unskipping files can change whether we're upload only
+	defer s.requestMore()
+
+	old := s.filePriorities[fileIndex]
+	s.filePriorities[fileIndex] = priority
+	if skipper, ok := s.storage.(storage.Skipper); ok {
+		skipper.SetSkipped(fileIndex, priority == PRIORITY_SKIP)
+	}
+
+	if old != PRIORITY_SKIP || priority == PRIORITY_SKIP {
+		return
+	}
+
+	// Pieces completed while the file was skipped never had its part
+	// written, so they have to be downloaded again
+	for i := range s.partialPieces {
+		for _, span := range s.pieceSpans[i] {
+			if span.fileIndex == fileIndex {
+				delete(s.partialPieces, i)
+				break
+			}
+		}
+	}
+}
+
+// PiecePriority is the highest priority of the files the piece covers,
+// raised above all of them while the piece is in a reader's readahead window
+func (s *Swarm) PiecePriority(pieceIndex int) Priority {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	return s.piecePriority(pieceIndex)
+}
+
+func (s *Swarm) piecePriority(pieceIndex int) Priority {
+	for _, w := range s.readerWindows {
+		if w.contains(pieceIndex) {
+			return priorityReadahead
+		}
+	}
+
+	priority := PRIORITY_SKIP
+	for _, span := range s.pieceSpans[pieceIndex] {
+		if p := s.filePriorities[span.fileIndex]; p > priority {
+			priority = p
+		}
+	}
+
+	return priority
+}
+
+// pieceSkipsFiles reports whether part of the piece belongs to a skipped file
+func (s *Swarm) pieceSkipsFiles(pieceIndex int) bool {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	return s.skipsFiles(pieceIndex)
+}
+
+// skipsFiles is pieceSkipsFiles for callers holding priorityLock
+func (s *Swarm) skipsFiles(pieceIndex int) bool {
+	for _, span := range s.pieceSpans[pieceIndex] {
+		if s.filePriorities[span.fileIndex] == PRIORITY_SKIP {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Swarm) havePiece(pieceIndex int) bool {
+	return s.Stats.Pieces.Get(pieceIndex) == 1 || s.partialPieces[pieceIndex]
+}
+
+// BytesWanted is the total size of all files that aren't skipped
+func (s *Swarm) BytesWanted() int {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	total := 0
+	for i, f := range s.Torrent.Files() {
+		if !f.IsPadding() && s.filePriorities[i] != PRIORITY_SKIP {
+			total += f.Length
+		}
+	}
+
+	return total
+}
+
+// BytesCompleted is the number of bytes of wanted files already verified
+func (s *Swarm) BytesCompleted() int {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	total := 0
+	for i, spans := range s.pieceSpans {
+		if !s.havePiece(i) {
+			continue
+		}
+
+		for _, span := range spans {
+			if s.filePriorities[span.fileIndex] != PRIORITY_SKIP {
+				total += span.length
+			}
+		}
+	}
+
+	return total
+}
+
+// FileBytesCompleted is how much of a file has been downloaded
+func (s *Swarm) FileBytesCompleted(fileIndex int) int {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	total := 0
+	for i, spans := range s.pieceSpans {
+		if !s.havePiece(i) {
+			continue
+		}
+
+		for _, span := range spans {
+			if span.fileIndex == fileIndex {
+				total += span.length
+			}
+		}
+	}
+
+	return total
+}
+
+// Complete reports whether every wanted file has been downloaded
+func (s *Swarm) Complete() bool {
+	return s.BytesCompleted() == s.BytesWanted()
+}
+
+type piecePick struct {
+	index    int
+	priority Priority
+	seen     int
+}
+
+type piecePicks []piecePick
+
+func (p piecePicks) Len() int      { return len(p) }
+func (p piecePicks) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Highest priority first, rarest first within a priority.
+// Readahead pieces are picked in order since they are read in order.
+func (p piecePicks) Less(i, j int) bool {
+	if p[i].priority != p[j].priority {
+		return p[i].priority > p[j].priority
+	}
+	if p[i].priority == priorityReadahead {
+		return p[i].index < p[j].index
+	}
+	if p[i].seen != p[j].seen {
+		return p[i].seen < p[j].seen
+	}
+	return p[i].index < p[j].index
+}
+
+// pickPieces returns the pieces to request from a peer, in request order
+func (s *Swarm) pickPieces(p *Peer) []int {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	seen := s.PiecesSeen()
+
+	var picks piecePicks
+	for i := range s.pieceSpans {
+		if s.havePiece(i) || p.Pieces.Get(i) == 0 {
+			continue
+		}
+
+		// Pieces pending from before a restart are picked again, only
+		// their missing blocks are requested
+		if _, ok := s.requestedPieces[i]; ok {
+			continue
+		}
+
+		priority := s.piecePriority(i)
+		if priority == PRIORITY_SKIP {
+			continue
+		}
+
+		picks = append(picks, piecePick{i, priority, seen[i]})
+	}
+
+	sort.Sort(picks)
+
+	indexes := make([]int, len(picks))
+	for i := range picks {
+		indexes[i] = picks[i].index
+	}
+
+	return indexes
+}
@@ -0,0 +1,149 @@
+package swarm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/bitfield"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestSwarm returns a swarm for a torrent with files of 20000, 20000
+// and 10000 bytes spread over 4 pieces
+func newTestSwarm() *Swarm {
+	root, err := ioutil.TempDir("", "yabtc-swarm")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "content")
+	os.Mkdir(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte{1}, 20000), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), bytes.Repeat([]byte{2}, 20000), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "c"), bytes.Repeat([]byte{3}, 10000), 0644)
+
+	t, err := torrent.Create(dir, torrent.CreateOptions{PieceLength: BLOCK_SIZE, V1: true})
+	if err != nil {
+		panic(err)
+	}
+
+	return New(t, storage.NewMemoryStorage(t))
+}
+
+func newTestPeer(numPieces int, pieces ...int) *Peer {
+	p := &Peer{Pieces: bitfield.New(numPieces)}
+	for _, i := range pieces {
+		p.Pieces.Set(i, 1)
+	}
+	return p
+}
+
+func newTestSeed(numPieces int) *Peer {
+	p := newTestPeer(numPieces)
+	for i := 0; i < numPieces; i++ {
+		p.Pieces.Set(i, 1)
+	}
+	return p
+}
+
+func TestFilePriorities(t *testing.T) {
+	Convey("When no priorities have been set", t, func() {
+		s := newTestSwarm()
+		seed := newTestSeed(4)
+
+		Convey("Every piece should be picked in order", func() {
+			So(s.pickPieces(seed), ShouldResemble, []int{0, 1, 2, 3})
+		})
+
+		Convey("Every byte should be wanted", func() {
+			So(s.BytesWanted(), ShouldEqual, 50000)
+			So(s.BytesCompleted(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("When a file is skipped", t, func() {
+		s := newTestSwarm()
+		seed := newTestSeed(4)
+		s.SetFilePriority(0, PRIORITY_SKIP)
+
+		Convey("Pieces only covering that file should not be picked", func() {
+			So(s.pickPieces(seed), ShouldResemble, []int{1, 2, 3})
+		})
+
+		Convey("Completion should only count wanted bytes", func() {
+			So(s.BytesWanted(), ShouldEqual, 30000)
+
+			s.Stats.Pieces.Set(2, 1)
+			So(s.BytesCompleted(), ShouldEqual, BLOCK_SIZE)
+		})
+
+		Convey("Shared pieces should be partial until the file is wanted again", func() {
+			So(s.pieceSkipsFiles(1), ShouldBeTrue)
+			s.setHave(1)
+			So(s.pickPieces(seed), ShouldResemble, []int{2, 3})
+			So(s.BytesCompleted(), ShouldEqual, 2*BLOCK_SIZE-20000)
+
+			s.SetFilePriority(0, PRIORITY_LOW)
+			So(s.pickPieces(seed), ShouldResemble, []int{1, 2, 3, 0})
+		})
+	})
+
+	Convey("When pieces complete while completion is being read", t, func() {
+		s := newTestSwarm()
+		content := append(append(bytes.Repeat([]byte{1}, 20000), bytes.Repeat([]byte{2}, 20000)...), bytes.Repeat([]byte{3}, 10000)...)
+
+		done := make(chan bool)
+		go func() {
+			for off := 0; off < len(content); off += BLOCK_SIZE {
+				end := off + BLOCK_SIZE
+				if end > len(content) {
+					end = len(content)
+				}
+				s.handleNewBlock(messages.NewPiece(off/BLOCK_SIZE, 0, content[off:end]))
+			}
+			close(done)
+		}()
+		for completing := true; completing; {
+			select {
+			case <-done:
+				completing = false
+			default:
+				s.BytesCompleted()
+			}
+		}
+
+		Convey("Every piece should be counted", func() {
+			So(s.BytesCompleted(), ShouldEqual, len(content))
+		})
+	})
+
+	Convey("When a file has a high priority", t, func() {
+		s := newTestSwarm()
+		seed := newTestSeed(4)
+		s.SetFilePriority(2, PRIORITY_HIGH)
+		s.SetFilePriority(0, PRIORITY_LOW)
+
+		Convey("Its pieces should be picked first and low priority pieces last", func() {
+			So(s.PiecePriority(1), ShouldEqual, PRIORITY_NORMAL)
+			So(s.pickPieces(seed), ShouldResemble, []int{2, 3, 1, 0})
+		})
+	})
+
+	Convey("When a piece is rarer than another of the same priority", t, func() {
+		s := newTestSwarm()
+		seed := newTestSeed(4)
+		other := newTestPeer(4, 0, 1, 3)
+		s.Peers = []*Peer{seed, other}
+
+		Convey("It should be picked first", func() {
+			So(s.pickPieces(seed), ShouldResemble, []int{2, 0, 1, 3})
+		})
+	})
+}
@@ -0,0 +1,248 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// Bytes past the read position whose pieces are fetched first
+const DEFAULT_READAHEAD = 4 << 20
+
+var ReaderClosedError = errors.New("reader is closed")
+
+var FileSkippedError = errors.New("file is skipped")
+
+var _ io.ReadSeekCloser = (*Reader)(nil)
+
+// pieceWindow is a range of pieces [first, last]
+type pieceWindow struct {
+	first, last int
+}
+
+func (w pieceWindow) contains(index int) bool {
+	return index >= w.first && index <= w.last
+}
+
+// File is a file within a swarm's torrent
+type File struct {
+	torrent.File
+	Index int
+
+	swarm *Swarm
+	// Offset of the file within the torrent's byte stream
+	offset int
+}
+
+// File returns the file at index i of the torrent's file list
+func (s *Swarm) File(i int) *File {
+	files := s.Torrent.Files()
+
+	offset := 0
+	for j := 0; j < i; j++ {
+		offset += files[j].Length
+	}
+
+	return &File{files[i], i, s, offset}
+}
+
+// Reader reads a file while it downloads. Reads block until the pieces
+// they cover are on disk.
+type Reader struct {
+	file      *File
+	ctx       context.Context
+	pos       int
+	readahead int
+	closed    chan bool
+	closeOnce sync.Once
+	lock      sync.Mutex
+}
+
+func (f *File) NewReader() *Reader {
+	return f.NewReaderContext(context.Background())
+}
+
+// NewReaderContext returns a reader whose blocked reads return
+// the context's error once it is done
+func (f *File) NewReaderContext(ctx context.Context) *Reader {
+	r := &Reader{
+		file:      f,
+		ctx:       ctx,
+		readahead: DEFAULT_READAHEAD,
+		closed:    make(chan bool),
+	}
+
+	r.updateWindow()
+	return r
+}
+
+// SetReadahead sets how many bytes past the read position are prioritized
+func (r *Reader) SetReadahead(n int) {
+	r.lock.Lock()
+	r.readahead = n
+	r.lock.Unlock()
+
+	r.updateWindow()
+}
+
+func (r *Reader) pieceIndex(pos int) int {
+	return (r.file.offset + pos) / r.file.swarm.Torrent.PieceSize()
+}
+
+func (r *Reader) updateWindow() {
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+
+	r.lock.Lock()
+	pos, readahead := r.pos, r.readahead
+	r.lock.Unlock()
+
+	s := r.file.swarm
+	if r.file.Length == 0 || pos >= r.file.Length {
+		s.removeReaderWindow(r)
+		return
+	}
+
+	end := pos + readahead
+	if end >= r.file.Length {
+		end = r.file.Length - 1
+	}
+
+	s.setReaderWindow(r, pieceWindow{r.pieceIndex(pos), r.pieceIndex(end)})
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, ReaderClosedError
+	default:
+	}
+
+	s := r.file.swarm
+	if s.FilePriority(r.file.Index) == PRIORITY_SKIP {
+		return 0, FileSkippedError
+	}
+
+	r.lock.Lock()
+	pos := r.pos
+	r.lock.Unlock()
+
+	if pos >= r.file.Length {
+		return 0, io.EOF
+	}
+
+	// Only read up to the end of the piece so data is returned
+	// as soon as each piece arrives
+	index := r.pieceIndex(pos)
+	piece := s.Torrent.GeneratePieces()[index]
+	n := len(p)
+	if left := r.file.Length - pos; n > left {
+		n = left
+	}
+	if left := piece.ByteOffset + piece.Length - (r.file.offset + pos); n > left {
+		n = left
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	if err := s.waitReadable(r.ctx, r.closed, index); err != nil {
+		return 0, err
+	}
+
+	offset := r.file.offset + pos - piece.ByteOffset
+	if _, err := s.ReadAt(p[:n], index, offset); err != nil {
+		return 0, err
+	}
+
+	r.lock.Lock()
+	r.pos = pos + n
+	r.lock.Unlock()
+
+	r.updateWindow()
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.lock.Lock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(r.pos) + offset
+	case io.SeekEnd:
+		pos = int64(r.file.Length) + offset
+	default:
+		r.lock.Unlock()
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		r.lock.Unlock()
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = int(pos)
+	r.lock.Unlock()
+
+	r.updateWindow()
+	return pos, nil
+}
+
+// Close unblocks any pending read and drops the reader's readahead window
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.file.swarm.removeReaderWindow(r)
+	})
+
+	return nil
+}
+
+func (s *Swarm) setReaderWindow(r *Reader, w pieceWindow) {
+	s.priorityLock.Lock()
+	old, ok := s.readerWindows[r]
+	s.readerWindows[r] = w
+	s.priorityLock.Unlock()
+
+	if !ok || old != w {
+		s.requestMore()
+	}
+}
+
+func (s *Swarm) removeReaderWindow(r *Reader) {
+	s.priorityLock.Lock()
+	delete(s.readerWindows, r)
+	s.priorityLock.Unlock()
+}
+
+// waitReadable blocks until the piece is on disk, the context is done
+// or closed is closed
+func (s *Swarm) waitReadable(ctx context.Context, closed chan bool, index int) error {
+	for {
+		s.readableLock.Lock()
+		if s.readable.Get(index) == 1 {
+			s.readableLock.Unlock()
+			return nil
+		}
+		changed := s.readableChanged
+		s.readableLock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-closed:
+			return ReaderClosedError
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeTestPiece stores the test torrent's piece on disk and marks it readable
+func writeTestPiece(s *Swarm, index int) {
+	content := append(bytes.Repeat([]byte{1}, 20000), bytes.Repeat([]byte{2}, 20000)...)
+	content = append(content, bytes.Repeat([]byte{3}, 10000)...)
+
+	p := s.Torrent.GeneratePieces()[index]
+	if _, err := s.storage.WriteAt(content[p.ByteOffset:p.ByteOffset+p.Length], index, 0); err != nil {
+		panic(err)
+	}
+
+	s.markReadable(index)
+}
+
+func TestReader(t *testing.T) {
+	Convey("When reading a file whose pieces are on disk", t, func() {
+		s := newTestSwarm()
+
+		for i := 0; i < 4; i++ {
+			writeTestPiece(s, i)
+		}
+
+		r := s.File(1).NewReader()
+		defer r.Close()
+
+		Convey("It should return the file's data", func() {
+			data, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(data, ShouldResemble, bytes.Repeat([]byte{2}, 20000))
+		})
+
+		Convey("It should read from the seeked position", func() {
+			pos, err := r.Seek(-10, io.SeekEnd)
+			So(err, ShouldBeNil)
+			So(pos, ShouldEqual, 19990)
+
+			data, _ := ioutil.ReadAll(r)
+			So(len(data), ShouldEqual, 10)
+		})
+	})
+
+	Convey("When reading a file that is still downloading", t, func() {
+		s := newTestSwarm()
+
+		r := s.File(2).NewReader()
+		defer r.Close()
+
+		Convey("Its pieces should be prioritized up to the readahead window", func() {
+			r.SetReadahead(0)
+			So(s.PiecePriority(2), ShouldEqual, priorityReadahead)
+			So(s.PiecePriority(3), ShouldEqual, PRIORITY_NORMAL)
+
+			r.SetReadahead(DEFAULT_READAHEAD)
+			So(s.PiecePriority(3), ShouldEqual, priorityReadahead)
+		})
+
+		Convey("Reads should block until the piece is written", func() {
+			done := make(chan []byte)
+			go func() {
+				buf := make([]byte, 100)
+				n, _ := r.Read(buf)
+				done <- buf[:n]
+			}()
+
+			select {
+			case <-done:
+				t.Error("read did not block")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			writeTestPiece(s, 2)
+			So(<-done, ShouldResemble, bytes.Repeat([]byte{3}, 100))
+		})
+
+		Convey("Several readers should be able to wait on the same file", func() {
+			other := s.File(2).NewReader()
+			defer other.Close()
+
+			done := make(chan error, 2)
+			for _, reader := range []*Reader{r, other} {
+				go func(reader *Reader) {
+					_, err := reader.Read(make([]byte, 10))
+					done <- err
+				}(reader)
+			}
+
+			writeTestPiece(s, 2)
+			So(<-done, ShouldBeNil)
+			So(<-done, ShouldBeNil)
+		})
+
+		Convey("A cancelled context should unblock the read", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cr := s.File(2).NewReaderContext(ctx)
+			defer cr.Close()
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			}()
+
+			_, err := cr.Read(make([]byte, 10))
+			So(err, ShouldEqual, context.Canceled)
+		})
+
+		Convey("Closing the reader should unblock the read and drop its window", func() {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				r.Close()
+			}()
+
+			_, err := r.Read(make([]byte, 10))
+			So(err, ShouldEqual, ReaderClosedError)
+			So(s.PiecePriority(3), ShouldEqual, PRIORITY_NORMAL)
+		})
+	})
+
+	Convey("When reading a skipped file", t, func() {
+		s := newTestSwarm()
+		s.SetFilePriority(0, PRIORITY_SKIP)
+		r := s.File(0).NewReader()
+
+		Convey("It should fail", func() {
+			_, err := r.Read(make([]byte, 10))
+			So(err, ShouldEqual, FileSkippedError)
+		})
+	})
+}
@@ -0,0 +1,41 @@
+package swarm
+
+import "time"
+
+// pieceRequest is a piece requested from a peer. The piece may be
+// requested from another peer once the request is released.
+type pieceRequest struct {
+	peer *Peer
+	at   time.Time
+}
+
+// releaseRequests forgets the pieces requested from p, so they're picked
+// again. Blocks already received are kept.
+func (s *Swarm) releaseRequests(p *Peer) {
+	released := false
+	for i, r := range s.requestedPieces {
+		if r.peer == p {
+			delete(s.requestedPieces, i)
+			released = true
+		}
+	}
+	if released {
+		s.requestMore()
+	}
+}
+
+// expireRequests forgets the pieces requested more than REQUEST_TIMEOUT
+// ago
+func (s *Swarm) expireRequests() {
+	now := s.clock()
+	expired := false
+	for i, r := range s.requestedPieces {
+		if now.Sub(r.at) > REQUEST_TIMEOUT {
+			delete(s.requestedPieces, i)
+			expired = true
+		}
+	}
+	if expired {
+		s.requestMore()
+	}
+}
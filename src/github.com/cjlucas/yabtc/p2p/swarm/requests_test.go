@@ -0,0 +1,88 @@
+package swarm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newRequestingPeer returns an unchoked seed whose requests are kept
+// in its write channel
+func newRequestingPeer(numPieces int) *Peer {
+	p := newTestSeed(numPieces)
+	p.Peer = &p2p.Peer{WriteChan: make(chan messages.Message, 100)}
+	return p
+}
+
+func TestPieceRequests(t *testing.T) {
+	Convey("Given a peer that was sent requests", t, func() {
+		s := newTestSwarm()
+		now := time.Now()
+		s.clock = func() time.Time { return now }
+		p := newRequestingPeer(4)
+		s.Peers = append(s.Peers, p)
+		s.monitorSwarm()
+		So(s.requestedPieces, ShouldHaveLength, 4)
+
+		Convey("When it chokes us mid-piece", func() {
+			s.handleNewBlock(messages.NewPiece(0, 0, make([]byte, 100)))
+			p.Choked = true
+			s.handlePeerMessage(PeerMessage{p, messages.NewChoke()})
+
+			Convey("Its pieces should be released for other peers", func() {
+				So(s.requestedPieces, ShouldBeEmpty)
+				So(len(s.pickNow), ShouldEqual, 1)
+
+				other := newRequestingPeer(4)
+				s.Peers = append(s.Peers, other)
+				s.monitorSwarm()
+				So(s.requestedPieces, ShouldHaveLength, 4)
+				So(s.requestedPieces[0].peer, ShouldEqual, other)
+			})
+		})
+
+		Convey("When a piece completes", func() {
+			s.handleNewBlock(messages.NewPiece(0, 0, bytes.Repeat([]byte{1}, BLOCK_SIZE)))
+
+			Convey("More should be requested without waiting for the tick", func() {
+				So(s.havePiece(0), ShouldBeTrue)
+				So(s.requestedPieces, ShouldHaveLength, 3)
+				So(len(s.pickNow), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When it sends a block of a piece that doesn't exist", func() {
+			Convey("It should be ignored", func() {
+				So(func() { s.handleNewBlock(messages.NewPiece(-1, 0, make([]byte, 100))) }, ShouldNotPanic)
+				So(func() { s.handleNewBlock(messages.NewPiece(4, 0, make([]byte, 100))) }, ShouldNotPanic)
+				So(s.pendingPieces, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When it disconnects", func() {
+			s.handlePeerMessage(PeerMessage{p, nil})
+
+			Convey("It should be dropped along with its requests", func() {
+				So(s.Peers, ShouldBeEmpty)
+				So(s.requestedPieces, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When it never answers", func() {
+			now = now.Add(REQUEST_TIMEOUT + time.Second)
+
+			Convey("The pieces should be requested again", func() {
+				for len(p.Peer.WriteChan) > 0 {
+					<-p.Peer.WriteChan
+				}
+				s.monitorSwarm()
+				So(s.requestedPieces, ShouldHaveLength, 4)
+				So(len(p.Peer.WriteChan), ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+}
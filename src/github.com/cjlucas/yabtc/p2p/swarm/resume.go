@@ -0,0 +1,229 @@
+package swarm
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/zeebo/bencode"
+)
+
+var ResumeDataMismatchError = errors.New("resume data does not match torrent")
+
+// UnfinishedPiece is a piece with some of its blocks already in storage
+type UnfinishedPiece struct {
+	Index int `bencode:"piece"`
+	// Bitmask of the blocks written, in the same layout as a bitfield
+	Blocks []byte `bencode:"blocks"`
+}
+
+// ResumeData is what a swarm needs to pick up where it left off
+// without checking every piece again
+type ResumeData struct {
+	InfoHash       []byte            `bencode:"info-hash"`
+	Root           string            `bencode:"root"`
+	Pieces         []byte            `bencode:"pieces"`
+	Unfinished     []UnfinishedPiece `bencode:"unfinished"`
+	FilePriorities []int             `bencode:"file-priority"`
+	// Lifetime transfer totals in bytes, and seeding time in seconds
+	Downloaded  int64    `bencode:"downloaded"`
+	Uploaded    int64    `bencode:"uploaded"`
+	SeedingTime int64    `bencode:"seeding-time"`
+	Labels      []string `bencode:"labels,omitempty"`
+	Trackers    []string `bencode:"trackers,omitempty"`
+}
+
+func ParseResumeData(b []byte) (*ResumeData, error) {
+	var rd ResumeData
+	if err := bencode.DecodeBytes(b, &rd); err != nil {
+		return nil, err
+	}
+
+	return &rd, nil
+}
+
+func LoadResumeDataFile(fname string) (*ResumeData, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseResumeData(b)
+}
+
+func (rd *ResumeData) Bytes() ([]byte, error) {
+	return bencode.EncodeBytes(rd)
+}
+
+// Save writes the resume data to a temporary file first, so a crash
+// never leaves a truncated file behind
+func (rd *ResumeData) Save(fname string) error {
+	b, err := rd.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fname)
+}
+
+// ResumeData returns a snapshot of the swarm's progress
+func (s *Swarm) ResumeData() *ResumeData {
+	s.runLock.Lock()
+	running, done := s.running, s.done
+	s.runLock.Unlock()
+
+	if running {
+		c := make(chan *ResumeData)
+		select {
+		case s.resumeDataChan <- c:
+			return <-c
+		case <-done:
+			// Stopped while we were asking
+		}
+	}
+
+	return s.resumeData()
+}
+
+// Must be called from the Run goroutine, or while the swarm isn't running
+func (s *Swarm) resumeData() *ResumeData {
+	// Progress is only saved for blocks that made it to storage
+	s.pieceWriter.Flush()
+
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	rd := &ResumeData{InfoHash: s.Torrent.InfoHash()}
+	if fs, ok := s.storage.(*storage.FileStorage); ok {
+		rd.Root = fs.Root()
+	}
+
+	have := s.Stats.Pieces.Copy()
+	for i := range s.partialPieces {
+		have.Set(i, 1)
+	}
+	rd.Pieces = have.Bytes()
+
+	for i := 0; i < s.Torrent.NumPieces(); i++ {
+		if pd, ok := s.pendingPieces[i]; ok {
+			rd.Unfinished = append(rd.Unfinished, UnfinishedPiece{i, pd.received.Bytes()})
+		}
+	}
+
+	rd.FilePriorities = make([]int, len(s.filePriorities))
+	for i, p := range s.filePriorities {
+		rd.FilePriorities[i] = int(p)
+	}
+
+	stats := s.StatsSnapshot()
+	rd.Downloaded = stats.TotalDownloaded
+	rd.Uploaded = stats.TotalUploaded
+	rd.SeedingTime = int64(stats.SeedingTime / time.Second)
+	rd.Labels = s.Labels()
+	rd.Trackers = s.Trackers()
+
+	return rd
+}
+
+func (s *Swarm) matchesInfoHash(infoHash []byte) bool {
+	for _, h := range s.Torrent.InfoHashes() {
+		if bytes.Equal(h, infoHash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadResumeData restores the swarm's progress. Only the blocks missing
+// from unfinished pieces will be requested. Must be called before Run.
+func (s *Swarm) LoadResumeData(rd *ResumeData) error {
+	numPieces := s.Torrent.NumPieces()
+	have := s.Stats.Pieces.Copy()
+	if !s.matchesInfoHash(rd.InfoHash) ||
+		len(rd.Pieces) != len(have.Bytes()) ||
+		len(rd.FilePriorities) != len(s.filePriorities) {
+		return ResumeDataMismatchError
+	}
+
+	pieces := s.Torrent.GeneratePieces()
+	for _, u := range rd.Unfinished {
+		if u.Index < 0 || u.Index >= numPieces {
+			return ResumeDataMismatchError
+		}
+		if len(u.Blocks) != len(newPieceData(&pieces[u.Index]).received.Bytes()) {
+			return ResumeDataMismatchError
+		}
+	}
+
+	for i, p := range rd.FilePriorities {
+		s.SetFilePriority(i, Priority(p))
+	}
+
+	s.statsLock.Lock()
+	s.Stats.TotalDownloaded = rd.Downloaded
+	s.Stats.TotalUploaded = rd.Uploaded
+	s.Stats.SeedingTime = time.Duration(rd.SeedingTime) * time.Second
+	s.statsLock.Unlock()
+	s.SetLabels(rd.Labels)
+	s.AddTrackers(rd.Trackers)
+
+	have.SetBytes(rd.Pieces)
+	for i := 0; i < numPieces; i++ {
+		if have.Get(i) == 0 {
+			continue
+		}
+
+		s.setHave(i)
+	}
+
+	for _, u := range rd.Unfinished {
+		if have.Get(u.Index) == 1 {
+			continue
+		}
+
+		pd := newPieceData(&pieces[u.Index])
+		pd.setReceived(u.Blocks)
+		if !pd.Done() {
+			s.pendingPieces[u.Index] = pd
+			continue
+		}
+
+		// Every block was written but the piece wasn't verified yet,
+		// if it fails it's downloaded again from scratch
+		data, err := pd.bytes(s.pieceWriter)
+		if err == nil && s.Torrent.VerifyPiece(u.Index, data) {
+			s.setHave(u.Index)
+		}
+	}
+
+	return nil
+}
+
+// setHave marks a verified piece as had. The have bitfield is read from
+// other goroutines under priorityLock.
+func (s *Swarm) setHave(index int) {
+	s.priorityLock.Lock()
+	// A piece that is only partly written can't be served to peers
+	if s.skipsFiles(index) {
+		s.partialPieces[index] = true
+	} else {
+		s.Stats.Pieces.Set(index, 1)
+	}
+	s.priorityLock.Unlock()
+
+	s.markReadable(index)
+}
@@ -0,0 +1,160 @@
+package swarm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var resumeContent = bytes.Repeat([]byte("abcdefghij"), 4000)
+
+// newResumeTorrent returns a torrent of 40000 bytes whose first piece
+// is two blocks long
+func newResumeTorrent() *torrent.MetaData {
+	root, err := ioutil.TempDir("", "yabtc-resume")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	fname := filepath.Join(root, "file")
+	ioutil.WriteFile(fname, resumeContent, 0644)
+
+	t, err := torrent.Create(fname, torrent.CreateOptions{PieceLength: 2 * BLOCK_SIZE, V1: true})
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func TestResumeData(t *testing.T) {
+	Convey("Given a swarm that received the first block of a piece", t, func() {
+		meta := newResumeTorrent()
+		store := storage.NewMemoryStorage(meta)
+		s := New(meta, store)
+		go s.pieceWriter.Run()
+
+		first := resumeContent[:BLOCK_SIZE]
+		second := resumeContent[BLOCK_SIZE : 2*BLOCK_SIZE]
+		s.handleNewBlock(messages.NewPiece(0, 0, first))
+
+		Convey("The block should be written through to storage", func() {
+			s.pieceWriter.Flush()
+
+			buf := make([]byte, BLOCK_SIZE)
+			_, err := store.ReadAt(buf, 0, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, first)
+		})
+
+		Convey("Its resume data should list the piece as unfinished", func() {
+			rd := s.resumeData()
+			So(rd.InfoHash, ShouldResemble, meta.InfoHash())
+			So(rd.Unfinished, ShouldResemble, []UnfinishedPiece{{0, []byte{0x80}}})
+		})
+
+		Convey("A duplicate block should be ignored", func() {
+			s.handleNewBlock(messages.NewPiece(0, 0, first))
+			So(s.pendingPieces[0].numReceived, ShouldEqual, 1)
+		})
+
+		Convey("When the resume data is loaded after a restart", func() {
+			b, err := s.resumeData().Bytes()
+			So(err, ShouldBeNil)
+			rd, err := ParseResumeData(b)
+			So(err, ShouldBeNil)
+
+			restarted := New(meta, store)
+			So(restarted.LoadResumeData(rd), ShouldBeNil)
+			go restarted.pieceWriter.Run()
+
+			Convey("Only the missing block should be requested", func() {
+				peer := &Peer{Peer: &p2p.Peer{WriteChan: make(chan messages.Message, 10)}}
+				peer.Pieces = newTestSeed(2).Pieces
+
+				So(restarted.pickPieces(peer), ShouldResemble, []int{0, 1})
+				restarted.Peers = append(restarted.Peers, peer)
+				restarted.monitorSwarm()
+				close(peer.Peer.WriteChan)
+
+				var requests []*messages.Request
+				for msg := range peer.Peer.WriteChan {
+					requests = append(requests, msg.(*messages.Request))
+				}
+				So(requests, ShouldHaveLength, 2)
+				So(*requests[0], ShouldResemble, *messages.NewRequest(0, BLOCK_SIZE, BLOCK_SIZE))
+				So(requests[1].Index, ShouldEqual, 1)
+			})
+
+			Convey("The piece should verify once the last block arrives", func() {
+				restarted.handleNewBlock(messages.NewPiece(0, BLOCK_SIZE, second))
+				So(restarted.Stats.Pieces.Get(0), ShouldEqual, 1)
+				So(restarted.pendingPieces, ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("When a corrupt piece completes", t, func() {
+		meta := newResumeTorrent()
+		s := New(meta, storage.NewMemoryStorage(meta))
+		go s.pieceWriter.Run()
+
+		s.handleNewBlock(messages.NewPiece(0, 0, resumeContent[:BLOCK_SIZE]))
+		s.handleNewBlock(messages.NewPiece(0, BLOCK_SIZE, make([]byte, BLOCK_SIZE)))
+
+		Convey("It should be dropped so it's downloaded again", func() {
+			So(s.Stats.Pieces.Get(0), ShouldEqual, 0)
+			So(s.pendingPieces, ShouldBeEmpty)
+		})
+	})
+
+	Convey("When resume data was saved for another torrent", t, func() {
+		meta := newResumeTorrent()
+		s := New(meta, storage.NewMemoryStorage(meta))
+		rd := &ResumeData{InfoHash: make([]byte, 20), Pieces: []byte{0}, FilePriorities: []int{2}}
+
+		Convey("It should be rejected", func() {
+			So(s.LoadResumeData(rd), ShouldEqual, ResumeDataMismatchError)
+		})
+	})
+
+	Convey("Given a swarm with trackers merged in", t, func() {
+		meta := newResumeTorrent()
+		meta.Announce = "http://a/announce"
+		s := New(meta, storage.NewMemoryStorage(meta))
+
+		So(s.AddTrackers([]string{"http://a/announce", "udp://b:80", "udp://b:80"}), ShouldResemble, []string{"udp://b:80"})
+		So(s.Trackers(), ShouldResemble, []string{"http://a/announce", "udp://b:80"})
+
+		Convey("They should be kept across restarts", func() {
+			restarted := New(meta, storage.NewMemoryStorage(meta))
+			So(restarted.LoadResumeData(s.resumeData()), ShouldBeNil)
+			So(restarted.Trackers(), ShouldResemble, []string{"http://a/announce", "udp://b:80"})
+		})
+	})
+
+	Convey("When saving resume data to a file", t, func() {
+		dir, _ := ioutil.TempDir("", "yabtc-resume")
+		defer os.RemoveAll(dir)
+
+		fname := filepath.Join(dir, "resume", "torrent.resume")
+		rd := &ResumeData{InfoHash: []byte("hash"), Root: "/downloads", Pieces: []byte{0xc0}}
+		So(rd.Save(fname), ShouldBeNil)
+
+		Convey("It should load back unchanged", func() {
+			loaded, err := LoadResumeDataFile(fname)
+			So(err, ShouldBeNil)
+			So(loaded.Root, ShouldEqual, "/downloads")
+			So(loaded.Pieces, ShouldResemble, []byte{0xc0})
+		})
+	})
+}
@@ -0,0 +1,84 @@
+package swarm
+
+import "time"
+
+func (s *Swarm) addDownloaded(n int) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	s.Stats.Downloaded += n
+	s.Stats.TotalDownloaded += int64(n)
+}
+
+func (s *Swarm) addUploaded(n int) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	s.Stats.Uploaded += n
+	s.Stats.TotalUploaded += int64(n)
+	s.lastUpload = s.clock()
+}
+
+// setSeeding starts or stops counting the time spent seeding
+func (s *Swarm) setSeeding(seeding bool) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	now := s.clock()
+	if seeding && s.seedingSince.IsZero() {
+		s.seedingSince = now
+	} else if !seeding && !s.seedingSince.IsZero() {
+		s.Stats.SeedingTime += now.Sub(s.seedingSince)
+		s.seedingSince = time.Time{}
+	}
+}
+
+// StatsSnapshot returns the transfer counters and can be called from any
+// goroutine. Pieces is left nil, it's only safe to read while the swarm
+// isn't running.
+func (s *Swarm) StatsSnapshot() Stats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	stats := s.Stats
+	stats.Pieces = nil
+	if !s.seedingSince.IsZero() {
+		stats.SeedingTime += s.clock().Sub(s.seedingSince)
+	}
+
+	return stats
+}
+
+// Ratio is the lifetime share ratio. A torrent that was never downloaded,
+// because we created it or already had the data, is measured against
+// the size of the wanted files.
+func (s *Swarm) Ratio() float64 {
+	stats := s.StatsSnapshot()
+	downloaded := stats.TotalDownloaded
+	if downloaded == 0 {
+		downloaded = int64(s.BytesWanted())
+	}
+	if downloaded == 0 {
+		return 0
+	}
+
+	return float64(stats.TotalUploaded) / float64(downloaded)
+}
+
+// IdleTime is how long the swarm has been seeding without uploading
+// anything, zero if it isn't seeding
+func (s *Swarm) IdleTime() time.Duration {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	if s.seedingSince.IsZero() {
+		return 0
+	}
+
+	since := s.seedingSince
+	if s.lastUpload.After(since) {
+		since = s.lastUpload
+	}
+
+	return s.clock().Sub(since)
+}
@@ -0,0 +1,119 @@
+package swarm
+
+import "fmt"
+
+type SwarmStatus int
+
+// Only checking, downloading and seeding swarms are running
+const (
+	// Waiting for a slot in the queue
+	QUEUED SwarmStatus = iota
+	// Verifying the data already in storage
+	CHECKING
+	DOWNLOADING
+	SEEDING
+	PAUSED
+	// Stopped by an error, Err says why
+	ERROR
+)
+
+// The states each state may move to. Every state can be paused or queued,
+// and a swarm only fails while it's running.
+var statusTransitions = map[SwarmStatus][]SwarmStatus{
+	QUEUED:      {CHECKING, DOWNLOADING, SEEDING, PAUSED},
+	CHECKING:    {QUEUED, DOWNLOADING, SEEDING, PAUSED, ERROR},
+	DOWNLOADING: {QUEUED, SEEDING, PAUSED, ERROR},
+	SEEDING:     {QUEUED, DOWNLOADING, PAUSED, ERROR},
+	PAUSED:      {QUEUED, CHECKING, DOWNLOADING, SEEDING},
+	ERROR:       {QUEUED, CHECKING, DOWNLOADING, SEEDING, PAUSED},
+}
+
+func (st SwarmStatus) String() string {
+	switch st {
+	case QUEUED:
+		return "queued"
+	case CHECKING:
+		return "checking"
+	case DOWNLOADING:
+		return "downloading"
+	case SEEDING:
+		return "seeding"
+	case PAUSED:
+		return "paused"
+	case ERROR:
+		return "error"
+	}
+	return "unknown"
+}
+
+// IsRunning reports whether swarms in this state are connected to peers
+// or checking their data
+func (st SwarmStatus) IsRunning() bool {
+	return st == CHECKING || st == DOWNLOADING || st == SEEDING
+}
+
+func (st SwarmStatus) canMoveTo(to SwarmStatus) bool {
+	if st == to {
+		return true
+	}
+
+	for _, next := range statusTransitions[st] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+type StatusTransitionError struct {
+	From SwarmStatus
+	To   SwarmStatus
+}
+
+func (e *StatusTransitionError) Error() string {
+	return fmt.Sprintf("swarm can't go from %s to %s", e.From, e.To)
+}
+
+func (s *Swarm) Status() SwarmStatus {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	return s.status
+}
+
+// Err is the error that stopped the swarm, nil unless its status is ERROR
+func (s *Swarm) Err() error {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	return s.err
+}
+
+// setStatus must be called with runLock held
+func (s *Swarm) setStatus(to SwarmStatus) error {
+	if !s.status.canMoveTo(to) {
+		return &StatusTransitionError{s.status, to}
+	}
+
+	s.status = to
+	if to != ERROR {
+		s.err = nil
+	}
+	return nil
+}
+
+// updateRunningStatus moves a running swarm between downloading and
+// seeding as it becomes upload only or starts wanting pieces again
+func (s *Swarm) updateRunningStatus() {
+	status := DOWNLOADING
+	if s.IsUploadOnly() {
+		status = SEEDING
+	}
+
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.running && s.status != CHECKING {
+		s.setStatus(status)
+	}
+}
@@ -0,0 +1,132 @@
+package swarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/storage"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// closeCountingStorage counts how often the swarm closes its storage
+type closeCountingStorage struct {
+	storage.Storage
+	closed int
+}
+
+func (s *closeCountingStorage) Close() error {
+	s.closed++
+	return s.Storage.Close()
+}
+
+// waitForStatusChange waits for the swarm to leave the given status
+func waitForStatusChange(s *Swarm, status SwarmStatus) SwarmStatus {
+	for i := 0; i < 1000 && s.Status() == status; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return s.Status()
+}
+
+func TestSwarmStatus(t *testing.T) {
+	Convey("Given a new swarm", t, func() {
+		s := newTestSwarm()
+
+		Convey("It should be paused", func() {
+			So(s.Status(), ShouldEqual, PAUSED)
+			So(s.IsRunning(), ShouldBeFalse)
+		})
+
+		Convey("Queueing it should leave it stopped", func() {
+			s.Queue()
+			So(s.Status(), ShouldEqual, QUEUED)
+			So(s.IsRunning(), ShouldBeFalse)
+		})
+
+		Convey("Only running swarms should be able to fail", func() {
+			s.runLock.Lock()
+			err := s.setStatus(ERROR)
+			s.runLock.Unlock()
+
+			So(err, ShouldResemble, &StatusTransitionError{PAUSED, ERROR})
+			So(s.Status(), ShouldEqual, PAUSED)
+		})
+
+		Convey("Starting it should make it download", func() {
+			s.Start()
+			So(s.Status(), ShouldEqual, DOWNLOADING)
+			So(s.IsRunning(), ShouldBeTrue)
+
+			Convey("Queueing it should stop it", func() {
+				s.Queue()
+				So(s.Status(), ShouldEqual, QUEUED)
+				So(s.IsRunning(), ShouldBeFalse)
+			})
+
+			Convey("Stopping it should pause it", func() {
+				s.Stop()
+				So(s.Status(), ShouldEqual, PAUSED)
+				So(s.IsRunning(), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given a running swarm", t, func() {
+		s := newTestSwarm()
+		store := &closeCountingStorage{Storage: s.storage}
+		s.storage = store
+		s.Start()
+
+		Convey("Stopping it should close its storage", func() {
+			s.Stop()
+			So(store.closed, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a seed", t, func() {
+		s := newSeedSwarm()
+
+		Convey("Starting it should make it seed", func() {
+			s.Start()
+			So(waitForStatusChange(s, DOWNLOADING), ShouldEqual, SEEDING)
+
+			Convey("Wanting a piece again should make it download", func() {
+				s.Stop()
+				s.Stats.Pieces = newTestSwarm().Stats.Pieces
+				s.Start()
+				So(waitForStatusChange(s, SEEDING), ShouldEqual, DOWNLOADING)
+				s.Stop()
+			})
+		})
+	})
+
+	Convey("Given a swarm with some pieces in storage", t, func() {
+		s := newTestSwarm()
+		writeTestPiece(s, 0)
+		writeTestPiece(s, 2)
+		// Progress the data doesn't back up
+		s.Stats.Pieces.Set(1, 1)
+
+		Convey("Rechecking it should keep only the pieces that verify", func() {
+			s.Recheck()
+			s.Start()
+			So(waitForStatusChange(s, CHECKING), ShouldEqual, DOWNLOADING)
+			s.Stop()
+
+			So(s.Stats.Pieces.Get(0), ShouldEqual, 1)
+			So(s.Stats.Pieces.Get(1), ShouldEqual, 0)
+			So(s.Stats.Pieces.Get(2), ShouldEqual, 1)
+			So(s.Stats.Pieces.Get(3), ShouldEqual, 0)
+		})
+
+		Convey("It shouldn't be checked again once the check finished", func() {
+			s.Recheck()
+			s.Start()
+			waitForStatusChange(s, CHECKING)
+			s.Stop()
+
+			s.Start()
+			So(s.Status(), ShouldEqual, DOWNLOADING)
+			s.Stop()
+		})
+	})
+}
@@ -0,0 +1,171 @@
+package swarm
+
+import (
+	"errors"
+
+	"github.com/cjlucas/yabtc/p2p/messages"
+)
+
+var NotSeedingError = errors.New("super-seeding requires every piece")
+
+// Super-seeding switches itself off once every piece is held by at
+// least this many peers. A single copy isn't enough: the seed would be
+// back to uploading pieces that only one peer can offer besides it.
+// With three, every piece still has two other sources when a peer
+// holding it leaves.
+const DEFAULT_SUPER_SEED_COPIES = 3
+
+// SetSuperSeeding turns BEP 16 super-seeding on or off. Instead of a
+// full bitfield each peer is offered one rare piece at a time, and only
+// gets another once its piece has been seen at a third peer, so the
+// original seed uploads as few redundant pieces as possible.
+//
+// Only a swarm with every piece can super-seed. Peers connected before
+// it's turned on keep the full bitfield they were sent.
+func (s *Swarm) SetSuperSeeding(on bool) error {
+	s.priorityLock.RLock()
+	complete := s.Stats.Pieces.Count() == s.Torrent.NumPieces()
+	s.priorityLock.RUnlock()
+	if on && !complete {
+		return NotSeedingError
+	}
+
+	s.superSeedLock.Lock()
+	defer s.superSeedLock.Unlock()
+
+	if on == s.superSeeding {
+		return nil
+	}
+
+	if on {
+		s.superSeeding = true
+		s.superSeedOffers = make(map[*Peer]int)
+	} else {
+		s.stopSuperSeeding()
+	}
+
+	return nil
+}
+
+// SetSuperSeedCopies sets how many copies the peers must hold between
+// them before super-seeding switches itself off
+func (s *Swarm) SetSuperSeedCopies(copies int) {
+	s.superSeedLock.Lock()
+	defer s.superSeedLock.Unlock()
+
+	s.superSeedCopies = copies
+}
+
+func (s *Swarm) IsSuperSeeding() bool {
+	s.superSeedLock.Lock()
+	defer s.superSeedLock.Unlock()
+
+	return s.superSeeding
+}
+
+// stopSuperSeeding reveals every piece to the peers that were only
+// offered some. Requires superSeedLock.
+func (s *Swarm) stopSuperSeeding() {
+	for p := range s.superSeedOffers {
+		p.Peer.WriteChan <- messages.NewBitfield(s.Stats.Pieces)
+	}
+
+	s.superSeeding = false
+	s.superSeedOffers = nil
+}
+
+// sendHaves sends a new peer what we have: our bitfield, or a single
+// offered piece if super-seeding
+func (s *Swarm) sendHaves(p *Peer) {
+	s.superSeedLock.Lock()
+	defer s.superSeedLock.Unlock()
+
+	if !s.superSeeding {
+		p.Peer.WriteChan <- messages.NewBitfield(s.Stats.Pieces)
+		return
+	}
+
+	s.superSeedOffers[p] = -1
+	s.offerPiece(p)
+}
+
+// offerPiece announces the rarest piece p doesn't have, preferring pieces
+// not offered to anyone else. Requires superSeedLock.
+func (s *Swarm) offerPiece(p *Peer) {
+	// Nothing offered to a seed would be downloaded
+	if p.isSeed(s.Torrent.NumPieces()) {
+		return
+	}
+
+	offered := make(map[int]bool)
+	for q, i := range s.superSeedOffers {
+		if q != p && i != -1 {
+			offered[i] = true
+		}
+	}
+
+	seen := s.PiecesSeen()
+	best := -1
+	for i := range seen {
+		if p.Pieces.Get(i) == 1 || i == s.superSeedOffers[p] {
+			continue
+		}
+
+		better := best == -1 ||
+			!offered[i] && offered[best] ||
+			offered[i] == offered[best] && seen[i] < seen[best]
+		if better {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		// The peer has every piece but the one it was offered
+		return
+	}
+
+	s.superSeedOffers[p] = best
+	p.Peer.WriteChan <- messages.NewHave(best)
+}
+
+// superSeedPiecesSeen handles a peer announcing it has pieces. Peers
+// offered one of those pieces have passed it on to a third peer and are
+// offered another.
+func (s *Swarm) superSeedPiecesSeen(from *Peer, pieces []int) {
+	s.superSeedLock.Lock()
+	defer s.superSeedLock.Unlock()
+
+	if !s.superSeeding {
+		return
+	}
+
+	for _, index := range pieces {
+		for p, offered := range s.superSeedOffers {
+			if p != from && offered == index {
+				s.offerPiece(p)
+			}
+		}
+	}
+
+	if s.distributedCopies() >= s.superSeedCopies {
+		s.stopSuperSeeding()
+	}
+}
+
+// distributedCopies is the number of complete copies of the torrent the
+// peers have between them
+func (s *Swarm) distributedCopies() int {
+	seen := s.PiecesSeen()
+	if len(seen) == 0 {
+		return 0
+	}
+
+	copies := seen[0]
+	for _, n := range seen[1:] {
+		if n < copies {
+			copies = n
+		}
+	}
+
+	return copies
+}
@@ -0,0 +1,142 @@
+package swarm
+
+import (
+	"testing"
+
+	"github.com/cjlucas/yabtc/bitfield"
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newSeedSwarm() *Swarm {
+	s := newTestSwarm()
+	for i := 0; i < s.Torrent.NumPieces(); i++ {
+		s.Stats.Pieces.Set(i, 1)
+	}
+	return s
+}
+
+// addIdlePeer adds a peer to s without starting its connection
+func addIdlePeer(s *Swarm) *Peer {
+	p := newPeer(p2p.NewPeer("10.0.0.1", 6881))
+	p.Pieces = bitfield.New(s.Torrent.NumPieces())
+	s.insertPeer(p)
+	s.sendHaves(p)
+	return p
+}
+
+func nextWrite(p *Peer) messages.Message {
+	select {
+	case msg := <-p.Peer.WriteChan:
+		return msg
+	default:
+		return nil
+	}
+}
+
+// peerHas has p announce it downloaded a piece
+func peerHas(s *Swarm, p *Peer, index int) {
+	p.Pieces.Set(index, 1)
+	s.handlePeerMessage(PeerMessage{p, messages.NewHave(index)})
+}
+
+func TestSuperSeeding(t *testing.T) {
+	Convey("When a swarm without every piece is set to super-seed", t, func() {
+		s := newTestSwarm()
+
+		Convey("It should refuse", func() {
+			So(s.SetSuperSeeding(true), ShouldEqual, NotSeedingError)
+			So(s.IsSuperSeeding(), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a super-seeding swarm", t, func() {
+		s := newSeedSwarm()
+		So(s.SetSuperSeeding(true), ShouldBeNil)
+
+		a := addIdlePeer(s)
+		b := addIdlePeer(s)
+		c := addIdlePeer(s)
+		offerA := nextWrite(a).(*messages.Have).PieceIndex
+		offerB := nextWrite(b).(*messages.Have).PieceIndex
+		offerC := nextWrite(c).(*messages.Have).PieceIndex
+
+		Convey("Each peer should be offered a different piece instead of a bitfield", func() {
+			So(offerA, ShouldNotEqual, offerB)
+			So(offerA, ShouldNotEqual, offerC)
+			So(offerB, ShouldNotEqual, offerC)
+		})
+
+		Convey("A peer that downloaded its piece should not be offered another yet", func() {
+			peerHas(s, a, offerA)
+			So(nextWrite(a), ShouldBeNil)
+
+			Convey("Until the piece is seen at a third peer", func() {
+				peerHas(s, b, offerA)
+
+				next, ok := nextWrite(a).(*messages.Have)
+				So(ok, ShouldBeTrue)
+				So(next.PieceIndex, ShouldNotEqual, offerA)
+				So(next.PieceIndex, ShouldNotEqual, offerB)
+				So(next.PieceIndex, ShouldNotEqual, offerC)
+				So(nextWrite(b), ShouldBeNil)
+			})
+		})
+
+		Convey("Once the peers have a full copy between them", func() {
+			for i := 0; i < s.Torrent.NumPieces(); i++ {
+				peerHas(s, c, i)
+			}
+
+			Convey("Super-seeding should carry on", func() {
+				So(s.IsSuperSeeding(), ShouldBeTrue)
+			})
+		})
+
+		Convey("Once the peers have enough copies between them", func() {
+			for _, p := range []*Peer{a, b, c} {
+				for i := 0; i < s.Torrent.NumPieces(); i++ {
+					peerHas(s, p, i)
+				}
+			}
+
+			Convey("Super-seeding should switch off and every piece be revealed", func() {
+				So(s.IsSuperSeeding(), ShouldBeFalse)
+				for _, p := range []*Peer{a, b} {
+					var msg messages.Message
+					for m := nextWrite(p); m != nil; m = nextWrite(p) {
+						msg = m
+					}
+					bits, ok := msg.(*messages.Bitfield)
+					So(ok, ShouldBeTrue)
+					So(bits.Bits.Count(), ShouldEqual, s.Torrent.NumPieces())
+				}
+			})
+		})
+	})
+
+	Convey("Given a swarm super-seeding until there's a single copy", t, func() {
+		s := newSeedSwarm()
+		So(s.SetSuperSeeding(true), ShouldBeNil)
+		s.SetSuperSeedCopies(1)
+		p := addIdlePeer(s)
+
+		Convey("It should stop once a peer has every piece", func() {
+			for i := 0; i < s.Torrent.NumPieces(); i++ {
+				peerHas(s, p, i)
+			}
+			So(s.IsSuperSeeding(), ShouldBeFalse)
+		})
+	})
+
+	Convey("When a swarm isn't super-seeding", t, func() {
+		s := newSeedSwarm()
+		p := addIdlePeer(s)
+
+		Convey("New peers should get the full bitfield", func() {
+			_, ok := nextWrite(p).(*messages.Bitfield)
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
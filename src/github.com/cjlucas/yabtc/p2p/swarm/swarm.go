@@ -4,11 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/cjlucas/yabtc/bitfield"
 	"github.com/cjlucas/yabtc/p2p"
 	"github.com/cjlucas/yabtc/p2p/messages"
+	"github.com/cjlucas/yabtc/storage"
 	"github.com/cjlucas/yabtc/torrent"
 )
 
@@ -16,57 +18,206 @@ var TorrentExistsError = errors.New("torrent already exists")
 
 const BLOCK_SIZE = 1 << 14
 
-type SwarmStatus int
+// Limit on pieces requested but not yet received, so priority
+// changes take effect on the next pieces requested
+const MAX_REQUESTED_PIECES = 32
 
-const (
-	STARTED SwarmStatus = iota
-	STOPPED
-)
+// Pieces requested longer ago than this may be requested again, in case
+// the peer dropped the requests without choking us
+const REQUEST_TIMEOUT = 60 * time.Second
 
 type Stats struct {
+	// This session
 	Downloaded int
 	Uploaded   int
 	Pieces     *bitfield.Bitfield
+
+	// Lifetime totals, kept in the resume data
+	TotalDownloaded int64
+	TotalUploaded   int64
+	SeedingTime     time.Duration
 }
 
 type Swarm struct {
 	Torrent           *torrent.MetaData
-	Status            SwarmStatus
 	Peers             []*Peer
 	Stats             Stats
 	peerMessageChan   chan PeerMessage
 	blockReceivedChan chan *messages.Piece
 	pendingPieces     map[int]*pieceData
+	pendingLayers     map[string]*pendingLayer
 	pieceWriter       *pieceDataWriter
+	storage           storage.Storage
+
+	filePriorities []Priority
+	pieceSpans     [][]fileSpan
+	// Verified pieces whose data was only written for the wanted files
+	partialPieces   map[int]bool
+	requestedPieces map[int]*pieceRequest
+	readerWindows   map[*Reader]pieceWindow
+	priorityLock    sync.RWMutex
+	pickNow         chan bool
+
+	// Pieces written to disk, readers block on readableChanged
+	readable        *bitfield.Bitfield
+	readableChanged chan bool
+	readableLock    sync.Mutex
+
+	resumeDataChan chan chan *ResumeData
+
+	// Decides where peers may come from, private torrents only use trackers
+	policy *p2p.PeerPolicy
+	// Peers learned about from other peers are sent here if it's set
+	PeerFoundChan chan<- FoundPeer
+
+	// Upload only swarms are announced as such to peers and trackers,
+	// which get the swarm from UploadOnlyChan when it changes
+	uploadOnly     bool
+	UploadOnlyChan chan<- *Swarm
+
+	// Guards the transfer counters in Stats and the times below
+	statsLock    sync.Mutex
+	seedingSince time.Time
+	lastUpload   time.Time
+	clock        func() time.Time
+
+	// Run returns once it receives from stopChan, closing done
+	running     bool
+	done        chan bool
+	stopChan    chan stopRequest
+	status      SwarmStatus
+	err         error
+	recheck     bool
+	runLock     sync.Mutex
+	startWriter sync.Once
+
+	// Labels are the client's, they're only kept in the resume data
+	labels []string
+	// The torrent's trackers and any merged in from duplicates of it
+	trackers []string
+
+	// Piece offered to each peer while super-seeding, -1 if none
+	superSeeding    bool
+	superSeedOffers map[*Peer]int
+	// Copies the peers must hold between them before super-seeding stops
+	superSeedCopies int
+	superSeedLock   sync.Mutex
 }
 
-func requestPiece(writeChan chan<- messages.Message, p *torrent.Piece) {
+// requestPiece requests the blocks of a piece that haven't been received
+// yet. pd is nil if no block of the piece has been received.
+func requestPiece(writeChan chan<- messages.Message, p *torrent.Piece, pd *pieceData) {
 	bytesLeft := p.Length
 	offset := 0
 
-	for bytesLeft > BLOCK_SIZE {
-		writeChan <- messages.NewRequest(p.Index, offset, BLOCK_SIZE)
-		offset += BLOCK_SIZE
-		bytesLeft -= BLOCK_SIZE
-	}
+	for block := 0; bytesLeft > 0; block++ {
+		length := BLOCK_SIZE
+		if bytesLeft < BLOCK_SIZE {
+			length = bytesLeft
+		}
+
+		if pd == nil || pd.received.Get(block) == 0 {
+			writeChan <- messages.NewRequest(p.Index, offset, length)
+		}
 
-	if bytesLeft > 0 {
-		writeChan <- messages.NewRequest(p.Index, offset, bytesLeft)
+		offset += length
+		bytesLeft -= length
 	}
 }
 
-func New(t *torrent.MetaData) *Swarm {
+func New(t *torrent.MetaData, store storage.Storage) *Swarm {
 	s := &Swarm{}
 	s.Torrent = t
-	s.Status = STOPPED
+	s.storage = store
+	s.status = PAUSED
 	s.peerMessageChan = make(chan PeerMessage, 10000)
 	s.Stats.Pieces = bitfield.New(t.NumPieces())
 	s.blockReceivedChan = make(chan *messages.Piece, 100)
 	s.pendingPieces = make(map[int]*pieceData)
+	s.pendingLayers = make(map[string]*pendingLayer)
+	s.initPendingLayers()
+	s.initPriorities()
+	s.requestedPieces = make(map[int]*pieceRequest)
+	s.readerWindows = make(map[*Reader]pieceWindow)
+	s.pickNow = make(chan bool, 1)
+	s.readable = bitfield.New(t.NumPieces())
+	s.readableChanged = make(chan bool)
+	s.pieceWriter = newPieceDataWriter(store, t.GeneratePieces())
+	s.resumeDataChan = make(chan chan *ResumeData)
+	s.policy = p2p.NewPeerPolicy(t.IsPrivate())
+	s.clock = time.Now
+	s.stopChan = make(chan stopRequest)
+	s.trackers = t.Trackers()
+	s.superSeedCopies = DEFAULT_SUPER_SEED_COPIES
 
 	return s
 }
 
+func (s *Swarm) Storage() storage.Storage {
+	return s.storage
+}
+
+func (s *Swarm) Labels() []string {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	return append([]string(nil), s.labels...)
+}
+
+func (s *Swarm) SetLabels(labels []string) {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	s.labels = append([]string(nil), labels...)
+}
+
+func (s *Swarm) Trackers() []string {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	return append([]string(nil), s.trackers...)
+}
+
+// AddTrackers adds the trackers the swarm doesn't have yet and returns
+// them
+func (s *Swarm) AddTrackers(urls []string) []string {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	var added []string
+	for _, url := range urls {
+		if url != "" && !containsString(s.trackers, url) {
+			s.trackers = append(s.trackers, url)
+			added = append(added, url)
+		}
+	}
+	return added
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadAt reads piece data, including blocks not yet written to storage
+func (s *Swarm) ReadAt(p []byte, piece, offset int) (int, error) {
+	return s.pieceWriter.ReadAt(p, piece, offset)
+}
+
+// SetCacheSize changes the size of the disk write and read caches in bytes.
+// Blocks are received no faster than the write cache can be flushed.
+func (s *Swarm) SetCacheSize(write, read int) {
+	s.pieceWriter.SetCacheSize(write, read)
+}
+
+func (s *Swarm) CacheStats() CacheStats {
+	return s.pieceWriter.Stats()
+}
+
 func (s *Swarm) PiecesSeen() []int {
 	pieces := make([]int, s.Torrent.NumPieces())
 	for _, p := range s.Peers {
@@ -82,30 +233,75 @@ func (s *Swarm) PiecesSeen() []int {
 
 func (s *Swarm) AddPeer(peer *p2p.Peer) {
 	p := newPeer(peer)
-	s.Peers = append(s.Peers, p)
+	s.insertPeer(p)
 	p.Pieces = bitfield.New(s.Torrent.NumPieces())
 	p.BlockReceivedChan = s.blockReceivedChan
 	p.PeerMessageChan = s.peerMessageChan
 	go p.Run()
 
-	p.Peer.WriteChan <- messages.NewBitfield(s.Stats.Pieces)
-	p.Peer.WriteChan <- messages.NewInterested()
+	if p.Peer.SupportsExtensions() {
+		p.Peer.WriteChan <- messages.NewExtendedHandshake(s.extendedHandshake())
+	}
+	s.sendHaves(p)
+	if s.IsUploadOnly() {
+		p.Peer.WriteChan <- messages.NewNotInterested()
+	} else {
+		p.Peer.WriteChan <- messages.NewInterested()
+	}
+}
+
+// LAN peers are kept ahead of everyone else so they are asked first
+func (s *Swarm) insertPeer(p *Peer) {
+	if !p.Peer.IsLocal() {
+		s.Peers = append(s.Peers, p)
+		return
+	}
+
+	i := 0
+	for i < len(s.Peers) && s.Peers[i].Peer.IsLocal() {
+		i++
+	}
+
+	s.Peers = append(s.Peers, nil)
+	copy(s.Peers[i+1:], s.Peers[i:])
+	s.Peers[i] = p
 }
 
 func (s *Swarm) monitorSwarm() {
 	fmt.Println("monitor")
+	s.expireRequests()
 	for _, p := range s.Peers {
+		s.requestPieceLayers(p)
+
 		if p.Choked {
 			continue
 		}
 
-		for i := range s.Torrent.GeneratePieces() {
-			requestPiece(p.Peer.WriteChan, &s.Torrent.GeneratePieces()[i])
+		pieces := s.Torrent.GeneratePieces()
+		for _, i := range s.pickPieces(p) {
+			if len(s.requestedPieces) >= MAX_REQUESTED_PIECES {
+				break
+			}
+
+			s.requestedPieces[i] = &pieceRequest{p, s.clock()}
+			requestPiece(p.Peer.WriteChan, &pieces[i], s.pendingPieces[i])
 		}
 	}
 }
 
 func (s *Swarm) handleNewBlock(msg *messages.Piece) {
+	// The index comes from the peer
+	if msg.Index < 0 || msg.Index >= s.Torrent.NumPieces() {
+		return
+	}
+
+	s.priorityLock.RLock()
+	have := s.havePiece(msg.Index)
+	s.priorityLock.RUnlock()
+	if have {
+		return
+	}
+
 	pd, ok := s.pendingPieces[msg.Index]
 
 	if pd == nil || !ok {
@@ -114,13 +310,36 @@ func (s *Swarm) handleNewBlock(msg *messages.Piece) {
 		s.pendingPieces[msg.Index] = pd
 	}
 
-	pd.blocks = append(pd.blocks, msg)
+	if !pd.addBlock(msg.Begin, msg.Block) {
+		return
+	}
+	s.addDownloaded(len(msg.Block))
+
+	// Blocks are written as they arrive so they survive a restart
+	s.pieceWriter.WriteBlock(msg.Index, msg.Begin, msg.Block)
 
 	if pd.Done() {
 		delete(s.pendingPieces, msg.Index)
+		delete(s.requestedPieces, msg.Index)
+		// The request's slot is free whether or not the piece verifies
+		s.requestMore()
+
+		data, err := pd.bytes(s.pieceWriter)
+		if err != nil {
+			fmt.Printf("could not read piece %d: %s\n", msg.Index, err)
+			return
+		}
+
+		if !s.Torrent.VerifyPiece(msg.Index, data) {
+			fmt.Printf("piece %d failed verification\n", msg.Index)
+			return
+		}
+
 		fmt.Println("HEY I RECEIVED A FULL PIECE")
-		s.Stats.Pieces.Set(msg.Index, 1)
-		s.pieceWriter.Write(pd)
+		// Reads go through the write cache, so the piece is readable
+		// before it reaches the disk
+		s.setHave(msg.Index)
+		s.updateUploadOnly()
 
 		if msg.Index+1 == len(s.Torrent.GeneratePieces()) {
 			fmt.Println(s.Stats.Pieces.Bytes())
@@ -130,28 +349,182 @@ func (s *Swarm) handleNewBlock(msg *messages.Piece) {
 
 }
 
+func (s *Swarm) markReadable(index int) {
+	s.readableLock.Lock()
+	defer s.readableLock.Unlock()
+
+	s.readable.Set(index, 1)
+	close(s.readableChanged)
+	s.readableChanged = make(chan bool)
+}
+
+// requestMore asks the swarm to request pieces without waiting for the next tick
+func (s *Swarm) requestMore() {
+	select {
+	case s.pickNow <- true:
+	default:
+	}
+}
+
+type stopRequest struct {
+	status SwarmStatus
+	done   chan bool
+}
+
+// Stop disconnects every peer and flushes the swarm's blocks to storage.
+// The swarm is paused until it's started again.
+func (s *Swarm) Stop() {
+	s.stopAs(PAUSED)
+}
+
+// Close stops the swarm for good, ending its background writer. It
+// can't be started again afterwards.
+func (s *Swarm) Close() {
+	s.Stop()
+	s.pieceWriter.Stop()
+}
+
+// Queue stops the swarm like Stop, leaving it waiting for a queue slot
+func (s *Swarm) Queue() {
+	s.stopAs(QUEUED)
+}
+
+func (s *Swarm) stopAs(status SwarmStatus) {
+	s.runLock.Lock()
+	running, done := s.running, s.done
+	if !running {
+		defer s.runLock.Unlock()
+		if err := s.setStatus(status); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	s.runLock.Unlock()
+
+	req := stopRequest{status, make(chan bool)}
+	select {
+	case s.stopChan <- req:
+		<-req.done
+	case <-done:
+		// Stopped by an error while we were asking
+		s.stopAs(status)
+	}
+}
+
+func (s *Swarm) IsRunning() bool {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	return s.running
+}
+
+// stop leaves the swarm in the given status, err is why it failed if the
+// status is ERROR
+func (s *Swarm) stop(status SwarmStatus, err error) {
+	for _, p := range append([]*Peer(nil), s.Peers...) {
+		s.removePeer(p)
+	}
+	s.requestedPieces = make(map[int]*pieceRequest)
+	s.pieceWriter.Flush()
+	// Stopped torrents don't hold on to file handles, they're reopened
+	// on the next start
+	s.storage.Close()
+
+	// Seeding time only counts while running, and upload only is
+	// announced again on the next start
+	s.setSeeding(false)
+	s.priorityLock.Lock()
+	s.uploadOnly = false
+	s.priorityLock.Unlock()
+
+	s.runLock.Lock()
+	s.running = false
+	if err := s.setStatus(status); err != nil {
+		fmt.Println(err)
+	}
+	s.err = err
+	close(s.done)
+	s.runLock.Unlock()
+}
+
+// begin marks the swarm as running, returning false if it already is
+func (s *Swarm) begin() bool {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.running {
+		return false
+	}
+
+	status := DOWNLOADING
+	if s.recheck {
+		status = CHECKING
+	}
+	if err := s.setStatus(status); err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	s.running = true
+	s.done = make(chan bool)
+	return true
+}
+
+// Start runs the swarm in the background. Its status has changed by the
+// time Start returns.
+func (s *Swarm) Start() {
+	if s.begin() {
+		go s.run()
+	}
+}
+
+// Run runs the swarm until it's stopped
 func (s *Swarm) Run() {
-	reqd := false
+	if s.begin() {
+		s.run()
+	}
+}
+
+func (s *Swarm) run() {
+	s.startWriter.Do(func() { go s.pieceWriter.Run() })
+	if s.Status() == CHECKING && !s.check() {
+		return
+	}
 
-	fs := torrent.NewFileStream("", s.Torrent.Files())
-	s.pieceWriter = newPieceDataWriter(fs)
+	s.runLock.Lock()
+	s.setStatus(DOWNLOADING)
+	s.runLock.Unlock()
+	s.updateUploadOnly()
 
-	go s.pieceWriter.Run()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.peerMessageChan:
+		case req := <-s.stopChan:
+			s.stop(req.status, nil)
+			close(req.done)
+			return
+		case pm := <-s.peerMessageChan:
+			s.handlePeerMessage(pm)
 		case msg := <-s.blockReceivedChan:
 			// TODO: Cancel any pending requests for received block
 			s.handleNewBlock(msg)
 		case err := <-s.pieceWriter.ErrorChan:
+			// A block that can't be written is lost, carrying on would
+			// only lose more
 			fmt.Printf("Received error when writing %s\n", err)
-		case <-time.NewTicker(1 * time.Second).C:
+			s.stop(ERROR, err)
+			return
+		case <-s.pickNow:
+			s.updateUploadOnly()
+			s.monitorSwarm()
+		case c := <-s.resumeDataChan:
+			c <- s.resumeData()
+		case <-ticker.C:
 			fmt.Println(runtime.NumGoroutine())
-			if !reqd && len(s.Peers) > 0 && !s.Peers[0].Choked {
-				s.monitorSwarm()
-				reqd = true
-			}
+			// Picks up peers that unchoked us without a piece finishing
+			s.monitorSwarm()
 		}
 	}
 }
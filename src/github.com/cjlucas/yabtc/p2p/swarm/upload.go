@@ -0,0 +1,37 @@
+package swarm
+
+import (
+	"fmt"
+
+	"github.com/cjlucas/yabtc/p2p/messages"
+)
+
+// Largest block a peer may request
+const MAX_REQUEST_LENGTH = 8 * BLOCK_SIZE
+
+// Every interested peer is unchoked
+func (s *Swarm) handleInterested(p *Peer) {
+	if p.AmChoking {
+		p.AmChoking = false
+		p.Peer.WriteChan <- messages.NewUnchoke()
+	}
+}
+
+// handleRequest uploads a block of a piece we have to an unchoked peer
+func (s *Swarm) handleRequest(p *Peer, req *messages.Request) {
+	if p.AmChoking || req.Length <= 0 || req.Length > MAX_REQUEST_LENGTH {
+		return
+	}
+	if req.Index < 0 || req.Index >= s.Torrent.NumPieces() || s.Stats.Pieces.Get(req.Index) == 0 {
+		return
+	}
+
+	block := make([]byte, req.Length)
+	if _, err := s.ReadAt(block, req.Index, req.Begin); err != nil {
+		fmt.Printf("could not read requested block %s: %s\n", req, err)
+		return
+	}
+
+	p.Peer.WriteChan <- messages.NewPiece(req.Index, req.Begin, block)
+	s.addUploaded(len(block))
+}
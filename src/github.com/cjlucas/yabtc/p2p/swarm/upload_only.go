@@ -0,0 +1,82 @@
+package swarm
+
+import "github.com/cjlucas/yabtc/p2p/messages"
+
+// IsUploadOnly reports whether the swarm wants no more pieces, because
+// it's a seed or every file it lacks is skipped (a BEP 21 partial seed)
+func (s *Swarm) IsUploadOnly() bool {
+	s.priorityLock.RLock()
+	defer s.priorityLock.RUnlock()
+
+	return s.uploadOnly
+}
+
+// updateUploadOnly tells peers and trackers when the swarm starts or
+// stops wanting pieces
+func (s *Swarm) updateUploadOnly() {
+	uploadOnly := s.Complete()
+
+	s.priorityLock.Lock()
+	changed := uploadOnly != s.uploadOnly
+	s.uploadOnly = uploadOnly
+	s.priorityLock.Unlock()
+
+	if !changed {
+		return
+	}
+	s.setSeeding(uploadOnly)
+	s.updateRunningStatus()
+
+	hs := s.extendedHandshake()
+	for _, p := range append([]*Peer(nil), s.Peers...) {
+		if s.dropSeedConnection(p) {
+			continue
+		}
+
+		if p.Peer.SupportsExtensions() {
+			p.Peer.WriteChan <- messages.NewExtendedHandshake(hs)
+		}
+		if uploadOnly {
+			p.Peer.WriteChan <- messages.NewNotInterested()
+		} else {
+			p.Peer.WriteChan <- messages.NewInterested()
+		}
+	}
+
+	if s.UploadOnlyChan != nil {
+		go func() { s.UploadOnlyChan <- s }()
+	}
+}
+
+// isSeed reports whether the peer will never download anything, either
+// because it has every piece or because it said it's upload only
+func (p *Peer) isSeed(numPieces int) bool {
+	return p.UploadOnly || p.Pieces.Count() == numPieces
+}
+
+// dropSeedConnection disconnects p if neither side will ever download
+// from the other
+func (s *Swarm) dropSeedConnection(p *Peer) bool {
+	if !s.IsUploadOnly() || !p.isSeed(s.Torrent.NumPieces()) {
+		return false
+	}
+
+	s.removePeer(p)
+	return true
+}
+
+func (s *Swarm) removePeer(p *Peer) {
+	for i, q := range s.Peers {
+		if q == p {
+			s.Peers = append(s.Peers[:i], s.Peers[i+1:]...)
+			break
+		}
+	}
+
+	s.superSeedLock.Lock()
+	delete(s.superSeedOffers, p)
+	s.superSeedLock.Unlock()
+
+	s.releaseRequests(p)
+	p.Peer.Close()
+}
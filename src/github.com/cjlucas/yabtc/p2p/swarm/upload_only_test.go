@@ -0,0 +1,115 @@
+package swarm
+
+import (
+	"testing"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newPartialSeed returns a swarm that has every piece of the files it
+// wants, with the last file skipped
+func newPartialSeed() *Swarm {
+	s := newTestSwarm()
+	s.SetFilePriority(2, PRIORITY_SKIP)
+
+	for i := 0; i < 3; i++ {
+		s.setHave(i)
+	}
+
+	return s
+}
+
+func addExtendedPeer(s *Swarm, pieces ...int) *Peer {
+	peer := p2p.NewPeer("10.0.0.1", 6881)
+	peer.Reserved = p2p.NewPeerPolicy(false).Reserved()
+
+	p := newTestPeer(s.Torrent.NumPieces(), pieces...)
+	p.Peer = peer
+	s.insertPeer(p)
+	return p
+}
+
+func extendedHandshake(p *Peer) *messages.ExtendedHandshake {
+	for msg := nextWrite(p); msg != nil; msg = nextWrite(p) {
+		if ext, ok := msg.(*messages.Extended); ok && ext.ExtendedId == messages.EXTENDED_HANDSHAKE_ID {
+			hs, _ := messages.ParseExtendedHandshake(ext.Data)
+			return hs
+		}
+	}
+
+	return nil
+}
+
+func TestUploadOnly(t *testing.T) {
+	Convey("Given a swarm that still wants pieces", t, func() {
+		s := newTestSwarm()
+		seed := addExtendedPeer(s, 0, 1, 2, 3)
+		s.updateUploadOnly()
+
+		Convey("It should not be upload only", func() {
+			So(s.IsUploadOnly(), ShouldBeFalse)
+			So(s.extendedHandshake().UploadOnly, ShouldEqual, 0)
+		})
+
+		Convey("Seeds should stay connected", func() {
+			s.handlePeerMessage(PeerMessage{seed, messages.NewHave(3)})
+			So(s.Peers, ShouldContain, seed)
+		})
+	})
+
+	Convey("Given a swarm that has every piece of the files it wants", t, func() {
+		s := newPartialSeed()
+		changed := make(chan *Swarm, 1)
+		s.UploadOnlyChan = changed
+
+		leech := addExtendedPeer(s, 0)
+		seed := addExtendedPeer(s, 0, 1, 2, 3)
+		s.updateUploadOnly()
+
+		Convey("It should become upload only", func() {
+			So(s.IsUploadOnly(), ShouldBeTrue)
+			So(<-changed, ShouldEqual, s)
+		})
+
+		Convey("Connected peers should be told with a new extended handshake", func() {
+			hs := extendedHandshake(leech)
+			So(hs, ShouldNotBeNil)
+			So(hs.UploadOnly, ShouldEqual, 1)
+		})
+
+		Convey("Connections to seeds should be dropped", func() {
+			So(s.Peers, ShouldContain, leech)
+			So(s.Peers, ShouldNotContain, seed)
+		})
+
+		Convey("Peers that say they're upload only should be dropped", func() {
+			hs := &messages.ExtendedHandshake{M: map[string]int{}, UploadOnly: 1}
+			s.handlePeerMessage(PeerMessage{leech, messages.NewExtendedHandshake(hs)})
+
+			So(leech.UploadOnly, ShouldBeTrue)
+			So(s.Peers, ShouldNotContain, leech)
+		})
+
+		Convey("A leech that completes the torrent should be dropped", func() {
+			for i := 1; i < 4; i++ {
+				leech.Pieces.Set(i, 1)
+			}
+			s.handlePeerMessage(PeerMessage{leech, messages.NewHave(3)})
+
+			So(s.Peers, ShouldNotContain, leech)
+		})
+
+		Convey("Unskipping the file should make it want pieces again", func() {
+			<-changed
+			extendedHandshake(leech)
+			s.SetFilePriority(2, PRIORITY_NORMAL)
+			s.updateUploadOnly()
+
+			So(s.IsUploadOnly(), ShouldBeFalse)
+			So(<-changed, ShouldEqual, s)
+			So(extendedHandshake(leech).UploadOnly, ShouldEqual, 0)
+		})
+	})
+}
@@ -11,6 +11,7 @@ import (
 type HandshakeInfo struct {
 	InfoHash [20]byte
 	PeerId   [20]byte
+	Policy   *p2p.PeerPolicy
 }
 
 type HandshakeInfoRequest struct {
@@ -28,6 +29,7 @@ type PeerManager struct {
 	ln                   net.Listener
 	Infos                map[[20]byte]*HandshakeInfo
 	registerTorrentChan  chan *HandshakeInfo
+	unregisterChan       chan [20]byte
 	handshakeInfoReqChan chan *HandshakeInfoRequest
 }
 
@@ -43,19 +45,28 @@ func NewPeerManager(port int) (*PeerManager, error) {
 	m.Infos = make(map[[20]byte]*HandshakeInfo)
 	m.handshakeInfoReqChan = make(chan *HandshakeInfoRequest)
 	m.registerTorrentChan = make(chan *HandshakeInfo)
+	m.unregisterChan = make(chan [20]byte)
 	m.VerifiedPeerChan = make(chan VerifiedPeer)
 
 	return m, nil
 }
 
-func (m *PeerManager) RegisterTorrent(infoHash, peerId []byte) {
-	hi := &HandshakeInfo{}
+func (m *PeerManager) RegisterTorrent(infoHash, peerId []byte, policy *p2p.PeerPolicy) {
+	hi := &HandshakeInfo{Policy: policy}
 	copy(hi.InfoHash[:], infoHash)
 	copy(hi.PeerId[:], peerId)
 
 	m.registerTorrentChan <- hi
 }
 
+// UnregisterTorrent stops accepting peers for the torrent
+func (m *PeerManager) UnregisterTorrent(infoHash []byte) {
+	var hash [20]byte
+	copy(hash[:], infoHash)
+
+	m.unregisterChan <- hash
+}
+
 func (m *PeerManager) getHandshakeInfo(infoHash []byte) *HandshakeInfo {
 	c := make(chan *HandshakeInfo)
 	var hash [20]byte
@@ -77,12 +88,14 @@ func (m *PeerManager) recvHandshake(peer *p2p.Peer) (*p2p.Handshake, error) {
 		return nil, errors.New("received peer handshaking with unknown info hash")
 	}
 
+	peer.Reserved = hsIn.Reserved
 	return hsIn, nil
 }
 
 func (m *PeerManager) sendHandshake(peer *p2p.Peer, infoHash []byte) error {
 	handshakeInfo := m.getHandshakeInfo(infoHash)
 	hs := p2p.NewHandshake("BitTorrent protocol", handshakeInfo.InfoHash[:], handshakeInfo.PeerId[:])
+	hs.Reserved = handshakeInfo.Policy.Reserved()
 	if err := peer.SendHandshake(*hs); err != nil {
 		logger.Printf("error sending handshake (%s:%d): %s", peer.Ip(), peer.Port(), err)
 		return err
@@ -102,6 +115,13 @@ func (m *PeerManager) verifyPeer(peer *p2p.Peer, infoHash []byte) {
 			m.VerifiedPeerChan <- VerifiedPeer{hs.InfoHash[:], hs.PeerId[:], peer}
 		}
 	} else {
+		// Peers from sources the torrent may not use are never contacted
+		handshakeInfo := m.getHandshakeInfo(infoHash)
+		if handshakeInfo == nil || !handshakeInfo.Policy.Allows(peer.Source) {
+			logger.Printf("Not connecting to %s:%d, source not allowed", peer.Ip(), peer.Port())
+			return
+		}
+
 		if err := peer.Connect(); err != nil {
 			return
 		}
@@ -118,8 +138,9 @@ func (m *PeerManager) verifyPeer(peer *p2p.Peer, infoHash []byte) {
 	}
 }
 
-func (m *PeerManager) VerifyPeer(infoHash []byte, ip string, port int) {
+func (m *PeerManager) VerifyPeer(infoHash []byte, ip string, port int, source p2p.PeerSource) {
 	peer := p2p.NewPeer(ip, port)
+	peer.Source = source
 	go m.verifyPeer(peer, infoHash)
 }
 
@@ -141,6 +162,8 @@ func (m *PeerManager) Run() {
 		select {
 		case info := <-m.registerTorrentChan:
 			m.Infos[info.InfoHash] = info
+		case hash := <-m.unregisterChan:
+			delete(m.Infos, hash)
 		case req := <-m.handshakeInfoReqChan:
 			req.C <- m.Infos[req.InfoHash]
 		}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package portmap
+
+import (
+	"errors"
+	"net"
+)
+
+func defaultGateway() (net.IP, error) {
+	return nil, errors.New("default gateway lookup not supported on this platform")
+}
@@ -0,0 +1,317 @@
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const NATPMP_PORT = 5351
+
+const (
+	natpmpVersion = 0
+	pcpVersion    = 2
+)
+
+const (
+	natpmpOpExternalAddress = 0
+	natpmpOpMapUDP          = 1
+	natpmpOpMapTCP          = 2
+	pcpOpMap                = 1
+)
+
+const (
+	pcpResultSuccess            = 0
+	pcpResultUnsupportedVersion = 1
+)
+
+// RFC 6886 asks for an initial 250ms timeout doubling on every retry.
+// We give up much sooner than the recommended 9 attempts.
+const NATPMP_INITIAL_TIMEOUT = 250 * time.Millisecond
+const NATPMP_MAX_ATTEMPTS = 4
+
+var natpmpResultErrors = map[int]string{
+	1: "unsupported version",
+	2: "not authorized/refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+var pcpResultErrors = map[int]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+// NATPMPGateway speaks PCP (RFC 6887) and falls back to NAT-PMP
+// (RFC 6886) if the gateway does not understand PCP.
+type NATPMPGateway struct {
+	Addr    string
+	usePCP  bool
+	probed  bool
+	nonces  map[string][12]byte
+	reqLock sync.Mutex
+}
+
+func NewNATPMPGateway(addr string) *NATPMPGateway {
+	return &NATPMPGateway{Addr: addr, nonces: make(map[string][12]byte)}
+}
+
+func (g *NATPMPGateway) Name() string {
+	if g.usePCP {
+		return "PCP"
+	}
+	return "NAT-PMP"
+}
+
+// roundTrip sends req and waits for a response, retransmitting with
+// exponential backoff. Response size checking is left to the caller.
+func (g *NATPMPGateway) roundTrip(req []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", g.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	localIp := conn.LocalAddr().(*net.UDPAddr).IP
+
+	// Client IP is embedded in PCP requests
+	if len(req) >= 24 && req[0] == pcpVersion {
+		copy(req[8:24], localIp.To16())
+	}
+
+	buf := make([]byte, 1100)
+	timeout := NATPMP_INITIAL_TIMEOUT
+	for i := 0; i < NATPMP_MAX_ATTEMPTS; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err == nil {
+			return buf[:n], nil
+		}
+
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			return nil, err
+		}
+
+		timeout *= 2
+	}
+
+	return nil, errors.New("gateway did not respond")
+}
+
+func natpmpResultError(code int) error {
+	if code == 0 {
+		return nil
+	}
+
+	if s, ok := natpmpResultErrors[code]; ok {
+		return fmt.Errorf("NAT-PMP error: %s", s)
+	}
+	return fmt.Errorf("NAT-PMP error: unknown result code %d", code)
+}
+
+func pcpResultError(code int) error {
+	if code == pcpResultSuccess {
+		return nil
+	}
+
+	if s, ok := pcpResultErrors[code]; ok {
+		return fmt.Errorf("PCP error: %s", s)
+	}
+	return fmt.Errorf("PCP error: unknown result code %d", code)
+}
+
+func (g *NATPMPGateway) ExternalAddress() (net.IP, error) {
+	g.reqLock.Lock()
+	defer g.reqLock.Unlock()
+
+	resp, err := g.roundTrip([]byte{natpmpVersion, natpmpOpExternalAddress})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 12 || resp[0] != natpmpVersion || resp[1] != 128+natpmpOpExternalAddress {
+		return nil, errors.New("invalid NAT-PMP response")
+	}
+
+	if err := natpmpResultError(int(binary.BigEndian.Uint16(resp[2:4]))); err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func natpmpOpcode(proto string) (byte, error) {
+	switch proto {
+	case TCP:
+		return natpmpOpMapTCP, nil
+	case UDP:
+		return natpmpOpMapUDP, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol: %s", proto)
+	}
+}
+
+func pcpProtocol(proto string) (byte, error) {
+	switch proto {
+	case TCP:
+		return 6, nil
+	case UDP:
+		return 17, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol: %s", proto)
+	}
+}
+
+func (g *NATPMPGateway) natpmpMap(proto string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	op, err := natpmpOpcode(proto)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	resp, err := g.roundTrip(req)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(resp) < 16 || resp[0] != natpmpVersion || resp[1] != 128+op {
+		return 0, 0, errors.New("invalid NAT-PMP response")
+	}
+
+	if err := natpmpResultError(int(binary.BigEndian.Uint16(resp[2:4]))); err != nil {
+		return 0, 0, err
+	}
+
+	ext := int(binary.BigEndian.Uint16(resp[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+
+	return ext, granted, nil
+}
+
+// pcpMap returns errUnsupportedVersion if the gateway only speaks NAT-PMP
+func (g *NATPMPGateway) pcpMap(proto string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	protoNum, err := pcpProtocol(proto)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	key := fmt.Sprintf("%s:%d", proto, internalPort)
+	nonce, ok := g.nonces[key]
+	if !ok {
+		rand.Read(nonce[:])
+		g.nonces[key] = nonce
+	}
+
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[24:36], nonce[:])
+	req[36] = protoNum
+	binary.BigEndian.PutUint16(req[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:44], uint16(externalPort))
+	copy(req[44:60], net.IPv4zero.To16())
+
+	resp, err := g.roundTrip(req)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// A NAT-PMP only gateway answers with a version 0 packet
+	if len(resp) >= 4 && resp[0] == natpmpVersion {
+		return 0, 0, errUnsupportedVersion
+	}
+
+	if len(resp) < 4 || resp[0] != pcpVersion || resp[1] != 0x80|pcpOpMap {
+		return 0, 0, errors.New("invalid PCP response")
+	}
+
+	if int(resp[3]) == pcpResultUnsupportedVersion {
+		return 0, 0, errUnsupportedVersion
+	}
+
+	if err := pcpResultError(int(resp[3])); err != nil {
+		return 0, 0, err
+	}
+
+	if len(resp) < 60 {
+		return 0, 0, errors.New("invalid PCP response")
+	}
+
+	if !bytes.Equal(resp[24:36], nonce[:]) {
+		return 0, 0, errors.New("PCP nonce mismatch")
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	ext := int(binary.BigEndian.Uint16(resp[42:44]))
+
+	if lifetime == 0 {
+		delete(g.nonces, key)
+	}
+
+	return ext, granted, nil
+}
+
+var errUnsupportedVersion = errors.New("unsupported version")
+
+func (g *NATPMPGateway) mapPort(proto string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	g.reqLock.Lock()
+	defer g.reqLock.Unlock()
+
+	if !g.probed || g.usePCP {
+		ext, granted, err := g.pcpMap(proto, internalPort, externalPort, lifetime)
+		if err != errUnsupportedVersion {
+			if err == nil {
+				g.probed = true
+				g.usePCP = true
+			}
+			return ext, granted, err
+		}
+
+		g.probed = true
+		g.usePCP = false
+	}
+
+	// NAT-PMP requires the suggested external port to be zero on delete
+	if lifetime == 0 {
+		externalPort = 0
+	}
+
+	return g.natpmpMap(proto, internalPort, externalPort, lifetime)
+}
+
+func (g *NATPMPGateway) AddPortMapping(proto string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	return g.mapPort(proto, internalPort, externalPort, lifetime)
+}
+
+func (g *NATPMPGateway) DeletePortMapping(proto string, internalPort, externalPort int) error {
+	_, _, err := g.mapPort(proto, internalPort, externalPort, 0)
+	return err
+}
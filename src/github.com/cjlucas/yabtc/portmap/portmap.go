@@ -0,0 +1,169 @@
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	TCP = "TCP"
+	UDP = "UDP"
+)
+
+const DEFAULT_LIFETIME = 2 * time.Hour
+
+// Permanent leases (UPnP lease duration of 0) are still refreshed
+// periodically in case the gateway reboots and forgets them
+const PERMANENT_LEASE_REFRESH = 30 * time.Minute
+
+const RETRY_INTERVAL = 1 * time.Minute
+
+var NoGatewayError = errors.New("no NAT-PMP/PCP or UPnP gateway found")
+
+type Gateway interface {
+	Name() string
+
+	// Returns the external port and lease duration granted by the gateway.
+	// A lifetime of zero means the mapping is permanent.
+	AddPortMapping(proto string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error)
+	DeletePortMapping(proto string, internalPort, externalPort int) error
+}
+
+type mapping struct {
+	Proto        string
+	InternalPort int
+	ExternalPort int
+	renewAt      time.Time
+}
+
+type Manager struct {
+	// Receives the external TCP port whenever it is mapped or changes
+	ExternalPortChan chan int
+	gateway          Gateway
+	externalPort     int
+	mappings         []*mapping
+	quit             chan bool
+	done             chan bool
+	stopOnce         sync.Once
+}
+
+// Discover looks for a gateway on the local network, preferring
+// NAT-PMP/PCP and falling back to UPnP IGD.
+func Discover() (Gateway, error) {
+	if addr, err := defaultGateway(); err == nil {
+		gw := NewNATPMPGateway(fmt.Sprintf("%s:%d", addr, NATPMP_PORT))
+		if _, err := gw.ExternalAddress(); err == nil {
+			return gw, nil
+		}
+	}
+
+	if gw, err := DiscoverUPnP(SSDP_ADDR, SSDP_TIMEOUT); err == nil {
+		return gw, nil
+	}
+
+	return nil, NoGatewayError
+}
+
+// NewManager maps the TCP and UDP listen port on the given gateway
+func NewManager(gw Gateway, port int) *Manager {
+	m := &Manager{}
+	m.gateway = gw
+	m.ExternalPortChan = make(chan int, 1)
+	m.quit = make(chan bool)
+	m.done = make(chan bool)
+
+	for _, proto := range []string{TCP, UDP} {
+		m.mappings = append(m.mappings, &mapping{
+			Proto:        proto,
+			InternalPort: port,
+			ExternalPort: port,
+		})
+	}
+
+	return m
+}
+
+func (m *Manager) publishExternalPort(port int) {
+	// Only the latest port is of interest, drop any stale value
+	select {
+	case <-m.ExternalPortChan:
+	default:
+	}
+	m.ExternalPortChan <- port
+}
+
+func (m *Manager) addMapping(mp *mapping) {
+	ext, lifetime, err := m.gateway.AddPortMapping(mp.Proto, mp.InternalPort, mp.ExternalPort, DEFAULT_LIFETIME)
+	if err != nil {
+		fmt.Printf("%s: could not map %s port %d: %s\n", m.gateway.Name(), mp.Proto, mp.InternalPort, err)
+		mp.renewAt = time.Now().Add(RETRY_INTERVAL)
+		return
+	}
+
+	if mp.Proto == TCP && ext != m.externalPort {
+		m.externalPort = ext
+		m.publishExternalPort(ext)
+	}
+	mp.ExternalPort = ext
+
+	if lifetime == 0 {
+		mp.renewAt = time.Now().Add(PERMANENT_LEASE_REFRESH)
+	} else {
+		mp.renewAt = time.Now().Add(lifetime / 2)
+	}
+}
+
+func (m *Manager) nextRenewal() time.Duration {
+	var next time.Time
+	for _, mp := range m.mappings {
+		if next.IsZero() || mp.renewAt.Before(next) {
+			next = mp.renewAt
+		}
+	}
+
+	return next.Sub(time.Now())
+}
+
+func (m *Manager) removeMappings() {
+	for _, mp := range m.mappings {
+		if err := m.gateway.DeletePortMapping(mp.Proto, mp.InternalPort, mp.ExternalPort); err != nil {
+			fmt.Printf("%s: could not remove %s mapping %d: %s\n", m.gateway.Name(), mp.Proto, mp.ExternalPort, err)
+		}
+	}
+}
+
+func (m *Manager) Run() {
+	defer close(m.done)
+
+	for _, mp := range m.mappings {
+		m.addMapping(mp)
+	}
+
+	for {
+		timer := time.NewTimer(m.nextRenewal())
+		select {
+		case <-m.quit:
+			timer.Stop()
+			m.removeMappings()
+			return
+		case <-timer.C:
+			now := time.Now()
+			for _, mp := range m.mappings {
+				if !mp.renewAt.After(now) {
+					m.addMapping(mp)
+				}
+			}
+		}
+	}
+}
+
+// Stop removes all mappings from the gateway and waits for Run to exit.
+// It may be called more than once.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.quit)
+		<-m.done
+	})
+}
@@ -0,0 +1,347 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeNATPMPServer answers NAT-PMP requests and, if pcp is set, PCP MAP requests
+type fakeNATPMPServer struct {
+	conn     *net.UDPConn
+	pcp      bool
+	lock     sync.Mutex
+	mappings map[string]int
+}
+
+func newFakeNATPMPServer(pcp bool) *fakeNATPMPServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+
+	s := &fakeNATPMPServer{conn: conn, pcp: pcp, mappings: make(map[string]int)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeNATPMPServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeNATPMPServer) Close() {
+	s.conn.Close()
+}
+
+func (s *fakeNATPMPServer) mapped(key string) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	port, ok := s.mappings[key]
+	return port, ok
+}
+
+func (s *fakeNATPMPServer) setMapping(key string, port int, lifetime uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if lifetime == 0 {
+		delete(s.mappings, key)
+	} else {
+		s.mappings[key] = port
+	}
+}
+
+func (s *fakeNATPMPServer) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		req := buf[:n]
+		var resp []byte
+		switch {
+		case req[0] == pcpVersion && s.pcp:
+			proto := map[byte]string{6: TCP, 17: UDP}[req[36]]
+			lifetime := binary.BigEndian.Uint32(req[4:8])
+			internal := binary.BigEndian.Uint16(req[40:42])
+			resp = make([]byte, 60)
+			copy(resp, req)
+			resp[1] = 0x80 | pcpOpMap
+			binary.BigEndian.PutUint16(resp[42:44], internal+1000)
+			s.setMapping(fmt.Sprintf("%s:%d", proto, internal), int(internal)+1000, lifetime)
+		case req[0] == pcpVersion:
+			resp = []byte{natpmpVersion, 0x80 | req[1], 0, 1, 0, 0, 0, 0}
+		case req[1] == natpmpOpExternalAddress:
+			resp = []byte{natpmpVersion, 128, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+		default:
+			proto := map[byte]string{natpmpOpMapTCP: TCP, natpmpOpMapUDP: UDP}[req[1]]
+			internal := binary.BigEndian.Uint16(req[4:6])
+			lifetime := binary.BigEndian.Uint32(req[8:12])
+			resp = make([]byte, 16)
+			resp[1] = 128 + req[1]
+			binary.BigEndian.PutUint16(resp[8:10], internal)
+			binary.BigEndian.PutUint16(resp[10:12], internal+2000)
+			binary.BigEndian.PutUint32(resp[12:16], lifetime)
+			s.setMapping(fmt.Sprintf("%s:%d", proto, internal), int(internal)+2000, lifetime)
+		}
+
+		s.conn.WriteToUDP(resp, addr)
+	}
+}
+
+const fakeDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// fakeUPnPServer answers SSDP searches and SOAP requests for a single IGD
+type fakeUPnPServer struct {
+	http     *httptest.Server
+	ssdp     *net.UDPConn
+	lock     sync.Mutex
+	mappings map[string]bool
+	taken    map[string]bool
+}
+
+func newFakeUPnPServer() *fakeUPnPServer {
+	s := &fakeUPnPServer{mappings: make(map[string]bool), taken: make(map[string]bool)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fakeDescription))
+	})
+	mux.HandleFunc("/ctl/IPConn", s.handleSoap)
+	s.http = httptest.NewServer(mux)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+	s.ssdp = conn
+	go s.serveSSDP()
+
+	return s
+}
+
+func (s *fakeUPnPServer) Close() {
+	s.http.Close()
+	s.ssdp.Close()
+}
+
+func (s *fakeUPnPServer) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			continue
+		}
+
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			fmt.Sprintf("LOCATION: %s/rootDesc.xml\r\n", s.http.URL) +
+			"\r\n"
+		s.ssdp.WriteToUDP([]byte(resp), addr)
+	}
+}
+
+func soapValue(body, name string) string {
+	start := strings.Index(body, "<"+name+">")
+	end := strings.Index(body, "</"+name+">")
+	if start < 0 || end < 0 {
+		return ""
+	}
+	return body[start+len(name)+2 : end]
+}
+
+func (s *fakeUPnPServer) handleSoap(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	body := string(b)
+	action := r.Header.Get("SOAPAction")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := soapValue(body, "NewProtocol") + ":" + soapValue(body, "NewExternalPort")
+
+	switch {
+	case strings.HasSuffix(action, `#AddPortMapping"`):
+		if s.taken[key] {
+			w.WriteHeader(500)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError><errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		s.mappings[key] = true
+	case strings.HasSuffix(action, `#DeletePortMapping"`):
+		delete(s.mappings, key)
+	case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse><NewExternalIPAddress>5.6.7.8</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		return
+	}
+
+	fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body></s:Body></s:Envelope>`)
+}
+
+func (s *fakeUPnPServer) hasMapping(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mappings[key]
+}
+
+func TestNATPMPGateway(t *testing.T) {
+	Convey("When the gateway only speaks NAT-PMP", t, func() {
+		srv := newFakeNATPMPServer(false)
+		defer srv.Close()
+		gw := NewNATPMPGateway(srv.Addr())
+
+		Convey("It should return the external address", func() {
+			ip, err := gw.ExternalAddress()
+			So(err, ShouldBeNil)
+			So(ip.String(), ShouldEqual, "1.2.3.4")
+		})
+
+		Convey("It should fall back to NAT-PMP for mappings", func() {
+			ext, lifetime, err := gw.AddPortMapping(TCP, 6881, 6881, time.Hour)
+			So(err, ShouldBeNil)
+			So(ext, ShouldEqual, 8881)
+			So(lifetime, ShouldEqual, time.Hour)
+			So(gw.Name(), ShouldEqual, "NAT-PMP")
+
+			_, ok := srv.mapped("TCP:6881")
+			So(ok, ShouldBeTrue)
+
+			So(gw.DeletePortMapping(TCP, 6881, ext), ShouldBeNil)
+			_, ok = srv.mapped("TCP:6881")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("When the gateway speaks PCP", t, func() {
+		srv := newFakeNATPMPServer(true)
+		defer srv.Close()
+		gw := NewNATPMPGateway(srv.Addr())
+
+		Convey("It should map the port with PCP", func() {
+			ext, _, err := gw.AddPortMapping(UDP, 6881, 6881, time.Hour)
+			So(err, ShouldBeNil)
+			So(ext, ShouldEqual, 7881)
+			So(gw.Name(), ShouldEqual, "PCP")
+
+			So(gw.DeletePortMapping(UDP, 6881, ext), ShouldBeNil)
+			_, ok := srv.mapped("UDP:6881")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestUPnPGateway(t *testing.T) {
+	Convey("When an IGD answers the SSDP search", t, func() {
+		srv := newFakeUPnPServer()
+		defer srv.Close()
+
+		gw, err := DiscoverUPnP(srv.ssdp.LocalAddr().String(), 500*time.Millisecond)
+
+		Convey("It should find the WANIPConnection service", func() {
+			So(err, ShouldBeNil)
+			So(gw.ServiceType, ShouldEqual, "urn:schemas-upnp-org:service:WANIPConnection:1")
+			So(gw.ControlUrl, ShouldEqual, srv.http.URL+"/ctl/IPConn")
+			So(gw.InternalClient, ShouldEqual, "127.0.0.1")
+		})
+
+		Convey("It should return the external address", func() {
+			ip, err := gw.ExternalAddress()
+			So(err, ShouldBeNil)
+			So(ip.String(), ShouldEqual, "5.6.7.8")
+		})
+
+		Convey("It should add and delete port mappings", func() {
+			ext, _, err := gw.AddPortMapping(TCP, 6881, 6881, time.Hour)
+			So(err, ShouldBeNil)
+			So(ext, ShouldEqual, 6881)
+			So(srv.hasMapping("TCP:6881"), ShouldBeTrue)
+
+			So(gw.DeletePortMapping(TCP, 6881, ext), ShouldBeNil)
+			So(srv.hasMapping("TCP:6881"), ShouldBeFalse)
+		})
+
+		Convey("It should pick another external port on conflict", func() {
+			srv.taken["TCP:6881"] = true
+			ext, _, err := gw.AddPortMapping(TCP, 6881, 6881, time.Hour)
+			So(err, ShouldBeNil)
+			So(ext, ShouldEqual, 6882)
+		})
+	})
+}
+
+func TestManager(t *testing.T) {
+	Convey("When running a Manager against a gateway", t, func() {
+		srv := newFakeNATPMPServer(false)
+		defer srv.Close()
+
+		m := NewManager(NewNATPMPGateway(srv.Addr()), 6881)
+		go m.Run()
+
+		Convey("It should report the external TCP port and map both protocols", func() {
+			var port int
+			select {
+			case port = <-m.ExternalPortChan:
+			case <-time.After(5 * time.Second):
+			}
+			So(port, ShouldEqual, 8881)
+
+			// UDP is mapped after the TCP port is reported
+			for i := 0; i < 50; i++ {
+				if _, ok := srv.mapped("UDP:6881"); ok {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			_, tcp := srv.mapped("TCP:6881")
+			_, udp := srv.mapped("UDP:6881")
+			So(tcp, ShouldBeTrue)
+			So(udp, ShouldBeTrue)
+
+			Convey("It should remove the mappings when stopped", func() {
+				m.Stop()
+				_, tcp := srv.mapped("TCP:6881")
+				_, udp := srv.mapped("UDP:6881")
+				So(tcp, ShouldBeFalse)
+				So(udp, ShouldBeFalse)
+
+				So(m.Stop, ShouldNotPanic)
+			})
+		})
+	})
+}
@@ -0,0 +1,330 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const SSDP_ADDR = "239.255.255.250:1900"
+
+const SSDP_TIMEOUT = 2 * time.Second
+
+const UPNP_MAPPING_DESCRIPTION = "yabtc"
+
+// Number of alternative external ports to try if the requested one
+// is already mapped to another client
+const UPNP_MAX_PORT_CONFLICTS = 10
+
+const (
+	upnpErrorConflictInMappingEntry = 718
+	upnpErrorOnlyPermanentLeases    = 725
+)
+
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type UPnPGateway struct {
+	ControlUrl  string
+	ServiceType string
+	// Local address the gateway knows us by
+	InternalClient string
+}
+
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlUrl  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	UrlBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+func (d *upnpDevice) findService(serviceType string) *upnpService {
+	for i := range d.Services {
+		if d.Services[i].ServiceType == serviceType {
+			return &d.Services[i]
+		}
+	}
+
+	for i := range d.Devices {
+		if s := d.Devices[i].findService(serviceType); s != nil {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func ssdpSearch(ssdpAddr string, timeout time.Duration) ([]string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		fmt.Sprintf("HOST: %s\r\n", SSDP_ADDR) +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		fmt.Sprintf("MX: %d\r\n", int(timeout/time.Second)) +
+		"\r\n"
+
+	if _, err := conn.WriteTo([]byte(req), addr); err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+
+		if loc := resp.Header.Get("Location"); loc != "" {
+			locations = append(locations, loc)
+		}
+	}
+
+	if len(locations) == 0 {
+		return nil, errors.New("no UPnP gateway responded")
+	}
+
+	return locations, nil
+}
+
+func fetchUPnPGateway(location string) (*UPnPGateway, error) {
+	resp, err := http.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected HTTP status code: %s", resp.Status)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, fmt.Errorf("error decoding device description: %s", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.UrlBase != "" {
+		if base, err = url.Parse(root.UrlBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serviceType := range upnpServiceTypes {
+		s := root.Device.findService(serviceType)
+		if s == nil {
+			continue
+		}
+
+		controlUrl, err := base.Parse(s.ControlUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		gw := &UPnPGateway{
+			ControlUrl:  controlUrl.String(),
+			ServiceType: serviceType,
+		}
+
+		// Determine which local address routes to the gateway
+		conn, err := net.Dial("udp", controlUrl.Host)
+		if err != nil {
+			return nil, err
+		}
+		gw.InternalClient = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+
+		return gw, nil
+	}
+
+	return nil, errors.New("device has no WAN connection service")
+}
+
+// DiscoverUPnP sends an SSDP search to ssdpAddr and returns
+// the first gateway offering a WAN connection service
+func DiscoverUPnP(ssdpAddr string, timeout time.Duration) (*UPnPGateway, error) {
+	locations, err := ssdpSearch(ssdpAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, loc := range locations {
+		if gw, err := fetchUPnPGateway(loc); err == nil {
+			return gw, nil
+		}
+	}
+
+	return nil, errors.New("no usable UPnP gateway found")
+}
+
+type soapArg struct {
+	Name, Value string
+}
+
+type soapFault struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (g *UPnPGateway) soapRequest(action string, args []soapArg) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>`)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`)
+	fmt.Fprintf(&body, `<s:Body><u:%s xmlns:u="%s">`, action, g.ServiceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg.Name)
+		xml.EscapeText(&body, []byte(arg.Value))
+		fmt.Fprintf(&body, "</%s>", arg.Name)
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", g.ControlUrl, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, g.ServiceType, action))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respBody bytes.Buffer
+	if _, err := respBody.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		var fault soapFault
+		if err := xml.Unmarshal(respBody.Bytes(), &fault); err == nil && fault.Code != 0 {
+			return nil, &upnpError{fault.Code, fault.Description}
+		}
+		return nil, fmt.Errorf("unexpected HTTP status code: %s", resp.Status)
+	}
+
+	return respBody.Bytes(), nil
+}
+
+func (g *UPnPGateway) Name() string {
+	return "UPnP"
+}
+
+func (g *UPnPGateway) ExternalAddress() (net.IP, error) {
+	resp, err := g.soapRequest("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var out struct {
+		Ip string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(resp, &out); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(out.Ip))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external address: %s", out.Ip)
+	}
+
+	return ip, nil
+}
+
+func (g *UPnPGateway) addPortMapping(proto string, internalPort, externalPort int, lifetime time.Duration) error {
+	_, err := g.soapRequest("AddPortMapping", []soapArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprintf("%d", externalPort)},
+		{"NewProtocol", proto},
+		{"NewInternalPort", fmt.Sprintf("%d", internalPort)},
+		{"NewInternalClient", g.InternalClient},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", UPNP_MAPPING_DESCRIPTION},
+		{"NewLeaseDuration", fmt.Sprintf("%d", int(lifetime/time.Second))},
+	})
+
+	return err
+}
+
+func (g *UPnPGateway) AddPortMapping(proto string, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	for i := 0; i < UPNP_MAX_PORT_CONFLICTS; i++ {
+		err := g.addPortMapping(proto, internalPort, externalPort, lifetime)
+
+		// Some IGDv1 implementations only accept permanent leases
+		if uerr, ok := err.(*upnpError); ok && uerr.Code == upnpErrorOnlyPermanentLeases {
+			lifetime = 0
+			err = g.addPortMapping(proto, internalPort, externalPort, lifetime)
+		}
+
+		if uerr, ok := err.(*upnpError); ok && uerr.Code == upnpErrorConflictInMappingEntry {
+			externalPort++
+			continue
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return externalPort, lifetime, nil
+	}
+
+	return 0, 0, errors.New("could not find a free external port")
+}
+
+func (g *UPnPGateway) DeletePortMapping(proto string, internalPort, externalPort int) error {
+	_, err := g.soapRequest("DeletePortMapping", []soapArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprintf("%d", externalPort)},
+		{"NewProtocol", proto},
+	})
+
+	return err
+}
@@ -0,0 +1,269 @@
+// Package queue decides which torrents may run when there are more of
+// them than the limits allow
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+)
+
+// Torrents that just started get this long to find peers before they can
+// be considered inactive
+const INACTIVE_GRACE_PERIOD = 2 * time.Minute
+
+var NotQueuedError = errors.New("torrent is not in the queue")
+
+// Limits on the torrents running at once, zero means no limit
+type Limits struct {
+	MaxDownloads int
+	MaxSeeds     int
+	// Downloads and seeds together
+	MaxActive int
+	// Running torrents transferring fewer bytes per second than this
+	// don't take up a slot, zero counts every running torrent
+	InactiveRate int
+}
+
+// Torrent is what the queue needs to know about a torrent. *swarm.Swarm
+// implements it.
+type Torrent interface {
+	Status() swarm.SwarmStatus
+	// Whether the torrent would seed if it was started
+	Complete() bool
+	StatsSnapshot() swarm.Stats
+}
+
+type entry struct {
+	t      Torrent
+	forced bool
+
+	// When the torrent was started, zero if it isn't running
+	runningSince time.Time
+	// Bytes transferred as of the last update, and the rate since the
+	// update before
+	bytes   int64
+	rate    float64
+	updated time.Time
+}
+
+func (e *entry) updateRate(now time.Time, running bool) {
+	stats := e.t.StatsSnapshot()
+	bytes := stats.TotalDownloaded + stats.TotalUploaded
+
+	switch {
+	case !running:
+		e.runningSince = time.Time{}
+		e.rate = 0
+	case e.runningSince.IsZero():
+		e.runningSince = now
+		e.rate = 0
+	default:
+		if elapsed := now.Sub(e.updated).Seconds(); elapsed > 0 {
+			e.rate = float64(bytes-e.bytes) / elapsed
+		}
+	}
+
+	e.bytes = bytes
+	e.updated = now
+}
+
+// Queue keeps torrents in order of how soon they should get a slot.
+// Torrents at the front take slots from running torrents further back.
+type Queue struct {
+	limits  Limits
+	entries []*entry
+	clock   func() time.Time
+	lock    sync.Mutex
+}
+
+func New(limits Limits) *Queue {
+	return &Queue{limits: limits, clock: time.Now}
+}
+
+func (q *Queue) Limits() Limits {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.limits
+}
+
+func (q *Queue) SetLimits(limits Limits) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.limits = limits
+}
+
+// Add puts a torrent at the back of the queue
+func (q *Queue) Add(t Torrent) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.indexOf(t) == -1 {
+		q.entries = append(q.entries, &entry{t: t})
+	}
+}
+
+func (q *Queue) Remove(t Torrent) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if i := q.indexOf(t); i != -1 {
+		q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	}
+}
+
+func (q *Queue) indexOf(t Torrent) int {
+	for i, e := range q.entries {
+		if e.t == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// Position is the torrent's place in the queue starting from 0, or -1 if
+// it isn't in the queue
+func (q *Queue) Position(t Torrent) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.indexOf(t)
+}
+
+// SetPosition moves a torrent to the given place in the queue, positions
+// past either end move it to that end
+func (q *Queue) SetPosition(t Torrent, pos int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	i := q.indexOf(t)
+	if i == -1 {
+		return NotQueuedError
+	}
+
+	if pos < 0 {
+		pos = 0
+	} else if pos >= len(q.entries) {
+		pos = len(q.entries) - 1
+	}
+
+	e := q.entries[i]
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	q.entries = append(q.entries, nil)
+	copy(q.entries[pos+1:], q.entries[pos:])
+	q.entries[pos] = e
+	return nil
+}
+
+func (q *Queue) MoveUp(t Torrent) error {
+	return q.move(t, -1)
+}
+
+func (q *Queue) MoveDown(t Torrent) error {
+	return q.move(t, 1)
+}
+
+func (q *Queue) move(t Torrent, by int) error {
+	pos := q.Position(t)
+	if pos == -1 {
+		return NotQueuedError
+	}
+
+	return q.SetPosition(t, pos+by)
+}
+
+// SetForced makes a torrent bypass the queue. Forced torrents are started
+// whenever they're queued and never take up a slot.
+func (q *Queue) SetForced(t Torrent, forced bool) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	i := q.indexOf(t)
+	if i == -1 {
+		return NotQueuedError
+	}
+
+	q.entries[i].forced = forced
+	return nil
+}
+
+func (q *Queue) IsForced(t Torrent) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	i := q.indexOf(t)
+	return i != -1 && q.entries[i].forced
+}
+
+// inactive reports whether a running torrent is too slow to count
+// against the limits
+func (q *Queue) inactive(e *entry, now time.Time) bool {
+	return q.limits.InactiveRate > 0 &&
+		now.Sub(e.runningSince) >= INACTIVE_GRACE_PERIOD &&
+		e.rate < float64(q.limits.InactiveRate)
+}
+
+func underLimit(n, limit int) bool {
+	return limit <= 0 || n < limit
+}
+
+// Update hands out the slots in queue order. It returns the queued
+// torrents that should be started and the running torrents that should
+// be queued again to make room for torrents ahead of them. Paused
+// torrents and torrents with errors are left alone.
+func (q *Queue) Update() (start, stop []Torrent) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := q.clock()
+	var downloads, seeds int
+	for _, e := range q.entries {
+		status := e.t.Status()
+		running := status.IsRunning()
+		e.updateRate(now, running)
+
+		if e.forced {
+			if status == swarm.QUEUED {
+				start = append(start, e.t)
+				e.runningSince = now
+			}
+			continue
+		}
+		if !running && status != swarm.QUEUED {
+			continue
+		}
+		// Stalled torrents keep running without holding anyone back
+		if running && q.inactive(e, now) {
+			continue
+		}
+
+		// Torrents are downloading while they're checked
+		seed := status == swarm.SEEDING || (status == swarm.QUEUED && e.t.Complete())
+		fits := underLimit(downloads+seeds, q.limits.MaxActive)
+		if seed {
+			fits = fits && underLimit(seeds, q.limits.MaxSeeds)
+		} else {
+			fits = fits && underLimit(downloads, q.limits.MaxDownloads)
+		}
+
+		switch {
+		case fits && seed:
+			seeds++
+		case fits:
+			downloads++
+		}
+
+		if fits && !running {
+			start = append(start, e.t)
+			e.runningSince = now
+		} else if !fits && running {
+			stop = append(stop, e.t)
+		}
+	}
+
+	return start, stop
+}
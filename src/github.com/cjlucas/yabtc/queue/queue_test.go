@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeTorrent struct {
+	name     string
+	status   swarm.SwarmStatus
+	complete bool
+	bytes    int64
+}
+
+func (t *fakeTorrent) Status() swarm.SwarmStatus {
+	return t.status
+}
+
+func (t *fakeTorrent) Complete() bool {
+	return t.complete
+}
+
+func (t *fakeTorrent) StatsSnapshot() swarm.Stats {
+	return swarm.Stats{TotalDownloaded: t.bytes}
+}
+
+func newQueue(limits Limits, torrents ...*fakeTorrent) *Queue {
+	q := New(limits)
+	for _, t := range torrents {
+		q.Add(t)
+	}
+	return q
+}
+
+// apply does what the queue asks for, like the swarm manager would
+func apply(start, stop []Torrent) {
+	for _, t := range stop {
+		t.(*fakeTorrent).status = swarm.QUEUED
+	}
+	for _, t := range start {
+		ft := t.(*fakeTorrent)
+		ft.status = swarm.DOWNLOADING
+		if ft.complete {
+			ft.status = swarm.SEEDING
+		}
+	}
+}
+
+func names(torrents []Torrent) []string {
+	var s []string
+	for _, t := range torrents {
+		s = append(s, t.(*fakeTorrent).name)
+	}
+	return s
+}
+
+func TestQueue(t *testing.T) {
+	Convey("Given a queue of downloads and seeds", t, func() {
+		a := &fakeTorrent{name: "a", status: swarm.QUEUED}
+		b := &fakeTorrent{name: "b", status: swarm.QUEUED}
+		c := &fakeTorrent{name: "c", status: swarm.QUEUED}
+		d := &fakeTorrent{name: "d", status: swarm.QUEUED, complete: true}
+		e := &fakeTorrent{name: "e", status: swarm.QUEUED, complete: true}
+		q := newQueue(Limits{MaxDownloads: 2, MaxSeeds: 1}, a, b, c, d, e)
+
+		Convey("Torrents should be started in queue order", func() {
+			start, stop := q.Update()
+			So(names(start), ShouldResemble, []string{"a", "b", "d"})
+			So(stop, ShouldBeEmpty)
+		})
+
+		Convey("Torrents that are already running should be left alone", func() {
+			apply(q.Update())
+			start, stop := q.Update()
+			So(start, ShouldBeEmpty)
+			So(stop, ShouldBeEmpty)
+		})
+
+		Convey("The total limit should apply to downloads and seeds", func() {
+			q.SetLimits(Limits{MaxDownloads: 2, MaxSeeds: 1, MaxActive: 2})
+			start, _ := q.Update()
+			So(names(start), ShouldResemble, []string{"a", "b"})
+		})
+
+		Convey("Paused torrents should be skipped", func() {
+			a.status = swarm.PAUSED
+			start, _ := q.Update()
+			So(names(start), ShouldResemble, []string{"b", "c", "d"})
+		})
+
+		Convey("Moving a torrent up should make it take a running torrent's slot", func() {
+			apply(q.Update())
+			So(q.MoveUp(c), ShouldBeNil)
+			So(q.Position(c), ShouldEqual, 1)
+
+			start, stop := q.Update()
+			So(names(start), ShouldResemble, []string{"c"})
+			So(names(stop), ShouldResemble, []string{"b"})
+		})
+
+		Convey("Positions past the end should move torrents to the end", func() {
+			So(q.SetPosition(a, 10), ShouldBeNil)
+			So(q.Position(a), ShouldEqual, 4)
+			So(q.SetPosition(a, -1), ShouldBeNil)
+			So(q.Position(a), ShouldEqual, 0)
+			So(q.MoveDown(a), ShouldBeNil)
+			So(q.Position(a), ShouldEqual, 1)
+		})
+
+		Convey("Removed torrents should free their slot", func() {
+			apply(q.Update())
+			q.Remove(a)
+			So(q.Position(a), ShouldEqual, -1)
+			So(q.MoveUp(a), ShouldEqual, NotQueuedError)
+
+			start, _ := q.Update()
+			So(names(start), ShouldResemble, []string{"c"})
+		})
+
+		Convey("Forced torrents should bypass the queue", func() {
+			So(q.SetForced(e, true), ShouldBeNil)
+			So(q.IsForced(e), ShouldBeTrue)
+
+			start, _ := q.Update()
+			So(names(start), ShouldResemble, []string{"a", "b", "d", "e"})
+
+			Convey("and not take up a slot", func() {
+				apply(start, nil)
+				So(q.MoveUp(e), ShouldBeNil)
+				_, stop := q.Update()
+				So(stop, ShouldBeEmpty)
+			})
+		})
+
+		Convey("A download that finishes should move to a seed slot", func() {
+			apply(q.Update())
+			a.status = swarm.SEEDING
+			a.complete = true
+
+			start, stop := q.Update()
+			So(names(start), ShouldResemble, []string{"c"})
+			So(names(stop), ShouldResemble, []string{"d"})
+		})
+	})
+
+	Convey("Given a queue with an inactive rate", t, func() {
+		now := time.Unix(1000, 0)
+		a := &fakeTorrent{name: "a", status: swarm.QUEUED}
+		b := &fakeTorrent{name: "b", status: swarm.QUEUED}
+		q := newQueue(Limits{MaxDownloads: 1, InactiveRate: 1000}, a, b)
+		q.clock = func() time.Time { return now }
+		apply(q.Update())
+
+		Convey("Torrents that just started should take up a slot", func() {
+			now = now.Add(time.Minute)
+			start, _ := q.Update()
+			So(start, ShouldBeEmpty)
+		})
+
+		Convey("Slow torrents should stop taking up a slot", func() {
+			now = now.Add(INACTIVE_GRACE_PERIOD)
+			a.bytes += 100
+			start, _ := q.Update()
+			So(names(start), ShouldResemble, []string{"b"})
+		})
+
+		Convey("Torrents above the rate should keep their slot", func() {
+			now = now.Add(INACTIVE_GRACE_PERIOD)
+			a.bytes += 1000 * int64(INACTIVE_GRACE_PERIOD/time.Second)
+			start, _ := q.Update()
+			So(start, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,86 @@
+// Package ratelimit limits transfer rates and switches between the normal
+// and alternative limits on a schedule
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by every connection it limits. Up to a
+// second's worth of bytes may be sent in a burst. A nil Limiter doesn't
+// limit anything.
+type Limiter struct {
+	// Bytes per second, zero for no limit
+	rate   int
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rate
+}
+
+// SetRate changes the limit in bytes per second, zero removes it
+func (l *Limiter) SetRate(rate int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if rate > 0 && l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.rate = rate
+}
+
+// Wait blocks until n more bytes may be transferred
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	d := l.reserve(n, time.Now())
+	l.lock.Unlock()
+
+	time.Sleep(d)
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait
+// before they may be used. The bucket goes into debt so transfers
+// waiting at the same time take turns.
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	if l.rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return 0
+	}
+
+	// The bucket starts out full
+	if l.last.IsZero() {
+		l.tokens = float64(l.rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	}
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
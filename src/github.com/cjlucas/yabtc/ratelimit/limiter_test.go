@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLimiter(t *testing.T) {
+	Convey("Given a limiter", t, func() {
+		l := NewLimiter(1000)
+		now := time.Unix(1000, 0)
+
+		Convey("A second's worth of bytes should go through at once", func() {
+			So(l.reserve(1000, now), ShouldEqual, 0)
+		})
+
+		Convey("Bytes past the burst should wait for the rate", func() {
+			So(l.reserve(1000, now), ShouldEqual, 0)
+			So(l.reserve(500, now), ShouldEqual, 500*time.Millisecond)
+			So(l.reserve(500, now), ShouldEqual, time.Second)
+		})
+
+		Convey("The bucket should refill over time", func() {
+			l.reserve(1500, now)
+			So(l.reserve(750, now.Add(time.Second)), ShouldEqual, 250*time.Millisecond)
+		})
+
+		Convey("The bucket should hold no more than a second's worth", func() {
+			l.reserve(0, now)
+			So(l.reserve(1500, now.Add(time.Minute)), ShouldEqual, 500*time.Millisecond)
+		})
+
+		Convey("Removing the limit should let everything through", func() {
+			l.reserve(5000, now)
+			l.SetRate(0)
+			So(l.reserve(1<<20, now), ShouldEqual, 0)
+			So(l.Rate(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("A nil limiter shouldn't limit anything", t, func() {
+		var l *Limiter
+		l.Wait(1 << 30)
+		So(l.Rate(), ShouldEqual, 0)
+	})
+}
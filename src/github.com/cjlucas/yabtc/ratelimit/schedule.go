@@ -0,0 +1,292 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the scheduler checks whether it should switch limits
+const SCHEDULE_CHECK_INTERVAL = 15 * time.Second
+
+// Limits are download and upload rates in bytes per second, zero for no
+// limit
+type Limits struct {
+	Download int
+	Upload   int
+}
+
+// Schedule is when the alternative limits are used: on the given days,
+// from Begin until End as times since midnight. A range that ends before
+// it begins runs past midnight into the next day.
+type Schedule struct {
+	Days  []time.Weekday
+	Begin time.Duration
+	End   time.Duration
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseDay(s string) (time.Weekday, error) {
+	for i, name := range dayNames {
+		if name == s {
+			return time.Weekday(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown day: %s", s)
+}
+
+// parseDays parses a comma separated list of days and day ranges
+// such as "mon-fri" or "sat,sun". "all" is every day.
+func parseDays(s string) ([]time.Weekday, error) {
+	if s == "all" {
+		s = "sun-sat"
+	}
+
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := parseDay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseDay(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		// Ranges may wrap around the end of the week
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeOfDay parses HH:MM as the time since midnight, up to 24:00
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); n != 2 || err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	if hours < 0 || minutes < 0 || minutes > 59 || d > 24*time.Hour {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+	return d, nil
+}
+
+// ParseSchedule parses schedules such as "mon-fri 09:00-17:00"
+func ParseSchedule(s string) (*Schedule, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid schedule: %s", s)
+	}
+
+	days, err := parseDays(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid time range: %s", fields[1])
+	}
+	begin, err := parseTimeOfDay(times[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(times[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Schedule{days, begin, end}, nil
+}
+
+func (sc *Schedule) hasDay(day time.Weekday) bool {
+	for _, d := range sc.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether the alternative limits are used at t
+func (sc *Schedule) Contains(t time.Time) bool {
+	since := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if sc.Begin <= sc.End {
+		return sc.hasDay(t.Weekday()) && since >= sc.Begin && since < sc.End
+	}
+
+	// The range started the day before if it's past midnight
+	yesterday := (t.Weekday() + 6) % 7
+	return (sc.hasDay(t.Weekday()) && since >= sc.Begin) ||
+		(sc.hasDay(yesterday) && since < sc.End)
+}
+
+type Event struct {
+	// Whether the alternative limits are in use
+	Alternative bool
+	Limits      Limits
+	// Set while the manual override decides which limits are used
+	Manual bool
+}
+
+// Scheduler switches between the normal and alternative limits. Every
+// switch, and every change to the limits in use, is sent on EventChan.
+type Scheduler struct {
+	EventChan chan Event
+
+	normal      Limits
+	alternative Limits
+	schedule    *Schedule
+	active      bool
+
+	// The override lasts until the schedule next switches by itself
+	overridden        bool
+	overrideActive    bool
+	overrideScheduled bool
+
+	clock func() time.Time
+	lock  sync.Mutex
+}
+
+// NewScheduler starts out with the normal limits. A nil schedule never
+// uses the alternative limits unless they're switched on by hand.
+func NewScheduler(normal, alternative Limits, schedule *Schedule) *Scheduler {
+	s := &Scheduler{}
+	s.EventChan = make(chan Event, 10)
+	s.normal = normal
+	s.alternative = alternative
+	s.schedule = schedule
+	s.clock = time.Now
+
+	return s
+}
+
+// Limits returns the limits in use
+func (s *Scheduler) Limits() Limits {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.limits()
+}
+
+func (s *Scheduler) limits() Limits {
+	if s.active {
+		return s.alternative
+	}
+	return s.normal
+}
+
+func (s *Scheduler) IsAlternative() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.active
+}
+
+func (s *Scheduler) SetLimits(normal, alternative Limits) {
+	s.lock.Lock()
+	before := s.limits()
+	s.normal = normal
+	s.alternative = alternative
+	changed := before != s.limits()
+	s.lock.Unlock()
+
+	if changed {
+		s.send()
+	}
+	s.Update()
+}
+
+func (s *Scheduler) SetSchedule(schedule *Schedule) {
+	s.lock.Lock()
+	s.schedule = schedule
+	s.lock.Unlock()
+
+	s.Update()
+}
+
+// Toggle switches to the other limits by hand, until the schedule
+// would switch by itself or ClearOverride is called
+func (s *Scheduler) Toggle() {
+	s.lock.Lock()
+	s.overridden = true
+	s.overrideActive = !s.active
+	s.overrideScheduled = s.scheduled()
+	s.lock.Unlock()
+
+	s.Update()
+}
+
+// SetAlternative switches the alternative limits on or off by hand,
+// like Toggle
+func (s *Scheduler) SetAlternative(on bool) {
+	if s.IsAlternative() != on {
+		s.Toggle()
+	}
+}
+
+// ClearOverride goes back to following the schedule
+func (s *Scheduler) ClearOverride() {
+	s.lock.Lock()
+	s.overridden = false
+	s.lock.Unlock()
+
+	s.Update()
+}
+
+func (s *Scheduler) scheduled() bool {
+	return s.schedule != nil && s.schedule.Contains(s.clock())
+}
+
+// Update switches limits if the schedule or the override calls for it
+func (s *Scheduler) Update() {
+	s.lock.Lock()
+	scheduled := s.scheduled()
+	if s.overridden && scheduled != s.overrideScheduled {
+		s.overridden = false
+	}
+
+	active := scheduled
+	if s.overridden {
+		active = s.overrideActive
+	}
+	changed := active != s.active
+	s.active = active
+	s.lock.Unlock()
+
+	if changed {
+		s.send()
+	}
+}
+
+func (s *Scheduler) send() {
+	s.lock.Lock()
+	e := Event{s.active, s.limits(), s.overridden}
+	s.lock.Unlock()
+
+	s.EventChan <- e
+}
+
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(SCHEDULE_CHECK_INTERVAL)
+	for range ticker.C {
+		s.Update()
+	}
+}
@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// 2024-01-01 was a Monday
+func at(day, hour, minute int) time.Time {
+	return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+}
+
+func nextEvent(s *Scheduler) *Event {
+	select {
+	case e := <-s.EventChan:
+		return &e
+	default:
+		return nil
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	Convey("Schedules should be parsed", t, func() {
+		sc, err := ParseSchedule("mon-fri 09:00-17:30")
+		So(err, ShouldBeNil)
+		So(sc.Days, ShouldResemble, []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday})
+		So(sc.Begin, ShouldEqual, 9*time.Hour)
+		So(sc.End, ShouldEqual, 17*time.Hour+30*time.Minute)
+	})
+
+	Convey("Day lists and ranges wrapping around the week should be parsed", t, func() {
+		sc, err := ParseSchedule("Fri-Sun,wed 22:00-06:00")
+		So(err, ShouldBeNil)
+		So(sc.Days, ShouldResemble, []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Wednesday})
+
+		sc, err = ParseSchedule("all 00:00-24:00")
+		So(err, ShouldBeNil)
+		So(len(sc.Days), ShouldEqual, 7)
+	})
+
+	Convey("Invalid schedules should be rejected", t, func() {
+		for _, s := range []string{"", "mon-fri", "mon-fry 09:00-17:00", "mon 09:00", "mon 09:60-10:00", "mon 09:00-25:00"} {
+			_, err := ParseSchedule(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	Convey("Given an office hours schedule", t, func() {
+		sc, _ := ParseSchedule("mon-fri 09:00-17:00")
+
+		Convey("It should only contain times within the range on its days", func() {
+			So(sc.Contains(at(1, 9, 0)), ShouldBeTrue)
+			So(sc.Contains(at(5, 16, 59)), ShouldBeTrue)
+			So(sc.Contains(at(1, 8, 59)), ShouldBeFalse)
+			So(sc.Contains(at(1, 17, 0)), ShouldBeFalse)
+			So(sc.Contains(at(6, 12, 0)), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a schedule past midnight", t, func() {
+		sc, _ := ParseSchedule("fri 22:00-06:00")
+
+		Convey("It should run into the next day", func() {
+			So(sc.Contains(at(5, 23, 0)), ShouldBeTrue)
+			So(sc.Contains(at(6, 5, 59)), ShouldBeTrue)
+			So(sc.Contains(at(6, 6, 0)), ShouldBeFalse)
+			So(sc.Contains(at(5, 5, 0)), ShouldBeFalse)
+			So(sc.Contains(at(6, 23, 0)), ShouldBeFalse)
+		})
+	})
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("Given a scheduler with office hours", t, func() {
+		normal := Limits{Download: 0, Upload: 0}
+		alt := Limits{Download: 100 << 10, Upload: 20 << 10}
+		sc, _ := ParseSchedule("mon-fri 09:00-17:00")
+		s := NewScheduler(normal, alt, sc)
+		now := at(1, 8, 0)
+		s.clock = func() time.Time { return now }
+		s.Update()
+
+		Convey("It should start with the normal limits", func() {
+			So(s.Limits(), ShouldResemble, normal)
+			So(nextEvent(s), ShouldBeNil)
+		})
+
+		Convey("It should switch when office hours start and end", func() {
+			now = at(1, 9, 0)
+			s.Update()
+			So(nextEvent(s), ShouldResemble, &Event{true, alt, false})
+			So(s.IsAlternative(), ShouldBeTrue)
+
+			s.Update()
+			So(nextEvent(s), ShouldBeNil)
+
+			now = at(1, 17, 0)
+			s.Update()
+			So(nextEvent(s), ShouldResemble, &Event{false, normal, false})
+		})
+
+		Convey("Toggling should override the schedule", func() {
+			s.Toggle()
+			So(nextEvent(s), ShouldResemble, &Event{true, alt, true})
+
+			Convey("until the schedule switches by itself", func() {
+				now = at(1, 9, 0)
+				s.Update()
+				So(nextEvent(s), ShouldBeNil)
+
+				now = at(1, 17, 0)
+				s.Update()
+				So(nextEvent(s), ShouldResemble, &Event{false, normal, false})
+			})
+
+			Convey("until the override is cleared", func() {
+				s.ClearOverride()
+				So(nextEvent(s), ShouldResemble, &Event{false, normal, false})
+			})
+		})
+
+		Convey("Turning the alternative limits off during office hours should last until they end", func() {
+			now = at(1, 10, 0)
+			s.Update()
+			nextEvent(s)
+
+			s.SetAlternative(false)
+			So(nextEvent(s), ShouldResemble, &Event{false, normal, true})
+			s.SetAlternative(false)
+			So(nextEvent(s), ShouldBeNil)
+
+			now = at(1, 16, 0)
+			s.Update()
+			So(s.IsAlternative(), ShouldBeFalse)
+		})
+
+		Convey("Changing the limits in use should be sent", func() {
+			faster := Limits{Download: 1 << 20}
+			s.SetLimits(faster, alt)
+			So(nextEvent(s), ShouldResemble, &Event{false, faster, false})
+
+			s.SetLimits(faster, normal)
+			So(nextEvent(s), ShouldBeNil)
+		})
+	})
+}
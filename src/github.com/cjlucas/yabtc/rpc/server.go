@@ -0,0 +1,292 @@
+// Package rpc serves Transmission's JSON-RPC protocol, so clients made for
+// Transmission such as Transmission Remote GUI can manage torrents
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+)
+
+const RPC_PATH = "/transmission/rpc"
+
+// Clients have to echo the session id back, which keeps other websites
+// from making requests through the user's browser
+const SESSION_ID_HEADER = "X-Transmission-Session-Id"
+
+const (
+	RPC_VERSION         = 17
+	RPC_VERSION_MINIMUM = 14
+)
+
+// How long removed torrents are reported to clients asking for
+// recently active torrents
+const RECENTLY_REMOVED_PERIOD = time.Minute
+
+// Largest request body accepted, metainfo included
+const MAX_REQUEST_SIZE = 16 << 20
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+type handler func(srv *Server, args json.RawMessage) (interface{}, error)
+
+var handlers = map[string]handler{
+	"session-get":          (*Server).sessionGet,
+	"session-set":          (*Server).sessionSet,
+	"session-stats":        (*Server).sessionStats,
+	"free-space":           (*Server).freeSpace,
+	"torrent-get":          (*Server).torrentGet,
+	"torrent-add":          (*Server).torrentAdd,
+	"torrent-remove":       (*Server).torrentRemove,
+	"torrent-start":        (*Server).torrentStart,
+	"torrent-start-now":    (*Server).torrentStartNow,
+	"torrent-stop":         (*Server).torrentStop,
+	"torrent-verify":       (*Server).torrentVerify,
+	"torrent-set":          (*Server).torrentSet,
+	"torrent-set-location": (*Server).torrentSetLocation,
+	"queue-move-top":       (*Server).queueMoveTop,
+	"queue-move-up":        (*Server).queueMoveUp,
+	"queue-move-down":      (*Server).queueMoveDown,
+	"queue-move-bottom":    (*Server).queueMoveBottom,
+}
+
+// seedModes are a torrent's seeding limits as Transmission clients see
+// them: each one follows the session (0), its own limit (1) or is
+// unlimited (2)
+type seedModes struct {
+	ratioMode  int
+	ratioLimit float64
+	idleMode   int
+	idleLimit  int
+}
+
+type rateSample struct {
+	downloaded, uploaded int
+	at                   time.Time
+	download, upload     int
+}
+
+type Server struct {
+	session   Session
+	sessionId string
+	username  string
+	password  string
+
+	// Transmission identifies torrents by small integers that stay the
+	// same for as long as the server runs
+	ids     map[*swarm.Swarm]int
+	nextId  int
+	removed map[int]time.Time
+
+	modes   map[*swarm.Swarm]*seedModes
+	samples map[*swarm.Swarm]*rateSample
+
+	clock func() time.Time
+	lock  sync.Mutex
+}
+
+func New(session Session) *Server {
+	srv := &Server{session: session}
+	srv.sessionId = newSessionId()
+	srv.ids = make(map[*swarm.Swarm]int)
+	srv.nextId = 1
+	srv.removed = make(map[int]time.Time)
+	srv.modes = make(map[*swarm.Swarm]*seedModes)
+	srv.samples = make(map[*swarm.Swarm]*rateSample)
+	srv.clock = time.Now
+
+	return srv
+}
+
+func newSessionId() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SetAuth requires clients to log in with HTTP basic auth
+func (srv *Server) SetAuth(username, password string) {
+	srv.username = username
+	srv.password = password
+}
+
+func (srv *Server) authorized(r *http.Request) bool {
+	if srv.username == "" && srv.password == "" {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(srv.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(srv.password)) == 1
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != RPC_PATH {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !srv.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// The first request from a client always fails this way, clients
+	// are expected to retry with the id they're given
+	w.Header().Set(SESSION_ID_HEADER, srv.sessionId)
+	if r.Header.Get(SESSION_ID_HEADER) != srv.sessionId {
+		http.Error(w, "invalid session id", http.StatusConflict)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := srv.handle(&req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (srv *Server) handle(req *request) *response {
+	resp := &response{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+
+	h, ok := handlers[req.Method]
+	if !ok {
+		resp.Result = "method name not recognized"
+		return resp
+	}
+
+	args := req.Arguments
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage("{}")
+	}
+
+	result, err := h(srv, args)
+	if err != nil {
+		resp.Result = err.Error()
+	} else if result != nil {
+		resp.Arguments = result
+	}
+	return resp
+}
+
+// refreshIds hands out ids to new torrents and forgets removed ones.
+// srv.lock must be held.
+func (srv *Server) refreshIds(swarms []*swarm.Swarm) {
+	now := srv.clock()
+	present := make(map[*swarm.Swarm]bool, len(swarms))
+	for _, s := range swarms {
+		present[s] = true
+		if _, ok := srv.ids[s]; !ok {
+			srv.ids[s] = srv.nextId
+			srv.nextId++
+		}
+	}
+
+	for s, id := range srv.ids {
+		if !present[s] {
+			delete(srv.ids, s)
+			delete(srv.modes, s)
+			delete(srv.samples, s)
+			srv.removed[id] = now
+		}
+	}
+	for id, at := range srv.removed {
+		if now.Sub(at) > RECENTLY_REMOVED_PERIOD {
+			delete(srv.removed, id)
+		}
+	}
+}
+
+func (srv *Server) id(s *swarm.Swarm) int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	return srv.ids[s]
+}
+
+// recentlyRemoved returns the ids of torrents removed within the last
+// RECENTLY_REMOVED_PERIOD
+func (srv *Server) recentlyRemoved() []int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	ids := []int{}
+	for id := range srv.removed {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (srv *Server) seedModes(s *swarm.Swarm) seedModes {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if m, ok := srv.modes[s]; ok {
+		return *m
+	}
+
+	st := srv.session.Settings()
+	return seedModes{ratioLimit: st.SeedRatioLimit, idleLimit: st.IdleSeedingLimit}
+}
+
+func (srv *Server) setSeedModes(s *swarm.Swarm, m seedModes) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	srv.modes[s] = &m
+}
+
+// rates returns the swarm's download and upload rates in bytes per
+// second, measured between polls at least a second apart
+func (srv *Server) rates(s *swarm.Swarm) (int, int) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	stats := s.StatsSnapshot()
+	now := srv.clock()
+	r, ok := srv.samples[s]
+	if !ok {
+		srv.samples[s] = &rateSample{downloaded: stats.Downloaded, uploaded: stats.Uploaded, at: now}
+		return 0, 0
+	}
+
+	if elapsed := now.Sub(r.at).Seconds(); elapsed >= 1 {
+		r.download = int(float64(stats.Downloaded-r.downloaded) / elapsed)
+		r.upload = int(float64(stats.Uploaded-r.uploaded) / elapsed)
+		r.downloaded, r.uploaded, r.at = stats.Downloaded, stats.Uploaded, now
+	}
+	if !s.IsRunning() {
+		return 0, 0
+	}
+	return r.download, r.upload
+}
@@ -0,0 +1,479 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/ratelimit"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeSession struct {
+	swarms   []*swarm.Swarm
+	added    []AddOptions
+	removed  [][20]byte
+	started  [][20]byte
+	paused   [][20]byte
+	moved    map[[20]byte]string
+	goals    swarm.SeedGoals
+	tgoals   map[[20]byte]*swarm.SeedGoals
+	settings Settings
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{tgoals: make(map[[20]byte]*swarm.SeedGoals), moved: make(map[[20]byte]string)}
+}
+
+func (f *fakeSession) Swarms() []*swarm.Swarm {
+	return f.swarms
+}
+
+func (f *fakeSession) AddTorrent(t *torrent.MetaData, opts AddOptions) error {
+	for _, s := range f.swarms {
+		if s.Torrent.InfoHashString() == t.InfoHashString() {
+			return swarm.TorrentExistsError
+		}
+	}
+
+	f.added = append(f.added, opts)
+	s := swarm.New(t, storage.NewMemoryStorage(t))
+	s.SetLabels(opts.Labels)
+	f.swarms = append(f.swarms, s)
+	return nil
+}
+
+func (f *fakeSession) index(hash [20]byte) int {
+	for i, s := range f.swarms {
+		if infoHash(s) == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeSession) RemoveTorrent(infoHash [20]byte, deleteData bool) error {
+	i := f.index(infoHash)
+	f.swarms = append(f.swarms[:i], f.swarms[i+1:]...)
+	f.removed = append(f.removed, infoHash)
+	return nil
+}
+
+func (f *fakeSession) StartTorrent(infoHash [20]byte) error {
+	f.started = append(f.started, infoHash)
+	return nil
+}
+
+func (f *fakeSession) ForceStartTorrent(infoHash [20]byte) error {
+	return f.StartTorrent(infoHash)
+}
+
+func (f *fakeSession) PauseTorrent(infoHash [20]byte) error {
+	f.paused = append(f.paused, infoHash)
+	return nil
+}
+
+func (f *fakeSession) VerifyTorrent(infoHash [20]byte) error {
+	return nil
+}
+
+func (f *fakeSession) MoveStorage(infoHash [20]byte, newRoot string) error {
+	f.moved[infoHash] = newRoot
+	return nil
+}
+
+// The queue is the order the torrents were added in
+func (f *fakeSession) QueuePosition(infoHash [20]byte) (int, error) {
+	return f.index(infoHash), nil
+}
+
+func (f *fakeSession) SetQueuePosition(infoHash [20]byte, pos int) error {
+	i := f.index(infoHash)
+	s := f.swarms[i]
+	f.swarms = append(f.swarms[:i], f.swarms[i+1:]...)
+	if pos < 0 {
+		pos = 0
+	} else if pos > len(f.swarms) {
+		pos = len(f.swarms)
+	}
+	f.swarms = append(f.swarms[:pos], append([]*swarm.Swarm{s}, f.swarms[pos:]...)...)
+	return nil
+}
+
+func (f *fakeSession) SeedGoals() swarm.SeedGoals {
+	return f.goals
+}
+
+func (f *fakeSession) TorrentSeedGoals(infoHash [20]byte) *swarm.SeedGoals {
+	return f.tgoals[infoHash]
+}
+
+func (f *fakeSession) SetTorrentSeedGoals(infoHash [20]byte, goals *swarm.SeedGoals) error {
+	f.tgoals[infoHash] = goals
+	return nil
+}
+
+func (f *fakeSession) Settings() Settings {
+	return f.settings
+}
+
+func (f *fakeSession) SetSettings(st Settings) error {
+	f.settings = st
+	return nil
+}
+
+// newTestTorrent returns a two file torrent, base64 encoded as
+// torrent-add wants it
+func newTestTorrent(name string) (*torrent.MetaData, string) {
+	root, _ := ioutil.TempDir("", "yabtc-rpc")
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, name)
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), bytes.Repeat([]byte("a"), 20000), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), bytes.Repeat([]byte("b"), 10000), 0644)
+
+	t, err := torrent.Create(dir, torrent.CreateOptions{PieceLength: 1 << 14, V1: true})
+	if err != nil {
+		panic(err)
+	}
+	b, err := t.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	t, err = torrent.ParseBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return t, base64.StdEncoding.EncodeToString(b)
+}
+
+type rpcResponse struct {
+	Result    string                     `json:"result"`
+	Arguments map[string]json.RawMessage `json:"arguments"`
+	Tag       *int                       `json:"tag"`
+}
+
+// call makes a request with the server's session id
+func call(srv *Server, method string, args interface{}) *rpcResponse {
+	body, _ := json.Marshal(map[string]interface{}{"method": method, "arguments": args, "tag": 7})
+	req := httptest.NewRequest("POST", RPC_PATH, bytes.NewReader(body))
+	req.Header.Set(SESSION_ID_HEADER, srv.sessionId)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	var resp rpcResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		panic(w.Body.String())
+	}
+	return &resp
+}
+
+func torrents(resp *rpcResponse) []map[string]interface{} {
+	var t []map[string]interface{}
+	json.Unmarshal(resp.Arguments["torrents"], &t)
+	return t
+}
+
+func TestServerHTTP(t *testing.T) {
+	Convey("Given a server", t, func() {
+		srv := New(newFakeSession())
+
+		Convey("Requests without the session id should get it with a 409", func() {
+			req := httptest.NewRequest("POST", RPC_PATH, bytes.NewBufferString(`{"method":"session-get"}`))
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, http.StatusConflict)
+			So(w.Header().Get(SESSION_ID_HEADER), ShouldEqual, srv.sessionId)
+
+			req = httptest.NewRequest("POST", RPC_PATH, bytes.NewBufferString(`{"method":"session-get"}`))
+			req.Header.Set(SESSION_ID_HEADER, w.Header().Get(SESSION_ID_HEADER))
+			w = httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Other paths shouldn't be served", func() {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("With auth required", func() {
+			srv.SetAuth("user", "secret")
+
+			Convey("Requests without valid credentials should be refused", func() {
+				req := httptest.NewRequest("POST", RPC_PATH, nil)
+				req.SetBasicAuth("user", "wrong")
+				w := httptest.NewRecorder()
+				srv.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(w.Header().Get("WWW-Authenticate"), ShouldContainSubstring, "Basic")
+				So(w.Header().Get(SESSION_ID_HEADER), ShouldBeBlank)
+			})
+
+			Convey("Requests with valid credentials should be handled", func() {
+				req := httptest.NewRequest("POST", RPC_PATH, bytes.NewBufferString(`{"method":"session-get"}`))
+				req.SetBasicAuth("user", "secret")
+				req.Header.Set(SESSION_ID_HEADER, srv.sessionId)
+				w := httptest.NewRecorder()
+				srv.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("Unknown methods should fail with the tag echoed", func() {
+			resp := call(srv, "port-test", nil)
+			So(resp.Result, ShouldEqual, "method name not recognized")
+			So(*resp.Tag, ShouldEqual, 7)
+		})
+	})
+}
+
+func TestSession(t *testing.T) {
+	Convey("Given a server", t, func() {
+		session := newFakeSession()
+		session.settings = Settings{DownloadDir: "/downloads", SpeedLimitDown: 100, PeerPort: 6881}
+		srv := New(session)
+
+		Convey("session-get should return every setting", func() {
+			resp := call(srv, "session-get", nil)
+			So(resp.Result, ShouldEqual, "success")
+			So(string(resp.Arguments["download-dir"]), ShouldEqual, `"/downloads"`)
+			So(string(resp.Arguments["rpc-version"]), ShouldEqual, "17")
+			So(string(resp.Arguments["speed-limit-down"]), ShouldEqual, "100")
+		})
+
+		Convey("session-get should only return the fields asked for", func() {
+			resp := call(srv, "session-get", map[string]interface{}{"fields": []string{"peer-port"}})
+			So(len(resp.Arguments), ShouldEqual, 1)
+			So(string(resp.Arguments["peer-port"]), ShouldEqual, "6881")
+		})
+
+		Convey("session-set should only change the settings given", func() {
+			resp := call(srv, "session-set", map[string]interface{}{"speed-limit-up": 50, "peer-port": 1})
+			So(resp.Result, ShouldEqual, "success")
+			So(session.settings.SpeedLimitUp, ShouldEqual, 50)
+			So(session.settings.SpeedLimitDown, ShouldEqual, 100)
+			So(session.settings.PeerPort, ShouldEqual, 6881)
+		})
+
+		Convey("free-space should report the space left", func() {
+			dir, _ := ioutil.TempDir("", "yabtc-rpc")
+			defer os.RemoveAll(dir)
+
+			resp := call(srv, "free-space", map[string]interface{}{"path": dir})
+			So(resp.Result, ShouldEqual, "success")
+			var size int64
+			json.Unmarshal(resp.Arguments["size-bytes"], &size)
+			So(size, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestSettings(t *testing.T) {
+	Convey("Schedules should convert to and from Transmission's settings", t, func() {
+		sc, _ := ratelimit.ParseSchedule("mon-fri 09:00-17:30")
+		var st Settings
+		st.SetSchedule(sc)
+		So(st.AltSpeedTimeEnabled, ShouldBeTrue)
+		So(st.AltSpeedTimeDay, ShouldEqual, 2+4+8+16+32)
+		So(st.AltSpeedTimeBegin, ShouldEqual, 9*60)
+		So(st.AltSpeedTimeEnd, ShouldEqual, 17*60+30)
+		So(st.Schedule(), ShouldResemble, sc)
+
+		st.AltSpeedTimeEnabled = false
+		So(st.Schedule(), ShouldBeNil)
+	})
+
+	Convey("Disabled limits should keep their values", t, func() {
+		st := Settings{SpeedLimitDown: 100, SpeedLimitUp: 20, SpeedLimitUpEnabled: true, AltSpeedDown: 10}
+		normal, alt := st.SpeedLimits()
+		So(normal.Download, ShouldEqual, 0)
+		So(normal.Upload, ShouldEqual, 20*1024)
+		So(alt.Download, ShouldEqual, 10*1024)
+	})
+
+	Convey("Seeding limits should become goals", t, func() {
+		st := Settings{SeedRatioLimit: 2, SeedRatioLimited: true, IdleSeedingLimit: 30}
+		goals := st.SeedGoals(swarm.SeedGoals{Ratio: 1, IdleTime: time.Hour, Action: swarm.GOAL_ACTION_REMOVE})
+		So(goals, ShouldResemble, swarm.SeedGoals{Ratio: 2, Action: swarm.GOAL_ACTION_REMOVE})
+	})
+}
+
+func TestTorrents(t *testing.T) {
+	Convey("Given a server with a torrent", t, func() {
+		session := newFakeSession()
+		session.goals = swarm.SeedGoals{Ratio: 1, IdleTime: time.Hour}
+		srv := New(session)
+		tor, metainfo := newTestTorrent("first")
+
+		resp := call(srv, "torrent-add", map[string]interface{}{
+			"metainfo":       metainfo,
+			"download-dir":   "/downloads",
+			"paused":         true,
+			"labels":         []string{"linux"},
+			"files-unwanted": []int{1},
+		})
+		So(resp.Result, ShouldEqual, "success")
+		var added map[string]interface{}
+		json.Unmarshal(resp.Arguments["torrent-added"], &added)
+		s := session.swarms[0]
+		hash := infoHash(s)
+
+		Convey("torrent-add should add it with the options given", func() {
+			So(added["id"], ShouldEqual, 1)
+			So(added["hashString"], ShouldEqual, tor.InfoHashString())
+			So(session.added, ShouldResemble, []AddOptions{{"/downloads", true, []string{"linux"}}})
+			So(s.FilePriority(1), ShouldEqual, swarm.PRIORITY_SKIP)
+		})
+
+		Convey("A torrent added unpaused should only start once its files are picked", func() {
+			other, metainfo := newTestTorrent("second")
+			resp := call(srv, "torrent-add", map[string]interface{}{
+				"metainfo":       metainfo,
+				"files-unwanted": []int{0},
+			})
+			So(resp.Result, ShouldEqual, "success")
+
+			So(session.added[1].Paused, ShouldBeTrue)
+			So(session.swarms[1].FilePriority(0), ShouldEqual, swarm.PRIORITY_SKIP)
+			var hash [20]byte
+			copy(hash[:], other.InfoHash())
+			So(session.started, ShouldResemble, [][20]byte{hash})
+		})
+
+		Convey("A torrent with invalid file arguments should not be added", func() {
+			_, metainfo := newTestTorrent("second")
+			resp := call(srv, "torrent-add", map[string]interface{}{
+				"metainfo":     metainfo,
+				"files-wanted": []int{5},
+			})
+			So(resp.Result, ShouldNotEqual, "success")
+			So(len(session.swarms), ShouldEqual, 1)
+			So(session.started, ShouldBeEmpty)
+		})
+
+		Convey("Adding it again should report the duplicate", func() {
+			resp := call(srv, "torrent-add", map[string]interface{}{"metainfo": metainfo})
+			So(resp.Result, ShouldEqual, "success")
+			So(resp.Arguments, ShouldContainKey, "torrent-duplicate")
+			So(len(session.swarms), ShouldEqual, 1)
+		})
+
+		Convey("torrent-get should return the fields asked for", func() {
+			resp := call(srv, "torrent-get", map[string]interface{}{
+				"ids":    []interface{}{1},
+				"fields": []string{"id", "name", "status", "totalSize", "sizeWhenDone", "labels", "wanted", "files", "bogus"},
+			})
+			So(resp.Result, ShouldEqual, "success")
+			ts := torrents(resp)
+			So(len(ts), ShouldEqual, 1)
+			So(ts[0]["name"], ShouldEqual, "first")
+			So(ts[0]["status"], ShouldEqual, STATUS_STOPPED)
+			So(ts[0]["totalSize"], ShouldEqual, 30000)
+			So(ts[0]["sizeWhenDone"], ShouldEqual, 20000)
+			So(ts[0]["labels"], ShouldResemble, []interface{}{"linux"})
+			So(ts[0]["wanted"], ShouldResemble, []interface{}{1.0, 0.0})
+			So(len(ts[0]["files"].([]interface{})), ShouldEqual, 2)
+			So(ts[0], ShouldNotContainKey, "bogus")
+		})
+
+		Convey("Torrents should be found by info hash", func() {
+			resp := call(srv, "torrent-get", map[string]interface{}{
+				"ids":    tor.InfoHashString(),
+				"fields": []string{"id"},
+			})
+			So(len(torrents(resp)), ShouldEqual, 1)
+
+			resp = call(srv, "torrent-get", map[string]interface{}{
+				"ids":    []interface{}{2},
+				"fields": []string{"id"},
+			})
+			So(torrents(resp), ShouldBeEmpty)
+		})
+
+		Convey("torrent-start and torrent-stop should go to the session", func() {
+			call(srv, "torrent-start", map[string]interface{}{"ids": 1})
+			call(srv, "torrent-stop", nil)
+			So(session.started, ShouldResemble, [][20]byte{hash})
+			So(session.paused, ShouldResemble, [][20]byte{hash})
+		})
+
+		Convey("torrent-set-location should move the data", func() {
+			resp := call(srv, "torrent-set-location", map[string]interface{}{"ids": 1, "location": "/nas", "move": true})
+			So(resp.Result, ShouldEqual, "success")
+			So(session.moved, ShouldResemble, map[[20]byte]string{hash: "/nas"})
+		})
+
+		Convey("torrent-set-location should refuse to only point at a new location", func() {
+			resp := call(srv, "torrent-set-location", map[string]interface{}{"ids": 1, "location": "/nas"})
+			So(resp.Result, ShouldNotEqual, "success")
+			So(session.moved, ShouldBeEmpty)
+		})
+
+		Convey("torrent-set should change file priorities", func() {
+			resp := call(srv, "torrent-set", map[string]interface{}{
+				"ids":           1,
+				"files-wanted":  []int{},
+				"priority-high": []int{0},
+			})
+			So(resp.Result, ShouldEqual, "success")
+			So(s.FilePriority(0), ShouldEqual, swarm.PRIORITY_HIGH)
+			So(s.FilePriority(1), ShouldEqual, swarm.PRIORITY_NORMAL)
+
+			resp = call(srv, "torrent-set", map[string]interface{}{"ids": 1, "files-wanted": []int{5}})
+			So(resp.Result, ShouldNotEqual, "success")
+		})
+
+		Convey("torrent-set should set the torrent's own seeding goals", func() {
+			call(srv, "torrent-set", map[string]interface{}{"ids": 1, "seedRatioMode": 1, "seedRatioLimit": 3})
+			So(session.tgoals[hash], ShouldResemble, &swarm.SeedGoals{Ratio: 3, IdleTime: time.Hour})
+
+			call(srv, "torrent-set", map[string]interface{}{"ids": 1, "seedIdleMode": 2})
+			So(session.tgoals[hash], ShouldResemble, &swarm.SeedGoals{Ratio: 3})
+
+			resp := call(srv, "torrent-get", map[string]interface{}{"ids": 1, "fields": []string{"seedRatioMode", "seedRatioLimit"}})
+			So(torrents(resp)[0]["seedRatioMode"], ShouldEqual, SEED_MODE_SINGLE)
+			So(torrents(resp)[0]["seedRatioLimit"], ShouldEqual, 3)
+
+			call(srv, "torrent-set", map[string]interface{}{"ids": 1, "seedRatioMode": 0, "seedIdleMode": 0})
+			So(session.tgoals[hash], ShouldBeNil)
+		})
+
+		Convey("Given a second torrent", func() {
+			_, metainfo := newTestTorrent("second")
+			call(srv, "torrent-add", map[string]interface{}{"metainfo": metainfo})
+			second := session.swarms[1]
+
+			Convey("queue-move-top should move it to the front", func() {
+				call(srv, "queue-move-top", map[string]interface{}{"ids": 2})
+				So(session.swarms[0], ShouldEqual, second)
+
+				call(srv, "queue-move-down", map[string]interface{}{"ids": 2})
+				So(session.swarms[1], ShouldEqual, second)
+			})
+
+			Convey("torrent-remove should report it as removed", func() {
+				resp := call(srv, "torrent-remove", map[string]interface{}{"ids": 2, "delete-local-data": true})
+				So(resp.Result, ShouldEqual, "success")
+				So(session.removed, ShouldResemble, [][20]byte{infoHash(second)})
+
+				resp = call(srv, "torrent-get", map[string]interface{}{"ids": "recently-active", "fields": []string{"id"}})
+				So(string(resp.Arguments["removed"]), ShouldEqual, "[2]")
+			})
+		})
+	})
+}
@@ -0,0 +1,315 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/queue"
+	"github.com/cjlucas/yabtc/ratelimit"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+type AddOptions struct {
+	// Empty for the session's download directory
+	DownloadDir string
+	Paused      bool
+	Labels      []string
+}
+
+// Session is the client the server manages. Torrents are identified by
+// their info hash.
+type Session interface {
+	// Every torrent, in the order they were added
+	Swarms() []*swarm.Swarm
+	// AddTorrent returns swarm.TorrentExistsError for duplicates
+	AddTorrent(t *torrent.MetaData, opts AddOptions) error
+	RemoveTorrent(infoHash [20]byte, deleteData bool) error
+
+	StartTorrent(infoHash [20]byte) error
+	// ForceStartTorrent starts the torrent even if the queue is full
+	ForceStartTorrent(infoHash [20]byte) error
+	PauseTorrent(infoHash [20]byte) error
+	VerifyTorrent(infoHash [20]byte) error
+	// MoveStorage moves the torrent's data, returning once it's moved
+	MoveStorage(infoHash [20]byte, newRoot string) error
+
+	QueuePosition(infoHash [20]byte) (int, error)
+	SetQueuePosition(infoHash [20]byte, pos int) error
+
+	SeedGoals() swarm.SeedGoals
+	// TorrentSeedGoals returns nil for torrents following SeedGoals
+	TorrentSeedGoals(infoHash [20]byte) *swarm.SeedGoals
+	SetTorrentSeedGoals(infoHash [20]byte, goals *swarm.SeedGoals) error
+
+	Settings() Settings
+	SetSettings(st Settings) error
+}
+
+// Settings are the session's settings under Transmission's names and
+// units: speeds are in KiB/s, times in minutes.
+type Settings struct {
+	DownloadDir string `json:"download-dir"`
+
+	SpeedLimitDown        int  `json:"speed-limit-down"`
+	SpeedLimitDownEnabled bool `json:"speed-limit-down-enabled"`
+	SpeedLimitUp          int  `json:"speed-limit-up"`
+	SpeedLimitUpEnabled   bool `json:"speed-limit-up-enabled"`
+
+	AltSpeedDown        int  `json:"alt-speed-down"`
+	AltSpeedUp          int  `json:"alt-speed-up"`
+	AltSpeedEnabled     bool `json:"alt-speed-enabled"`
+	AltSpeedTimeEnabled bool `json:"alt-speed-time-enabled"`
+	// Minutes since midnight
+	AltSpeedTimeBegin int `json:"alt-speed-time-begin"`
+	AltSpeedTimeEnd   int `json:"alt-speed-time-end"`
+	// Days as a bitmask, Sunday is 1 and Saturday is 64
+	AltSpeedTimeDay int `json:"alt-speed-time-day"`
+
+	DownloadQueueEnabled bool `json:"download-queue-enabled"`
+	DownloadQueueSize    int  `json:"download-queue-size"`
+	SeedQueueEnabled     bool `json:"seed-queue-enabled"`
+	SeedQueueSize        int  `json:"seed-queue-size"`
+
+	SeedRatioLimit          float64 `json:"seedRatioLimit"`
+	SeedRatioLimited        bool    `json:"seedRatioLimited"`
+	IdleSeedingLimit        int     `json:"idle-seeding-limit"`
+	IdleSeedingLimitEnabled bool    `json:"idle-seeding-limit-enabled"`
+
+	// Reported to clients but can't be changed over RPC
+	PeerPort   int  `json:"peer-port"`
+	PexEnabled bool `json:"pex-enabled"`
+	LpdEnabled bool `json:"lpd-enabled"`
+	DhtEnabled bool `json:"dht-enabled"`
+}
+
+// SpeedLimits returns the normal and alternative limits in bytes per
+// second
+func (st *Settings) SpeedLimits() (ratelimit.Limits, ratelimit.Limits) {
+	var normal ratelimit.Limits
+	if st.SpeedLimitDownEnabled {
+		normal.Download = st.SpeedLimitDown * 1024
+	}
+	if st.SpeedLimitUpEnabled {
+		normal.Upload = st.SpeedLimitUp * 1024
+	}
+
+	alt := ratelimit.Limits{Download: st.AltSpeedDown * 1024, Upload: st.AltSpeedUp * 1024}
+	return normal, alt
+}
+
+// SetSpeedLimits sets the limits from bytes per second
+func (st *Settings) SetSpeedLimits(normal, alt ratelimit.Limits) {
+	st.SpeedLimitDown = normal.Download / 1024
+	st.SpeedLimitDownEnabled = normal.Download > 0
+	st.SpeedLimitUp = normal.Upload / 1024
+	st.SpeedLimitUpEnabled = normal.Upload > 0
+	st.AltSpeedDown = alt.Download / 1024
+	st.AltSpeedUp = alt.Upload / 1024
+}
+
+// Schedule returns when the alternative limits are used, nil if the
+// schedule is turned off
+func (st *Settings) Schedule() *ratelimit.Schedule {
+	if !st.AltSpeedTimeEnabled {
+		return nil
+	}
+
+	sc := &ratelimit.Schedule{
+		Begin: time.Duration(st.AltSpeedTimeBegin) * time.Minute,
+		End:   time.Duration(st.AltSpeedTimeEnd) * time.Minute,
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if st.AltSpeedTimeDay&(1<<uint(d)) != 0 {
+			sc.Days = append(sc.Days, d)
+		}
+	}
+	return sc
+}
+
+// SetSchedule turns the schedule off if sc is nil
+func (st *Settings) SetSchedule(sc *ratelimit.Schedule) {
+	st.AltSpeedTimeEnabled = sc != nil
+	if sc == nil {
+		return
+	}
+
+	st.AltSpeedTimeBegin = int(sc.Begin / time.Minute)
+	st.AltSpeedTimeEnd = int(sc.End / time.Minute)
+	st.AltSpeedTimeDay = 0
+	for _, d := range sc.Days {
+		st.AltSpeedTimeDay |= 1 << uint(d)
+	}
+}
+
+// QueueLimits applies the queue settings to limits
+func (st *Settings) QueueLimits(limits queue.Limits) queue.Limits {
+	limits.MaxDownloads = 0
+	if st.DownloadQueueEnabled {
+		limits.MaxDownloads = st.DownloadQueueSize
+	}
+	limits.MaxSeeds = 0
+	if st.SeedQueueEnabled {
+		limits.MaxSeeds = st.SeedQueueSize
+	}
+	return limits
+}
+
+func (st *Settings) SetQueueLimits(limits queue.Limits) {
+	st.DownloadQueueEnabled = limits.MaxDownloads > 0
+	if limits.MaxDownloads > 0 {
+		st.DownloadQueueSize = limits.MaxDownloads
+	}
+	st.SeedQueueEnabled = limits.MaxSeeds > 0
+	if limits.MaxSeeds > 0 {
+		st.SeedQueueSize = limits.MaxSeeds
+	}
+}
+
+// SeedGoals applies the seeding limits to goals
+func (st *Settings) SeedGoals(goals swarm.SeedGoals) swarm.SeedGoals {
+	goals.Ratio = 0
+	if st.SeedRatioLimited {
+		goals.Ratio = st.SeedRatioLimit
+	}
+	goals.IdleTime = 0
+	if st.IdleSeedingLimitEnabled {
+		goals.IdleTime = time.Duration(st.IdleSeedingLimit) * time.Minute
+	}
+	return goals
+}
+
+func (st *Settings) SetSeedGoals(goals swarm.SeedGoals) {
+	st.SeedRatioLimited = goals.Ratio > 0
+	if goals.Ratio > 0 {
+		st.SeedRatioLimit = goals.Ratio
+	}
+	st.IdleSeedingLimitEnabled = goals.IdleTime > 0
+	if goals.IdleTime > 0 {
+		st.IdleSeedingLimit = int(goals.IdleTime / time.Minute)
+	}
+}
+
+// toMap returns the fields of v under their JSON names
+func toMap(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	rv := reflect.ValueOf(v)
+	for i := 0; i < rv.NumField(); i++ {
+		name := strings.Split(rv.Type().Field(i).Tag.Get("json"), ",")[0]
+		m[name] = rv.Field(i).Interface()
+	}
+	return m
+}
+
+func (srv *Server) sessionGet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Fields []string `json:"fields"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	m := toMap(srv.session.Settings())
+	m["version"] = "yabtc"
+	m["rpc-version"] = RPC_VERSION
+	m["rpc-version-minimum"] = RPC_VERSION_MINIMUM
+	m["session-id"] = srv.sessionId
+	m["units"] = map[string]interface{}{
+		"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+		"speed-bytes":  1024,
+		"size-units":   []string{"kB", "MB", "GB", "TB"},
+		"size-bytes":   1024,
+		"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+		"memory-bytes": 1024,
+	}
+
+	if len(req.Fields) == 0 {
+		return m, nil
+	}
+
+	filtered := make(map[string]interface{})
+	for _, f := range req.Fields {
+		if v, ok := m[f]; ok {
+			filtered[f] = v
+		}
+	}
+	return filtered, nil
+}
+
+// sessionSet changes only the settings given, the rest keep their values
+func (srv *Server) sessionSet(args json.RawMessage) (interface{}, error) {
+	st := srv.session.Settings()
+	readOnly := st
+	if err := json.Unmarshal(args, &st); err != nil {
+		return nil, err
+	}
+
+	st.PeerPort = readOnly.PeerPort
+	st.PexEnabled = readOnly.PexEnabled
+	st.LpdEnabled = readOnly.LpdEnabled
+	st.DhtEnabled = readOnly.DhtEnabled
+
+	return nil, srv.session.SetSettings(st)
+}
+
+func (srv *Server) sessionStats(args json.RawMessage) (interface{}, error) {
+	swarms := srv.session.Swarms()
+	srv.lock.Lock()
+	srv.refreshIds(swarms)
+	srv.lock.Unlock()
+
+	var active, download, upload int
+	var downloaded, uploaded, totalDownloaded, totalUploaded int64
+	for _, s := range swarms {
+		if s.IsRunning() {
+			active++
+		}
+		d, u := srv.rates(s)
+		download += d
+		upload += u
+
+		stats := s.StatsSnapshot()
+		downloaded += int64(stats.Downloaded)
+		uploaded += int64(stats.Uploaded)
+		totalDownloaded += stats.TotalDownloaded
+		totalUploaded += stats.TotalUploaded
+	}
+
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": len(swarms) - active,
+		"torrentCount":       len(swarms),
+		"downloadSpeed":      download,
+		"uploadSpeed":        upload,
+		"current-stats": map[string]interface{}{
+			"downloadedBytes": downloaded,
+			"uploadedBytes":   uploaded,
+		},
+		"cumulative-stats": map[string]interface{}{
+			"downloadedBytes": totalDownloaded,
+			"uploadedBytes":   totalUploaded,
+		},
+	}, nil
+}
+
+func (srv *Server) freeSpace(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+	if req.Path == "" {
+		return nil, errors.New("no path given")
+	}
+
+	size, err := storage.FreeSpace(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"path": req.Path, "size-bytes": size}, nil
+}
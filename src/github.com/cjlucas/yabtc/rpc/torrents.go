@@ -0,0 +1,783 @@
+package rpc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// Largest .torrent file fetched for torrent-add
+const MAX_TORRENT_SIZE = 10 << 20
+
+// Transmission's torrent statuses
+const (
+	STATUS_STOPPED = iota
+	STATUS_CHECK_WAIT
+	STATUS_CHECK
+	STATUS_DOWNLOAD_WAIT
+	STATUS_DOWNLOAD
+	STATUS_SEED_WAIT
+	STATUS_SEED
+)
+
+// Transmission reports every error we have as a local one
+const ERROR_LOCAL = 3
+
+// Seeding limit modes
+const (
+	SEED_MODE_GLOBAL = iota
+	SEED_MODE_SINGLE
+	SEED_MODE_UNLIMITED
+)
+
+func infoHash(s *swarm.Swarm) [20]byte {
+	var hash [20]byte
+	copy(hash[:], s.Torrent.InfoHash())
+	return hash
+}
+
+func matchesHash(s *swarm.Swarm, hash string) bool {
+	for _, h := range s.Torrent.InfoHashes() {
+		if strings.EqualFold(hash, fmt.Sprintf("%x", h)) {
+			return true
+		}
+	}
+	return strings.EqualFold(hash, s.Torrent.InfoHashString())
+}
+
+// selectSwarms returns the torrents picked by an ids argument: an id, an
+// info hash, "recently-active", or a list of ids and info hashes.
+// Without ids every torrent is picked.
+func (srv *Server) selectSwarms(ids json.RawMessage) ([]*swarm.Swarm, error) {
+	swarms := srv.session.Swarms()
+	srv.lock.Lock()
+	srv.refreshIds(swarms)
+	byId := make(map[int]*swarm.Swarm, len(swarms))
+	for s, id := range srv.ids {
+		byId[id] = s
+	}
+	srv.lock.Unlock()
+
+	if len(ids) == 0 || string(ids) == "null" {
+		return swarms, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(ids, &v); err != nil {
+		return nil, err
+	}
+
+	if v == "recently-active" {
+		var active []*swarm.Swarm
+		for _, s := range swarms {
+			if s.IsRunning() {
+				active = append(active, s)
+			}
+		}
+		return active, nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+
+	var selected []*swarm.Swarm
+	for _, item := range list {
+		switch id := item.(type) {
+		case float64:
+			if s, ok := byId[int(id)]; ok {
+				selected = append(selected, s)
+			}
+		case string:
+			for _, s := range swarms {
+				if matchesHash(s, id) {
+					selected = append(selected, s)
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid torrent id: %v", item)
+		}
+	}
+	return selected, nil
+}
+
+func (srv *Server) findSwarm(hash [20]byte) *swarm.Swarm {
+	for _, s := range srv.session.Swarms() {
+		if infoHash(s) == hash {
+			return s
+		}
+	}
+	return nil
+}
+
+// fileIndexes maps the files clients see to the torrent's files. Padding
+// files are left out.
+func fileIndexes(s *swarm.Swarm) []int {
+	var indexes []int
+	for i, f := range s.Torrent.Files() {
+		if !f.IsPadding() {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func status(s *swarm.Swarm) int {
+	switch s.Status() {
+	case swarm.CHECKING:
+		return STATUS_CHECK
+	case swarm.QUEUED:
+		if s.Complete() {
+			return STATUS_SEED_WAIT
+		}
+		return STATUS_DOWNLOAD_WAIT
+	case swarm.DOWNLOADING:
+		return STATUS_DOWNLOAD
+	case swarm.SEEDING:
+		return STATUS_SEED
+	}
+	return STATUS_STOPPED
+}
+
+func priority(p swarm.Priority) int {
+	switch p {
+	case swarm.PRIORITY_LOW:
+		return -1
+	case swarm.PRIORITY_HIGH:
+		return 1
+	}
+	return 0
+}
+
+// Fields torrentField knows
+var torrentFields = map[string]bool{}
+
+func init() {
+	for _, f := range []string{
+		"id", "name", "hashString", "status", "error", "errorString",
+		"isFinished", "totalSize", "sizeWhenDone", "leftUntilDone",
+		"haveValid", "percentDone", "rateDownload", "rateUpload", "eta",
+		"downloadedEver", "uploadedEver", "uploadRatio", "secondsSeeding",
+		"queuePosition", "downloadDir", "isPrivate", "comment", "creator",
+		"dateCreated", "labels", "pieceCount", "pieceSize", "trackers",
+		"files", "fileStats", "wanted", "priorities", "seedRatioLimit",
+		"seedRatioMode", "seedIdleLimit", "seedIdleMode",
+	} {
+		torrentFields[f] = true
+	}
+}
+
+// torrentField returns the value of a torrent-get field, false for fields
+// that aren't supported
+func (srv *Server) torrentField(s *swarm.Swarm, field string) (interface{}, bool) {
+	t := s.Torrent
+	switch field {
+	case "id":
+		return srv.id(s), true
+	case "name":
+		return t.Name(), true
+	case "hashString":
+		return t.InfoHashString(), true
+	case "status":
+		return status(s), true
+	case "error":
+		if s.Status() == swarm.ERROR {
+			return ERROR_LOCAL, true
+		}
+		return 0, true
+	case "errorString":
+		if err := s.Err(); err != nil && s.Status() == swarm.ERROR {
+			return err.Error(), true
+		}
+		return "", true
+	case "isFinished":
+		return !s.IsRunning() && s.Status() != swarm.QUEUED && s.Complete(), true
+	case "totalSize":
+		total := 0
+		for _, f := range t.Files() {
+			if !f.IsPadding() {
+				total += f.Length
+			}
+		}
+		return total, true
+	case "sizeWhenDone":
+		return s.BytesWanted(), true
+	case "leftUntilDone":
+		return s.BytesWanted() - s.BytesCompleted(), true
+	case "haveValid":
+		return s.BytesCompleted(), true
+	case "percentDone":
+		wanted := s.BytesWanted()
+		if wanted == 0 {
+			return 1.0, true
+		}
+		return float64(s.BytesCompleted()) / float64(wanted), true
+	case "rateDownload":
+		download, _ := srv.rates(s)
+		return download, true
+	case "rateUpload":
+		_, upload := srv.rates(s)
+		return upload, true
+	case "eta":
+		download, _ := srv.rates(s)
+		left := s.BytesWanted() - s.BytesCompleted()
+		if left == 0 || download == 0 {
+			return -1, true
+		}
+		return left / download, true
+	case "downloadedEver":
+		return s.StatsSnapshot().TotalDownloaded, true
+	case "uploadedEver":
+		return s.StatsSnapshot().TotalUploaded, true
+	case "uploadRatio":
+		return s.Ratio(), true
+	case "secondsSeeding":
+		return int64(s.StatsSnapshot().SeedingTime.Seconds()), true
+	case "queuePosition":
+		pos, err := srv.session.QueuePosition(infoHash(s))
+		if err != nil {
+			return -1, true
+		}
+		return pos, true
+	case "downloadDir":
+		if fs, ok := s.Storage().(*storage.FileStorage); ok {
+			return fs.Root(), true
+		}
+		return "", true
+	case "isPrivate":
+		return t.IsPrivate(), true
+	case "comment":
+		return t.Comment, true
+	case "creator":
+		return t.CreatedBy, true
+	case "dateCreated":
+		return t.CreationDate, true
+	case "labels":
+		labels := s.Labels()
+		if labels == nil {
+			labels = []string{}
+		}
+		return labels, true
+	case "pieceCount":
+		return t.NumPieces(), true
+	case "pieceSize":
+		return t.PieceSize(), true
+	case "trackers":
+		// Every tracker is announced to, none is a fallback for another
+		trackers := []map[string]interface{}{}
+		for i, url := range s.Trackers() {
+			trackers = append(trackers, map[string]interface{}{"id": i, "announce": url, "tier": i})
+		}
+		return trackers, true
+	case "files":
+		files := []map[string]interface{}{}
+		all := t.Files()
+		for _, i := range fileIndexes(s) {
+			f := all[i]
+			files = append(files, map[string]interface{}{
+				"name":           f.Path(),
+				"length":         f.Length,
+				"bytesCompleted": s.FileBytesCompleted(i),
+			})
+		}
+		return files, true
+	case "fileStats":
+		stats := []map[string]interface{}{}
+		for _, i := range fileIndexes(s) {
+			p := s.FilePriority(i)
+			stats = append(stats, map[string]interface{}{
+				"bytesCompleted": s.FileBytesCompleted(i),
+				"wanted":         p != swarm.PRIORITY_SKIP,
+				"priority":       priority(p),
+			})
+		}
+		return stats, true
+	case "wanted":
+		wanted := []int{}
+		for _, i := range fileIndexes(s) {
+			if s.FilePriority(i) != swarm.PRIORITY_SKIP {
+				wanted = append(wanted, 1)
+			} else {
+				wanted = append(wanted, 0)
+			}
+		}
+		return wanted, true
+	case "priorities":
+		priorities := []int{}
+		for _, i := range fileIndexes(s) {
+			priorities = append(priorities, priority(s.FilePriority(i)))
+		}
+		return priorities, true
+	case "seedRatioLimit":
+		return srv.seedModes(s).ratioLimit, true
+	case "seedRatioMode":
+		return srv.seedModes(s).ratioMode, true
+	case "seedIdleLimit":
+		return srv.seedModes(s).idleLimit, true
+	case "seedIdleMode":
+		return srv.seedModes(s).idleMode, true
+	}
+	return nil, false
+}
+
+func (srv *Server) torrentGet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Ids    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+		Format string          `json:"format"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Fields) == 0 {
+		return nil, errors.New("no fields given")
+	}
+
+	swarms, err := srv.selectSwarms(req.Ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unsupported fields are left out rather than failing the request
+	fields := []string{}
+	for _, f := range req.Fields {
+		if torrentFields[f] {
+			fields = append(fields, f)
+		}
+	}
+
+	result := map[string]interface{}{}
+	if req.Format == "table" {
+		table := []interface{}{fields}
+		for _, s := range swarms {
+			row := make([]interface{}, len(fields))
+			for i, f := range fields {
+				row[i], _ = srv.torrentField(s, f)
+			}
+			table = append(table, row)
+		}
+		result["torrents"] = table
+	} else {
+		torrents := []map[string]interface{}{}
+		for _, s := range swarms {
+			t := make(map[string]interface{}, len(fields))
+			for _, f := range fields {
+				t[f], _ = srv.torrentField(s, f)
+			}
+			torrents = append(torrents, t)
+		}
+		result["torrents"] = torrents
+	}
+
+	if string(req.Ids) == `"recently-active"` {
+		result["removed"] = srv.recentlyRemoved()
+	}
+	return result, nil
+}
+
+// fileArgs are the file selection arguments of torrent-add and
+// torrent-set. An empty list means every file.
+type fileArgs struct {
+	Wanted   *[]int `json:"files-wanted"`
+	Unwanted *[]int `json:"files-unwanted"`
+	High     *[]int `json:"priority-high"`
+	Low      *[]int `json:"priority-low"`
+	Normal   *[]int `json:"priority-normal"`
+}
+
+// apply changes the files' priorities. The swarm has no separate wanted
+// flag, so a priority set on an unwanted file is ignored.
+func (a *fileArgs) apply(s *swarm.Swarm) error {
+	indexes := fileIndexes(s)
+	set := func(files *[]int, f func(i int)) error {
+		if files == nil {
+			return nil
+		}
+
+		if len(*files) == 0 {
+			for _, i := range indexes {
+				f(i)
+			}
+			return nil
+		}
+		for _, n := range *files {
+			if n < 0 || n >= len(indexes) {
+				return fmt.Errorf("invalid file index: %d", n)
+			}
+		}
+		for _, n := range *files {
+			f(indexes[n])
+		}
+		return nil
+	}
+
+	wanted := func(i int) {
+		if s.FilePriority(i) == swarm.PRIORITY_SKIP {
+			s.SetFilePriority(i, swarm.PRIORITY_NORMAL)
+		}
+	}
+	unwanted := func(i int) { s.SetFilePriority(i, swarm.PRIORITY_SKIP) }
+	prioritize := func(p swarm.Priority) func(i int) {
+		return func(i int) {
+			if s.FilePriority(i) != swarm.PRIORITY_SKIP {
+				s.SetFilePriority(i, p)
+			}
+		}
+	}
+
+	for _, step := range []struct {
+		files *[]int
+		f     func(i int)
+	}{
+		{a.Wanted, wanted},
+		{a.Unwanted, unwanted},
+		{a.High, prioritize(swarm.PRIORITY_HIGH)},
+		{a.Low, prioritize(swarm.PRIORITY_LOW)},
+		{a.Normal, prioritize(swarm.PRIORITY_NORMAL)},
+	} {
+		if err := set(step.files, step.f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchTorrent reads a .torrent file from a local path or an http(s) URL
+func fetchTorrent(filename string) (*torrent.MetaData, error) {
+	if strings.HasPrefix(filename, "magnet:") {
+		return nil, errors.New("magnet links are not supported")
+	}
+
+	if !strings.HasPrefix(filename, "http://") && !strings.HasPrefix(filename, "https://") {
+		return torrent.ParseFile(filename)
+	}
+
+	resp, err := http.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch torrent: %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_TORRENT_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MAX_TORRENT_SIZE {
+		return nil, errors.New("torrent file is too large")
+	}
+	return torrent.ParseBytes(b)
+}
+
+func (srv *Server) torrentAdd(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		fileArgs
+		Filename    string   `json:"filename"`
+		Metainfo    string   `json:"metainfo"`
+		DownloadDir string   `json:"download-dir"`
+		Paused      bool     `json:"paused"`
+		Labels      []string `json:"labels"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	var t *torrent.MetaData
+	var err error
+	switch {
+	case req.Metainfo != "":
+		b, decodeErr := base64.StdEncoding.DecodeString(req.Metainfo)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("invalid metainfo: %s", decodeErr)
+		}
+		t, err = torrent.ParseBytes(b)
+	case req.Filename != "":
+		t, err = fetchTorrent(req.Filename)
+	default:
+		return nil, errors.New("no filename or metainfo given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hash [20]byte
+	copy(hash[:], t.InfoHash())
+
+	// Added paused so the file arguments are in place before anything
+	// is allocated or downloaded
+	err = srv.session.AddTorrent(t, AddOptions{DownloadDir: req.DownloadDir, Paused: true, Labels: req.Labels})
+	key := "torrent-added"
+	if err == swarm.TorrentExistsError {
+		key = "torrent-duplicate"
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := srv.findSwarm(hash)
+	if s == nil {
+		return nil, errors.New("torrent was removed while being added")
+	}
+	if key == "torrent-added" {
+		if err := req.fileArgs.apply(s); err != nil {
+			srv.session.RemoveTorrent(hash, false)
+			return nil, err
+		}
+		if !req.Paused {
+			if err := srv.session.StartTorrent(hash); err != nil {
+				srv.session.RemoveTorrent(hash, false)
+				return nil, err
+			}
+		}
+	}
+
+	srv.lock.Lock()
+	srv.refreshIds(srv.session.Swarms())
+	srv.lock.Unlock()
+
+	return map[string]interface{}{key: map[string]interface{}{
+		"id":         srv.id(s),
+		"name":       t.Name(),
+		"hashString": s.Torrent.InfoHashString(),
+	}}, nil
+}
+
+type idsArgs struct {
+	Ids json.RawMessage `json:"ids"`
+}
+
+// forEach calls f with the info hash of every torrent picked by the
+// request's ids
+func (srv *Server) forEach(args json.RawMessage, f func(hash [20]byte) error) (interface{}, error) {
+	var req idsArgs
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	swarms, err := srv.selectSwarms(req.Ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range swarms {
+		if err := f(infoHash(s)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (srv *Server) torrentRemove(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	return srv.forEach(args, func(hash [20]byte) error {
+		return srv.session.RemoveTorrent(hash, req.DeleteLocalData)
+	})
+}
+
+func (srv *Server) torrentStart(args json.RawMessage) (interface{}, error) {
+	return srv.forEach(args, srv.session.StartTorrent)
+}
+
+func (srv *Server) torrentStartNow(args json.RawMessage) (interface{}, error) {
+	return srv.forEach(args, srv.session.ForceStartTorrent)
+}
+
+func (srv *Server) torrentStop(args json.RawMessage) (interface{}, error) {
+	return srv.forEach(args, srv.session.PauseTorrent)
+}
+
+func (srv *Server) torrentVerify(args json.RawMessage) (interface{}, error) {
+	return srv.forEach(args, srv.session.VerifyTorrent)
+}
+
+// torrentSetLocation moves the torrents' data. Only moving is supported,
+// pointing a torrent at data that's already elsewhere isn't.
+func (srv *Server) torrentSetLocation(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Location string `json:"location"`
+		Move     bool   `json:"move"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+	if req.Location == "" {
+		return nil, errors.New("no location given")
+	}
+	if !req.Move {
+		return nil, errors.New("the data can only be moved to the new location")
+	}
+
+	return srv.forEach(args, func(hash [20]byte) error {
+		return srv.session.MoveStorage(hash, req.Location)
+	})
+}
+
+// seedGoals returns the goals a torrent's seeding modes call for, nil if
+// it follows the session
+func (srv *Server) seedGoals(m seedModes) *swarm.SeedGoals {
+	if m.ratioMode == SEED_MODE_GLOBAL && m.idleMode == SEED_MODE_GLOBAL {
+		return nil
+	}
+
+	goals := srv.session.SeedGoals()
+	switch m.ratioMode {
+	case SEED_MODE_SINGLE:
+		goals.Ratio = m.ratioLimit
+	case SEED_MODE_UNLIMITED:
+		goals.Ratio = 0
+	}
+	switch m.idleMode {
+	case SEED_MODE_SINGLE:
+		goals.IdleTime = time.Duration(m.idleLimit) * time.Minute
+	case SEED_MODE_UNLIMITED:
+		goals.IdleTime = 0
+	}
+	return &goals
+}
+
+func (srv *Server) torrentSet(args json.RawMessage) (interface{}, error) {
+	var req struct {
+		idsArgs
+		fileArgs
+		QueuePosition  *int      `json:"queuePosition"`
+		Labels         *[]string `json:"labels"`
+		SeedRatioLimit *float64  `json:"seedRatioLimit"`
+		SeedRatioMode  *int      `json:"seedRatioMode"`
+		SeedIdleLimit  *int      `json:"seedIdleLimit"`
+		SeedIdleMode   *int      `json:"seedIdleMode"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	swarms, err := srv.selectSwarms(req.Ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range swarms {
+		hash := infoHash(s)
+		if err := req.fileArgs.apply(s); err != nil {
+			return nil, err
+		}
+		if req.QueuePosition != nil {
+			if err := srv.session.SetQueuePosition(hash, *req.QueuePosition); err != nil {
+				return nil, err
+			}
+		}
+		if req.Labels != nil {
+			s.SetLabels(*req.Labels)
+		}
+
+		if req.SeedRatioLimit == nil && req.SeedRatioMode == nil &&
+			req.SeedIdleLimit == nil && req.SeedIdleMode == nil {
+			continue
+		}
+
+		m := srv.seedModes(s)
+		if req.SeedRatioLimit != nil {
+			m.ratioLimit = *req.SeedRatioLimit
+		}
+		if req.SeedRatioMode != nil {
+			m.ratioMode = *req.SeedRatioMode
+		}
+		if req.SeedIdleLimit != nil {
+			m.idleLimit = *req.SeedIdleLimit
+		}
+		if req.SeedIdleMode != nil {
+			m.idleMode = *req.SeedIdleMode
+		}
+		if m.ratioMode < SEED_MODE_GLOBAL || m.ratioMode > SEED_MODE_UNLIMITED ||
+			m.idleMode < SEED_MODE_GLOBAL || m.idleMode > SEED_MODE_UNLIMITED {
+			return nil, errors.New("invalid seeding limit mode")
+		}
+
+		if err := srv.session.SetTorrentSeedGoals(hash, srv.seedGoals(m)); err != nil {
+			return nil, err
+		}
+		srv.setSeedModes(s, m)
+	}
+	return nil, nil
+}
+
+// moveQueue moves the picked torrents to the positions newPos gives for
+// their current ones. Torrents are moved in queue order, from the back
+// if reverse is set, so they keep their order relative to each other.
+func (srv *Server) moveQueue(args json.RawMessage, reverse bool, newPos func(pos int) int) (interface{}, error) {
+	var req idsArgs
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, err
+	}
+
+	swarms, err := srv.selectSwarms(req.Ids)
+	if err != nil {
+		return nil, err
+	}
+
+	type queued struct {
+		hash [20]byte
+		pos  int
+	}
+	var entries []queued
+	for _, s := range swarms {
+		pos, err := srv.session.QueuePosition(infoHash(s))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, queued{infoHash(s), pos})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if reverse {
+			return entries[i].pos > entries[j].pos
+		}
+		return entries[i].pos < entries[j].pos
+	})
+
+	for _, e := range entries {
+		pos, err := srv.session.QueuePosition(e.hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := srv.session.SetQueuePosition(e.hash, newPos(pos)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (srv *Server) queueMoveTop(args json.RawMessage) (interface{}, error) {
+	return srv.moveQueue(args, true, func(pos int) int { return 0 })
+}
+
+func (srv *Server) queueMoveUp(args json.RawMessage) (interface{}, error) {
+	return srv.moveQueue(args, false, func(pos int) int { return pos - 1 })
+}
+
+func (srv *Server) queueMoveDown(args json.RawMessage) (interface{}, error) {
+	return srv.moveQueue(args, true, func(pos int) int { return pos + 1 })
+}
+
+// Positions past the end of the queue are clamped to the last one
+func (srv *Server) queueMoveBottom(args json.RawMessage) (interface{}, error) {
+	return srv.moveQueue(args, false, func(pos int) int { return len(srv.session.Swarms()) })
+}
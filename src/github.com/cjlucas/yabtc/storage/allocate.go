@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type AllocationMode int
+
+const (
+	// Files grow as pieces are written
+	ALLOCATE_SPARSE AllocationMode = iota
+	// Files are extended to their full size on creation without
+	// reserving any blocks
+	ALLOCATE_TRUNCATE
+	// Every block is reserved on creation
+	ALLOCATE_FULL
+)
+
+func (m AllocationMode) String() string {
+	switch m {
+	case ALLOCATE_SPARSE:
+		return "sparse"
+	case ALLOCATE_TRUNCATE:
+		return "truncate"
+	case ALLOCATE_FULL:
+		return "full"
+	}
+	return "unknown"
+}
+
+func ParseAllocationMode(s string) (AllocationMode, error) {
+	for _, m := range []AllocationMode{ALLOCATE_SPARSE, ALLOCATE_TRUNCATE, ALLOCATE_FULL} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown allocation mode: %s", s)
+}
+
+type InsufficientSpaceError struct {
+	Path      string
+	Needed    int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space in %s: %d bytes needed, %d available",
+		e.Path, e.Needed, e.Available)
+}
+
+// allocateFile creates the file if needed and grows it to length
+func allocateFile(fpath string, length int64, mode AllocationMode) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	if size >= length {
+		return nil
+	}
+
+	switch mode {
+	case ALLOCATE_TRUNCATE:
+		return fp.Truncate(length)
+	case ALLOCATE_FULL:
+		if err := fallocate(fp, size, length-size); err == nil {
+			return nil
+		}
+		// Not every file system supports fallocate
+		return zeroFill(fp, size, length)
+	}
+
+	return nil
+}
+
+// zeroFill writes zeros to the file from offset up to length
+func zeroFill(fp *os.File, offset, length int64) error {
+	zeros := make([]byte, 1<<16)
+	for offset < length {
+		n := int64(len(zeros))
+		if length-offset < n {
+			n = length - offset
+		}
+
+		if _, err := fp.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	return nil
+}
+
+// FreeSpace returns the bytes available on the file system holding path,
+// which doesn't have to exist yet
+func FreeSpace(path string) (int64, error) {
+	// Walk up to the closest directory that exists
+	dir := filepath.Clean(path)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return freeSpace(dir)
+}
+
+// CheckDiskSpace returns an InsufficientSpaceError if the file system
+// holding path has less than needed bytes available
+func CheckDiskSpace(path string, needed int64) error {
+	available, err := FreeSpace(path)
+	if err != nil {
+		// Not knowing is no reason to refuse the download
+		return nil
+	}
+
+	if available < needed {
+		return &InsufficientSpaceError{path, needed, available}
+	}
+
+	return nil
+}
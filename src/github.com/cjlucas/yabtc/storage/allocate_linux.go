@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(fp *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(fp.Fd()), 0, offset, length)
+}
+
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func fallocate(fp *os.File, offset, length int64) error {
+	return errors.New("fallocate not supported on this platform")
+}
+
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("free space lookup not supported on this platform")
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func fileSize(fpath string) int64 {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+func TestAllocation(t *testing.T) {
+	for _, mode := range []AllocationMode{ALLOCATE_SPARSE, ALLOCATE_TRUNCATE, ALLOCATE_FULL} {
+		Convey("When writing the first piece with "+mode.String()+" allocation", t, func() {
+			tor, data := newTestTorrent()
+			root, _ := ioutil.TempDir("", "yabtc-allocate")
+			defer os.RemoveAll(root)
+
+			s := NewFileStorage(root, tor)
+			s.SetAllocationMode(mode)
+			_, err := s.WriteAt(data[:1<<14], 0, 0)
+			So(err, ShouldBeNil)
+
+			a := filepath.Join(root, "content", "a")
+			b := filepath.Join(root, "content", "sub", "b")
+
+			Convey("Only the files it covers should be created", func() {
+				So(fileSize(b), ShouldEqual, -1)
+			})
+
+			Convey("The file should be sized according to the mode", func() {
+				if mode == ALLOCATE_SPARSE {
+					So(fileSize(a), ShouldEqual, 1<<14)
+				} else {
+					So(fileSize(a), ShouldEqual, 20000)
+				}
+			})
+
+			Convey("The written data should read back", func() {
+				buf := make([]byte, 1<<14)
+				_, err := s.ReadAt(buf, 0, 0)
+				So(err, ShouldBeNil)
+				So(buf, ShouldResemble, data[:1<<14])
+			})
+		})
+	}
+
+	Convey("When zero filling a file", t, func() {
+		fp, _ := ioutil.TempFile("", "yabtc-allocate")
+		defer os.Remove(fp.Name())
+		defer fp.Close()
+
+		fp.Write([]byte("abc"))
+		So(zeroFill(fp, 3, 100000), ShouldBeNil)
+
+		Convey("It should keep existing data and grow to the length", func() {
+			data, _ := ioutil.ReadFile(fp.Name())
+			So(len(data), ShouldEqual, 100000)
+			So(string(data[:3]), ShouldEqual, "abc")
+			So(data[99999], ShouldEqual, 0)
+		})
+	})
+
+	Convey("When parsing allocation modes", t, func() {
+		mode, err := ParseAllocationMode("full")
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, ALLOCATE_FULL)
+
+		_, err = ParseAllocationMode("bogus")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCheckSpace(t *testing.T) {
+	Convey("When the save path does not exist yet", t, func() {
+		tor, _ := newTestTorrent()
+		root, _ := ioutil.TempDir("", "yabtc-allocate")
+		defer os.RemoveAll(root)
+
+		s := NewFileStorage(filepath.Join(root, "not", "created"), tor)
+
+		Convey("All wanted bytes should be needed", func() {
+			So(s.BytesNeeded(), ShouldEqual, 30000)
+			So(s.CheckSpace(), ShouldBeNil)
+		})
+
+		Convey("Skipped files should not count", func() {
+			s.SetSkipped(0, true)
+			So(s.BytesNeeded(), ShouldEqual, 10000)
+		})
+	})
+
+	Convey("When more space is needed than available", t, func() {
+		if _, err := freeSpace(os.TempDir()); err != nil {
+			return
+		}
+
+		err := CheckDiskSpace(os.TempDir(), 1<<62)
+
+		Convey("It should report how much is missing", func() {
+			So(err, ShouldHaveSameTypeAs, &InsufficientSpaceError{})
+			So(err.(*InsufficientSpaceError).Needed, ShouldEqual, 1<<62)
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+func setExecutable(fpath string) error {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+
+	// Executable for everyone who can read it
+	mode := fi.Mode().Perm()
+	return os.Chmod(fpath, mode|(mode&0444)>>2)
+}
+
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// symlinkTarget returns where the symlink should point, relative to
+// the link's directory. Links are only created if they point at another
+// path within the torrent.
+func symlinkTarget(files []torrent.File, paths *torrent.PathMap, fileIndex int) (string, bool) {
+	f := &files[fileIndex]
+	if !f.IsSymlink() || len(f.SymlinkPath) == 0 || len(f.PathComponents) == 0 {
+		return "", false
+	}
+
+	for _, c := range f.SymlinkPath {
+		if c == "" || c == "." || c == ".." || filepath.IsAbs(c) || filepath.Base(c) != c {
+			return "", false
+		}
+	}
+
+	// Paths of multi file torrents start with the torrent's directory
+	if len(f.PathComponents) > 1 && f.SymlinkPath[0] != f.PathComponents[0] {
+		return "", false
+	}
+
+	// Links to a file of the torrent follow it if it had to be renamed
+	target := filepath.Join(torrent.SanitizePath(f.SymlinkPath)...)
+	for i := range files {
+		if samePath(files[i].PathComponents, f.SymlinkPath) {
+			target = paths.Files[i].Path
+			break
+		}
+	}
+
+	link := paths.Files[fileIndex].Path
+	rel, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// createSymlinks creates the torrent's symlinks. It's not an error if
+// the platform doesn't support them or the file already exists.
+// Must be called with allocLock held.
+func (s *FileStorage) createSymlinks() {
+	for i := range s.fs.Files {
+		target, ok := symlinkTarget(s.fs.Files, s.fs.PathMap(), i)
+		if !ok || s.fs.Skipped(i) {
+			continue
+		}
+
+		link := s.fs.FilePath(i)
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err == nil {
+			os.Symlink(target, link)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileAttributes(t *testing.T) {
+	Convey("Given a padded torrent with an executable and a symlink", t, func() {
+		src, _ := ioutil.TempDir("", "yabtc-attr")
+		defer os.RemoveAll(src)
+
+		dir := filepath.Join(src, "content")
+		os.Mkdir(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "run"), bytes.Repeat([]byte{1}, 20000), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "z"), []byte("data"), 0644)
+		os.Symlink("z", filepath.Join(dir, "link"))
+
+		tor, err := torrent.Create(dir, torrent.CreateOptions{V1: true, PadFiles: true, PieceLength: 1 << 14})
+		So(err, ShouldBeNil)
+
+		root, _ := ioutil.TempDir("", "yabtc-attr")
+		defer os.RemoveAll(root)
+		s := NewFileStorage(root, tor)
+
+		from := NewFileStorage(src, tor)
+		for _, p := range tor.GeneratePieces() {
+			data := make([]byte, p.Length)
+			_, err := from.ReadAt(data, p.Index, 0)
+			So(err, ShouldBeNil)
+			So(tor.VerifyPiece(p.Index, data), ShouldBeTrue)
+
+			_, err = s.WriteAt(data, p.Index, 0)
+			So(err, ShouldBeNil)
+		}
+
+		Convey("Padding files should never be written", func() {
+			_, err := os.Stat(filepath.Join(root, "content", ".pad"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Executable files should get their executable bits", func() {
+			fi, err := os.Stat(filepath.Join(root, "content", "run"))
+			So(err, ShouldBeNil)
+			So(fi.Mode().Perm()&0100, ShouldNotEqual, 0)
+		})
+
+		Convey("Symlinks should point at their target", func() {
+			target, err := os.Readlink(filepath.Join(root, "content", "link"))
+			So(err, ShouldBeNil)
+			So(target, ShouldEqual, "z")
+
+			data, err := ioutil.ReadFile(filepath.Join(root, "content", "link"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "data")
+		})
+	})
+
+	Convey("When a symlink points outside the torrent", t, func() {
+		files := []torrent.File{{
+			PathComponents: []string{"content", "link"},
+			Attr:           "l",
+			SymlinkPath:    []string{"content", "..", "..", "etc", "passwd"},
+		}}
+		paths := torrent.NewPathMap(files)
+
+		Convey("It should not be created", func() {
+			_, ok := symlinkTarget(files, paths, 0)
+			So(ok, ShouldBeFalse)
+
+			files[0].SymlinkPath = []string{"other", "file"}
+			_, ok = symlinkTarget(files, paths, 0)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
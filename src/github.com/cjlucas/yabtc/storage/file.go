@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// FileStorage stores a torrent's files under a save path, the way
+// other clients lay them out on disk
+type FileStorage struct {
+	savePath string
+	fs       *torrent.FileStream
+	layout   layout
+	// Held for writing while the files are moved to a new save path
+	moveLock sync.RWMutex
+
+	mode      AllocationMode
+	allocated []bool
+	linked    bool
+	allocLock sync.Mutex
+}
+
+func NewFileStorage(savePath string, t *torrent.MetaData) *FileStorage {
+	files := t.Files()
+	return &FileStorage{
+		savePath:  savePath,
+		fs:        torrent.NewFileStream(savePath, files),
+		layout:    newLayout(t),
+		allocated: make([]bool, len(files)),
+	}
+}
+
+// Root returns the save path the files are currently laid out under
+func (s *FileStorage) Root() string {
+	s.moveLock.RLock()
+	defer s.moveLock.RUnlock()
+
+	return s.savePath
+}
+
+// FilePath returns the path the file is stored at, which can differ from
+// its path in the torrent if that wasn't safe to use
+func (s *FileStorage) FilePath(fileIndex int) string {
+	s.moveLock.RLock()
+	defer s.moveLock.RUnlock()
+
+	return s.fs.FilePath(fileIndex)
+}
+
+// SetAllocationMode sets how files are allocated when first written to
+func (s *FileStorage) SetAllocationMode(mode AllocationMode) {
+	s.mode = mode
+}
+
+// allocate creates every wanted file the range covers that hasn't been yet
+func (s *FileStorage) allocate(offset, length int) error {
+	s.allocLock.Lock()
+	defer s.allocLock.Unlock()
+
+	// Symlinks have no data, they're created along with the first file
+	if !s.linked {
+		s.createSymlinks()
+		s.linked = true
+	}
+
+	for i := range s.fs.FileSpans(torrent.Block{Offset: offset, Length: length}) {
+		f := &s.fs.Files[i]
+		if s.allocated[i] || !f.HasData() || s.fs.Skipped(i) {
+			continue
+		}
+
+		fpath := s.fs.FilePath(i)
+		if err := allocateFile(fpath, int64(f.Length), s.mode); err != nil {
+			return err
+		}
+		if f.IsExecutable() {
+			if err := setExecutable(fpath); err != nil {
+				return err
+			}
+		}
+		s.allocated[i] = true
+	}
+
+	return nil
+}
+
+func (s *FileStorage) FileSize(fileIndex int) (int64, error) {
+	s.moveLock.RLock()
+	defer s.moveLock.RUnlock()
+
+	fi, err := os.Stat(s.fs.FilePath(fileIndex))
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// BytesNeeded is the space still needed on disk for the wanted files
+func (s *FileStorage) BytesNeeded() int64 {
+	s.moveLock.RLock()
+	defer s.moveLock.RUnlock()
+
+	var needed int64
+	for i := range s.fs.Files {
+		f := &s.fs.Files[i]
+		if !f.HasData() || s.fs.Skipped(i) {
+			continue
+		}
+
+		needed += int64(f.Length)
+		if fi, err := os.Stat(s.fs.FilePath(i)); err == nil {
+			needed -= fi.Size()
+		}
+	}
+
+	if needed < 0 {
+		return 0
+	}
+	return needed
+}
+
+// CheckSpace makes sure the save path can hold the wanted files
+func (s *FileStorage) CheckSpace() error {
+	return CheckDiskSpace(s.Root(), s.BytesNeeded())
+}
+
+func (s *FileStorage) SetSkipped(fileIndex int, skip bool) {
+	s.fs.SetSkipped(fileIndex, skip)
+}
+
+func (s *FileStorage) ReadAt(p []byte, piece, offset int) (int, error) {
+	s.moveLock.RLock()
+	defer s.moveLock.RUnlock()
+
+	off, err := s.layout.streamOffset(piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	data, err := s.fs.ReadBlock(torrent.Block{Offset: off, Length: len(p)})
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(p, data), nil
+}
+
+func (s *FileStorage) WriteAt(p []byte, piece, offset int) (int, error) {
+	off, err := s.layout.streamOffset(piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return s.writeStream(p, off)
+}
+
+func (s *FileStorage) WriteStreamAt(p []byte, off int) (int, error) {
+	if err := s.layout.checkStream(off, len(p)); err != nil {
+		return 0, err
+	}
+
+	return s.writeStream(p, off)
+}
+
+func (s *FileStorage) writeStream(p []byte, off int) (int, error) {
+	s.moveLock.RLock()
+	defer s.moveLock.RUnlock()
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if err := s.allocate(off, len(p)); err != nil {
+		return 0, err
+	}
+
+	if err := s.fs.WriteBlock(torrent.Block{Offset: off, Length: len(p)}, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Writes go straight to the files, so there is nothing to flush
+func (s *FileStorage) Flush() error {
+	return nil
+}
+
+// Close releases the torrent's cached file handles
+func (s *FileStorage) Close() error {
+	s.fs.Close()
+	return nil
+}
+
+// Delete removes the torrent's files and any directories left empty
+func (s *FileStorage) Delete() error {
+	s.moveLock.Lock()
+	defer s.moveLock.Unlock()
+
+	s.Close()
+
+	s.allocLock.Lock()
+	for i := range s.allocated {
+		s.allocated[i] = false
+	}
+	s.linked = false
+	s.allocLock.Unlock()
+
+	var fpaths []string
+	for i, f := range s.fs.Files {
+		if f.IsPadding() {
+			continue
+		}
+
+		fpath := s.fs.FilePath(i)
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fpaths = append(fpaths, fpath)
+	}
+
+	removeEmptyDirs(s.savePath, fpaths)
+	return nil
+}
+
+// removeEmptyDirs removes the directories between root and the given
+// files, leaving alone any that still hold other data
+func removeEmptyDirs(root string, fpaths []string) {
+	dirs := make(map[string]bool)
+	for _, fpath := range fpaths {
+		for dir := filepath.Dir(fpath); dir != filepath.Clean(root) && dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// Deepest directories first, so parents are empty by the time they're removed
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	for _, dir := range sorted {
+		os.Remove(dir)
+	}
+}
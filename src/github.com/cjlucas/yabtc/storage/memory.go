@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// MemoryStorage keeps pieces in memory, for tests and downloads
+// that don't need to outlive the process
+type MemoryStorage struct {
+	layout layout
+	pieces map[int][]byte
+	lock   sync.RWMutex
+}
+
+func NewMemoryStorage(t *torrent.MetaData) *MemoryStorage {
+	return &MemoryStorage{
+		layout: newLayout(t),
+		pieces: make(map[int][]byte),
+	}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, piece, offset int) (int, error) {
+	if _, err := s.layout.streamOffset(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.pieces == nil {
+		return 0, StorageClosedError
+	}
+
+	data, ok := s.pieces[piece]
+	if !ok {
+		return 0, PieceNotFoundError
+	}
+
+	return copy(p, data[offset:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, piece, offset int) (int, error) {
+	if _, err := s.layout.streamOffset(piece, offset, len(p)); err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pieces == nil {
+		return 0, StorageClosedError
+	}
+
+	data, ok := s.pieces[piece]
+	if !ok {
+		data = make([]byte, s.layout.pieces[piece].Length)
+		s.pieces[piece] = data
+	}
+
+	return copy(data[offset:], p), nil
+}
+
+func (s *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) Delete() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pieces = nil
+	return nil
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var DestinationExistsError = errors.New("file already exists at destination")
+
+// Mover is implemented by storage whose data can be moved to another
+// save path while the torrent is active
+type Mover interface {
+	// Move relocates the data under newRoot, calling progress as bytes
+	// are moved. Nothing is changed if it fails.
+	Move(newRoot string, progress func(moved, total int64)) error
+}
+
+// SizeMismatchError is returned when a moved file doesn't have the size
+// of the original
+type SizeMismatchError struct {
+	Path             string
+	Expected, Actual int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("%s: expected %d bytes after move, found %d", e.Path, e.Expected, e.Actual)
+}
+
+type fileMove struct {
+	from, to string
+	size     int64
+	symlink  bool
+	// Renamed files no longer exist at their source
+	renamed bool
+}
+
+// copyFile copies from to to, reporting each chunk copied
+func copyFile(from, to string, copied func(n int64)) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				dst.Close()
+				return werr
+			}
+			copied(int64(n))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+
+	// The source is removed afterwards, so make sure the copy is on disk
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+func copySymlink(from, to string) error {
+	target, err := os.Readlink(from)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(target, to)
+}
+
+// rollback puts every moved file back where it was
+func rollback(moves []*fileMove, newRoot string) {
+	var created []string
+	for _, m := range moves {
+		created = append(created, m.to)
+		if m.renamed {
+			os.Rename(m.to, m.from)
+		} else {
+			// Also cleans up a partial copy
+			os.Remove(m.to)
+		}
+	}
+
+	removeEmptyDirs(newRoot, created)
+}
+
+// Move moves the torrent's files to newRoot, renaming them when possible
+// and copying them when the new root is on another device. I/O waits
+// until the move is done. If anything fails the files are put back and
+// the storage keeps using the old save path.
+func (s *FileStorage) Move(newRoot string, progress func(moved, total int64)) error {
+	s.moveLock.Lock()
+	defer s.moveLock.Unlock()
+
+	if filepath.Clean(newRoot) == filepath.Clean(s.savePath) {
+		return nil
+	}
+
+	// Handles to the old paths must not be reused
+	s.fs.Close()
+
+	var moves []*fileMove
+	var total int64
+	for i, f := range s.fs.Files {
+		if f.IsPadding() {
+			continue
+		}
+
+		from := s.fs.FilePath(i)
+		fi, err := os.Lstat(from)
+		if os.IsNotExist(err) {
+			// Skipped or not downloaded yet
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		to := s.fs.PathMap().PathFromRoot(newRoot, i)
+		if _, err := os.Lstat(to); err == nil {
+			return DestinationExistsError
+		}
+
+		symlink := fi.Mode()&os.ModeSymlink != 0
+		moves = append(moves, &fileMove{from: from, to: to, size: fi.Size(), symlink: symlink})
+		total += fi.Size()
+	}
+
+	var moved int64
+	report := func(n int64) {
+		moved += n
+		if progress != nil {
+			progress(moved, total)
+		}
+	}
+
+	for i, m := range moves {
+		err := os.MkdirAll(filepath.Dir(m.to), 0755)
+		if err == nil {
+			if os.Rename(m.from, m.to) == nil {
+				m.renamed = true
+				report(m.size)
+			} else if m.symlink {
+				err = copySymlink(m.from, m.to)
+				report(m.size)
+			} else {
+				// Renaming fails across devices, fall back to copying
+				err = copyFile(m.from, m.to, report)
+			}
+		}
+
+		if err == nil {
+			if fi, serr := os.Lstat(m.to); serr != nil {
+				err = serr
+			} else if fi.Size() != m.size {
+				err = &SizeMismatchError{m.to, m.size, fi.Size()}
+			}
+		}
+
+		if err != nil {
+			rollback(moves[:i+1], newRoot)
+			return err
+		}
+	}
+
+	var sources []string
+	for _, m := range moves {
+		sources = append(sources, m.from)
+		if !m.renamed {
+			os.Remove(m.from)
+		}
+	}
+	removeEmptyDirs(s.savePath, sources)
+
+	s.savePath = newRoot
+	s.fs.Root = newRoot
+
+	return nil
+}
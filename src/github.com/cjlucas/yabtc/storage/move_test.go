@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMove(t *testing.T) {
+	Convey("Given file storage holding a torrent", t, func() {
+		tor, data := newTestTorrent()
+		oldRoot, _ := ioutil.TempDir("", "yabtc-move")
+		newRoot, _ := ioutil.TempDir("", "yabtc-move")
+		defer os.RemoveAll(oldRoot)
+		defer os.RemoveAll(newRoot)
+
+		s := NewFileStorage(oldRoot, tor)
+		s.WriteAt(data[:1<<14], 0, 0)
+		s.WriteAt(data[1<<14:], 1, 0)
+
+		Convey("Moving it should relocate every file", func() {
+			var moved, total int64
+			err := s.Move(newRoot, func(m, t int64) { moved, total = m, t })
+			So(err, ShouldBeNil)
+			So(moved, ShouldEqual, len(data))
+			So(total, ShouldEqual, len(data))
+			So(s.Root(), ShouldEqual, newRoot)
+
+			b, err := ioutil.ReadFile(filepath.Join(newRoot, "content", "sub", "b"))
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, data[20000:])
+
+			_, err = os.Stat(filepath.Join(oldRoot, "content"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			Convey("Reads and writes should use the new location", func() {
+				buf := make([]byte, 100)
+				_, err := s.ReadAt(buf, 1, 0)
+				So(err, ShouldBeNil)
+				So(buf, ShouldResemble, data[1<<14:(1<<14)+100])
+			})
+		})
+
+		Convey("Moving onto existing files should fail", func() {
+			os.MkdirAll(filepath.Join(newRoot, "content"), 0755)
+			ioutil.WriteFile(filepath.Join(newRoot, "content", "a"), []byte("other"), 0644)
+
+			So(s.Move(newRoot, nil), ShouldEqual, DestinationExistsError)
+			So(s.Root(), ShouldEqual, oldRoot)
+		})
+
+		Convey("When a file can't be moved", func() {
+			// A file where b's directory should go makes its move fail
+			os.MkdirAll(filepath.Join(newRoot, "content"), 0755)
+			ioutil.WriteFile(filepath.Join(newRoot, "content", "sub"), nil, 0644)
+
+			err := s.Move(newRoot, nil)
+
+			Convey("The files already moved should be put back", func() {
+				So(err, ShouldNotBeNil)
+				So(s.Root(), ShouldEqual, oldRoot)
+
+				a, err := ioutil.ReadFile(filepath.Join(oldRoot, "content", "a"))
+				So(err, ShouldBeNil)
+				So(a, ShouldResemble, data[:20000])
+
+				_, err = os.Stat(filepath.Join(newRoot, "content", "a"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("When copying a file", t, func() {
+		dir, _ := ioutil.TempDir("", "yabtc-move")
+		defer os.RemoveAll(dir)
+
+		data := make([]byte, 3<<20)
+		from := filepath.Join(dir, "from")
+		ioutil.WriteFile(from, data, 0644)
+
+		var copied int64
+		err := copyFile(from, filepath.Join(dir, "to"), func(n int64) { copied += n })
+
+		Convey("Its content should be copied in chunks", func() {
+			So(err, ShouldBeNil)
+			So(copied, ShouldEqual, len(data))
+
+			b, _ := ioutil.ReadFile(filepath.Join(dir, "to"))
+			So(len(b), ShouldEqual, len(data))
+		})
+	})
+}
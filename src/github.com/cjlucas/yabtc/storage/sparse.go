@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// SparseStorage keeps the whole torrent in a single sparse file laid
+// out like the piece stream. Useful when only parts of a torrent are
+// ever fetched, since unwritten ranges take no disk space.
+type SparseStorage struct {
+	Path   string
+	layout layout
+	fp     *os.File
+	// Set once the file is deleted, it's only reopened until then
+	deleted bool
+	lock    sync.Mutex
+}
+
+func NewSparseStorage(path string, t *torrent.MetaData) (*SparseStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SparseStorage{Path: path, layout: newLayout(t), fp: fp}
+
+	// Extending the file with Truncate doesn't allocate any blocks
+	if err := fp.Truncate(int64(s.layout.totalLength)); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SparseStorage) file() (*os.File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.fp == nil {
+		if s.deleted {
+			return nil, StorageClosedError
+		}
+
+		fp, err := os.OpenFile(s.Path, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.fp = fp
+	}
+	return s.fp, nil
+}
+
+// Unwritten ranges read back as zeros
+func (s *SparseStorage) ReadAt(p []byte, piece, offset int) (int, error) {
+	off, err := s.layout.streamOffset(piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	fp, err := s.file()
+	if err != nil {
+		return 0, err
+	}
+
+	return fp.ReadAt(p, int64(off))
+}
+
+func (s *SparseStorage) WriteAt(p []byte, piece, offset int) (int, error) {
+	off, err := s.layout.streamOffset(piece, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	fp, err := s.file()
+	if err != nil {
+		return 0, err
+	}
+
+	return fp.WriteAt(p, int64(off))
+}
+
+func (s *SparseStorage) WriteStreamAt(p []byte, off int) (int, error) {
+	if err := s.layout.checkStream(off, len(p)); err != nil {
+		return 0, err
+	}
+
+	fp, err := s.file()
+	if err != nil {
+		return 0, err
+	}
+
+	return fp.WriteAt(p, int64(off))
+}
+
+func (s *SparseStorage) Flush() error {
+	fp, err := s.file()
+	if err != nil {
+		return err
+	}
+
+	return fp.Sync()
+}
+
+func (s *SparseStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.fp == nil {
+		return nil
+	}
+
+	err := s.fp.Close()
+	s.fp = nil
+	return err
+}
+
+func (s *SparseStorage) Delete() error {
+	s.Close()
+	s.lock.Lock()
+	s.deleted = true
+	s.lock.Unlock()
+
+	if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
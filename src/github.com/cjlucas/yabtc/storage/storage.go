@@ -0,0 +1,87 @@
+// Package storage persists torrent data addressed by piece and offset
+package storage
+
+import (
+	"errors"
+
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+var InvalidOffsetError = errors.New("offset out of range")
+
+var PieceNotFoundError = errors.New("piece has not been written")
+
+var StorageClosedError = errors.New("storage is closed")
+
+type Storage interface {
+	// ReadAt reads len(p) bytes starting at offset within the piece
+	ReadAt(p []byte, piece, offset int) (int, error)
+	// WriteAt writes p starting at offset within the piece
+	WriteAt(p []byte, piece, offset int) (int, error)
+	// Flush persists any buffered writes
+	Flush() error
+	// Close releases open files. They're opened again if the storage is
+	// used afterwards.
+	Close() error
+	// Delete closes the storage and removes all data it holds
+	Delete() error
+}
+
+// Skipper is implemented by storage that can avoid writing skipped files
+type Skipper interface {
+	SetSkipped(fileIndex int, skip bool)
+}
+
+// SpaceChecker is implemented by storage that can tell up front whether
+// there is enough room for the download
+type SpaceChecker interface {
+	CheckSpace() error
+}
+
+// FileSizer is implemented by storage that keeps the torrent's files
+// on disk, so they can be checked for existence and size without reading
+type FileSizer interface {
+	FileSize(fileIndex int) (int64, error)
+}
+
+// StreamWriter is implemented by storage that can write a run of
+// bytes spanning several pieces in a single call
+type StreamWriter interface {
+	// WriteStreamAt writes p at offset off of the torrent's byte stream
+	WriteStreamAt(p []byte, off int) (int, error)
+}
+
+// layout maps piece offsets to offsets in the torrent's byte stream
+type layout struct {
+	pieces      []torrent.Piece
+	totalLength int
+}
+
+func newLayout(t *torrent.MetaData) layout {
+	files := torrent.FileList(t.Files())
+	return layout{t.GeneratePieces(), files.TotalLength()}
+}
+
+// streamOffset checks that [offset, offset+length) lies within the piece
+// and returns the offset of its start in the byte stream
+func (l *layout) streamOffset(piece, offset, length int) (int, error) {
+	if piece < 0 || piece >= len(l.pieces) {
+		return 0, InvalidOffsetError
+	}
+
+	p := &l.pieces[piece]
+	if offset < 0 || length < 0 || offset+length > p.Length {
+		return 0, InvalidOffsetError
+	}
+
+	return p.ByteOffset + offset, nil
+}
+
+// checkStream checks that [off, off+length) lies within the byte stream
+func (l *layout) checkStream(off, length int) error {
+	if off < 0 || length < 0 || off+length > l.totalLength {
+		return InvalidOffsetError
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestTorrent returns a torrent of two files, 20000 and 10000 bytes
+// long, spread over two 16KiB pieces
+func newTestTorrent() (*torrent.MetaData, []byte) {
+	root, err := ioutil.TempDir("", "yabtc-storage")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	a := bytes.Repeat([]byte{1}, 20000)
+	b := bytes.Repeat([]byte{2}, 10000)
+	dir := filepath.Join(root, "content")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), a, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b"), b, 0644)
+
+	t, err := torrent.Create(dir, torrent.CreateOptions{PieceLength: 1 << 14, V1: true})
+	if err != nil {
+		panic(err)
+	}
+
+	return t, append(a, b...)
+}
+
+func testStorage(s Storage, data []byte) {
+	Convey("Data written across files should read back", func() {
+		n, err := s.WriteAt(data[:1<<14], 0, 0)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1<<14)
+
+		n, err = s.WriteAt(data[1<<14:], 1, 0)
+		So(err, ShouldBeNil)
+
+		buf := make([]byte, 100)
+		_, err = s.ReadAt(buf, 1, 20000-(1<<14)-50)
+		So(err, ShouldBeNil)
+		So(buf, ShouldResemble, data[20000-50:20000+50])
+		So(s.Flush(), ShouldBeNil)
+	})
+
+	Convey("Ranges past the end of a piece should be rejected", func() {
+		_, err := s.WriteAt(make([]byte, 10), 1, len(data)-(1<<14)-5)
+		So(err, ShouldEqual, InvalidOffsetError)
+
+		_, err = s.ReadAt(make([]byte, 10), 2, 0)
+		So(err, ShouldEqual, InvalidOffsetError)
+	})
+
+	if sw, ok := s.(StreamWriter); ok {
+		Convey("A run spanning both pieces should be written in one call", func() {
+			n, err := sw.WriteStreamAt(data[100:], 100)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(data)-100)
+
+			buf := make([]byte, 100)
+			_, err = s.ReadAt(buf, 1, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, data[1<<14:(1<<14)+100])
+
+			_, err = sw.WriteStreamAt(data, 1)
+			So(err, ShouldEqual, InvalidOffsetError)
+		})
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	Convey("When using file storage", t, func() {
+		tor, data := newTestTorrent()
+		root, _ := ioutil.TempDir("", "yabtc-storage")
+		defer os.RemoveAll(root)
+		s := NewFileStorage(root, tor)
+
+		testStorage(s, data)
+
+		Convey("Files should be laid out under the save path", func() {
+			s.WriteAt(data[1<<14:], 1, 0)
+			b, err := ioutil.ReadFile(filepath.Join(root, "content", "sub", "b"))
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, data[20000:])
+		})
+
+		Convey("Skipped files should not be written", func() {
+			s.SetSkipped(0, true)
+			s.WriteAt(data[1<<14:], 1, 0)
+
+			_, err := os.Stat(filepath.Join(root, "content", "a"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Delete should remove the files and their directories", func() {
+			s.WriteAt(data[:1<<14], 0, 0)
+			s.WriteAt(data[1<<14:], 1, 0)
+			So(s.Delete(), ShouldBeNil)
+
+			_, err := os.Stat(filepath.Join(root, "content"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(root)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	Convey("When using memory storage", t, func() {
+		tor, data := newTestTorrent()
+		s := NewMemoryStorage(tor)
+
+		testStorage(s, data)
+
+		Convey("Reading an unwritten piece should fail", func() {
+			_, err := s.ReadAt(make([]byte, 10), 0, 0)
+			So(err, ShouldEqual, PieceNotFoundError)
+		})
+
+		Convey("Delete should drop all data", func() {
+			s.WriteAt(data[:10], 0, 0)
+			So(s.Delete(), ShouldBeNil)
+
+			_, err := s.ReadAt(make([]byte, 10), 0, 0)
+			So(err, ShouldEqual, StorageClosedError)
+		})
+	})
+}
+
+func TestSparseStorage(t *testing.T) {
+	Convey("When using sparse storage", t, func() {
+		tor, data := newTestTorrent()
+		root, _ := ioutil.TempDir("", "yabtc-storage")
+		defer os.RemoveAll(root)
+
+		path := filepath.Join(root, "blob")
+		s, err := NewSparseStorage(path, tor)
+		So(err, ShouldBeNil)
+		defer s.Close()
+
+		testStorage(s, data)
+
+		Convey("It should reopen the file after being closed", func() {
+			s.WriteAt(data[:10], 0, 0)
+			So(s.Close(), ShouldBeNil)
+
+			buf := make([]byte, 10)
+			_, err := s.ReadAt(buf, 0, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, data[:10])
+		})
+
+		Convey("The file should span the whole torrent", func() {
+			fi, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(fi.Size(), ShouldEqual, len(data))
+		})
+
+		Convey("Unwritten ranges should read as zeros", func() {
+			buf := []byte{1, 2, 3}
+			_, err := s.ReadAt(buf, 1, 0)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, []byte{0, 0, 0})
+		})
+
+		Convey("Delete should remove the file", func() {
+			So(s.Delete(), ShouldBeNil)
+			_, err := os.Stat(path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
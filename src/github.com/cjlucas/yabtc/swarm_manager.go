@@ -1,56 +1,606 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/cjlucas/yabtc/p2p"
 	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/queue"
+	"github.com/cjlucas/yabtc/ratelimit"
+	"github.com/cjlucas/yabtc/storage"
 	"github.com/cjlucas/yabtc/torrent"
 )
 
+// How often resume data is saved while torrents are running
+const RESUME_SAVE_INTERVAL = 1 * time.Minute
+
+// How often seeding torrents are checked against their goals
+const SEED_GOAL_CHECK_INTERVAL = 10 * time.Second
+
+// How often queue slots are handed out again
+const QUEUE_UPDATE_INTERVAL = 5 * time.Second
+
+type AddOptions struct {
+	// Where the data is saved, the manager's save path if empty
+	SavePath string
+	// Paused torrents aren't queued until they're started
+	Paused bool
+	Labels []string
+}
+
+type newTorrent struct {
+	t       *torrent.MetaData
+	policy  *p2p.PeerPolicy
+	opts    AddOptions
+	errChan chan error
+}
+
 type SwarmManager struct {
-	Swarms         map[[20]byte]*swarm.Swarm
+	Swarms map[[20]byte]*swarm.Swarm
+	// Every swarm once, in the order they were added
+	swarmList []*swarm.Swarm
+	// Peers the swarms learned about from other peers
+	PeerFoundChan chan swarm.FoundPeer
+	// Swarms that started or stopped being upload only
+	UploadOnlyChan chan *swarm.Swarm
+	// Swarms that started or stopped running, their trackers are told
+	StartedChan    chan *swarm.Swarm
+	StoppedChan    chan *swarm.Swarm
 	swarmLock      sync.RWMutex
-	addTorrentChan chan *torrent.MetaData
+	addTorrentChan chan newTorrent
+	savePath       string
+	resumeDir      string
+	allocationMode storage.AllocationMode
+
+	// Torrents without goals of their own use seedGoals
+	seedGoals    swarm.SeedGoals
+	torrentGoals map[*swarm.Swarm]*swarm.SeedGoals
+	// Removes torrents that reached a goal, see SetGoalRemover
+	removeForGoal func(infoHash [20]byte, deleteData bool) error
+	goalsLock     sync.Mutex
+
+	queue     *queue.Queue
+	queueLock sync.Mutex
+
+	// Shared by the peers of every torrent
+	downloadLimiter *ratelimit.Limiter
+	uploadLimiter   *ratelimit.Limiter
 }
 
-func NewSwarmManager() *SwarmManager {
+func NewSwarmManager(savePath, resumeDir string, mode storage.AllocationMode) *SwarmManager {
 	m := &SwarmManager{}
+	m.savePath = savePath
+	m.resumeDir = resumeDir
+	m.allocationMode = mode
 
 	m.Swarms = make(map[[20]byte]*swarm.Swarm)
-	m.addTorrentChan = make(chan *torrent.MetaData)
+	m.addTorrentChan = make(chan newTorrent)
+	m.PeerFoundChan = make(chan swarm.FoundPeer, 100)
+	m.UploadOnlyChan = make(chan *swarm.Swarm)
+	m.StartedChan = make(chan *swarm.Swarm, 100)
+	m.StoppedChan = make(chan *swarm.Swarm, 100)
+	m.torrentGoals = make(map[*swarm.Swarm]*swarm.SeedGoals)
+	m.removeForGoal = m.RemoveTorrent
+	m.queue = queue.New(queue.Limits{})
+	m.downloadLimiter = ratelimit.NewLimiter(0)
+	m.uploadLimiter = ratelimit.NewLimiter(0)
 
 	return m
 }
 
-// Assumes torrent with given info hash is not already addded
-func (m *SwarmManager) AddTorrent(t *torrent.MetaData) {
-	m.addTorrentChan <- t
+// AddTorrent returns swarm.TorrentExistsError if the torrent was already
+// added. The swarm only finds peers where policy allows.
+func (m *SwarmManager) AddTorrent(t *torrent.MetaData, policy *p2p.PeerPolicy, opts AddOptions) error {
+	nt := newTorrent{t, policy, opts, make(chan error, 1)}
+	m.addTorrentChan <- nt
+	return <-nt.errChan
 }
 
 func (m *SwarmManager) AddPeer(infoHash []byte, peer *p2p.Peer) {
 	var hash [20]byte
 	copy(hash[:], infoHash)
-	s := m.Swarms[hash]
 
+	// Queued and paused torrents don't talk to peers
+	s := m.Swarm(hash)
+	if s == nil || !s.IsRunning() {
+		peer.Close()
+		return
+	}
+
+	peer.DownloadLimiter = m.downloadLimiter
+	peer.UploadLimiter = m.uploadLimiter
 	s.AddPeer(peer)
 }
 
-func (m *SwarmManager) handleNewSwarm(t *torrent.MetaData) {
+// SetSpeedLimits changes the download and upload limits of every torrent
+func (m *SwarmManager) SetSpeedLimits(limits ratelimit.Limits) {
+	m.downloadLimiter.SetRate(limits.Download)
+	m.uploadLimiter.SetRate(limits.Upload)
+}
+
+// Swarm returns the swarm for the given info hash, or nil if there is none
+func (m *SwarmManager) Swarm(infoHash [20]byte) *swarm.Swarm {
+	m.swarmLock.RLock()
+	defer m.swarmLock.RUnlock()
+
+	return m.Swarms[infoHash]
+}
+
+// SwarmList returns every swarm in the order they were added
+func (m *SwarmManager) SwarmList() []*swarm.Swarm {
+	m.swarmLock.RLock()
+	defer m.swarmLock.RUnlock()
+
+	return append([]*swarm.Swarm(nil), m.swarmList...)
+}
+
+// SavePath is where torrents are saved unless they're added with a path
+// of their own
+func (m *SwarmManager) SavePath() string {
+	m.swarmLock.RLock()
+	defer m.swarmLock.RUnlock()
+
+	return m.savePath
+}
+
+func (m *SwarmManager) SetSavePath(savePath string) {
+	m.swarmLock.Lock()
+	defer m.swarmLock.Unlock()
+
+	m.savePath = savePath
+}
+
+func (m *SwarmManager) handleNewSwarm(t *torrent.MetaData, policy *p2p.PeerPolicy, opts AddOptions) error {
+	for _, infoHash := range t.InfoHashes() {
+		var hash [20]byte
+		copy(hash[:], infoHash)
+		if m.Swarm(hash) != nil {
+			return swarm.TorrentExistsError
+		}
+	}
+
 	logger.Printf("Adding new swarm for torrent: %d", t.InfoHash())
-	s := swarm.New(t)
+	rd, rdErr := swarm.LoadResumeDataFile(m.resumeFile(t))
 
-	var hash [20]byte
-	copy(hash[:], t.InfoHash())
-	m.Swarms[hash] = s
-	go s.Run()
+	// The data stays wherever it was last moved to
+	savePath := opts.SavePath
+	if savePath == "" {
+		savePath = m.SavePath()
+	}
+	if rdErr == nil && rd.Root != "" {
+		savePath = rd.Root
+	}
+
+	store := storage.NewFileStorage(savePath, t)
+	store.SetAllocationMode(m.allocationMode)
+
+	s := swarm.New(t, store)
+	s.SetPeerPolicy(policy)
+	s.PeerFoundChan = m.PeerFoundChan
+	s.UploadOnlyChan = m.UploadOnlyChan
+	if rdErr == nil {
+		if err := s.LoadResumeData(rd); err != nil {
+			logger.Printf("Ignoring resume data for torrent %s: %s", t.InfoHashString(), err)
+			rdErr = err
+		}
+	}
+	// Without resume data whatever is already in storage is checked
+	if rdErr != nil {
+		s.Recheck()
+	}
+	if opts.Labels != nil {
+		s.SetLabels(opts.Labels)
+	}
+	// Paused torrents are checked when they're started, once the files
+	// to skip have been picked
+	if !opts.Paused {
+		if err := m.checkSpace(s); err != nil {
+			return err
+		}
+		s.Queue()
+	}
+
+	m.swarmLock.Lock()
+	for _, infoHash := range t.InfoHashes() {
+		var hash [20]byte
+		copy(hash[:], infoHash)
+		m.Swarms[hash] = s
+	}
+	m.swarmList = append(m.swarmList, s)
+	m.swarmLock.Unlock()
+
+	m.queue.Add(s)
+	m.updateQueue()
+	return nil
+}
+
+func (m *SwarmManager) resumeFile(t *torrent.MetaData) string {
+	return filepath.Join(m.resumeDir, fmt.Sprintf("%x.resume", t.InfoHash()))
+}
+
+// SaveResumeData saves the progress of every swarm so partly downloaded
+// pieces aren't downloaded again after a restart
+func (m *SwarmManager) SaveResumeData() {
+	for _, s := range m.SwarmList() {
+		if err := s.ResumeData().Save(m.resumeFile(s.Torrent)); err != nil {
+			logger.Printf("Could not save resume data for torrent %s: %s", s.Torrent.InfoHashString(), err)
+		}
+	}
+}
+
+// MoveStorage moves a torrent's data to newRoot, saving the new
+// location in its resume data once the move is done
+func (m *SwarmManager) MoveStorage(infoHash [20]byte, newRoot string) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	var p *swarm.MoveProgress
+	for p = range s.MoveStorage(newRoot) {
+		if !p.Done {
+			logger.Printf("Moving torrent %s: %d/%d bytes", s.Torrent.InfoHashString(), p.BytesMoved, p.BytesTotal)
+		}
+	}
+	if p.Err != nil {
+		return p.Err
+	}
+
+	return s.ResumeData().Save(m.resumeFile(s.Torrent))
+}
+
+// RemoveTorrent stops a torrent and forgets it, deleting its data too
+// if deleteData is set
+func (m *SwarmManager) RemoveTorrent(infoHash [20]byte, deleteData bool) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	wasRunning := s.IsRunning()
+	s.Close()
+	m.queue.Remove(s)
+
+	m.swarmLock.Lock()
+	for _, h := range s.Torrent.InfoHashes() {
+		var hash [20]byte
+		copy(hash[:], h)
+		delete(m.Swarms, hash)
+	}
+	for i, other := range m.swarmList {
+		if other == s {
+			m.swarmList = append(m.swarmList[:i], m.swarmList[i+1:]...)
+			break
+		}
+	}
+	m.swarmLock.Unlock()
+
+	m.goalsLock.Lock()
+	delete(m.torrentGoals, s)
+	m.goalsLock.Unlock()
+
+	os.Remove(m.resumeFile(s.Torrent))
+	if wasRunning {
+		m.StoppedChan <- s
+		m.updateQueue()
+	}
+
+	if deleteData {
+		return s.Storage().Delete()
+	}
+	return s.Storage().Close()
+}
+
+// SetSeedGoals sets the goals of every torrent without goals of its own
+func (m *SwarmManager) SetSeedGoals(goals swarm.SeedGoals) {
+	m.goalsLock.Lock()
+	defer m.goalsLock.Unlock()
+
+	m.seedGoals = goals
+}
+
+// SetTorrentSeedGoals overrides the global goals for one torrent, nil
+// goes back to the global goals
+func (m *SwarmManager) SetTorrentSeedGoals(infoHash [20]byte, goals *swarm.SeedGoals) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	m.goalsLock.Lock()
+	defer m.goalsLock.Unlock()
+
+	if goals == nil {
+		delete(m.torrentGoals, s)
+	} else {
+		m.torrentGoals[s] = goals
+	}
+	return nil
+}
+
+// SeedGoals returns the goals of torrents without goals of their own
+func (m *SwarmManager) SeedGoals() swarm.SeedGoals {
+	m.goalsLock.Lock()
+	defer m.goalsLock.Unlock()
+
+	return m.seedGoals
+}
+
+// TorrentSeedGoals returns a torrent's own goals, nil if it has none
+func (m *SwarmManager) TorrentSeedGoals(infoHash [20]byte) *swarm.SeedGoals {
+	s := m.Swarm(infoHash)
+
+	m.goalsLock.Lock()
+	defer m.goalsLock.Unlock()
+
+	if goals, ok := m.torrentGoals[s]; ok {
+		g := *goals
+		return &g
+	}
+	return nil
+}
+
+func (m *SwarmManager) goals(s *swarm.Swarm) swarm.SeedGoals {
+	m.goalsLock.Lock()
+	defer m.goalsLock.Unlock()
+
+	if goals, ok := m.torrentGoals[s]; ok {
+		return *goals
+	}
+	return m.seedGoals
+}
+
+// SetGoalRemover sets what removes the torrents that reached a goal with
+// a remove action. It's RemoveTorrent unless whoever owns the manager has
+// more to clean up, such as unregistering the torrent from peer sources.
+func (m *SwarmManager) SetGoalRemover(remove func(infoHash [20]byte, deleteData bool) error) {
+	m.goalsLock.Lock()
+	defer m.goalsLock.Unlock()
+
+	m.removeForGoal = remove
+}
+
+// checkSeedGoals stops every running torrent that reached a seeding goal
+func (m *SwarmManager) checkSeedGoals() {
+	for _, s := range m.SwarmList() {
+		if !s.IsRunning() {
+			continue
+		}
+
+		goals := m.goals(s)
+		goal := s.GoalReached(&goals)
+		if goal == swarm.GOAL_NONE {
+			continue
+		}
+
+		logger.Printf("Torrent %s reached its %s goal, action: %s", s.Torrent.InfoHashString(), goal, goals.Action)
+
+		m.goalsLock.Lock()
+		remove := m.removeForGoal
+		m.goalsLock.Unlock()
+
+		var err error
+		var hash [20]byte
+		copy(hash[:], s.Torrent.InfoHash())
+		switch goals.Action {
+		case swarm.GOAL_ACTION_PAUSE:
+			err = m.PauseTorrent(hash)
+		case swarm.GOAL_ACTION_REMOVE:
+			err = remove(hash, false)
+		case swarm.GOAL_ACTION_DELETE:
+			err = remove(hash, true)
+		}
+		if err != nil {
+			logger.Printf("Torrent %s: %s", s.Torrent.InfoHashString(), err)
+		}
+	}
+}
+
+func (m *SwarmManager) QueueLimits() queue.Limits {
+	return m.queue.Limits()
+}
+
+// SetQueueLimits limits how many torrents run at once
+func (m *SwarmManager) SetQueueLimits(limits queue.Limits) {
+	m.queue.SetLimits(limits)
+	m.updateQueue()
+}
+
+// updateQueue starts and queues torrents as the queue hands out slots
+func (m *SwarmManager) updateQueue() {
+	m.queueLock.Lock()
+	start, stop := m.queue.Update()
+	// Slots are freed before they're handed out
+	for _, t := range stop {
+		t.(*swarm.Swarm).Queue()
+	}
+	for _, t := range start {
+		t.(*swarm.Swarm).Start()
+	}
+	m.queueLock.Unlock()
+
+	// The client is told once the queue is unlocked, it may fall behind
+	// when many torrents start at once
+	for _, t := range stop {
+		m.stopped(t.(*swarm.Swarm))
+	}
+	for _, t := range start {
+		m.StartedChan <- t.(*swarm.Swarm)
+	}
+}
+
+// stopped saves the progress of a swarm that stopped running and tells
+// its trackers
+func (m *SwarmManager) stopped(s *swarm.Swarm) {
+	if err := s.ResumeData().Save(m.resumeFile(s.Torrent)); err != nil {
+		logger.Printf("Could not save resume data for torrent %s: %s", s.Torrent.InfoHashString(), err)
+	}
+	m.StoppedChan <- s
+}
+
+// checkSpace fails before any data is written, rather than once the disk
+// is full, if the files that aren't skipped don't fit in the save path
+func (m *SwarmManager) checkSpace(s *swarm.Swarm) error {
+	sc, ok := s.Storage().(storage.SpaceChecker)
+	if !ok {
+		return nil
+	}
+
+	if err := sc.CheckSpace(); err != nil {
+		logger.Printf("Not starting torrent %s: %s", s.Torrent.InfoHashString(), err)
+		return err
+	}
+	return nil
+}
+
+// StartTorrent puts a paused torrent back in the queue, it's started
+// once there's a slot for it
+func (m *SwarmManager) StartTorrent(infoHash [20]byte) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	if !s.IsRunning() {
+		if err := m.checkSpace(s); err != nil {
+			return err
+		}
+		s.Queue()
+	}
+	m.updateQueue()
+	return nil
+}
+
+// ForceStartTorrent starts a torrent right away, whatever the limits
+func (m *SwarmManager) ForceStartTorrent(infoHash [20]byte) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	if !s.IsRunning() {
+		if err := m.checkSpace(s); err != nil {
+			return err
+		}
+	}
+	if err := m.queue.SetForced(s, true); err != nil {
+		return err
+	}
+	if !s.IsRunning() {
+		s.Queue()
+	}
+	m.updateQueue()
+	return nil
+}
+
+// PauseTorrent stops a torrent until it's started again, giving up its
+// queue slot
+func (m *SwarmManager) PauseTorrent(infoHash [20]byte) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	m.queue.SetForced(s, false)
+	wasRunning := s.IsRunning()
+	s.Stop()
+	if wasRunning {
+		m.stopped(s)
+		m.updateQueue()
+	}
+	return nil
+}
+
+// SetSuperSeeding turns super-seeding on or off. Only torrents with every
+// piece can super-seed.
+func (m *SwarmManager) SetSuperSeeding(infoHash [20]byte, on bool) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	return s.SetSuperSeeding(on)
+}
+
+// VerifyTorrent checks a torrent's data again. Running torrents are
+// restarted, others are checked the next time they start.
+func (m *SwarmManager) VerifyTorrent(infoHash [20]byte) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	s.Recheck()
+	if s.IsRunning() {
+		// Trackers see the torrent stop and start again, like any other
+		// restart
+		s.Queue()
+		m.stopped(s)
+		s.Start()
+		m.StartedChan <- s
+	}
+	return nil
+}
+
+// SetQueuePosition moves a torrent to the given place in the queue,
+// 0 being the front
+func (m *SwarmManager) SetQueuePosition(infoHash [20]byte, pos int) error {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	if err := m.queue.SetPosition(s, pos); err != nil {
+		return err
+	}
+	m.updateQueue()
+	return nil
+}
+
+// QueuePosition is the torrent's place in the queue, 0 being the front
+func (m *SwarmManager) QueuePosition(infoHash [20]byte) (int, error) {
+	s := m.Swarm(infoHash)
+	if s == nil {
+		return 0, fmt.Errorf("unknown torrent %x", infoHash)
+	}
+
+	return m.queue.Position(s), nil
+}
+
+func (m *SwarmManager) MoveQueueUp(infoHash [20]byte) error {
+	pos, err := m.QueuePosition(infoHash)
+	if err != nil {
+		return err
+	}
+	return m.SetQueuePosition(infoHash, pos-1)
+}
+
+func (m *SwarmManager) MoveQueueDown(infoHash [20]byte) error {
+	pos, err := m.QueuePosition(infoHash)
+	if err != nil {
+		return err
+	}
+	return m.SetQueuePosition(infoHash, pos+1)
 }
 
 func (m *SwarmManager) Run() {
+	ticker := time.NewTicker(RESUME_SAVE_INTERVAL)
+	goalTicker := time.NewTicker(SEED_GOAL_CHECK_INTERVAL)
+	queueTicker := time.NewTicker(QUEUE_UPDATE_INTERVAL)
 	for {
 		select {
-		case t := <-m.addTorrentChan:
-			m.handleNewSwarm(t)
+		case nt := <-m.addTorrentChan:
+			nt.errChan <- m.handleNewSwarm(nt.t, nt.policy, nt.opts)
+		case <-ticker.C:
+			m.SaveResumeData()
+		case <-goalTicker.C:
+			m.checkSeedGoals()
+		case <-queueTicker.C:
+			m.updateQueue()
 		}
 	}
 }
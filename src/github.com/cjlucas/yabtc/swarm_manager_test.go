@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p"
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/storage"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zeebo/bencode"
+)
+
+// newHugeTorrent returns a torrent with a file far larger than any disk
+// followed by a small one
+func newHugeTorrent() *torrent.MetaData {
+	pieceLength := 1 << 40
+	numPieces := (1<<50 + 10 + pieceLength - 1) / pieceLength
+	info := map[string]interface{}{
+		"name":         "huge",
+		"piece length": pieceLength,
+		"pieces":       string(make([]byte, 20*numPieces)),
+		"files": []interface{}{
+			map[string]interface{}{"length": 1 << 50, "path": []string{"big"}},
+			map[string]interface{}{"length": 10, "path": []string{"small"}},
+		},
+	}
+
+	b, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+	if err != nil {
+		panic(err)
+	}
+	t, err := torrent.ParseBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSwarmManagerSpace(t *testing.T) {
+	Convey("Given a torrent larger than the disk", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-manager")
+		defer os.RemoveAll(root)
+
+		m := NewSwarmManager(root, root, storage.ALLOCATE_SPARSE)
+		go m.Run()
+		go func() {
+			for range m.StartedChan {
+			}
+		}()
+		tor := newHugeTorrent()
+		var hash [20]byte
+		copy(hash[:], tor.InfoHash())
+
+		Convey("Adding it unpaused should fail", func() {
+			err := m.AddTorrent(tor, p2p.NewPeerPolicy(false), AddOptions{})
+			So(err, ShouldHaveSameTypeAs, &storage.InsufficientSpaceError{})
+		})
+
+		Convey("When it's added paused", func() {
+			So(m.AddTorrent(tor, p2p.NewPeerPolicy(false), AddOptions{Paused: true}), ShouldBeNil)
+			s := m.Swarm(hash)
+
+			Convey("Starting it with every file wanted should fail", func() {
+				So(m.StartTorrent(hash), ShouldHaveSameTypeAs, &storage.InsufficientSpaceError{})
+				So(s.IsRunning(), ShouldBeFalse)
+			})
+
+			Convey("Starting it with only the small file wanted should work", func() {
+				s.SetFilePriority(0, swarm.PRIORITY_SKIP)
+				So(m.StartTorrent(hash), ShouldBeNil)
+				So(m.Swarm(hash).Status(), ShouldNotEqual, swarm.PAUSED)
+				s.Stop()
+			})
+		})
+	})
+}
+
+func TestSwarmManagerVerify(t *testing.T) {
+	Convey("Given a running torrent", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-manager")
+		defer os.RemoveAll(root)
+		savePath, resumeDir := filepath.Join(root, "data"), filepath.Join(root, "resume")
+		os.MkdirAll(savePath, 0755)
+		newCompletedTorrents(savePath, resumeDir, 1)
+		files, _ := filepath.Glob(filepath.Join(resumeDir, "*.torrent"))
+		tor, err := torrent.ParseFile(files[0])
+		So(err, ShouldBeNil)
+
+		m := NewSwarmManager(savePath, resumeDir, storage.ALLOCATE_SPARSE)
+		go m.Run()
+		So(m.AddTorrent(tor, p2p.NewPeerPolicy(false), AddOptions{}), ShouldBeNil)
+		s := <-m.StartedChan
+		defer s.Stop()
+
+		Convey("Verifying it should tell its trackers it stopped and started", func() {
+			var hash [20]byte
+			copy(hash[:], tor.InfoHash())
+			So(m.VerifyTorrent(hash), ShouldBeNil)
+
+			So(len(m.StoppedChan), ShouldEqual, 1)
+			So(<-m.StoppedChan, ShouldEqual, s)
+			So(len(m.StartedChan), ShouldEqual, 1)
+			So(<-m.StartedChan, ShouldEqual, s)
+		})
+	})
+}
+
+func TestSwarmManagerSuperSeeding(t *testing.T) {
+	Convey("Given a seeding torrent", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-manager")
+		defer os.RemoveAll(root)
+		savePath, resumeDir := filepath.Join(root, "data"), filepath.Join(root, "resume")
+		os.MkdirAll(savePath, 0755)
+		newCompletedTorrents(savePath, resumeDir, 1)
+		files, _ := filepath.Glob(filepath.Join(resumeDir, "*.torrent"))
+		tor, _ := torrent.ParseFile(files[0])
+
+		m := NewSwarmManager(savePath, resumeDir, storage.ALLOCATE_SPARSE)
+		go m.Run()
+		So(m.AddTorrent(tor, p2p.NewPeerPolicy(false), AddOptions{}), ShouldBeNil)
+		s := <-m.StartedChan
+		defer s.Stop()
+
+		deadline := time.Now().Add(10 * time.Second)
+		for s.Status() != swarm.SEEDING && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		Convey("It should be able to super-seed", func() {
+			var hash [20]byte
+			copy(hash[:], tor.InfoHash())
+			So(m.SetSuperSeeding(hash, true), ShouldBeNil)
+			So(s.IsSuperSeeding(), ShouldBeTrue)
+		})
+
+		Convey("An unknown torrent should be reported", func() {
+			So(m.SetSuperSeeding([20]byte{1}, true), ShouldNotBeNil)
+		})
+	})
+}
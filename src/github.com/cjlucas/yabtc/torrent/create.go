@@ -0,0 +1,417 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	MIN_CREATE_PIECE_LENGTH = 1 << 14
+	MAX_CREATE_PIECE_LENGTH = 1 << 24
+
+	// Piece length is picked so torrents end up with about this many pieces
+	TARGET_PIECE_COUNT = 1500
+)
+
+type CreateOptions struct {
+	// Must be a power of two, picked from the content size if zero
+	PieceLength int
+	Announce    string
+	Comment     string
+	CreatedBy   string
+	Private     bool
+
+	// Enable both for a hybrid torrent
+	V1, V2 bool
+
+	// Pad every file but the last to a piece boundary (BEP 47), so each
+	// file can be verified on its own. Hybrid torrents are always padded.
+	PadFiles bool
+}
+
+type createFile struct {
+	path       string
+	components []string
+	length     int
+	executable bool
+	// Target of a symlink, relative to the torrent's root
+	symlink []string
+
+	// v2 hashes
+	piecesRoot []byte
+	pieceLayer []byte
+}
+
+func choosePieceLength(totalLength int) int {
+	pl := MIN_CREATE_PIECE_LENGTH
+	for pl < MAX_CREATE_PIECE_LENGTH && totalLength/pl > TARGET_PIECE_COUNT {
+		pl <<= 1
+	}
+	return pl
+}
+
+func collectFiles(root string) ([]*createFile, bool, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !fi.IsDir() {
+		f := &createFile{path: root, components: []string{fi.Name()}, length: int(fi.Size())}
+		f.executable = fi.Mode()&0111 != 0
+		return []*createFile{f}, false, nil
+	}
+
+	var files []*createFile
+	// Walk visits entries in lexical order, the same order as a v2 file tree
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		isSymlink := info.Mode()&os.ModeSymlink != 0
+		if !info.Mode().IsRegular() && !isSymlink {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		f := &createFile{path: path, components: splitPath(rel)}
+		if isSymlink {
+			// Links pointing outside the torrent can't be represented
+			if f.symlink = symlinkTarget(root, path); f.symlink == nil {
+				return nil
+			}
+		} else {
+			f.length = int(info.Size())
+			f.executable = info.Mode()&0111 != 0
+		}
+
+		files = append(files, f)
+		return nil
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(files) == 0 {
+		return nil, false, errors.New("no files found")
+	}
+
+	return files, true, nil
+}
+
+func splitPath(rel string) []string {
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+// symlinkTarget returns the path the link points to relative to root,
+// or nil if it points outside of root
+func symlinkTarget(root, link string) []string {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return nil
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	return splitPath(rel)
+}
+
+func (f *createFile) attr() string {
+	if f.symlink != nil {
+		return "l"
+	}
+	if f.executable {
+		return "x"
+	}
+	return ""
+}
+
+// hashFile feeds the file's data into the v1 piece stream and computes
+// the file's v2 merkle hashes
+func hashFile(f *createFile, pieceLength int, opts *CreateOptions, v1 *v1Hasher) error {
+	if f.symlink != nil {
+		return nil
+	}
+
+	fp, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	buf := make([]byte, pieceLength)
+	var layer [][]byte
+	bytesLeft := f.length
+	for bytesLeft > 0 {
+		n := pieceLength
+		if bytesLeft < n {
+			n = bytesLeft
+		}
+
+		if _, err := io.ReadFull(fp, buf[:n]); err != nil {
+			return fmt.Errorf("error reading %s: %s", f.path, err)
+		}
+
+		if opts.V1 {
+			v1.Write(buf[:n])
+		}
+
+		if opts.V2 {
+			leaves := pieceLength / MERKLE_BLOCK_SIZE
+			if f.length <= pieceLength {
+				leaves = NextPowerOfTwo((f.length + MERKLE_BLOCK_SIZE - 1) / MERKLE_BLOCK_SIZE)
+			}
+			layer = append(layer, MerkleRoot(buf[:n], leaves))
+		}
+
+		bytesLeft -= n
+	}
+
+	if opts.V2 && f.length > 0 {
+		if f.length <= pieceLength {
+			f.piecesRoot = layer[0]
+		} else {
+			f.piecesRoot = PieceLayerRoot(layer, pieceLength)
+			for _, h := range layer {
+				f.pieceLayer = append(f.pieceLayer, h...)
+			}
+		}
+	}
+
+	return nil
+}
+
+// v1Hasher hashes a byte stream into fixed size pieces
+type v1Hasher struct {
+	pieceLength int
+	pieces      []byte
+	cur         []byte
+}
+
+func (h *v1Hasher) Write(data []byte) {
+	for len(data) > 0 {
+		n := h.pieceLength - len(h.cur)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		h.cur = append(h.cur, data[:n]...)
+		data = data[n:]
+
+		if len(h.cur) == h.pieceLength {
+			h.flush()
+		}
+	}
+}
+
+func (h *v1Hasher) flush() {
+	if len(h.cur) == 0 {
+		return
+	}
+
+	sum := sha1.Sum(h.cur)
+	h.pieces = append(h.pieces, sum[:]...)
+	h.cur = h.cur[:0]
+}
+
+// Create builds a torrent from a file or directory. Hybrid torrents pad
+// every file but the last to a piece boundary so v1 and v2 pieces line up.
+func Create(root string, opts CreateOptions) (*MetaData, error) {
+	if !opts.V1 && !opts.V2 {
+		return nil, errors.New("at least one of V1 and V2 must be enabled")
+	}
+
+	files, isDir, err := collectFiles(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// v2 file trees have no way to describe symlinks
+	if opts.V2 {
+		var regular []*createFile
+		for _, f := range files {
+			if f.symlink == nil {
+				regular = append(regular, f)
+			}
+		}
+		files = regular
+	}
+
+	totalLength := 0
+	for _, f := range files {
+		totalLength += f.length
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(totalLength)
+	}
+
+	if opts.V2 && (!isPowerOfTwo(pieceLength) || pieceLength < MERKLE_BLOCK_SIZE) {
+		return nil, errors.New("v2 piece length must be a power of two of at least 16KiB")
+	}
+
+	name := filepath.Base(filepath.Clean(root))
+	hybrid := opts.V1 && opts.V2
+	v1 := &v1Hasher{pieceLength: pieceLength}
+
+	var v1Files []map[string]interface{}
+	for i, f := range files {
+		if err := hashFile(f, pieceLength, &opts, v1); err != nil {
+			return nil, err
+		}
+
+		entry := map[string]interface{}{
+			"length": f.length,
+			"path":   f.components,
+		}
+		if attr := f.attr(); attr != "" {
+			entry["attr"] = attr
+		}
+		if f.symlink != nil {
+			entry["symlink path"] = f.symlink
+		}
+		v1Files = append(v1Files, entry)
+
+		rem := f.length % pieceLength
+		if (hybrid || opts.PadFiles) && rem != 0 && i != len(files)-1 {
+			pad := pieceLength - rem
+			v1.Write(make([]byte, pad))
+			v1Files = append(v1Files, map[string]interface{}{
+				"attr":   "p",
+				"length": pad,
+				"path":   []string{".pad", fmt.Sprintf("%d", pad)},
+			})
+		}
+	}
+	v1.flush()
+
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+	}
+
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	if opts.V1 {
+		info["pieces"] = v1.pieces
+		if isDir {
+			info["files"] = v1Files
+		} else {
+			info["length"] = files[0].length
+			if attr := files[0].attr(); attr != "" {
+				info["attr"] = attr
+			}
+		}
+	}
+
+	pieceLayers := make(map[string][]byte)
+	if opts.V2 {
+		info["meta version"] = 2
+
+		tree := make(map[string]interface{})
+		for _, f := range files {
+			components := f.components
+			node := tree
+			for _, c := range components[:len(components)-1] {
+				child, ok := node[c].(map[string]interface{})
+				if !ok {
+					child = make(map[string]interface{})
+					node[c] = child
+				}
+				node = child
+			}
+
+			entry := map[string]interface{}{"length": f.length}
+			if f.length > 0 {
+				entry["pieces root"] = f.piecesRoot
+			}
+			if attr := f.attr(); attr != "" {
+				entry["attr"] = attr
+			}
+			node[components[len(components)-1]] = map[string]interface{}{"": entry}
+
+			if f.pieceLayer != nil {
+				pieceLayers[string(f.piecesRoot)] = f.pieceLayer
+			}
+		}
+		info["file tree"] = tree
+	}
+
+	rawInfo, err := bencode.EncodeBytes(info)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MetaData{
+		RawInfo:      rawInfo,
+		Announce:     opts.Announce,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		PieceLayers:  pieceLayers,
+	}
+
+	b, err := m.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseBytes(b)
+}
+
+// Bytes encodes the torrent in .torrent file format
+func (m *MetaData) Bytes() ([]byte, error) {
+	out := map[string]interface{}{
+		"info": m.RawInfo,
+	}
+
+	if m.Announce != "" {
+		out["announce"] = m.Announce
+	}
+	if len(m.AnnounceList) > 0 {
+		out["announce-list"] = m.AnnounceList
+	}
+	if m.Comment != "" {
+		out["comment"] = m.Comment
+	}
+	if m.CreatedBy != "" {
+		out["created by"] = m.CreatedBy
+	}
+	if m.CreationDate != 0 {
+		out["creation date"] = m.CreationDate
+	}
+	if m.Encoding != "" {
+		out["encoding"] = m.Encoding
+	}
+	m.piecesLock.RLock()
+	defer m.piecesLock.RUnlock()
+	if len(m.PieceLayers) > 0 {
+		out["piece layers"] = m.PieceLayers
+	}
+
+	return bencode.EncodeBytes(out)
+}
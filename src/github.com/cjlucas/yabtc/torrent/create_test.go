@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func createTestDir() string {
+	root, err := ioutil.TempDir("", "yabtc-create")
+	if err != nil {
+		panic(err)
+	}
+
+	dir := filepath.Join(root, "content")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.bin"), bytes.Repeat([]byte{1}, 2*MERKLE_BLOCK_SIZE+100), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("small file"), 0644)
+
+	return dir
+}
+
+func TestCreate(t *testing.T) {
+	Convey("When creating a hybrid torrent from a directory", t, func() {
+		dir := createTestDir()
+		defer os.RemoveAll(filepath.Dir(dir))
+
+		m, err := Create(dir, CreateOptions{PieceLength: MERKLE_BLOCK_SIZE, V1: true, V2: true})
+		So(err, ShouldBeNil)
+
+		Convey("It should be recognized as hybrid", func() {
+			So(m.IsHybrid(), ShouldBeTrue)
+			So(len(m.InfoHashes()), ShouldEqual, 2)
+			So(m.InfoHash(), ShouldResemble, m.InfoHashV1())
+		})
+
+		Convey("It should pad files to piece boundaries", func() {
+			files := m.Files()
+			So(len(files), ShouldEqual, 3)
+			So(files[1].IsPadding(), ShouldBeTrue)
+			So(files[2].Path(), ShouldEqual, "content/sub/b.txt")
+			So(files[2].PiecesRoot, ShouldNotBeNil)
+		})
+
+		Convey("Every piece should verify against both hash sets", func() {
+			fs := NewFileStream(filepath.Dir(dir), m.Files())
+			for _, p := range m.GeneratePieces() {
+				data, err := fs.ReadBlock(Block{p.ByteOffset, p.Length})
+				So(err, ShouldBeNil)
+				So(m.VerifyPiece(p.Index, data), ShouldBeTrue)
+			}
+			So(m.IsInconsistent(), ShouldBeFalse)
+		})
+
+		Convey("It should survive a round trip through Bytes", func() {
+			b, err := m.Bytes()
+			So(err, ShouldBeNil)
+
+			parsed, err := ParseBytes(b)
+			So(err, ShouldBeNil)
+			So(parsed.InfoHashes(), ShouldResemble, m.InfoHashes())
+		})
+	})
+
+	Convey("When a hybrid torrent's v1 hashes disagree with its v2 hashes", t, func() {
+		dir := createTestDir()
+		defer os.RemoveAll(filepath.Dir(dir))
+
+		m, _ := Create(dir, CreateOptions{PieceLength: MERKLE_BLOCK_SIZE, V1: true, V2: true})
+		pieces := m.GeneratePieces()
+		pieces[0].Hash = make([]byte, 20)
+
+		Convey("The piece should fail and the torrent flagged inconsistent", func() {
+			data := bytes.Repeat([]byte{1}, MERKLE_BLOCK_SIZE)
+			So(m.VerifyPiece(0, data), ShouldBeFalse)
+			So(m.IsInconsistent(), ShouldBeTrue)
+		})
+	})
+
+	Convey("When creating a v1 torrent from a single file", t, func() {
+		dir := createTestDir()
+		defer os.RemoveAll(filepath.Dir(dir))
+
+		m, err := Create(filepath.Join(dir, "a.bin"), CreateOptions{V1: true})
+		So(err, ShouldBeNil)
+
+		Convey("It should be a single file v1 torrent without padding", func() {
+			So(m.IsV2(), ShouldBeFalse)
+			So(m.IsMultiFile(), ShouldBeFalse)
+			So(len(m.GeneratePieces()), ShouldEqual, 3)
+		})
+	})
+
+	Convey("When creating a padded v1 torrent with an executable and a symlink", t, func() {
+		dir := createTestDir()
+		defer os.RemoveAll(filepath.Dir(dir))
+		os.Chmod(filepath.Join(dir, "a.bin"), 0755)
+		os.Symlink(filepath.Join("sub", "b.txt"), filepath.Join(dir, "link"))
+
+		m, err := Create(dir, CreateOptions{V1: true, PadFiles: true, PieceLength: MERKLE_BLOCK_SIZE})
+		So(err, ShouldBeNil)
+		files := m.Files()
+
+		Convey("Files should be padded to piece boundaries", func() {
+			So(files, ShouldHaveLength, 4)
+			So(files[1].IsPadding(), ShouldBeTrue)
+			So(files[1].Length, ShouldEqual, MERKLE_BLOCK_SIZE-100)
+			So(len(m.GeneratePieces()), ShouldEqual, 4)
+		})
+
+		Convey("The attributes should survive a round trip", func() {
+			b, err := m.Bytes()
+			So(err, ShouldBeNil)
+			parsed, err := ParseBytes(b)
+			So(err, ShouldBeNil)
+			files = parsed.Files()
+
+			So(files[0].IsExecutable(), ShouldBeTrue)
+			So(files[2].Path(), ShouldEqual, "content/link")
+			So(files[2].IsSymlink(), ShouldBeTrue)
+			So(files[2].SymlinkPath, ShouldResemble, []string{"content", "sub", "b.txt"})
+			So(files[3].IsExecutable(), ShouldBeFalse)
+		})
+
+		Convey("Padding should read as zeros when verifying", func() {
+			fs := NewFileStream(filepath.Dir(dir), files)
+			p := m.GeneratePieces()[2]
+			data, err := fs.ReadBlock(Block{Offset: p.ByteOffset, Length: p.Length})
+			So(err, ShouldBeNil)
+			So(m.VerifyPiece(2, data), ShouldBeTrue)
+		})
+	})
+}
@@ -1,11 +1,26 @@
 package torrent
 
-import "path"
+import (
+	"path"
+	"path/filepath"
+)
 
 type File struct {
 	PathComponents []string `bencode:"path"`
 	Length         int      `bencode:"length"`
 	MD5sum         string   `bencode:"md5sum"`
+	SHA1           []byte   `bencode:"sha1"`
+
+	// Preferred over PathComponents, which may be in another encoding
+	PathUTF8 []string `bencode:"path.utf-8"`
+
+	// BEP 47 attributes: p (padding), x (executable), h (hidden), l (symlink)
+	Attr string `bencode:"attr"`
+	// Target of a symlink, relative to the save path like PathComponents
+	SymlinkPath []string `bencode:"symlink path"`
+
+	// Root of the file's merkle tree (v2 torrents only)
+	PiecesRoot []byte `bencode:"-"`
 }
 
 type FileList []File
@@ -14,8 +29,42 @@ func (f *File) Path() string {
 	return path.Join(f.PathComponents...)
 }
 
+// PathFromRoot returns the file's path below root with every component
+// sanitized. Use a PathMap to also resolve collisions with other files.
 func (f *File) PathFromRoot(root string) string {
-	return path.Join(root, f.Path())
+	return filepath.Join(root, filepath.Join(SanitizePath(f.PathComponents)...))
+}
+
+func (f *File) hasAttr(attr rune) bool {
+	for _, c := range f.Attr {
+		if c == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// Padding files only exist to align the next file to a piece boundary
+func (f *File) IsPadding() bool {
+	return f.hasAttr('p')
+}
+
+func (f *File) IsExecutable() bool {
+	return f.hasAttr('x')
+}
+
+func (f *File) IsHidden() bool {
+	return f.hasAttr('h')
+}
+
+// Symlinks have no data of their own, they point at SymlinkPath
+func (f *File) IsSymlink() bool {
+	return f.hasAttr('l')
+}
+
+// HasData reports whether the file has content stored on disk
+func (f *File) HasData() bool {
+	return !f.IsPadding() && !f.IsSymlink()
 }
 
 func (fl *FileList) TotalLength() int {
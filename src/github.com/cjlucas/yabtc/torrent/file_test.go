@@ -8,9 +8,9 @@ import (
 func TestTotalLength(t *testing.T) {
 	Convey("When given a FileList of files", t, func() {
 		fl := FileList{
-			File{[]string{"file1.mp3"}, 100, ""},
-			File{[]string{"file2.mp3"}, 200, ""},
-			File{[]string{"file3.mp3"}, 500, ""},
+			File{PathComponents: []string{"file1.mp3"}, Length: 100},
+			File{PathComponents: []string{"file2.mp3"}, Length: 200},
+			File{PathComponents: []string{"file3.mp3"}, Length: 500},
 		}
 
 		Convey("It should return the sum of each file's length", func() {
@@ -21,7 +21,7 @@ func TestTotalLength(t *testing.T) {
 
 func TestPath(t *testing.T) {
 	Convey("When given a file located at the root", t, func() {
-		f := File{[]string{"file1.mp3"}, 100, ""}
+		f := File{PathComponents: []string{"file1.mp3"}, Length: 100}
 
 		Convey("It should return the correct relative path", func() {
 			So(f.Path(), ShouldEqual, "file1.mp3")
@@ -29,10 +29,34 @@ func TestPath(t *testing.T) {
 	})
 
 	Convey("When given a file located within multiple subdirectories", t, func() {
-		f := File{[]string{"path", "to", "file1.mp3"}, 100, ""}
+		f := File{PathComponents: []string{"path", "to", "file1.mp3"}, Length: 100}
 
 		Convey("It should return the correct relative path", func() {
 			So(f.Path(), ShouldEqual, "path/to/file1.mp3")
 		})
 	})
 }
+
+func TestAttributes(t *testing.T) {
+	Convey("When a file has BEP 47 attributes", t, func() {
+		f := File{PathComponents: []string{"run.sh"}, Attr: "xh"}
+
+		Convey("Each attribute should be recognized", func() {
+			So(f.IsExecutable(), ShouldBeTrue)
+			So(f.IsHidden(), ShouldBeTrue)
+			So(f.IsPadding(), ShouldBeFalse)
+			So(f.IsSymlink(), ShouldBeFalse)
+			So(f.HasData(), ShouldBeTrue)
+		})
+	})
+
+	Convey("When a file is a padding file or a symlink", t, func() {
+		pad := File{Length: 100, Attr: "p"}
+		link := File{PathComponents: []string{"link"}, Attr: "l", SymlinkPath: []string{"target"}}
+
+		Convey("It should have no data on disk", func() {
+			So(pad.HasData(), ShouldBeFalse)
+			So(link.HasData(), ShouldBeFalse)
+		})
+	})
+}
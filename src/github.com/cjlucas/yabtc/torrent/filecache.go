@@ -0,0 +1,143 @@
+package torrent
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Default limit on open files, shared by every torrent
+const DEFAULT_MAX_OPEN_FILES = 256
+
+var DefaultFileHandleCache = NewFileHandleCache(DEFAULT_MAX_OPEN_FILES)
+
+type fileHandle struct {
+	path     string
+	fp       *os.File
+	writable bool
+	refs     int
+	// Set once the handle left the cache, it's closed on last release
+	detached bool
+	elem     *list.Element
+}
+
+// FileHandleCache keeps up to max files open, closing the least recently
+// used ones first. Handles in use are never closed, so the limit can be
+// exceeded while all of them are busy. A max of 0 disables caching.
+type FileHandleCache struct {
+	max     int
+	lru     *list.List
+	handles map[string]*fileHandle
+	lock    sync.Mutex
+}
+
+func NewFileHandleCache(max int) *FileHandleCache {
+	return &FileHandleCache{
+		max:     max,
+		lru:     list.New(),
+		handles: make(map[string]*fileHandle),
+	}
+}
+
+func openFile(fpath string, writable bool) (*os.File, error) {
+	if !writable {
+		return os.Open(fpath)
+	}
+
+	// Files (and their directories) are created on first write
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// acquire returns an open handle for fpath, which must be given back
+// with release. Read-only handles are upgraded when writable is set.
+func (c *FileHandleCache) acquire(fpath string, writable bool) (*fileHandle, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if h, ok := c.handles[fpath]; ok {
+		if h.writable || !writable {
+			h.refs++
+			c.lru.MoveToFront(h.elem)
+			return h, nil
+		}
+
+		c.detach(h)
+	}
+
+	fp, err := openFile(fpath, writable)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &fileHandle{path: fpath, fp: fp, writable: writable, refs: 1}
+	if c.max == 0 {
+		h.detached = true
+		return h, nil
+	}
+
+	h.elem = c.lru.PushFront(h)
+	c.handles[fpath] = h
+	c.evict()
+
+	return h, nil
+}
+
+func (c *FileHandleCache) release(h *fileHandle) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	h.refs--
+	if h.detached && h.refs == 0 {
+		h.fp.Close()
+	}
+}
+
+// detach removes the handle from the cache, closing it once unused.
+// Must be called with the lock held.
+func (c *FileHandleCache) detach(h *fileHandle) {
+	c.lru.Remove(h.elem)
+	delete(c.handles, h.path)
+	h.detached = true
+
+	if h.refs == 0 {
+		h.fp.Close()
+	}
+}
+
+// Must be called with the lock held
+func (c *FileHandleCache) evict() {
+	e := c.lru.Back()
+	for c.lru.Len() > c.max && e != nil {
+		prev := e.Prev()
+		if h := e.Value.(*fileHandle); h.refs == 0 {
+			c.detach(h)
+		}
+		e = prev
+	}
+}
+
+// Close closes the handles of the given files, for example when their
+// torrent is paused or removed
+func (c *FileHandleCache) Close(fpaths ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, fpath := range fpaths {
+		if h, ok := c.handles[fpath]; ok {
+			c.detach(h)
+		}
+	}
+}
+
+// Len returns the number of cached handles
+func (c *FileHandleCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.lru.Len()
+}
@@ -0,0 +1,91 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileHandleCache(t *testing.T) {
+	Convey("When more files are opened than the cache holds", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-filecache")
+		defer os.RemoveAll(root)
+
+		c := NewFileHandleCache(2)
+		var handles []*fileHandle
+		for _, name := range []string{"a", "b", "c"} {
+			h, err := c.acquire(filepath.Join(root, name), true)
+			So(err, ShouldBeNil)
+			handles = append(handles, h)
+		}
+
+		Convey("Handles still in use should not be closed", func() {
+			So(c.Len(), ShouldEqual, 3)
+			_, err := handles[0].fp.Write([]byte("x"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("The least recently used handle should be closed once released", func() {
+			for _, h := range handles {
+				c.release(h)
+			}
+			h, _ := c.acquire(filepath.Join(root, "d"), true)
+			c.release(h)
+
+			So(c.Len(), ShouldEqual, 2)
+			_, ok := c.handles[filepath.Join(root, "a")]
+			So(ok, ShouldBeFalse)
+			_, err := handles[0].fp.Write([]byte("x"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("When a read-only handle is needed for writing", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-filecache")
+		defer os.RemoveAll(root)
+
+		fpath := filepath.Join(root, "a")
+		ioutil.WriteFile(fpath, []byte("hello"), 0644)
+
+		c := NewFileHandleCache(2)
+		ro, _ := c.acquire(fpath, false)
+		rw, err := c.acquire(fpath, true)
+		So(err, ShouldBeNil)
+
+		Convey("It should be upgraded to read-write", func() {
+			So(rw.writable, ShouldBeTrue)
+			_, err := rw.fp.WriteAt([]byte("j"), 0)
+			So(err, ShouldBeNil)
+			So(c.Len(), ShouldEqual, 1)
+		})
+
+		Convey("The read-only handle should stay usable until released", func() {
+			buf := make([]byte, 5)
+			_, err := ro.fp.ReadAt(buf, 0)
+			So(err, ShouldBeNil)
+
+			c.release(ro)
+			_, err = ro.fp.ReadAt(buf, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("When a file stream is closed", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-filecache")
+		defer os.RemoveAll(root)
+
+		c := NewFileHandleCache(10)
+		fs := NewFileStream(root, norm)
+		fs.SetCache(c)
+		fs.WriteBlock(Block{0, 1700}, make([]byte, 1700))
+		So(c.Len(), ShouldEqual, 3)
+
+		Convey("Its handles should be closed", func() {
+			fs.Close()
+			So(c.Len(), ShouldEqual, 0)
+		})
+	})
+}
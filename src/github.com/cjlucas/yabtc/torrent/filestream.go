@@ -3,7 +3,7 @@ package torrent
 import (
 	"crypto/sha1"
 	"errors"
-	"os"
+	"sync"
 )
 
 type Block struct {
@@ -13,53 +13,78 @@ type Block struct {
 type FileStream struct {
 	Root  string
 	Files FileList
+
+	// Skipped files are never written to (or created on) disk
+	skip     []bool
+	skipLock sync.RWMutex
+
+	cache *FileHandleCache
+	paths *PathMap
 }
 
 type fileAccessPoint struct {
 	File          *File
+	FileIndex     int
 	Offset        int
 	BytesExpected int
 }
 
 func NewFileStream(root string, files []File) *FileStream {
-	return &FileStream{root, files}
+	return &FileStream{Root: root, Files: files, cache: DefaultFileHandleCache, paths: NewPathMap(files)}
 }
 
-func (fs *FileStream) BlockValid(block Block) bool {
-	return block.Offset >= 0 &&
-		block.Length > 0 &&
-		block.Offset+block.Length <= fs.Files.TotalLength()
+// PathMap returns where the stream's files are stored relative to Root
+func (fs *FileStream) PathMap() *PathMap {
+	return fs.paths
+}
+
+// FilePath returns the path the file is stored at on disk
+func (fs *FileStream) FilePath(fileIndex int) string {
+	return fs.paths.PathFromRoot(fs.Root, fileIndex)
 }
 
-func (fs *FileStream) nextFile(curFile *File) *File {
+// SetCache sets the cache file handles are taken from
+func (fs *FileStream) SetCache(cache *FileHandleCache) {
+	fs.cache = cache
+}
+
+// Close closes any cached handles of the stream's files
+func (fs *FileStream) Close() {
+	var fpaths []string
 	for i := range fs.Files {
-		if curFile == &fs.Files[i] {
-			return &fs.Files[i+1]
-		}
+		fpaths = append(fpaths, fs.FilePath(i))
 	}
 
-	return nil
+	fs.cache.Close(fpaths...)
 }
 
-func openFileAndSeek(fpath string, seekPos int, mode int) (*os.File, error) {
-	fi, err := os.OpenFile(fpath, mode, 0644)
+func (fs *FileStream) SetSkipped(fileIndex int, skip bool) {
+	fs.skipLock.Lock()
+	defer fs.skipLock.Unlock()
 
-	if err != nil {
-		return nil, err
+	if fs.skip == nil {
+		fs.skip = make([]bool, len(fs.Files))
 	}
+	fs.skip[fileIndex] = skip
+}
 
-	if _, err := fi.Seek(int64(seekPos), os.SEEK_SET); err != nil {
-		fi.Close()
-		return nil, err
-	}
+func (fs *FileStream) Skipped(fileIndex int) bool {
+	fs.skipLock.RLock()
+	defer fs.skipLock.RUnlock()
 
-	return fi, nil
+	return fs.skip != nil && fs.skip[fileIndex]
+}
+
+func (fs *FileStream) BlockValid(block Block) bool {
+	return block.Offset >= 0 &&
+		block.Length > 0 &&
+		block.Offset+block.Length <= fs.Files.TotalLength()
 }
 
 // block must be valid
 func (fs *FileStream) determineAccessPoints(block Block) []fileAccessPoint {
 	var points []fileAccessPoint
-	var curFile *File
+	var curIndex int
 	var curOffset int
 
 	// Find start of block
@@ -68,7 +93,7 @@ func (fs *FileStream) determineAccessPoints(block Block) []fileAccessPoint {
 	for i := range fs.Files {
 		fileSize := int(fs.Files[i].Length)
 		if bytesLeftUntilBlockStart < fileSize {
-			curFile = &fs.Files[i]
+			curIndex = i
 			curOffset = bytesLeftUntilBlockStart
 			break
 		}
@@ -81,15 +106,16 @@ func (fs *FileStream) determineAccessPoints(block Block) []fileAccessPoint {
 	for bytesLeft > 0 {
 		var p fileAccessPoint
 
+		curFile := &fs.Files[curIndex]
 		bytesLeftInFile := curFile.Length - curOffset
 		// If
 		if bytesLeft > bytesLeftInFile {
-			p = fileAccessPoint{curFile, curOffset, bytesLeftInFile}
-			curFile = fs.nextFile(curFile)
+			p = fileAccessPoint{curFile, curIndex, curOffset, bytesLeftInFile}
+			curIndex++
 			curOffset = 0
 			bytesLeft -= bytesLeftInFile
 		} else {
-			p = fileAccessPoint{curFile, curOffset, bytesLeft}
+			p = fileAccessPoint{curFile, curIndex, curOffset, bytesLeft}
 			bytesLeft -= bytesLeft
 		}
 
@@ -110,12 +136,18 @@ func (fs *FileStream) WriteBlock(block Block, data []byte) error {
 
 	bytesWritten := 0
 	for _, p := range fs.determineAccessPoints(block) {
-		fpath := p.File.PathFromRoot(fs.Root)
-		if fp, err := openFileAndSeek(fpath, p.Offset, os.O_WRONLY); err != nil {
+		// Padding only exists in the piece layout, never on disk
+		if p.File.IsPadding() || fs.Skipped(p.FileIndex) {
+			bytesWritten += p.BytesExpected
+			continue
+		}
+
+		fpath := fs.FilePath(p.FileIndex)
+		if h, err := fs.cache.acquire(fpath, true); err != nil {
 			return err
 		} else {
-			n, err := fp.Write(data[bytesWritten:])
-			fp.Close()
+			n, err := h.fp.WriteAt(data[bytesWritten:bytesWritten+p.BytesExpected], int64(p.Offset))
+			fs.cache.release(h)
 
 			if err != nil {
 				return err
@@ -141,12 +173,18 @@ func (fs *FileStream) ReadBlock(block Block) ([]byte, error) {
 
 	bytesRead := 0
 	for _, p := range fs.determineAccessPoints(block) {
-		fpath := p.File.PathFromRoot(fs.Root)
-		if fp, err := openFileAndSeek(fpath, p.Offset, os.O_RDONLY); err != nil {
+		// Padding reads back as zeros
+		if p.File.IsPadding() {
+			bytesRead += p.BytesExpected
+			continue
+		}
+
+		fpath := fs.FilePath(p.FileIndex)
+		if h, err := fs.cache.acquire(fpath, false); err != nil {
 			return nil, err
 		} else {
-			n, err := fp.Read(data[bytesRead:])
-			fp.Close()
+			n, err := h.fp.ReadAt(data[bytesRead:bytesRead+p.BytesExpected], int64(p.Offset))
+			fs.cache.release(h)
 
 			if err != nil {
 				return nil, err
@@ -163,6 +201,17 @@ func (fs *FileStream) ReadBlock(block Block) ([]byte, error) {
 	return data, nil
 }
 
+// FileSpans maps the index of every file the block covers to the
+// number of bytes of the block that fall in it
+func (fs *FileStream) FileSpans(block Block) map[int]int {
+	spans := make(map[int]int)
+	for _, p := range fs.determineAccessPoints(block) {
+		spans[p.FileIndex] += p.BytesExpected
+	}
+
+	return spans
+}
+
 func (fs *FileStream) CalculatePieceChecksum(block Block) []byte {
 	data, err := fs.ReadBlock(block)
 
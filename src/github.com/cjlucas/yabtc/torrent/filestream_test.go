@@ -1,7 +1,10 @@
 package torrent
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -10,12 +13,12 @@ import (
 var goPath = os.Getenv("GOPATH")
 
 var norm = FileList{
-	File{[]string{"file1.mp3"}, 1000, ""},
-	File{[]string{"file2.mp3"}, 500, ""},
-	File{[]string{"file3.mp3"}, 200, ""},
+	File{PathComponents: []string{"file1.mp3"}, Length: 1000},
+	File{PathComponents: []string{"file2.mp3"}, Length: 500},
+	File{PathComponents: []string{"file3.mp3"}, Length: 200},
 }
 
-var simpleFileStream = FileStream{goPath, norm}
+var simpleFileStream = NewFileStream(goPath, norm)
 
 func TestNewFileStream(t *testing.T) {
 	Convey("When given valid arguments", t, func() {
@@ -140,3 +143,91 @@ func TestDetermineAccessPoints(t *testing.T) {
 		})
 	})
 }
+
+func TestFileSpans(t *testing.T) {
+	fs := simpleFileStream
+
+	Convey("When given a block spanning multiple files", t, func() {
+		spans := fs.FileSpans(Block{900, 700})
+
+		Convey("It should report the bytes falling in each file", func() {
+			So(spans, ShouldResemble, map[int]int{0: 100, 1: 500, 2: 100})
+		})
+	})
+}
+
+func TestWriteBlockSkipped(t *testing.T) {
+	Convey("When writing a block that spans a skipped file", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-filestream")
+		defer os.RemoveAll(root)
+
+		fs := NewFileStream(root, FileList{
+			File{PathComponents: []string{"dir", "a"}, Length: 10},
+			File{PathComponents: []string{"dir", "b"}, Length: 10},
+		})
+		fs.SetSkipped(0, true)
+
+		err := fs.WriteBlock(Block{5, 10}, []byte("0123456789"))
+		So(err, ShouldBeNil)
+
+		Convey("The skipped file should not be created", func() {
+			_, err := os.Stat(filepath.Join(root, "dir", "a"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("The wanted file should be created with its data", func() {
+			data, err := ioutil.ReadFile(filepath.Join(root, "dir", "b"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "56789")
+		})
+	})
+}
+
+func benchmarkFileStream(b *testing.B, cache *FileHandleCache, write bool) {
+	root, _ := ioutil.TempDir("", "yabtc-bench")
+	defer os.RemoveAll(root)
+
+	var files FileList
+	for i := 0; i < 8; i++ {
+		files = append(files, File{PathComponents: []string{fmt.Sprintf("file%d", i)}, Length: 1 << 20})
+	}
+
+	fs := NewFileStream(root, files)
+	fs.SetCache(cache)
+	defer fs.Close()
+
+	// Create every file up front so reads don't fail
+	fs.WriteBlock(Block{0, files.TotalLength()}, make([]byte, files.TotalLength()))
+
+	data := make([]byte, 1<<14)
+	numBlocks := files.TotalLength() / len(data)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		block := Block{(i % numBlocks) * len(data), len(data)}
+		if write {
+			fs.WriteBlock(block, data)
+		} else {
+			fs.ReadBlock(block)
+		}
+	}
+}
+
+// Uncached benchmarks open and close files for every block, as
+// FileStream did before the handle cache
+func BenchmarkReadBlockUncached(b *testing.B) {
+	benchmarkFileStream(b, NewFileHandleCache(0), false)
+}
+
+func BenchmarkReadBlockCached(b *testing.B) {
+	benchmarkFileStream(b, NewFileHandleCache(DEFAULT_MAX_OPEN_FILES), false)
+}
+
+func BenchmarkWriteBlockUncached(b *testing.B) {
+	benchmarkFileStream(b, NewFileHandleCache(0), true)
+}
+
+func BenchmarkWriteBlockCached(b *testing.B) {
+	benchmarkFileStream(b, NewFileHandleCache(DEFAULT_MAX_OPEN_FILES), true)
+}
@@ -0,0 +1,36 @@
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// MagnetURI returns a BEP 9 magnet link for the torrent. v2 torrents are
+// linked by their multihash (BEP 52), hybrid torrents by both hashes.
+func (m *MetaData) MagnetURI() string {
+	var xt []string
+	if m.IsV1() {
+		xt = append(xt, fmt.Sprintf("urn:btih:%x", m.InfoHashV1()))
+	}
+	if m.IsV2() {
+		// 0x12 is SHA-256 and 0x20 its length
+		xt = append(xt, fmt.Sprintf("urn:btmh:1220%x", m.InfoHashV2()))
+	}
+
+	// The hashes' colons are left as they are, clients expect them that way
+	uri := "magnet:?"
+	for i, x := range xt {
+		if i > 0 {
+			uri += "&"
+		}
+		uri += "xt=" + x
+	}
+	if name := m.Name(); name != "" {
+		uri += "&dn=" + url.QueryEscape(name)
+	}
+	for _, tr := range m.Trackers() {
+		uri += "&tr=" + url.QueryEscape(tr)
+	}
+
+	return uri
+}
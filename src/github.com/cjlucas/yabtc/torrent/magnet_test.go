@@ -0,0 +1,31 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMagnetURI(t *testing.T) {
+	dir := createTestDir()
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	Convey("A v1 torrent should be linked by its info hash", t, func() {
+		m, _ := Create(dir, CreateOptions{PieceLength: MERKLE_BLOCK_SIZE, V1: true, Announce: "http://tracker.example.com/announce?key=1"})
+
+		So(m.MagnetURI(), ShouldEqual, fmt.Sprintf(
+			"magnet:?xt=urn:btih:%x&dn=content&tr=http%%3A%%2F%%2Ftracker.example.com%%2Fannounce%%3Fkey%%3D1",
+			m.InfoHashV1()))
+	})
+
+	Convey("A hybrid torrent should be linked by both hashes", t, func() {
+		m, _ := Create(dir, CreateOptions{PieceLength: MERKLE_BLOCK_SIZE, V1: true, V2: true})
+
+		So(m.MagnetURI(), ShouldEqual, fmt.Sprintf(
+			"magnet:?xt=urn:btih:%x&xt=urn:btmh:1220%x&dn=content",
+			m.InfoHashV1(), m.InfoHashV2()))
+	})
+}
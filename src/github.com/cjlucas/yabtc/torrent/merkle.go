@@ -0,0 +1,195 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// Leaves of a v2 merkle tree each cover 16KiB of a file
+const MERKLE_BLOCK_SIZE = 1 << 14
+
+var zeroHash = make([]byte, sha256.Size)
+
+func hashPair(left, right []byte) []byte {
+	sha := sha256.New()
+	sha.Write(left)
+	sha.Write(right)
+	return sha.Sum(nil)
+}
+
+// NextPowerOfTwo returns the smallest power of two at least n, the
+// width of a merkle tree with n leaves
+func NextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// Log2 returns the base 2 logarithm of n rounded down, the height of a
+// merkle tree with n leaves when n is a power of two
+func Log2(n int) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
+
+// zeroSubtreeHash returns the root of a tree with numLeaves zero leaves
+func zeroSubtreeHash(numLeaves int) []byte {
+	h := zeroHash
+	for n := numLeaves; n > 1; n >>= 1 {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+// merkleRoot builds a tree of numLeaves leaves (a power of two) from hashes,
+// filling the leaves past len(hashes) with pad
+func merkleRoot(hashes [][]byte, numLeaves int, pad []byte) []byte {
+	layer := make([][]byte, numLeaves)
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = pad
+		}
+	}
+
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+		pad = hashPair(pad, pad)
+	}
+
+	return layer[0]
+}
+
+// blockHashes returns the leaf hashes for data
+func blockHashes(data []byte) [][]byte {
+	var hashes [][]byte
+	for off := 0; off < len(data); off += MERKLE_BLOCK_SIZE {
+		end := off + MERKLE_BLOCK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha256.Sum256(data[off:end])
+		hashes = append(hashes, sum[:])
+	}
+
+	return hashes
+}
+
+// MerkleRoot returns the root of the subtree with numLeaves leaves covering data
+func MerkleRoot(data []byte, numLeaves int) []byte {
+	return merkleRoot(blockHashes(data), numLeaves, zeroHash)
+}
+
+// PieceLayerRoot computes a file's pieces root from its piece layer
+func PieceLayerRoot(layer [][]byte, pieceLength int) []byte {
+	pad := zeroSubtreeHash(pieceLength / MERKLE_BLOCK_SIZE)
+	return merkleRoot(layer, NextPowerOfTwo(len(layer)), pad)
+}
+
+func splitHashes(b []byte) [][]byte {
+	hashes := make([][]byte, len(b)/sha256.Size)
+	for i := range hashes {
+		hashes[i] = b[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	return hashes
+}
+
+// MerkleProof returns the hashes [index, index+length) of layer followed by
+// the uncle hashes needed to climb proofLayers levels above their subtree.
+// pad is the hash used for leaves of layer past its end.
+func MerkleProof(layer [][]byte, pad []byte, index, length, proofLayers int) ([][]byte, error) {
+	if length <= 0 || length&(length-1) != 0 || index%length != 0 || index >= len(layer) {
+		return nil, errors.New("invalid hash range")
+	}
+
+	width := NextPowerOfTwo(len(layer))
+	if length > width {
+		width = length
+	}
+
+	cur := make([][]byte, width)
+	for i := range cur {
+		if i < len(layer) {
+			cur[i] = layer[i]
+		} else {
+			cur[i] = pad
+		}
+	}
+
+	out := make([][]byte, length)
+	copy(out, cur[index:index+length])
+
+	// Climb to the root of the requested range
+	pos := index
+	for n := length; n > 1; n >>= 1 {
+		cur, pad = parentLayer(cur), hashPair(pad, pad)
+		pos >>= 1
+	}
+
+	for i := 0; i < proofLayers && len(cur) > 1; i++ {
+		out = append(out, cur[pos^1])
+		cur, pad = parentLayer(cur), hashPair(pad, pad)
+		pos >>= 1
+	}
+
+	return out, nil
+}
+
+func parentLayer(layer [][]byte) [][]byte {
+	next := make([][]byte, len(layer)/2)
+	for i := range next {
+		next[i] = hashPair(layer[2*i], layer[2*i+1])
+	}
+	return next
+}
+
+// VerifyMerkleProof checks that hashes (as produced by MerkleProof) lead up
+// to root. The number of uncles must reach all the way to the root.
+func VerifyMerkleProof(hashes [][]byte, root []byte, index, length int) bool {
+	if length <= 0 || length&(length-1) != 0 || index%length != 0 || len(hashes) < length {
+		return false
+	}
+
+	sub := merkleRoot(hashes[:length], length, zeroHash)
+	pos := index / length
+	for _, uncle := range hashes[length:] {
+		if pos&1 == 0 {
+			sub = hashPair(sub, uncle)
+		} else {
+			sub = hashPair(uncle, sub)
+		}
+		pos >>= 1
+	}
+
+	return pos == 0 && bytes.Equal(sub, root)
+}
+
+// PieceLayerHashes answers a hash request for a file's piece layer
+func (m *MetaData) PieceLayerHashes(piecesRoot []byte, index, length, proofLayers int) ([][]byte, error) {
+	layer := m.PieceLayer(piecesRoot)
+	if layer == nil {
+		return nil, errors.New("piece layer unknown")
+	}
+
+	pad := zeroSubtreeHash(m.PieceSize() / MERKLE_BLOCK_SIZE)
+	return MerkleProof(layer, pad, index, length, proofLayers)
+}
+
+// PieceLayerHeight is the number of proof layers needed to climb
+// from a file's piece layer to its pieces root
+func (m *MetaData) PieceLayerHeight(fileLength int) int {
+	numPieces := (fileLength + m.PieceSize() - 1) / m.PieceSize()
+	return Log2(NextPowerOfTwo(numPieces))
+}
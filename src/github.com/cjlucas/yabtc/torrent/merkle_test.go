@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zeebo/bencode"
+)
+
+func sum256(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func TestMerkleRoot(t *testing.T) {
+	Convey("When given data fitting in a single block", t, func() {
+		data := []byte("hello")
+
+		Convey("The root of a one leaf tree should be the block hash", func() {
+			So(MerkleRoot(data, 1), ShouldResemble, sum256(data))
+		})
+
+		Convey("Missing leaves should be zero hashes", func() {
+			expected := hashPair(sum256(data), make([]byte, 32))
+			So(MerkleRoot(data, 2), ShouldResemble, expected)
+		})
+	})
+
+	Convey("When given data spanning several blocks", t, func() {
+		data := bytes.Repeat([]byte{1}, MERKLE_BLOCK_SIZE+10)
+
+		Convey("Each block should be hashed separately", func() {
+			expected := hashPair(sum256(data[:MERKLE_BLOCK_SIZE]), sum256(data[MERKLE_BLOCK_SIZE:]))
+			So(MerkleRoot(data, 2), ShouldResemble, expected)
+		})
+	})
+}
+
+func TestMerkleProof(t *testing.T) {
+	Convey("When given a layer of 5 hashes", t, func() {
+		var layer [][]byte
+		for i := 0; i < 5; i++ {
+			layer = append(layer, sum256([]byte{byte(i)}))
+		}
+		pad := zeroSubtreeHash(4)
+		root := merkleRoot(layer, 8, pad)
+
+		Convey("A proof for a range should verify against the root", func() {
+			hashes, err := MerkleProof(layer, pad, 2, 2, 2)
+			So(err, ShouldBeNil)
+			So(len(hashes), ShouldEqual, 4)
+			So(hashes[0], ShouldResemble, layer[2])
+			So(VerifyMerkleProof(hashes, root, 2, 2), ShouldBeTrue)
+		})
+
+		Convey("A proof for the whole layer should need no uncles", func() {
+			hashes, err := MerkleProof(layer, pad, 0, 8, 0)
+			So(err, ShouldBeNil)
+			So(VerifyMerkleProof(hashes, root, 0, 8), ShouldBeTrue)
+		})
+
+		Convey("A tampered proof should not verify", func() {
+			hashes, _ := MerkleProof(layer, pad, 4, 1, 3)
+			hashes[1] = sum256([]byte("bogus"))
+			So(VerifyMerkleProof(hashes, root, 4, 1), ShouldBeFalse)
+		})
+
+		Convey("A proof that stops below the root should not verify", func() {
+			hashes, _ := MerkleProof(layer, pad, 0, 1, 2)
+			So(VerifyMerkleProof(hashes, root, 0, 1), ShouldBeFalse)
+		})
+
+		Convey("An unaligned range should be rejected", func() {
+			_, err := MerkleProof(layer, pad, 1, 2, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// buildV2Torrent returns a v2 torrent with a 3 piece file and a small file
+func buildV2Torrent(withLayers bool) ([]byte, []byte, []byte) {
+	pieceLength := MERKLE_BLOCK_SIZE
+	big := bytes.Repeat([]byte{7}, 2*pieceLength+100)
+	small := []byte("small file")
+
+	var layer [][]byte
+	for off := 0; off < len(big); off += pieceLength {
+		end := off + pieceLength
+		if end > len(big) {
+			end = len(big)
+		}
+		layer = append(layer, MerkleRoot(big[off:end], 1))
+	}
+	bigRoot := PieceLayerRoot(layer, pieceLength)
+	smallRoot := MerkleRoot(small, 1)
+
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"a.bin": map[string]interface{}{
+				"": map[string]interface{}{"length": len(big), "pieces root": bigRoot},
+			},
+			"b.txt": map[string]interface{}{
+				"": map[string]interface{}{"length": len(small), "pieces root": smallRoot},
+			},
+		},
+	}
+
+	meta := map[string]interface{}{"info": info}
+	if withLayers {
+		var raw []byte
+		for _, h := range layer {
+			raw = append(raw, h...)
+		}
+		meta["piece layers"] = map[string]interface{}{string(bigRoot): raw}
+	}
+
+	b, err := bencode.EncodeBytes(meta)
+	if err != nil {
+		panic(err)
+	}
+
+	return b, big, small
+}
+
+func TestParseV2(t *testing.T) {
+	Convey("When parsing a v2 torrent", t, func() {
+		b, big, small := buildV2Torrent(true)
+		m, err := ParseBytes(b)
+		So(err, ShouldBeNil)
+
+		Convey("It should align files to pieces with padding", func() {
+			files := m.Files()
+			So(len(files), ShouldEqual, 3)
+			So(files[0].Path(), ShouldEqual, "dir/a.bin")
+			So(files[1].IsPadding(), ShouldBeTrue)
+			So(files[1].Length, ShouldEqual, MERKLE_BLOCK_SIZE-100)
+			So(files[2].Path(), ShouldEqual, "dir/b.txt")
+		})
+
+		Convey("It should generate file aligned pieces", func() {
+			pieces := m.GeneratePieces()
+			So(len(pieces), ShouldEqual, 4)
+			So(pieces[2].Length, ShouldEqual, 100)
+			So(pieces[3].ByteOffset, ShouldEqual, 3*MERKLE_BLOCK_SIZE)
+			So(pieces[3].Length, ShouldEqual, len(small))
+		})
+
+		Convey("It should verify pieces against the merkle hashes", func() {
+			So(m.VerifyPiece(0, big[:MERKLE_BLOCK_SIZE]), ShouldBeTrue)
+			So(m.VerifyPiece(2, big[2*MERKLE_BLOCK_SIZE:]), ShouldBeTrue)
+			So(m.VerifyPiece(3, small), ShouldBeTrue)
+			So(m.VerifyPiece(3, []byte("wrong file")), ShouldBeFalse)
+			So(m.VerifyPiece(-1, small), ShouldBeFalse)
+			So(m.VerifyPiece(4, small), ShouldBeFalse)
+		})
+
+		Convey("It should use the truncated SHA-256 info hash", func() {
+			So(m.InfoHash(), ShouldResemble, sum256(m.RawInfo)[:20])
+			So(len(m.InfoHashV2()), ShouldEqual, 32)
+		})
+	})
+
+	Convey("When parsing a v2 torrent without piece layers", t, func() {
+		b, big, _ := buildV2Torrent(false)
+		m, err := ParseBytes(b)
+		So(err, ShouldBeNil)
+
+		Convey("Pieces of large files should not verify until the layer is known", func() {
+			So(m.VerifyPiece(0, big[:MERKLE_BLOCK_SIZE]), ShouldBeFalse)
+
+			full, _, _ := buildV2Torrent(true)
+			withLayers, _ := ParseBytes(full)
+			root := m.Files()[0].PiecesRoot
+			var layer []byte
+			for _, h := range withLayers.PieceLayer(root) {
+				layer = append(layer, h...)
+			}
+
+			So(m.SetPieceLayer(root, layer), ShouldBeNil)
+			So(m.VerifyPiece(0, big[:MERKLE_BLOCK_SIZE]), ShouldBeTrue)
+		})
+
+		Convey("Setting a layer should not disturb pieces in use", func() {
+			full, _, _ := buildV2Torrent(true)
+			withLayers, _ := ParseBytes(full)
+			root := m.Files()[0].PiecesRoot
+			var layer []byte
+			for _, h := range withLayers.PieceLayer(root) {
+				layer = append(layer, h...)
+			}
+
+			before := m.GeneratePieces()
+			done := make(chan bool)
+			go func() {
+				for i := 0; i < 100; i++ {
+					m.VerifyPiece(0, big[:MERKLE_BLOCK_SIZE])
+				}
+				close(done)
+			}()
+			So(m.SetPieceLayer(root, layer), ShouldBeNil)
+			<-done
+
+			So(before[0].MerkleHash, ShouldBeNil)
+			So(m.GeneratePieces()[0].MerkleHash, ShouldNotBeNil)
+		})
+	})
+
+	Convey("When parsing a v2 torrent with a corrupt piece layer", t, func() {
+		b, _, _ := buildV2Torrent(true)
+		m, _ := ParseBytes(b)
+		root := m.Files()[0].PiecesRoot
+		m.PieceLayers[string(root)] = make([]byte, 3*32)
+
+		Convey("It should be rejected", func() {
+			So(m.validatePieceLayers(), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,207 @@
+package torrent
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest file name, in bytes, most filesystems accept
+const MAX_NAME_LENGTH = 255
+
+// Names Windows reserves for devices, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func isInvalidChar(r rune) bool {
+	return r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r)
+}
+
+// sanitizeName turns a single path component from a torrent into a
+// name that is safe to create on any common filesystem. Components are
+// sanitized the same way on every platform, so a torrent is laid out
+// identically wherever it's downloaded.
+func sanitizeName(name string) string {
+	// Traversal components can't be made safe, only replaced
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	var b strings.Builder
+	for i, r := range name {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(name[i:]); size == 1 {
+				b.WriteRune('_')
+				continue
+			}
+		}
+
+		if isInvalidChar(r) {
+			b.WriteRune('_')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+
+	// Windows drops trailing dots and spaces, which would make two
+	// different names refer to the same file
+	if last := name[len(name)-1]; last == '.' || last == ' ' {
+		name = name[:len(name)-1] + "_"
+	}
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i != -1 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+
+	return truncateName(name, MAX_NAME_LENGTH)
+}
+
+// truncateName shortens name to at most max bytes, keeping the
+// extension and never cutting a character in half
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	ext := path.Ext(name)
+	if len(ext) > max/2 {
+		ext = ""
+	}
+
+	stem := name[:max-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+
+	return stem + ext
+}
+
+// SanitizePath sanitizes every component of a torrent path
+func SanitizePath(components []string) []string {
+	safe := make([]string, len(components))
+	for i, c := range components {
+		safe[i] = sanitizeName(c)
+	}
+
+	return safe
+}
+
+// foldName returns the key two names share if a case-insensitive or
+// Unicode normalizing filesystem would treat them as the same file
+func foldName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if d, ok := decompositions[r]; ok {
+			b.WriteString(d)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return strings.ToLower(b.String())
+}
+
+type MappedFile struct {
+	// Path relative to the save path, with the OS path separator
+	Path string
+	// Set if the path differs from the one in the torrent
+	Sanitized bool
+	// Index of a file whose path this one collided with, or -1. The
+	// later file is renamed so both can exist side by side.
+	CollidesWith int
+}
+
+// PathMap maps the untrusted paths in a torrent to the paths its files
+// are stored at. Every path stays within the save path, and no two files
+// map to paths a case-insensitive or normalizing filesystem would mix up.
+type PathMap struct {
+	Files []MappedFile
+}
+
+func uniqueName(name string, n int) string {
+	suffix := fmt.Sprintf("_%d", n)
+	ext := path.Ext(name)
+	if len(ext) > MAX_NAME_LENGTH/2 {
+		ext = ""
+	}
+
+	stem := truncateName(strings.TrimSuffix(name, ext), MAX_NAME_LENGTH-len(suffix)-len(ext))
+	return stem + suffix + ext
+}
+
+func NewPathMap(files []File) *PathMap {
+	m := &PathMap{Files: make([]MappedFile, len(files))}
+
+	// Folded paths placed so far, mapped to the file that placed them
+	placedFiles := make(map[string]int)
+	placedDirs := make(map[string]int)
+
+	for i := range files {
+		f := &files[i]
+		mapped := &m.Files[i]
+		mapped.CollidesWith = -1
+
+		components := SanitizePath(f.PathComponents)
+		if len(components) == 0 {
+			components = []string{"_"}
+		}
+
+		// Padding is never stored, so it can't collide with anything
+		if f.IsPadding() {
+			mapped.Path = filepath.Join(components...)
+			continue
+		}
+
+		folded := make([]string, len(components))
+		for j := range components {
+			isFile := j == len(components)-1
+			name := components[j]
+			for n := 1; ; n++ {
+				folded[j] = foldName(components[j])
+				key := strings.Join(folded[:j+1], "/")
+
+				// Files may share directories, nothing else
+				owner, collides := placedFiles[key]
+				if !collides && isFile {
+					owner, collides = placedDirs[key]
+				}
+
+				if !collides {
+					if isFile {
+						placedFiles[key] = i
+					} else if _, ok := placedDirs[key]; !ok {
+						placedDirs[key] = i
+					}
+					break
+				}
+
+				if mapped.CollidesWith == -1 {
+					mapped.CollidesWith = owner
+				}
+				components[j] = uniqueName(name, n)
+			}
+		}
+
+		mapped.Path = filepath.Join(components...)
+		mapped.Sanitized = filepath.ToSlash(mapped.Path) != strings.Join(f.PathComponents, "/")
+	}
+
+	return m
+}
+
+// PathFromRoot returns where the file is stored below root
+func (m *PathMap) PathFromRoot(root string, fileIndex int) string {
+	return filepath.Join(root, m.Files[fileIndex].Path)
+}
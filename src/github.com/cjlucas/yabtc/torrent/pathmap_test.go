@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zeebo/bencode"
+)
+
+func mapPaths(paths ...[]string) *PathMap {
+	var files []File
+	for _, p := range paths {
+		files = append(files, File{PathComponents: p, Length: 1})
+	}
+	return NewPathMap(files)
+}
+
+func TestPathMap(t *testing.T) {
+	Convey("When a path tries to leave the save path", t, func() {
+		m := mapPaths(
+			[]string{"dir", "..", "..", "etc", "passwd"},
+			[]string{"/etc", "shadow"},
+			[]string{"C:", "evil"},
+		)
+
+		Convey("It should be neutralized", func() {
+			So(m.Files[0].Path, ShouldEqual, filepath.Join("dir", "_", "_", "etc", "passwd"))
+			So(m.Files[1].Path, ShouldEqual, filepath.Join("_etc", "shadow"))
+			So(m.Files[2].Path, ShouldEqual, filepath.Join("C_", "evil"))
+			So(m.Files[0].Sanitized, ShouldBeTrue)
+		})
+
+		Convey("File.PathFromRoot should stay below the root too", func() {
+			f := File{PathComponents: []string{"..", "x"}}
+			So(f.PathFromRoot("/save"), ShouldEqual, filepath.Join("/save", "_", "x"))
+		})
+	})
+
+	Convey("When names contain invalid characters or reserved names", t, func() {
+		m := mapPaths(
+			[]string{"a<b>c?.txt"},
+			[]string{"con.txt"},
+			[]string{"trailing. "},
+			[]string{"bad\xffutf8"},
+		)
+
+		Convey("They should be sanitized", func() {
+			So(m.Files[0].Path, ShouldEqual, "a_b_c_.txt")
+			So(m.Files[1].Path, ShouldEqual, "_con.txt")
+			So(m.Files[2].Path, ShouldEqual, "trailing._")
+			So(m.Files[3].Path, ShouldEqual, "bad_utf8")
+		})
+	})
+
+	Convey("When a name is too long", t, func() {
+		long := strings.Repeat("é", 200) + ".mkv"
+		m := mapPaths([]string{long})
+
+		Convey("It should be shortened keeping its extension", func() {
+			So(len(m.Files[0].Path), ShouldBeLessThanOrEqualTo, MAX_NAME_LENGTH)
+			So(m.Files[0].Path, ShouldEndWith, "é.mkv")
+		})
+	})
+
+	Convey("When paths only differ in case or Unicode normalization", t, func() {
+		m := mapPaths(
+			[]string{"dir", "Song.mp3"},
+			[]string{"dir", "song.MP3"},
+			[]string{"caf\u00e9.txt"},
+			[]string{"cafe\u0301.txt"},
+			[]string{"DIR", "other"},
+		)
+
+		Convey("Later files should be renamed and the collision reported", func() {
+			So(m.Files[0].CollidesWith, ShouldEqual, -1)
+			So(m.Files[1].Path, ShouldEqual, filepath.Join("dir", "song_1.MP3"))
+			So(m.Files[1].CollidesWith, ShouldEqual, 0)
+			So(m.Files[3].Path, ShouldEqual, "cafe\u0301_1.txt")
+			So(m.Files[3].CollidesWith, ShouldEqual, 2)
+		})
+
+		Convey("Files should still share directories", func() {
+			So(m.Files[4].Path, ShouldEqual, filepath.Join("DIR", "other"))
+			So(m.Files[4].CollidesWith, ShouldEqual, -1)
+		})
+	})
+
+	Convey("When a file has the same path as another file's directory", t, func() {
+		m := mapPaths([]string{"a", "b"}, []string{"a"})
+
+		Convey("It should be renamed", func() {
+			So(m.Files[1].Path, ShouldEqual, "a_1")
+			So(m.Files[1].CollidesWith, ShouldEqual, 0)
+		})
+	})
+
+	Convey("When a torrent has name.utf-8 and path.utf-8", t, func() {
+		info := map[string]interface{}{
+			"name":         "\xe9t\xe9",
+			"name.utf-8":   "été",
+			"piece length": 16384,
+			"pieces":       string(make([]byte, 20)),
+			"files": []map[string]interface{}{{
+				"length":     1,
+				"path":       []string{"\xe9"},
+				"path.utf-8": []string{"é"},
+			}},
+		}
+		rawInfo, _ := bencode.EncodeBytes(info)
+		b, _ := (&MetaData{RawInfo: rawInfo}).Bytes()
+		m, err := ParseBytes(b)
+		So(err, ShouldBeNil)
+
+		Convey("The UTF-8 names should be used", func() {
+			So(m.Name(), ShouldEqual, "été")
+			So(m.Files()[0].Path(), ShouldEqual, "été/é")
+		})
+	})
+
+	Convey("When writing through a file stream", t, func() {
+		root, _ := ioutil.TempDir("", "yabtc-pathmap")
+		defer os.RemoveAll(root)
+		save := filepath.Join(root, "save")
+
+		fs := NewFileStream(save, []File{{PathComponents: []string{"..", "escaped"}, Length: 4}})
+		defer fs.Close()
+		So(fs.WriteBlock(Block{0, 4}, []byte("data")), ShouldBeNil)
+
+		Convey("The file should land below the save path", func() {
+			_, err := os.Stat(filepath.Join(root, "escaped"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			data, err := ioutil.ReadFile(filepath.Join(save, "_", "escaped"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "data")
+		})
+	})
+}
@@ -1,9 +1,16 @@
 package torrent
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/zeebo/bencode"
 )
@@ -13,27 +20,53 @@ type Piece struct {
 	ByteOffset int
 	Length     int
 	Hash       []byte
+
+	// v2 pieces are verified against a merkle subtree of MerkleLeaves
+	// 16KiB blocks covering the first FileBytes of the piece
+	FileIndex    int
+	FileBytes    int
+	MerkleHash   []byte
+	MerkleLeaves int
 }
 
 type Info struct {
-	Name        string `bencode:"name"`
-	Length      int    `bencode:"length"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      []byte `bencode:"pieces"`
-	Private     int    `bencode:"private"`
-	Files       []File `bencode:"files"`
-	MD5sum      string `bencode:"md5sum"`
+	Name        string             `bencode:"name"`
+	NameUTF8    string             `bencode:"name.utf-8"`
+	Length      int                `bencode:"length"`
+	PieceLength int                `bencode:"piece length"`
+	Pieces      []byte             `bencode:"pieces"`
+	Private     int                `bencode:"private"`
+	Files       []File             `bencode:"files"`
+	MD5sum      string             `bencode:"md5sum"`
+	SHA1        []byte             `bencode:"sha1"`
+	Attr        string             `bencode:"attr"`
+	SymlinkPath []string           `bencode:"symlink path"`
+	MetaVersion int                `bencode:"meta version"`
+	FileTree    bencode.RawMessage `bencode:"file tree"`
 }
 
 type MetaData struct {
 	RawInfo      bencode.RawMessage `bencode:"info"`
 	Info         Info
-	Announce     string `bencode:"announce"`
-	CreationDate int64  `bencode:"creation date"`
-	Comment      string `bencode:"comment"`
-	CreatedBy    string `bencode:"created by"`
-	Encoding     string `bencode:"encoding"`
-	Pieces       []Piece
+	Announce     string            `bencode:"announce"`
+	AnnounceList [][]string        `bencode:"announce-list"`
+	CreationDate int64             `bencode:"creation date"`
+	Comment      string            `bencode:"comment"`
+	CreatedBy    string            `bencode:"created by"`
+	Encoding     string            `bencode:"encoding"`
+	PieceLayers  map[string][]byte `bencode:"piece layers"`
+	// Generated on first use, use GeneratePieces
+	Pieces []Piece
+
+	// Guards Pieces and PieceLayers, which change as piece layers
+	// arrive from peers while the torrent is in use
+	piecesLock sync.RWMutex
+	// Non-zero when a hybrid torrent's v1 and v2 hashes disagree about a
+	// piece
+	inconsistent int32
+
+	// Files decoded from a v2 file tree, in tree order
+	v2Files FileList
 }
 
 func ParseFile(fname string) (*MetaData, error) {
@@ -54,14 +87,230 @@ func ParseBytes(b []byte) (*MetaData, error) {
 		return nil, fmt.Errorf("bencode error: %s", err)
 	}
 
+	if m.IsV2() {
+		if err := m.parseFileTree(); err != nil {
+			return nil, err
+		}
+
+		if err := m.validatePieceLayers(); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.IsHybrid() {
+		if err := m.checkHybridFiles(); err != nil {
+			return nil, err
+		}
+	}
+
 	return &m, nil
 }
 
+// checkHybridFiles makes sure the v1 file list describes the same files
+// as the v2 file tree, in the same order
+func (m *MetaData) checkHybridFiles() error {
+	var v1Files FileList
+	for _, f := range m.v1Files() {
+		if !f.IsPadding() {
+			v1Files = append(v1Files, f)
+		}
+	}
+
+	if len(v1Files) != len(m.v2Files) {
+		return errors.New("hybrid torrent has mismatching v1 and v2 file lists")
+	}
+
+	for i := range v1Files {
+		if v1Files[i].Path() != m.v2Files[i].Path() || v1Files[i].Length != m.v2Files[i].Length {
+			return fmt.Errorf("hybrid torrent file mismatch: %s", v1Files[i].Path())
+		}
+	}
+
+	return nil
+}
+
+type fileTreeEntry struct {
+	Length     int    `bencode:"length"`
+	PiecesRoot []byte `bencode:"pieces root"`
+	Attr       string `bencode:"attr"`
+}
+
+// walkFileTree appends every file below node to files. Dictionary keys are
+// visited in sorted order, which is also the order they are encoded in.
+func walkFileTree(node map[string]bencode.RawMessage, path []string, files FileList) (FileList, error) {
+	keys := make([]string, 0, len(node))
+	for k := range node {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if k == "" {
+			var entry fileTreeEntry
+			if err := bencode.DecodeBytes(node[k], &entry); err != nil {
+				return nil, fmt.Errorf("bencode error: %s", err)
+			}
+
+			if entry.Length > 0 && len(entry.PiecesRoot) != sha256.Size {
+				return nil, fmt.Errorf("invalid pieces root for %v", path)
+			}
+
+			f := File{Length: entry.Length, Attr: entry.Attr, PiecesRoot: entry.PiecesRoot}
+			f.PathComponents = append([]string{}, path...)
+			files = append(files, f)
+			continue
+		}
+
+		var child map[string]bencode.RawMessage
+		if err := bencode.DecodeBytes(node[k], &child); err != nil {
+			return nil, fmt.Errorf("bencode error: %s", err)
+		}
+
+		var err error
+		files, err = walkFileTree(child, append(path, k), files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (m *MetaData) parseFileTree() error {
+	if !isPowerOfTwo(m.Info.PieceLength) || m.Info.PieceLength < MERKLE_BLOCK_SIZE {
+		return errors.New("v2 piece length must be a power of two of at least 16KiB")
+	}
+
+	var tree map[string]bencode.RawMessage
+	if err := bencode.DecodeBytes(m.Info.FileTree, &tree); err != nil {
+		return fmt.Errorf("bencode error: %s", err)
+	}
+
+	files, err := walkFileTree(tree, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return errors.New("empty file tree")
+	}
+
+	// A single file torrent's tree holds just that file, named after the torrent
+	isSingleFile := len(files) == 1 && len(files[0].PathComponents) == 1 &&
+		files[0].PathComponents[0] == m.Name()
+	if !isSingleFile {
+		for i := range files {
+			files[i].PathComponents = append([]string{m.Name()}, files[i].PathComponents...)
+		}
+	}
+
+	m.v2Files = files
+	return nil
+}
+
+func (m *MetaData) validatePieceLayers() error {
+	for _, f := range m.v2Files {
+		if f.Length <= m.PieceSize() {
+			continue
+		}
+
+		layer, ok := m.PieceLayers[string(f.PiecesRoot)]
+		if !ok {
+			// May be fetched from peers later with hash requests
+			continue
+		}
+
+		if err := m.checkPieceLayer(&f, layer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MetaData) checkPieceLayer(f *File, layer []byte) error {
+	numPieces := (f.Length + m.PieceSize() - 1) / m.PieceSize()
+	if len(layer) != numPieces*sha256.Size {
+		return fmt.Errorf("piece layer for %s has invalid length", f.Path())
+	}
+
+	if !bytes.Equal(PieceLayerRoot(splitHashes(layer), m.PieceSize()), f.PiecesRoot) {
+		return fmt.Errorf("piece layer for %s does not match its pieces root", f.Path())
+	}
+
+	return nil
+}
+
+// SetPieceLayer stores a piece layer received from a peer after
+// checking it against the file's pieces root
+func (m *MetaData) SetPieceLayer(piecesRoot []byte, layer []byte) error {
+	for i := range m.v2Files {
+		f := &m.v2Files[i]
+		if !bytes.Equal(f.PiecesRoot, piecesRoot) {
+			continue
+		}
+
+		if err := m.checkPieceLayer(f, layer); err != nil {
+			return err
+		}
+
+		m.piecesLock.Lock()
+		defer m.piecesLock.Unlock()
+
+		if m.PieceLayers == nil {
+			m.PieceLayers = make(map[string][]byte)
+		}
+		m.PieceLayers[string(piecesRoot)] = layer
+
+		// Pieces have to pick up the new hashes. They're replaced rather
+		// than changed so pieces already handed out stay as they were.
+		if m.Pieces != nil {
+			m.Pieces = m.generatePieces()
+		}
+		return nil
+	}
+
+	return errors.New("unknown pieces root")
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+func (m *MetaData) IsV1() bool {
+	return len(m.Info.Pieces) > 0
+}
+
+func (m *MetaData) IsV2() bool {
+	return m.Info.MetaVersion == 2
+}
+
+// Hybrid torrents carry both v1 and v2 metadata and join both swarms
+func (m *MetaData) IsHybrid() bool {
+	return m.IsV1() && m.IsV2()
+}
+
 func (m *MetaData) NumPieces() int {
-	return len(m.Info.Pieces) / sha1.Size
+	if m.IsV1() {
+		return len(m.Info.Pieces) / sha1.Size
+	}
+
+	numPieces := 0
+	for _, f := range m.v2Files {
+		numPieces += (f.Length + m.PieceSize() - 1) / m.PieceSize()
+	}
+
+	return numPieces
+}
+
+func (m *MetaData) IsPrivate() bool {
+	return m.Info.Private == 1
 }
 
 func (m *MetaData) IsMultiFile() bool {
+	if !m.IsV1() && m.IsV2() {
+		return len(m.v2Files) > 1 || len(m.v2Files[0].PathComponents) > 1
+	}
 	return len(m.Info.Files) > 0
 }
 
@@ -69,27 +318,118 @@ func (m *MetaData) PieceSize() int {
 	return m.Info.PieceLength
 }
 
+// v2Layout returns the files of a v2 torrent with padding inserted
+// so that every file starts on a piece boundary
+func (m *MetaData) v2Layout() FileList {
+	var files FileList
+	for i, f := range m.v2Files {
+		files = append(files, f)
+
+		rem := f.Length % m.PieceSize()
+		if rem == 0 || i == len(m.v2Files)-1 {
+			continue
+		}
+
+		pad := File{Length: m.PieceSize() - rem, Attr: "p"}
+		pad.PathComponents = []string{m.Name(), ".pad", fmt.Sprintf("%d", pad.Length)}
+		files = append(files, pad)
+	}
+
+	return files
+}
+
 func (m *MetaData) Files() FileList {
+	if m.IsHybrid() {
+		// The v1 list already contains the padding, pieces roots come from v2
+		files := m.v1Files()
+		j := 0
+		for i := range files {
+			if !files[i].IsPadding() {
+				files[i].PiecesRoot = m.v2Files[j].PiecesRoot
+				j++
+			}
+		}
+		return files
+	}
+
+	if m.IsV2() {
+		return m.v2Layout()
+	}
+
+	return m.v1Files()
+}
+
+func validUTF8(components []string) bool {
+	for _, c := range components {
+		if !utf8.ValidString(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Name is the torrent's name, from name.utf-8 if the torrent has one
+func (m *MetaData) Name() string {
+	if m.Info.NameUTF8 != "" && utf8.ValidString(m.Info.NameUTF8) {
+		return m.Info.NameUTF8
+	}
+	return m.Info.Name
+}
+
+func (m *MetaData) v1Files() FileList {
 	var files FileList
 	info := m.Info
+	name := m.Name()
 	if m.IsMultiFile() {
 		for _, f := range info.Files {
-			newPathComponents := []string{info.Name}
+			if len(f.PathUTF8) > 0 && validUTF8(f.PathUTF8) {
+				f.PathComponents = f.PathUTF8
+			}
+
+			newPathComponents := []string{name}
 			newPathComponents = append(newPathComponents, f.PathComponents...)
 			f.PathComponents = newPathComponents
+			if f.IsSymlink() {
+				f.SymlinkPath = append([]string{name}, f.SymlinkPath...)
+			}
 			files = append(files, f)
 		}
 	} else {
-		f := File{[]string{info.Name},
-			info.Length,
-			info.MD5sum}
+		f := File{
+			PathComponents: []string{name},
+			Length:         info.Length,
+			MD5sum:         info.MD5sum,
+			SHA1:           info.SHA1,
+			Attr:           info.Attr,
+			SymlinkPath:    info.SymlinkPath,
+		}
 		files = append(files, f)
 	}
 
 	return files
 }
 
+// InfoHash returns the 20 byte hash used in handshakes and tracker
+// announces. For v2 only torrents this is the truncated SHA-256 hash.
 func (m *MetaData) InfoHash() []byte {
+	if !m.IsV1() && m.IsV2() {
+		return m.InfoHashV2()[:20]
+	}
+
+	return m.InfoHashV1()
+}
+
+// InfoHashes returns every 20 byte info hash the torrent is known by.
+// Hybrid torrents have both the v1 and the truncated v2 hash.
+func (m *MetaData) InfoHashes() [][]byte {
+	if m.IsHybrid() {
+		return [][]byte{m.InfoHashV1(), m.InfoHashV2()[:20]}
+	}
+
+	return [][]byte{m.InfoHash()}
+}
+
+func (m *MetaData) InfoHashV1() []byte {
 	sha := sha1.New()
 	encoder := bencode.NewEncoder(sha)
 
@@ -100,30 +440,69 @@ func (m *MetaData) InfoHash() []byte {
 	return sha.Sum(nil)
 }
 
+// InfoHashV2 returns the full 32 byte SHA-256 info hash
+func (m *MetaData) InfoHashV2() []byte {
+	sha := sha256.New()
+	encoder := bencode.NewEncoder(sha)
+
+	if err := encoder.Encode(&m.RawInfo); err != nil {
+		panic(err)
+	}
+
+	return sha.Sum(nil)
+}
+
 func (m *MetaData) InfoHashString() string {
 	return fmt.Sprintf("%02X", m.InfoHash())
 }
 
-// TODO: make function private
-// User should grab Pieces field directly
+// IsInconsistent reports whether the v1 and v2 hashes of a hybrid
+// torrent disagree about a piece
+func (m *MetaData) IsInconsistent() bool {
+	return atomic.LoadInt32(&m.inconsistent) != 0
+}
+
+func (m *MetaData) setInconsistent() {
+	atomic.StoreInt32(&m.inconsistent, 1)
+}
+
+// GeneratePieces returns the torrent's pieces. The slice is shared and
+// must not be modified.
 func (m *MetaData) GeneratePieces() []Piece {
-	if m.Pieces != nil {
-		return m.Pieces
+	m.piecesLock.RLock()
+	pieces := m.Pieces
+	m.piecesLock.RUnlock()
+	if pieces != nil {
+		return pieces
+	}
+
+	m.piecesLock.Lock()
+	defer m.piecesLock.Unlock()
+	if m.Pieces == nil {
+		m.Pieces = m.generatePieces()
+	}
+	return m.Pieces
+}
+
+// generatePieces must be called with piecesLock held
+func (m *MetaData) generatePieces() []Piece {
+	if !m.IsV1() && m.IsV2() {
+		return m.generateV2Pieces()
 	}
 
 	numPieces := m.NumPieces()
-	m.Pieces = make([]Piece, numPieces)
+	pieces := make([]Piece, numPieces)
 
 	files := m.Files()
 
 	curByteOffset := 0
 	for i := 0; i < numPieces; i++ {
-		p := &m.Pieces[i]
+		p := &pieces[i]
 		p.Hash = make([]byte, sha1.Size)
 
 		p.Index = i
 		if isLastPiece := i == numPieces-1; isLastPiece {
-			p.Length = files.TotalLength() % m.PieceSize()
+			p.Length = files.TotalLength() - curByteOffset
 		} else {
 			p.Length = m.PieceSize()
 		}
@@ -133,5 +512,134 @@ func (m *MetaData) GeneratePieces() []Piece {
 		curByteOffset += p.Length
 	}
 
-	return m.Pieces
+	if m.IsHybrid() {
+		// Padding keeps v1 and v2 pieces aligned, so they map one to one
+		v2Pieces := m.generateV2Pieces()
+		for i := range pieces {
+			if i >= len(v2Pieces) || v2Pieces[i].ByteOffset != pieces[i].ByteOffset {
+				m.setInconsistent()
+				break
+			}
+
+			p := &pieces[i]
+			p.FileIndex = v2Pieces[i].FileIndex
+			p.FileBytes = v2Pieces[i].FileBytes
+			p.MerkleHash = v2Pieces[i].MerkleHash
+			p.MerkleLeaves = v2Pieces[i].MerkleLeaves
+		}
+	}
+
+	return pieces
+}
+
+func (m *MetaData) generateV2Pieces() []Piece {
+	pieces := make([]Piece, 0, m.NumPieces())
+	blocksPerPiece := m.PieceSize() / MERKLE_BLOCK_SIZE
+
+	curByteOffset := 0
+	for i, f := range m.Files() {
+		if f.IsPadding() || f.Length == 0 {
+			curByteOffset += f.Length
+			continue
+		}
+
+		layer := splitHashes(m.PieceLayers[string(f.PiecesRoot)])
+		for off := 0; off < f.Length; off += m.PieceSize() {
+			p := Piece{Index: len(pieces), ByteOffset: curByteOffset + off, FileIndex: i}
+
+			p.FileBytes = f.Length - off
+			if p.FileBytes > m.PieceSize() {
+				p.FileBytes = m.PieceSize()
+			}
+			p.Length = p.FileBytes
+
+			if f.Length <= m.PieceSize() {
+				// Small files are verified against the pieces root directly
+				p.MerkleHash = f.PiecesRoot
+				p.MerkleLeaves = NextPowerOfTwo((f.Length + MERKLE_BLOCK_SIZE - 1) / MERKLE_BLOCK_SIZE)
+			} else if j := off / m.PieceSize(); j < len(layer) {
+				p.MerkleHash = layer[j]
+				p.MerkleLeaves = blocksPerPiece
+			}
+
+			pieces = append(pieces, p)
+		}
+
+		curByteOffset += f.Length
+	}
+
+	return pieces
+}
+
+// VerifyPiece checks data against every hash known for the piece.
+// Pieces of v2 only files whose piece layer is still missing never verify.
+// A hybrid torrent is marked inconsistent if its v1 and v2 hashes disagree.
+func (m *MetaData) VerifyPiece(index int, data []byte) bool {
+	pieces := m.GeneratePieces()
+	if index < 0 || index >= len(pieces) {
+		return false
+	}
+
+	p := &pieces[index]
+	if len(data) != p.Length {
+		return false
+	}
+
+	v1Ok := false
+	if p.Hash != nil {
+		sum := sha1.Sum(data)
+		v1Ok = bytes.Equal(sum[:], p.Hash)
+	}
+
+	v2Ok := false
+	if p.MerkleHash != nil && p.FileBytes <= len(data) {
+		v2Ok = bytes.Equal(MerkleRoot(data[:p.FileBytes], p.MerkleLeaves), p.MerkleHash)
+	}
+
+	if m.IsHybrid() {
+		// Without the piece layer only the v1 hash can be checked
+		if p.MerkleHash == nil {
+			return v1Ok
+		}
+
+		if v1Ok != v2Ok {
+			m.setInconsistent()
+		}
+		return v1Ok && v2Ok
+	}
+
+	if m.IsV2() {
+		return v2Ok
+	}
+
+	return v1Ok
+}
+
+// FileByPiecesRoot returns the index into Files() of the v2 file with
+// the given pieces root, or -1
+func (m *MetaData) FileByPiecesRoot(piecesRoot []byte) int {
+	for i, f := range m.Files() {
+		if !f.IsPadding() && bytes.Equal(f.PiecesRoot, piecesRoot) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// PieceLayerIndex is the merkle layer holding one hash per piece
+func (m *MetaData) PieceLayerIndex() int {
+	return Log2(m.PieceSize() / MERKLE_BLOCK_SIZE)
+}
+
+// PieceLayer returns the piece layer hashes for a file, if known
+func (m *MetaData) PieceLayer(piecesRoot []byte) [][]byte {
+	m.piecesLock.RLock()
+	layer, ok := m.PieceLayers[string(piecesRoot)]
+	m.piecesLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return splitHashes(layer)
 }
@@ -0,0 +1,26 @@
+package torrent
+
+// Trackers returns every tracker of the torrent, tier by tier, without
+// duplicates. The announce-list (BEP 12) takes the place of announce
+// when there is one.
+func (m *MetaData) Trackers() []string {
+	var trackers []string
+	seen := make(map[string]bool)
+	add := func(url string) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			trackers = append(trackers, url)
+		}
+	}
+
+	for _, tier := range m.AnnounceList {
+		for _, url := range tier {
+			add(url)
+		}
+	}
+	if len(trackers) == 0 {
+		add(m.Announce)
+	}
+
+	return trackers
+}
@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTrackers(t *testing.T) {
+	Convey("Without an announce-list", t, func() {
+		m := &MetaData{Announce: "http://a/announce"}
+		So(m.Trackers(), ShouldResemble, []string{"http://a/announce"})
+
+		m.Announce = ""
+		So(m.Trackers(), ShouldBeNil)
+	})
+
+	Convey("The announce-list should replace announce", t, func() {
+		m := &MetaData{
+			Announce: "http://a/announce",
+			AnnounceList: [][]string{
+				{"http://b/announce", "udp://c:80"},
+				{"http://b/announce", "http://d/announce"},
+			},
+		}
+		So(m.Trackers(), ShouldResemble, []string{"http://b/announce", "udp://c:80", "http://d/announce"})
+	})
+
+	Convey("The announce-list should survive encoding", t, func() {
+		dir := createTestDir()
+		defer os.RemoveAll(filepath.Dir(dir))
+
+		m, err := Create(dir, CreateOptions{PieceLength: MERKLE_BLOCK_SIZE, V1: true, Announce: "http://a/announce"})
+		So(err, ShouldBeNil)
+		infoHash := m.InfoHash()
+
+		m.AnnounceList = [][]string{{"http://a/announce"}, {"udp://c:80"}}
+		b, err := m.Bytes()
+		So(err, ShouldBeNil)
+
+		m, err = ParseBytes(b)
+		So(err, ShouldBeNil)
+		So(m.Trackers(), ShouldResemble, []string{"http://a/announce", "udp://c:80"})
+		So(m.InfoHash(), ShouldResemble, infoHash)
+	})
+}
@@ -5,6 +5,16 @@ import (
 	"net/url"
 )
 
+// Announce events, the regular announces in between have none
+const (
+	EVENT_NONE      = ""
+	EVENT_STARTED   = "started"
+	EVENT_COMPLETED = "completed"
+	EVENT_STOPPED   = "stopped"
+	// BEP 21: seeding part of the torrent, never downloading more
+	EVENT_PAUSED = "paused"
+)
+
 type AnnounceRequest struct {
 	Url        string
 	InfoHash   []byte
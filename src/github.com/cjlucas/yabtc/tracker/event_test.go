@@ -0,0 +1,50 @@
+package tracker
+
+import (
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAnnounceEvents(t *testing.T) {
+	newRequest := func(event string) *AnnounceRequest {
+		return &AnnounceRequest{
+			Url:      "http://tracker.example.com/announce",
+			InfoHash: make([]byte, 20),
+			PeerId:   make([]byte, 20),
+			Port:     6881,
+			Event:    event,
+		}
+	}
+
+	Convey("When announcing a partial seed over HTTP", t, func() {
+		u, err := newRequest(EVENT_PAUSED).announceUrl()
+
+		Convey("The paused event should be sent", func() {
+			So(err, ShouldBeNil)
+			parsed, _ := url.Parse(u)
+			So(parsed.Query().Get("event"), ShouldEqual, "paused")
+		})
+	})
+
+	Convey("When sending a regular HTTP announce", t, func() {
+		u, _ := newRequest(EVENT_NONE).announceUrl()
+
+		Convey("No event should be sent", func() {
+			parsed, _ := url.Parse(u)
+			_, ok := parsed.Query()["event"]
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("When announcing over UDP", t, func() {
+		Convey("Each event should have its protocol number", func() {
+			So(eventNum(EVENT_NONE), ShouldEqual, 0)
+			So(eventNum(EVENT_COMPLETED), ShouldEqual, 1)
+			So(eventNum(EVENT_STARTED), ShouldEqual, 2)
+			So(eventNum(EVENT_STOPPED), ShouldEqual, 3)
+			So(eventNum(EVENT_PAUSED), ShouldEqual, 4)
+		})
+	})
+}
@@ -77,13 +77,14 @@ func (r *AnnounceRequest) announceUrl() (string, error) {
 	vals := make(url.Values)
 	vals.Add("info_hash", string(r.InfoHash))
 	vals.Add("peer_id", string(r.PeerId))
-	//vals.Add("port", fmt.Sprintf("%d", r.Port))
-	vals.Add("port", fmt.Sprintf("%d", 54343))
+	vals.Add("port", fmt.Sprintf("%d", r.Port))
 	vals.Add("uploaded", fmt.Sprintf("%d", r.Uploaded))
 	vals.Add("downloaded", fmt.Sprintf("%d", r.Downloaded))
 	//vals.Add("left", fmt.Sprintf("%d", r.Left))
 	vals.Add("left", fmt.Sprintf("%d", 1))
-	vals.Add("event", r.Event)
+	if r.Event != EVENT_NONE {
+		vals.Add("event", r.Event)
+	}
 	vals.Add("compact", "1")
 
 	return fmt.Sprintf("%s?%s", r.Url, vals.Encode()), nil
@@ -0,0 +1,204 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// How long a UDP tracker has to answer a scrape
+const UDP_SCRAPE_TIMEOUT = 15 * time.Second
+
+// ScrapeResult is what a tracker knows about one torrent
+type ScrapeResult struct {
+	Seeders int
+	// Peers that finished downloading the torrent
+	Completed int
+	Leechers  int
+}
+
+type httpScrapeResponse struct {
+	FailureReason string `bencode:"failure reason"`
+	Files         map[string]struct {
+		Complete   int `bencode:"complete"`
+		Downloaded int `bencode:"downloaded"`
+		Incomplete int `bencode:"incomplete"`
+	} `bencode:"files"`
+}
+
+// Scrape asks the tracker for the number of peers of each torrent. The
+// results are keyed by info hash, torrents the tracker doesn't know are
+// left out.
+func Scrape(announceUrl string, infoHashes [][]byte) (map[[20]byte]ScrapeResult, error) {
+	for _, h := range infoHashes {
+		if len(h) != 20 {
+			return nil, errors.New("invalid InfoHash value")
+		}
+	}
+
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return httpScrape(u, infoHashes)
+	case "udp":
+		return udpScrape(u, infoHashes)
+	default:
+		return nil, fmt.Errorf("unknown url scheme: %s", u.Scheme)
+	}
+}
+
+// scrapeUrl derives the scrape URL from the announce URL, which only
+// works for trackers whose announce path ends in "announce"
+func scrapeUrl(u *url.URL, infoHashes [][]byte) (string, error) {
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return "", fmt.Errorf("tracker doesn't support scraping: %s", u)
+	}
+
+	scrape := *u
+	scrape.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+
+	query := scrape.RawQuery
+	for _, h := range infoHashes {
+		if query != "" {
+			query += "&"
+		}
+		query += "info_hash=" + url.QueryEscape(string(h))
+	}
+	scrape.RawQuery = query
+
+	return scrape.String(), nil
+}
+
+func httpScrape(u *url.URL, infoHashes [][]byte) (map[[20]byte]ScrapeResult, error) {
+	scrape, err := scrapeUrl(u, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", scrape, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request error: %s", err)
+	}
+	req.Header.Add("User-Agent", "Transmission/2.11")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected HTTP status code: %s", resp.Status)
+	}
+
+	var out httpScrapeResponse
+	if err := bencode.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("bencode decoding error: %s", err)
+	}
+	if out.FailureReason != "" {
+		return nil, errors.New(out.FailureReason)
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for h, f := range out.Files {
+		if len(h) != 20 {
+			continue
+		}
+		var hash [20]byte
+		copy(hash[:], h)
+		results[hash] = ScrapeResult{f.Complete, f.Downloaded, f.Incomplete}
+	}
+	return results, nil
+}
+
+type scrapeInput struct {
+	ConnectionId  uint64
+	Action        uint32 // 2
+	TransactionId uint32
+}
+
+type scrapeOutput struct {
+	Action        uint32 // 2, or 3 for an error
+	TransactionId uint32
+}
+
+type scrapeOutputTorrent struct {
+	Seeders   uint32
+	Completed uint32
+	Leechers  uint32
+}
+
+func performUdpScrape(conn net.Conn, connId uint64, infoHashes [][]byte) (map[[20]byte]ScrapeResult, error) {
+	in := scrapeInput{connId, 2, rand.Uint32()}
+
+	var req bytes.Buffer
+	binary.Write(&req, binary.BigEndian, &in)
+	for _, h := range infoHashes {
+		req.Write(h)
+	}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 8+12*len(infoHashes))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	} else if n < 8 {
+		return nil, errors.New("not enough bytes read for scrape output")
+	}
+
+	buffer := bytes.NewBuffer(buf[:n])
+	var out scrapeOutput
+	binary.Read(buffer, binary.BigEndian, &out)
+	if in.TransactionId != out.TransactionId {
+		return nil, fmt.Errorf("transaction id mismatch")
+	}
+	if out.Action == 3 {
+		return nil, errors.New(string(buffer.Bytes()))
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for _, h := range infoHashes {
+		var t scrapeOutputTorrent
+		if err := binary.Read(buffer, binary.BigEndian, &t); err != nil {
+			break
+		}
+
+		var hash [20]byte
+		copy(hash[:], h)
+		results[hash] = ScrapeResult{int(t.Seeders), int(t.Completed), int(t.Leechers)}
+	}
+	return results, nil
+}
+
+func udpScrape(u *url.URL, infoHashes [][]byte) (map[[20]byte]ScrapeResult, error) {
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UDP_SCRAPE_TIMEOUT))
+
+	connId, err := startUdpConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return performUdpScrape(conn, connId, infoHashes)
+}
@@ -0,0 +1,102 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// runUdpTracker answers one connect and one scrape, reporting the same
+// counts for every torrent
+func runUdpTracker(conn net.PacketConn) {
+	buf := make([]byte, 1024)
+
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil || n < 16 {
+		return
+	}
+	var connIn connectInput
+	binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, &connIn)
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, &connectOutput{0, connIn.TransactionId, 42})
+	conn.WriteTo(out.Bytes(), addr)
+
+	n, addr, err = conn.ReadFrom(buf)
+	if err != nil || n < 16 {
+		return
+	}
+	var in scrapeInput
+	binary.Read(bytes.NewReader(buf[:n]), binary.BigEndian, &in)
+	out.Reset()
+	binary.Write(&out, binary.BigEndian, &scrapeOutput{2, in.TransactionId})
+	for i := 16; i+20 <= n; i += 20 {
+		binary.Write(&out, binary.BigEndian, &scrapeOutputTorrent{5, 10, 3})
+	}
+	conn.WriteTo(out.Bytes(), addr)
+}
+
+func TestScrape(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 20)
+	var key [20]byte
+	copy(key[:], hash)
+
+	Convey("Scrape URLs should be derived from announce URLs", t, func() {
+		u, _ := url.Parse("http://tracker.example.com/x/announce.php?passkey=1")
+		s, err := scrapeUrl(u, [][]byte{hash})
+		So(err, ShouldBeNil)
+
+		parsed, _ := url.Parse(s)
+		So(parsed.Path, ShouldEqual, "/x/scrape.php")
+		So(parsed.Query().Get("passkey"), ShouldEqual, "1")
+		So(parsed.Query().Get("info_hash"), ShouldEqual, string(hash))
+
+		u, _ = url.Parse("http://tracker.example.com/a")
+		_, err = scrapeUrl(u, [][]byte{hash})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When scraping an HTTP tracker", t, func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/scrape" {
+				http.NotFound(w, r)
+				return
+			}
+			h := r.URL.Query().Get("info_hash")
+			fmt.Fprintf(w, "d5:filesd20:%sd8:completei5e10:downloadedi10e10:incompletei3eeee", h)
+		}))
+		defer srv.Close()
+
+		results, err := Scrape(srv.URL+"/announce", [][]byte{hash})
+
+		Convey("It should return the counts for each torrent", func() {
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, map[[20]byte]ScrapeResult{key: {5, 10, 3}})
+		})
+	})
+
+	Convey("When scraping a UDP tracker", t, func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		go runUdpTracker(conn)
+
+		results, err := Scrape("udp://"+conn.LocalAddr().String(), [][]byte{hash})
+
+		Convey("It should return the counts for each torrent", func() {
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, map[[20]byte]ScrapeResult{key: {5, 10, 3}})
+		})
+	})
+
+	Convey("Invalid info hashes should be rejected", t, func() {
+		_, err := Scrape("http://tracker.example.com/announce", [][]byte{{1, 2, 3}})
+		So(err, ShouldNotBeNil)
+	})
+}
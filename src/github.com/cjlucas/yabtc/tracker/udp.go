@@ -111,8 +111,14 @@ func (r *udpAnnounceResponse) Peers() []Peer {
 
 func eventNum(e string) int {
 	switch e {
-	case "started":
-		return 0
+	case EVENT_COMPLETED:
+		return 1
+	case EVENT_STARTED:
+		return 2
+	case EVENT_STOPPED:
+		return 3
+	case EVENT_PAUSED:
+		return 4
 	default:
 		return 0
 	}
@@ -25,6 +25,9 @@ type trackerInfo struct {
 	PeerId            [20]byte
 	nextAnnounceTimer *time.Timer
 	announceQueue     chan *trackerInfo
+
+	// Partial seeds announce with the paused event (BEP 21)
+	uploadOnly bool
 }
 
 type trackerInfoKey struct {
@@ -37,6 +40,8 @@ type TrackerManager struct {
 	trackers             map[trackerInfoKey]*trackerInfo
 	trackersLock         sync.RWMutex
 	announceQueue        chan *trackerInfo
+	port                 int
+	portLock             sync.RWMutex
 }
 
 func (t *trackerInfo) setNextAnnounceTimer(d time.Duration) {
@@ -67,6 +72,10 @@ func (tm *TrackerManager) announceWorker() {
 		key := trackerInfoKey{InfoHash: t.InfoHash, Url: t.Url}
 		tm.trackersLock.RLock()
 		t = tm.trackers[key]
+		event := tracker.EVENT_NONE
+		if t != nil && t.uploadOnly {
+			event = tracker.EVENT_PAUSED
+		}
 		tm.trackersLock.RUnlock()
 
 		if t == nil {
@@ -74,11 +83,7 @@ func (tm *TrackerManager) announceWorker() {
 		}
 
 		fmt.Println("hereeeee")
-		req := tracker.AnnounceRequest{
-			Url:      t.Url,
-			InfoHash: t.InfoHash[:],
-			PeerId:   t.PeerId[:],
-		}
+		req := tm.announceRequest(t, event)
 
 		if resp, err := req.Request(); err != nil {
 			fmt.Printf("err: %s\n", err)
@@ -104,23 +109,38 @@ func (tm *TrackerManager) announceWorker() {
 
 }
 
+func (tm *TrackerManager) announceRequest(t *trackerInfo, event string) tracker.AnnounceRequest {
+	return tracker.AnnounceRequest{
+		Url:      t.Url,
+		InfoHash: t.InfoHash[:],
+		PeerId:   t.PeerId[:],
+		Port:     tm.Port(),
+		Event:    event,
+	}
+}
+
 // TODO: don't use metadata, use an actual torrent struct
 // which contains all of the stats related to it
+// AddTracker does nothing if the tracker is already announced to for
+// infoHash
 func (tm *TrackerManager) AddTracker(url string, infoHash []byte, peerId []byte) {
 	ti := &trackerInfo{}
 	copy(ti.InfoHash[:], infoHash)
 	copy(ti.PeerId[:], peerId)
 
 	ti.Url = url
-	ti.setNextAnnounceTimer(0 * time.Second)
+	ti.announceQueue = tm.announceQueue
 
 	key := trackerInfoKey{Url: url}
-	ti.announceQueue = tm.announceQueue
 	copy(key.InfoHash[:], infoHash)
 
 	tm.trackersLock.Lock()
+	defer tm.trackersLock.Unlock()
+	if _, ok := tm.trackers[key]; ok {
+		return
+	}
 	tm.trackers[key] = ti
-	tm.trackersLock.Unlock()
+	ti.setNextAnnounceTimer(0 * time.Second)
 }
 
 func (tm *TrackerManager) RemoveTracker(url string, infoHash []byte) {
@@ -142,12 +162,84 @@ func (tm *TrackerManager) ForceAnnounce(url string, infoHash []byte) {
 	}
 }
 
+// StopTorrent stops announcing infoHash. Its trackers get a final
+// stopped announce so they no longer hand us out to peers.
+func (tm *TrackerManager) StopTorrent(infoHash []byte) {
+	var hash [20]byte
+	copy(hash[:], infoHash)
+
+	var stopped []*trackerInfo
+	tm.trackersLock.Lock()
+	for key, t := range tm.trackers {
+		if key.InfoHash == hash {
+			t.nextAnnounceTimer.Stop()
+			delete(tm.trackers, key)
+			stopped = append(stopped, t)
+		}
+	}
+	tm.trackersLock.Unlock()
+
+	for _, t := range stopped {
+		req := tm.announceRequest(t, tracker.EVENT_STOPPED)
+		go func() {
+			if _, err := req.Request(); err != nil {
+				fmt.Printf("stopped announce to %s failed: %s\n", req.Url, err)
+			}
+		}()
+	}
+}
+
+// SetUploadOnly sets whether the torrent is only seeding, so trackers
+// stop handing it out to peers looking for pieces it will never have
+func (tm *TrackerManager) SetUploadOnly(infoHash []byte, uploadOnly bool) {
+	var hash [20]byte
+	copy(hash[:], infoHash)
+
+	tm.trackersLock.Lock()
+	defer tm.trackersLock.Unlock()
+
+	for key, t := range tm.trackers {
+		if key.InfoHash != hash || t.uploadOnly == uploadOnly {
+			continue
+		}
+
+		t.uploadOnly = uploadOnly
+		t.nextAnnounceTimer.Reset(0)
+	}
+}
+
+// SetPort changes the port reported to trackers and re-announces
+// so peers learn about the new port
+func (tm *TrackerManager) SetPort(port int) {
+	tm.portLock.Lock()
+	changed := tm.port != port
+	tm.port = port
+	tm.portLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	tm.trackersLock.RLock()
+	for _, t := range tm.trackers {
+		t.nextAnnounceTimer.Reset(0)
+	}
+	tm.trackersLock.RUnlock()
+}
+
+func (tm *TrackerManager) Port() int {
+	tm.portLock.RLock()
+	defer tm.portLock.RUnlock()
+	return tm.port
+}
+
 func (tm *TrackerManager) Stop() {
 	close(tm.announceQueue)
 }
 
-func NewTrackerManager() *TrackerManager {
+func NewTrackerManager(port int) *TrackerManager {
 	tm := &TrackerManager{}
+	tm.port = port
 	tm.AnnounceResponseChan = make(chan *AnnounceResponseInfo)
 	tm.announceQueue = make(chan *trackerInfo, 100)
 	tm.trackers = make(map[trackerInfoKey]*trackerInfo)
@@ -0,0 +1,236 @@
+// Package watch adds the .torrent files dropped into a directory.
+//
+// Magnet links dropped in as .magnet files aren't supported: the client
+// can't fetch a torrent's metadata from peers yet, so they're marked
+// invalid.
+package watch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/torrent"
+)
+
+// How often the directory is polled where it can't be watched
+const DEFAULT_POLL_INTERVAL = 5 * time.Second
+
+const (
+	TORRENT_SUFFIX = ".torrent"
+	MAGNET_SUFFIX  = ".magnet"
+)
+
+// Files are renamed once they're processed so they aren't added again
+const (
+	ADDED_SUFFIX   = ".added"
+	INVALID_SUFFIX = ".invalid"
+)
+
+type AddOptions struct {
+	// Empty for the session's save path
+	SavePath string
+	Labels   []string
+}
+
+// Session is where the torrents are added
+type Session interface {
+	// AddTorrent returns swarm.TorrentExistsError for duplicates
+	AddTorrent(t *torrent.MetaData, opts AddOptions) error
+	// MergeTrackers adds t's trackers to the torrent already added under
+	// the same info hash
+	MergeTrackers(t *torrent.MetaData) error
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type Watcher struct {
+	Dir          string
+	Options      AddOptions
+	PollInterval time.Duration
+	session      Session
+
+	// When polling, files are only added once they stop changing between
+	// two polls, so files still being written aren't marked invalid
+	seen map[string]fileState
+	// Files the session couldn't add, they're left in place and retried
+	failed map[string]bool
+
+	quit chan bool
+	done chan bool
+}
+
+func New(dir string, session Session, opts AddOptions) *Watcher {
+	w := &Watcher{}
+	w.Dir = dir
+	w.Options = opts
+	w.PollInterval = DEFAULT_POLL_INTERVAL
+	w.session = session
+	w.seen = make(map[string]fileState)
+	w.failed = make(map[string]bool)
+	w.quit = make(chan bool)
+	w.done = make(chan bool)
+
+	return w
+}
+
+// Run adds the torrents already in the directory, then every torrent
+// dropped into it until Stop is called. The directory is watched with
+// inotify on Linux and polled elsewhere, or once watching fails.
+func (w *Watcher) Run() {
+	defer close(w.done)
+
+	// Watch before scanning so no file slips in between
+	names, err := watchDir(w.Dir, w.quit)
+	polling := err != nil
+	if polling {
+		fmt.Printf("watch: polling %s every %s: %s\n", w.Dir, w.PollInterval, err)
+	}
+	// Polls the directory, or retries the files that failed while it's
+	// being watched
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+
+	w.scan(false)
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		case name, ok := <-names:
+			switch {
+			case !ok:
+				fmt.Printf("watch: stopped watching %s, polling every %s instead\n", w.Dir, w.PollInterval)
+				names = nil
+				polling = true
+			case name == "":
+				// Events were lost, look at everything instead
+				w.scan(false)
+			default:
+				w.addFile(filepath.Join(w.Dir, name))
+			}
+		case <-ticker.C:
+			if polling {
+				w.scan(true)
+			} else {
+				w.retry()
+			}
+		}
+	}
+}
+
+// Stop waits for Run to return
+func (w *Watcher) Stop() {
+	close(w.quit)
+	<-w.done
+}
+
+// scan adds the torrents in the directory. If settled is set only the
+// files that haven't changed since the last scan are added.
+func (w *Watcher) scan(settled bool) {
+	entries, err := ioutil.ReadDir(w.Dir)
+	if err != nil {
+		fmt.Printf("watch: could not read %s: %s\n", w.Dir, err)
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, fi := range entries {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !isWatched(name) {
+			continue
+		}
+		present[name] = true
+
+		state := fileState{fi.Size(), fi.ModTime()}
+		if prev, ok := w.seen[name]; settled && (!ok || prev != state) {
+			w.seen[name] = state
+			continue
+		}
+
+		delete(w.seen, name)
+		w.addFile(filepath.Join(w.Dir, name))
+	}
+
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+	for fname := range w.failed {
+		if !present[filepath.Base(fname)] {
+			delete(w.failed, fname)
+		}
+	}
+}
+
+// retry adds the files the session failed to add again
+func (w *Watcher) retry() {
+	for fname := range w.failed {
+		w.addFile(fname)
+	}
+}
+
+func isWatched(name string) bool {
+	return strings.HasSuffix(name, TORRENT_SUFFIX) || strings.HasSuffix(name, MAGNET_SUFFIX)
+}
+
+// addFile adds the torrent in fname, then renames the file to show how
+// it went. Torrents that were already added have their trackers merged
+// into the existing torrent. Files the session couldn't add are left in
+// place to be retried.
+func (w *Watcher) addFile(fname string) {
+	if !isWatched(fname) {
+		return
+	}
+	if _, err := os.Stat(fname); err != nil {
+		delete(w.failed, fname)
+		return
+	}
+
+	if strings.HasSuffix(fname, MAGNET_SUFFIX) {
+		fmt.Printf("watch: can't add %s: magnet links aren't supported, the torrent's metadata can't be fetched from peers\n", fname)
+		w.rename(fname, INVALID_SUFFIX)
+		return
+	}
+
+	t, err := torrent.ParseFile(fname)
+	if err != nil {
+		fmt.Printf("watch: could not parse %s: %s\n", fname, err)
+		w.rename(fname, INVALID_SUFFIX)
+		return
+	}
+
+	if err := w.add(t); err != nil {
+		// Only logged the first time so retries don't flood the log
+		if !w.failed[fname] {
+			fmt.Printf("watch: could not add %s, retrying later: %s\n", fname, err)
+		}
+		w.failed[fname] = true
+		return
+	}
+
+	delete(w.failed, fname)
+	w.rename(fname, ADDED_SUFFIX)
+}
+
+func (w *Watcher) rename(fname, suffix string) {
+	if err := os.Rename(fname, fname+suffix); err != nil {
+		fmt.Printf("watch: could not rename %s: %s\n", fname, err)
+	}
+}
+
+func (w *Watcher) add(t *torrent.MetaData) error {
+	err := w.session.AddTorrent(t, w.Options)
+	if err == swarm.TorrentExistsError {
+		return w.session.MergeTrackers(t)
+	}
+	return err
+}
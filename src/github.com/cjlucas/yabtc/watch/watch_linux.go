@@ -0,0 +1,64 @@
+package watch
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchDir sends the names of the files written or moved into dir until
+// quit is closed. An empty name means events were lost.
+func watchDir(dir string, quit <-chan bool) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// Non-blocking, so closing the file interrupts a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-quit
+		f.Close()
+	}()
+
+	names := make(chan string)
+	go func() {
+		defer close(names)
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				start := off + syscall.SizeofInotifyEvent
+				off = start + int(event.Len)
+
+				var name string
+				switch {
+				case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+				case event.Len > 0:
+					name = strings.TrimRight(string(buf[start:off]), "\x00")
+				default:
+					continue
+				}
+
+				select {
+				case names <- name:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	return names, nil
+}
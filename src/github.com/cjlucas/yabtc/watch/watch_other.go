@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package watch
+
+import "errors"
+
+func watchDir(dir string, quit <-chan bool) (<-chan string, error) {
+	return nil, errors.New("directory watching not supported on this platform")
+}
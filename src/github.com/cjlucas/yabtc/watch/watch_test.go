@@ -0,0 +1,180 @@
+package watch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cjlucas/yabtc/p2p/swarm"
+	"github.com/cjlucas/yabtc/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeSession struct {
+	added    map[string]AddOptions
+	trackers map[string][]string
+	// Returned by AddTorrent while set
+	err  error
+	lock sync.Mutex
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{added: make(map[string]AddOptions), trackers: make(map[string][]string)}
+}
+
+func (f *fakeSession) AddTorrent(t *torrent.MetaData, opts AddOptions) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	hash := t.InfoHashString()
+	if _, ok := f.added[hash]; ok {
+		return swarm.TorrentExistsError
+	}
+	f.added[hash] = opts
+	f.trackers[hash] = t.Trackers()
+	return nil
+}
+
+func (f *fakeSession) MergeTrackers(t *torrent.MetaData) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	hash := t.InfoHashString()
+	f.trackers[hash] = append(f.trackers[hash], t.Trackers()...)
+	return nil
+}
+
+func (f *fakeSession) numAdded() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.added)
+}
+
+// writeTorrent writes a torrent of content announcing to announce into
+// dir. Torrents of the same content have the same info hash.
+func writeTorrent(dir, name, content, announce string) *torrent.MetaData {
+	root, err := ioutil.TempDir("", "yabtc-watch-content")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	fname := filepath.Join(root, "file")
+	ioutil.WriteFile(fname, []byte(content), 0644)
+	t, err := torrent.Create(fname, torrent.CreateOptions{PieceLength: 16384, V1: true, Announce: announce})
+	if err != nil {
+		panic(err)
+	}
+
+	b, _ := t.Bytes()
+	ioutil.WriteFile(filepath.Join(dir, name), b, 0644)
+	return t
+}
+
+func exists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+func TestWatcher(t *testing.T) {
+	Convey("Given a watched directory", t, func() {
+		dir, _ := ioutil.TempDir("", "yabtc-watch")
+		defer os.RemoveAll(dir)
+
+		session := newFakeSession()
+		w := New(dir, session, AddOptions{SavePath: "/downloads", Labels: []string{"ingest"}})
+
+		Convey("A torrent should be added with the watcher's options", func() {
+			m := writeTorrent(dir, "a.torrent", "a", "http://a/announce")
+			w.scan(false)
+
+			So(session.added[m.InfoHashString()], ShouldResemble, AddOptions{SavePath: "/downloads", Labels: []string{"ingest"}})
+			So(exists(filepath.Join(dir, "a.torrent")), ShouldBeFalse)
+			So(exists(filepath.Join(dir, "a.torrent.added")), ShouldBeTrue)
+		})
+
+		Convey("A file that isn't a torrent should be marked invalid", func() {
+			ioutil.WriteFile(filepath.Join(dir, "bad.torrent"), []byte("not bencode"), 0644)
+			w.scan(false)
+
+			So(session.numAdded(), ShouldEqual, 0)
+			So(exists(filepath.Join(dir, "bad.torrent.invalid")), ShouldBeTrue)
+		})
+
+		Convey("A magnet link should be marked invalid", func() {
+			ioutil.WriteFile(filepath.Join(dir, "a.magnet"), []byte("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"), 0644)
+			w.scan(false)
+
+			So(session.numAdded(), ShouldEqual, 0)
+			So(exists(filepath.Join(dir, "a.magnet.invalid")), ShouldBeTrue)
+		})
+
+		Convey("A torrent the session can't add yet should be left in place and retried", func() {
+			session.err = errors.New("not enough space")
+			writeTorrent(dir, "a.torrent", "a", "http://a/announce")
+			w.scan(false)
+
+			So(session.numAdded(), ShouldEqual, 0)
+			So(exists(filepath.Join(dir, "a.torrent")), ShouldBeTrue)
+
+			session.err = nil
+			w.retry()
+			So(session.numAdded(), ShouldEqual, 1)
+			So(exists(filepath.Join(dir, "a.torrent.added")), ShouldBeTrue)
+		})
+
+		Convey("Other files should be left alone", func() {
+			ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644)
+			w.scan(false)
+
+			So(exists(filepath.Join(dir, "notes.txt")), ShouldBeTrue)
+		})
+
+		Convey("A duplicate should have its trackers merged", func() {
+			m := writeTorrent(dir, "a.torrent", "a", "http://a/announce")
+			w.scan(false)
+			writeTorrent(dir, "b.torrent", "a", "udp://b:80")
+			w.scan(false)
+
+			So(session.numAdded(), ShouldEqual, 1)
+			So(session.trackers[m.InfoHashString()], ShouldResemble, []string{"http://a/announce", "udp://b:80"})
+			So(exists(filepath.Join(dir, "b.torrent.added")), ShouldBeTrue)
+		})
+
+		Convey("When polling, a file should only be added once it stops changing", func() {
+			writeTorrent(dir, "a.torrent", "a", "http://a/announce")
+			w.scan(true)
+			So(session.numAdded(), ShouldEqual, 0)
+
+			w.scan(true)
+			So(session.numAdded(), ShouldEqual, 1)
+		})
+
+		Convey("When running", func() {
+			writeTorrent(dir, "before.torrent", "before", "http://a/announce")
+			w.PollInterval = 10 * time.Millisecond
+			go w.Run()
+			defer w.Stop()
+
+			Convey("Files already there and files dropped in should be added", func() {
+				// Written elsewhere and moved in, as ingest jobs should
+				tmp, _ := ioutil.TempDir(dir, "tmp")
+				writeTorrent(tmp, "after.torrent", "after", "http://b/announce")
+				os.Rename(filepath.Join(tmp, "after.torrent"), filepath.Join(dir, "after.torrent"))
+
+				deadline := time.Now().Add(5 * time.Second)
+				for session.numAdded() < 2 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				So(session.numAdded(), ShouldEqual, 2)
+			})
+		})
+	})
+}